@@ -0,0 +1,24 @@
+package opus
+
+import (
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec/opus"
+
+	"github.com/thingify-app/thing-rtc/peer-go/codec"
+)
+
+func NewCodec(bitrate int) (*codec.Codec, error) {
+	params, err := opus.NewParams()
+	if err != nil {
+		return nil, err
+	}
+	params.BitRate = bitrate
+
+	codecSelector := mediadevices.NewCodecSelector(
+		mediadevices.WithAudioEncoders(&params),
+	)
+
+	return &codec.Codec{
+		CodecSelector: codecSelector,
+	}, nil
+}
@@ -0,0 +1,101 @@
+package thingrtc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ConnectionState describes how far a Peer has progressed towards connecting.
+type ConnectionState int
+
+const (
+	// Not connected, and not attempting to connect.
+	Disconnected ConnectionState = iota
+	// Connecting to the signalling server.
+	SignallingConnecting
+	// Connected to the signalling server, waiting for the other peer to join.
+	WaitingForPeer
+	// Exchanging offer/answer with the other peer.
+	Negotiating
+	// Negotiation is complete, and ICE is checking connectivity to the peer.
+	IceChecking
+	// Connected directly to the peer.
+	Connected
+	// The last connection attempt ended, and we are waiting to retry.
+	Reconnecting
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Disconnected:
+		return "Disconnected"
+	case SignallingConnecting:
+		return "SignallingConnecting"
+	case WaitingForPeer:
+		return "WaitingForPeer"
+	case Negotiating:
+		return "Negotiating"
+	case IceChecking:
+		return "IceChecking"
+	case Connected:
+		return "Connected"
+	case Reconnecting:
+		return "Reconnecting"
+	default:
+		return fmt.Sprintf("ConnectionState(%d)", int(s))
+	}
+}
+
+// Reasons for a connection attempt ending, reported alongside the state
+// change.
+var (
+	ErrSignallingFailed = errors.New("signalling server connection failed")
+	ErrPeerDisconnected = errors.New("peer disconnected")
+	ErrIceFailed        = errors.New("ICE connection failed")
+)
+
+// Runs functions in order on a background goroutine, so that slow listeners
+// neither block the caller nor see events out of order.
+type serialExecutor struct {
+	mutex   sync.Mutex
+	queue   []func()
+	running bool
+	// Tracks the goroutine draining the queue.
+	wg sync.WaitGroup
+}
+
+func (e *serialExecutor) run(f func()) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.queue = append(e.queue, f)
+	if !e.running {
+		e.running = true
+		e.wg.Add(1)
+		go e.drain()
+	}
+}
+
+// Waits until all queued functions have run. Nothing may be queued once this
+// has been called.
+func (e *serialExecutor) wait() {
+	e.wg.Wait()
+}
+
+func (e *serialExecutor) drain() {
+	defer e.wg.Done()
+	for {
+		e.mutex.Lock()
+		if len(e.queue) == 0 {
+			e.running = false
+			e.mutex.Unlock()
+			return
+		}
+		f := e.queue[0]
+		e.queue = e.queue[1:]
+		e.mutex.Unlock()
+
+		f()
+	}
+}
@@ -0,0 +1,171 @@
+package thingrtc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+type stateChange struct {
+	state  ConnectionState
+	reason error
+}
+
+func TestConnectionStateTransitions(t *testing.T) {
+	closeConnection := make(chan interface{})
+	server := createWebsocketServer(func(conn *websocket.Conn) {
+		// Consume auth message
+		conn.ReadMessage()
+		<-closeConnection
+	})
+	url := strings.Replace(server.URL, "http", "ws", 1)
+
+	peer := New(url, MockServerAuth{Token: "token"}, createTestPeerConfig(), WithRetryPolicy(NewConstantRetryPolicy(time.Hour)))
+	changes := make(chan stateChange, 10)
+	peer.OnConnectionStateChange(func(state ConnectionState, reason error) {
+		changes <- stateChange{state, reason}
+	})
+
+	if peer.State() != Disconnected {
+		t.Fatalf("expected initial state to be Disconnected, got: %v", peer.State())
+	}
+
+	err := peer.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStateChange(t, changes, SignallingConnecting, nil)
+	expectStateChange(t, changes, WaitingForPeer, nil)
+	if peer.State() != WaitingForPeer {
+		t.Errorf("expected State() to be WaitingForPeer, got: %v", peer.State())
+	}
+
+	close(closeConnection)
+	expectStateChange(t, changes, Reconnecting, ErrSignallingFailed)
+
+	peer.Close()
+	expectStateChange(t, changes, Disconnected, nil)
+}
+
+func TestSignallingLossWhileIceChecking(t *testing.T) {
+	// Play the initiator with a bare peer connection, offering all of its
+	// candidates up front so that none need to be trickled.
+	remote, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	_, err = remote.CreateDataChannel("data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := remote.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(remote)
+	err = remote.SetLocalDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	iceChecking := make(chan interface{})
+	server := createWebsocketServer(func(conn *websocket.Conn) {
+		// Consume auth message
+		conn.ReadMessage()
+		conn.WriteJSON(PeerConnectMessage{Type: "peerConnect", Nonce: "remoteNonce"})
+
+		data, _ := addField(remote.LocalDescription(), "nonce", "nonce")
+		offerData, _ := json.Marshal(data)
+		conn.WriteJSON(Message{Type: "offer", Data: string(offerData)})
+
+		for {
+			message := Message{}
+			err := conn.ReadJSON(&message)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if message.Type == "answer" {
+				answer := webrtc.SessionDescription{}
+				json.Unmarshal([]byte(message.Data), &answer)
+				err = remote.SetRemoteDescription(answer)
+				if err != nil {
+					t.Error(err)
+				}
+				break
+			}
+		}
+
+		// Drop the connection while ICE is still checking, as the real server
+		// does when the other peer connects first and leaves.
+		<-iceChecking
+	})
+	url := strings.Replace(server.URL, "http", "ws", 1)
+
+	peer := New(url, MockServerAuth{Token: "token"}, createTestPeerConfig(), WithICEServers(), WithRetryPolicy(NewConstantRetryPolicy(time.Hour)))
+	defer peer.Close()
+	changes := make(chan stateChange, 10)
+	var once sync.Once
+	peer.OnConnectionStateChange(func(state ConnectionState, reason error) {
+		if state == IceChecking {
+			once.Do(func() { close(iceChecking) })
+		}
+		changes <- stateChange{state, reason}
+	})
+
+	err = peer.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStateChange(t, changes, SignallingConnecting, nil)
+	expectStateChange(t, changes, WaitingForPeer, nil)
+	expectStateChange(t, changes, Negotiating, nil)
+	expectStateChange(t, changes, IceChecking, nil)
+
+	// Our candidates are never trickled to the remote, which only learns them
+	// from our checks, so this is slower than a normal connection.
+	select {
+	case change := <-changes:
+		if change.state != Connected {
+			t.Fatalf("expected state Connected, got: %v (%v)", change.state, change.reason)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for state Connected")
+	}
+}
+
+func TestConnectionStateString(t *testing.T) {
+	if IceChecking.String() != "IceChecking" {
+		t.Errorf("unexpected string: %v", IceChecking.String())
+	}
+	if ConnectionState(100).String() != "ConnectionState(100)" {
+		t.Errorf("unexpected string for unknown state: %v", ConnectionState(100).String())
+	}
+}
+
+func expectStateChange(t *testing.T, changes <-chan stateChange, state ConnectionState, reason error) {
+	t.Helper()
+
+	select {
+	case change := <-changes:
+		if change.state != state {
+			t.Fatalf("expected state %v, got: %v", state, change.state)
+		}
+		if reason == nil && change.reason != nil || !errors.Is(change.reason, reason) {
+			t.Fatalf("expected reason %v, got: %v", reason, change.reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for state %v", state)
+	}
+}
@@ -1,69 +1,254 @@
 package thingrtc
 
 import (
+	"context"
 	"io"
+	"sync"
 
 	"github.com/pion/webrtc/v3"
+
+	"github.com/thingify-app/thing-rtc/peer-go/internal/queue"
 )
 
+// ErrDataChannelClosed is returned when sending on or receiving from a data
+// channel which is not open.
+var ErrDataChannelClosed = queue.ErrClosed
+
+// The default BufferedAmountLowThreshold, which bounds how much data Send
+// allows to be queued.
+const DefaultBufferedAmountLowThreshold = 256 * 1024
+
 type DataChannel interface {
-	SendStringMessage(message string)
-	SendBinaryMessage(message []byte)
+	// SendStringMessage queues a string message to be sent, returning
+	// ErrDataChannelClosed if the channel is not open.
+	SendStringMessage(message string) error
+	// SendBinaryMessage queues a binary message to be sent, returning
+	// ErrDataChannelClosed if the channel is not open.
+	SendBinaryMessage(message []byte) error
+	// Send sends a binary message, first blocking until no more than
+	// BufferedAmountLowThreshold bytes are queued, so that producers are paced
+	// by the network. Returns ctx.Err() if ctx is done while waiting.
+	Send(ctx context.Context, message []byte) error
 
+	// OnStringMessage and OnBinaryMessage set listeners for received
+	// messages, which are called in order on a dedicated goroutine.
 	OnStringMessage(listener func(message string))
 	OnBinaryMessage(listener func(message []byte))
 
+	// Messages returns a channel of received messages, shared by all callers
+	// of Messages and Recv. It is closed once the data channel closes. Its
+	// queue uses the Block policy, so if it is not drained, receiving stalls
+	// for every consumer of the channel. Use Subscribe to choose a policy.
+	Messages() <-chan DataChannelMessage
+	// Recv waits for the next message from the same queue as Messages.
+	Recv(ctx context.Context) (DataChannelMessage, error)
+	// Subscribe creates an independent queue of received messages, so
+	// several consumers can each see every message.
+	Subscribe(options SubscribeOptions) *Subscription
+
+	// OnOpen is called once the channel is open and messages can be sent. It
+	// is called straight away if the channel is already open.
+	OnOpen(listener func())
+	// OnClose is called once the channel has closed.
+	OnClose(listener func())
+	// OnError is called when the underlying transport reports an error, or
+	// with ErrMessageDropped.
+	OnError(listener func(err error))
+
+	// BufferedAmount returns the number of bytes queued to be sent.
+	BufferedAmount() uint64
+	BufferedAmountLowThreshold() uint64
+	SetBufferedAmountLowThreshold(threshold uint64)
+	// OnBufferedAmountLow is called when BufferedAmount falls to
+	// BufferedAmountLowThreshold or below.
+	OnBufferedAmountLow(listener func())
+
 	Close()
 
 	GetLabel() string
+	// Options returns how the channel was configured, by whichever peer
+	// created it.
+	Options() DataChannelOptions
+	// Protocol returns the application-defined sub-protocol name, if any.
+	Protocol() string
 
 	AsStream() (io.ReadWriteCloser, error)
 }
 
 type dataChannelWrapper struct {
-	wrapped               *webrtc.DataChannel
-	stringMessageListener func(message string)
-	binaryMessageListener func(message []byte)
+	queue.Receiver
+
+	wrapped      *webrtc.DataChannel
+	backpressure *backpressure
+
+	// Guards listeners, which are called from Pion's goroutines, and opened.
+	mutex     sync.Mutex
+	listeners dataChannelListeners
+	opened    bool
+}
+
+type dataChannelListeners struct {
+	stringMessage     func(message string)
+	binaryMessage     func(message []byte)
+	open              func()
+	close             func()
+	err               func(err error)
+	bufferedAmountLow func()
+}
+
+func emptyDataChannelListeners() dataChannelListeners {
+	return dataChannelListeners{
+		stringMessage:     func(message string) {},
+		binaryMessage:     func(message []byte) {},
+		open:              func() {},
+		close:             func() {},
+		err:               func(err error) {},
+		bufferedAmountLow: func() {},
+	}
 }
 
 func createDataChannelWrapper(wrapped *webrtc.DataChannel) DataChannel {
 	wrapper := &dataChannelWrapper{
-		wrapped:               wrapped,
-		stringMessageListener: func(message string) {},
-		binaryMessageListener: func(message []byte) {},
+		wrapped:      wrapped,
+		backpressure: newBackpressure(),
+		listeners:    emptyDataChannelListeners(),
 	}
 
+	wrapped.SetBufferedAmountLowThreshold(DefaultBufferedAmountLowThreshold)
+
+	// Messages are queued from creation, so that none are lost before a
+	// listener or subscription is set up.
 	wrapped.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if msg.IsString {
-			wrapper.stringMessageListener(string(msg.Data))
-		} else {
-			wrapper.binaryMessageListener(msg.Data)
+		if !wrapper.Dispatcher.Deliver(DataChannelMessage{Data: msg.Data, IsString: msg.IsString}) {
+			wrapper.getListeners().err(ErrMessageDropped)
 		}
 	})
 
+	wrapped.OnOpen(func() {
+		wrapper.mutex.Lock()
+		wrapper.opened = true
+		listener := wrapper.listeners.open
+		wrapper.mutex.Unlock()
+
+		listener()
+	})
+
+	wrapped.OnClose(func() {
+		// Wake up any blocked senders, so they see that we are closed.
+		wrapper.backpressure.notify()
+		wrapper.Dispatcher.Close()
+		wrapper.getListeners().close()
+	})
+
+	wrapped.OnError(func(err error) {
+		wrapper.getListeners().err(err)
+	})
+
+	wrapped.OnBufferedAmountLow(func() {
+		wrapper.backpressure.notify()
+		wrapper.getListeners().bufferedAmountLow()
+	})
+
 	return wrapper
 }
 
-func (dc *dataChannelWrapper) SendStringMessage(message string) {
-	dc.wrapped.SendText(message)
+func (dc *dataChannelWrapper) getListeners() dataChannelListeners {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return dc.listeners
+}
+
+func (dc *dataChannelWrapper) SendStringMessage(message string) error {
+	if dc.wrapped.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrDataChannelClosed
+	}
+	return dc.wrapped.SendText(message)
+}
+
+func (dc *dataChannelWrapper) SendBinaryMessage(message []byte) error {
+	if dc.wrapped.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrDataChannelClosed
+	}
+	return dc.wrapped.Send(message)
 }
 
-func (dc *dataChannelWrapper) SendBinaryMessage(message []byte) {
-	dc.wrapped.Send(message)
+func (dc *dataChannelWrapper) Send(ctx context.Context, message []byte) error {
+	err := dc.backpressure.wait(ctx, dc.wrapped)
+	if err != nil {
+		return err
+	}
+	return dc.SendBinaryMessage(message)
 }
 
 func (dc *dataChannelWrapper) OnStringMessage(listener func(message string)) {
-	dc.stringMessageListener = listener
+	dc.mutex.Lock()
+	dc.listeners.stringMessage = listener
+	dc.mutex.Unlock()
+
+	dc.StartListeners(messageListener(dc.getListeners))
 }
 
 func (dc *dataChannelWrapper) OnBinaryMessage(listener func(message []byte)) {
-	dc.binaryMessageListener = listener
+	dc.mutex.Lock()
+	dc.listeners.binaryMessage = listener
+	dc.mutex.Unlock()
+
+	dc.StartListeners(messageListener(dc.getListeners))
+}
+
+func (dc *dataChannelWrapper) OnOpen(listener func()) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.open = listener
+
+	// Channels received from the remote peer are usually already open.
+	if dc.opened {
+		go listener()
+	}
+}
+
+func (dc *dataChannelWrapper) OnClose(listener func()) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.close = listener
+}
+
+func (dc *dataChannelWrapper) OnError(listener func(err error)) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.err = listener
+}
+
+func (dc *dataChannelWrapper) BufferedAmount() uint64 {
+	return dc.wrapped.BufferedAmount()
+}
+
+func (dc *dataChannelWrapper) BufferedAmountLowThreshold() uint64 {
+	return dc.wrapped.BufferedAmountLowThreshold()
+}
+
+func (dc *dataChannelWrapper) SetBufferedAmountLowThreshold(threshold uint64) {
+	dc.wrapped.SetBufferedAmountLowThreshold(threshold)
+}
+
+func (dc *dataChannelWrapper) OnBufferedAmountLow(listener func()) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.bufferedAmountLow = listener
 }
 
 func (dc *dataChannelWrapper) GetLabel() string {
 	return dc.wrapped.Label()
 }
 
+func (dc *dataChannelWrapper) Options() DataChannelOptions {
+	return optionsFromDataChannel(dc.wrapped)
+}
+
+func (dc *dataChannelWrapper) Protocol() string {
+	return dc.wrapped.Protocol()
+}
+
 func (dc *dataChannelWrapper) Close() {
 	dc.wrapped.Close()
 }
@@ -71,3 +256,47 @@ func (dc *dataChannelWrapper) Close() {
 func (dc *dataChannelWrapper) AsStream() (io.ReadWriteCloser, error) {
 	return dc.wrapped.Detach()
 }
+
+// Lets senders wait for a data channel's buffered amount to fall to its low
+// threshold.
+type backpressure struct {
+	mutex sync.Mutex
+	// Closed and replaced whenever the buffered amount falls, or the channel
+	// closes.
+	signal chan struct{}
+}
+
+func newBackpressure() *backpressure {
+	return &backpressure{signal: make(chan struct{})}
+}
+
+func (b *backpressure) notify() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	close(b.signal)
+	b.signal = make(chan struct{})
+}
+
+// Blocks until dataChannel has room to send, returning ErrDataChannelClosed if
+// it is not open, or ctx.Err() if ctx is done first.
+func (b *backpressure) wait(ctx context.Context, dataChannel *webrtc.DataChannel) error {
+	for {
+		// Take the signal before checking, so we can't miss a notification.
+		b.mutex.Lock()
+		signal := b.signal
+		b.mutex.Unlock()
+
+		if dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+			return ErrDataChannelClosed
+		}
+		if dataChannel.BufferedAmount() <= dataChannel.BufferedAmountLowThreshold() {
+			return nil
+		}
+
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
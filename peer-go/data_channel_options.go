@@ -0,0 +1,128 @@
+package thingrtc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var ErrInvalidDataChannelOptions = errors.New("invalid data channel options")
+
+// DataChannelOptions configures how a data channel delivers messages. The zero
+// value is an ordered, reliable channel.
+//
+// Channel priority is not supported, as the underlying WebRTC implementation
+// does not implement it.
+type DataChannelOptions struct {
+	// Allows messages to be delivered out of order.
+	Unordered bool
+	// Limits how many times a message is retransmitted before it is dropped.
+	// At most one of MaxRetransmits and MaxPacketLifeTime may be set; if
+	// neither is, messages are retransmitted until delivered.
+	MaxRetransmits *uint16
+	// Limits how long a message is retransmitted for before it is dropped, with
+	// millisecond precision.
+	MaxPacketLifeTime *time.Duration
+	// Application-defined sub-protocol name, visible to the remote peer.
+	Protocol string
+	// Whether the channel is pre-negotiated, i.e. created by both peers with
+	// the same ID instead of being announced to the remote peer. This avoids a
+	// round trip before the channel is usable, but the remote peer will not
+	// receive it in OnDataChannel.
+	Negotiated bool
+	// The SCTP stream ID of a pre-negotiated channel. Ignored unless
+	// Negotiated is set.
+	ID uint16
+}
+
+// ReliableDataChannelOptions returns options for an ordered channel which
+// retransmits messages until they are delivered.
+func ReliableDataChannelOptions() DataChannelOptions {
+	return DataChannelOptions{}
+}
+
+// UnreliableDataChannelOptions returns options for an unordered channel which
+// never retransmits messages.
+func UnreliableDataChannelOptions() DataChannelOptions {
+	maxRetransmits := uint16(0)
+	return DataChannelOptions{
+		Unordered:      true,
+		MaxRetransmits: &maxRetransmits,
+	}
+}
+
+func reliabilityOptions(reliable bool) DataChannelOptions {
+	if reliable {
+		return ReliableDataChannelOptions()
+	}
+	return UnreliableDataChannelOptions()
+}
+
+func (o DataChannelOptions) validate() error {
+	if o.MaxRetransmits != nil && o.MaxPacketLifeTime != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidDataChannelOptions, webrtc.ErrRetransmitsOrPacketLifeTime)
+	}
+	if o.MaxPacketLifeTime != nil {
+		lifetime := o.MaxPacketLifeTime.Milliseconds()
+		if lifetime < 0 || lifetime > math.MaxUint16 {
+			return fmt.Errorf("%w: MaxPacketLifeTime must be between 0 and %vms", ErrInvalidDataChannelOptions, math.MaxUint16)
+		}
+	}
+	return nil
+}
+
+// Converts the options to Pion's equivalent, validating them first.
+func (o DataChannelOptions) toInit() (*webrtc.DataChannelInit, error) {
+	err := o.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := !o.Unordered
+	init := &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: o.MaxRetransmits,
+		Protocol:       &o.Protocol,
+	}
+
+	if o.MaxPacketLifeTime != nil {
+		lifetime := uint16(o.MaxPacketLifeTime.Milliseconds())
+		init.MaxPacketLifeTime = &lifetime
+	}
+
+	if o.Negotiated {
+		negotiated := true
+		id := o.ID
+		init.Negotiated = &negotiated
+		init.ID = &id
+	}
+
+	return init, nil
+}
+
+// Reads the options a Pion data channel was created with, either locally or by
+// the remote peer.
+func optionsFromDataChannel(dataChannel *webrtc.DataChannel) DataChannelOptions {
+	options := DataChannelOptions{
+		Unordered:      !dataChannel.Ordered(),
+		MaxRetransmits: dataChannel.MaxRetransmits(),
+		Protocol:       dataChannel.Protocol(),
+		Negotiated:     dataChannel.Negotiated(),
+	}
+
+	if lifetime := dataChannel.MaxPacketLifeTime(); lifetime != nil {
+		duration := time.Duration(*lifetime) * time.Millisecond
+		options.MaxPacketLifeTime = &duration
+	}
+
+	if options.Negotiated {
+		if id := dataChannel.ID(); id != nil {
+			options.ID = *id
+		}
+	}
+
+	return options
+}
@@ -0,0 +1,152 @@
+package thingrtc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDataChannelOptionsToInit(t *testing.T) {
+	lifetime := 200 * time.Millisecond
+	options := DataChannelOptions{
+		Unordered:         true,
+		MaxPacketLifeTime: &lifetime,
+		Protocol:          "telemetry",
+		Negotiated:        true,
+		ID:                7,
+	}
+
+	init, err := options.toInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *init.Ordered {
+		t.Error("expected channel to be unordered")
+	}
+	if init.MaxRetransmits != nil {
+		t.Error("expected MaxRetransmits to be unset")
+	}
+	if *init.MaxPacketLifeTime != 200 {
+		t.Errorf("expected MaxPacketLifeTime 200, got %v", *init.MaxPacketLifeTime)
+	}
+	if *init.Protocol != "telemetry" {
+		t.Errorf("expected protocol telemetry, got %v", *init.Protocol)
+	}
+	if !*init.Negotiated || *init.ID != 7 {
+		t.Errorf("expected negotiated channel with ID 7, got %v/%v", *init.Negotiated, *init.ID)
+	}
+}
+
+func TestDataChannelOptionsDefaultIsReliable(t *testing.T) {
+	init, err := DataChannelOptions{}.toInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !*init.Ordered || init.MaxRetransmits != nil || init.MaxPacketLifeTime != nil {
+		t.Error("expected an ordered, reliable channel")
+	}
+	if init.Negotiated != nil || init.ID != nil {
+		t.Error("expected channel not to be negotiated")
+	}
+}
+
+func TestDataChannelOptionsValidation(t *testing.T) {
+	maxRetransmits := uint16(1)
+	lifetime := time.Second
+	tooLong := 2 * time.Minute
+
+	invalid := []DataChannelOptions{
+		{MaxRetransmits: &maxRetransmits, MaxPacketLifeTime: &lifetime},
+		{MaxPacketLifeTime: &tooLong},
+	}
+
+	for _, options := range invalid {
+		_, err := options.toInit()
+		if !errors.Is(err, ErrInvalidDataChannelOptions) {
+			t.Errorf("expected ErrInvalidDataChannelOptions, got %v", err)
+		}
+	}
+}
+
+func TestDataChannelOptionsReceivedByRemotePeer(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+
+	received := make(chan DataChannel, 1)
+	responder.OnDataChannel(func(dataChannel DataChannel) {
+		received <- dataChannel
+	})
+	connectPeers(t, initiator, responder)
+
+	lifetime := 200 * time.Millisecond
+	options := DataChannelOptions{
+		Unordered:         true,
+		MaxPacketLifeTime: &lifetime,
+		Protocol:          "telemetry",
+	}
+	dataChannel, err := initiator.CreateDataChannelWithOptions("telemetry", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dataChannel.Protocol() != "telemetry" {
+		t.Errorf("expected protocol telemetry, got %v", dataChannel.Protocol())
+	}
+
+	select {
+	case remoteChannel := <-received:
+		remoteOptions := remoteChannel.Options()
+		if !remoteOptions.Unordered {
+			t.Error("expected remote channel to be unordered")
+		}
+		if remoteOptions.MaxPacketLifeTime == nil || *remoteOptions.MaxPacketLifeTime != lifetime {
+			t.Errorf("expected remote MaxPacketLifeTime %v, got %v", lifetime, remoteOptions.MaxPacketLifeTime)
+		}
+		if remoteChannel.Protocol() != "telemetry" {
+			t.Errorf("expected remote protocol telemetry, got %v", remoteChannel.Protocol())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel was not received")
+	}
+}
+
+func TestNegotiatedDeclaredDataChannel(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+
+	dataChannels := make(chan DataChannel, 1)
+	responder.OnDataChannel(func(dataChannel DataChannel) {
+		dataChannels <- dataChannel
+	})
+
+	options := DataChannelOptions{Negotiated: true, ID: 42}
+	localChannel, err := initiator.DeclareDataChannelWithOptions("control", options, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteChannel, err := responder.DeclareDataChannelWithOptions("control", options, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	remoteChannel.OnStringMessage(func(message string) {
+		received <- message
+	})
+
+	connectPeers(t, initiator, responder)
+	waitForOpen(t, localChannel)
+	waitForOpen(t, remoteChannel)
+
+	localChannel.SendStringMessage("hello")
+	expectMessage(t, received, "hello")
+
+	select {
+	case dataChannel := <-dataChannels:
+		t.Fatalf("negotiated channel should not be announced, got %v", dataChannel.GetLabel())
+	default:
+	}
+}
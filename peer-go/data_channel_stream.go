@@ -0,0 +1,167 @@
+package thingrtc
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// The largest message sent by a DataChannelStream. Browsers only guarantee
+// support for data channel messages up to 16KiB.
+const MaxStreamMessageSize = 16 * 1024
+
+// Reads from a detached data channel fail if the buffer is smaller than the
+// message, so read into a buffer large enough for any message.
+const streamReadBufferSize = 64 * 1024
+
+// DataChannelStream adapts a DataChannel to a stream of bytes. Writes are
+// split into messages of at most MaxStreamMessageSize, and reads return the
+// bytes of received messages in order.
+//
+// It uses the channel detached if the peer was created with
+// WithDetachDataChannels(true), and subscribes to its messages otherwise.
+type DataChannelStream struct {
+	channel DataChannel
+	// Cancelled on Close, to stop any waiting Send.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Set if the channel could be detached, otherwise we subscribe to its
+	// messages.
+	detached     io.ReadWriteCloser
+	subscription *Subscription
+
+	// Guards the fields below.
+	readMutex sync.Mutex
+	buffer    []byte
+	// The unread part of the last message received.
+	leftover []byte
+}
+
+// OpenDataChannelStream waits for channel to open, then wraps it in a stream.
+// It replaces the channel's OnOpen and OnClose listeners. If ctx is done
+// first, the channel is closed; ctx should have a deadline, as a channel which
+// was closed before this is called never opens.
+func OpenDataChannelStream(ctx context.Context, channel DataChannel) (*DataChannelStream, error) {
+	opened := make(chan struct{})
+	closed := make(chan struct{})
+	var openOnce, closeOnce sync.Once
+	channel.OnOpen(func() {
+		openOnce.Do(func() { close(opened) })
+	})
+	channel.OnClose(func() {
+		closeOnce.Do(func() { close(closed) })
+	})
+
+	select {
+	case <-opened:
+		// Continue
+	case <-closed:
+		return nil, ErrDataChannelClosed
+	case <-ctx.Done():
+		channel.Close()
+		return nil, ctx.Err()
+	}
+
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream := &DataChannelStream{channel: channel, ctx: streamCtx, cancel: cancel}
+	detached, err := channel.AsStream()
+	if err == nil {
+		stream.detached = detached
+		stream.buffer = make([]byte, streamReadBufferSize)
+	} else {
+		stream.subscription = channel.Subscribe(SubscribeOptions{})
+	}
+	return stream, nil
+}
+
+// Channel returns the underlying data channel.
+func (s *DataChannelStream) Channel() DataChannel {
+	return s.channel
+}
+
+func (s *DataChannelStream) Read(p []byte) (int, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+
+	if len(s.leftover) == 0 {
+		message, err := s.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		s.leftover = message
+	}
+	n := copy(p, s.leftover)
+	s.leftover = s.leftover[n:]
+	return n, nil
+}
+
+// ReadMessage returns the next message received, or what remains of it after
+// a partial Read. This is useful for datagrams, which must not be merged.
+func (s *DataChannelStream) ReadMessage() ([]byte, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+
+	if len(s.leftover) > 0 {
+		message := s.leftover
+		s.leftover = nil
+		return message, nil
+	}
+	message, err := s.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	// The buffer is reused by the next read.
+	return append([]byte(nil), message...), nil
+}
+
+func (s *DataChannelStream) readMessage() ([]byte, error) {
+	if s.detached != nil {
+		n, err := s.detached.Read(s.buffer)
+		if err != nil {
+			return nil, io.EOF
+		}
+		return s.buffer[:n], nil
+	}
+
+	message, err := s.subscription.Recv(s.ctx)
+	if err != nil {
+		return nil, io.EOF
+	}
+	return message.Data, nil
+}
+
+// Write sends p in as many messages as needed, waiting for room in the
+// channel's send buffer.
+func (s *DataChannelStream) Write(p []byte) (int, error) {
+	return s.write(s.ctx, p)
+}
+
+func (s *DataChannelStream) write(ctx context.Context, p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+MaxStreamMessageSize)]
+		err := s.channel.Send(ctx, chunk)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// WriteMessage sends p as a single message, for datagrams which must not be
+// split.
+func (s *DataChannelStream) WriteMessage(p []byte) error {
+	return s.channel.Send(s.ctx, p)
+}
+
+// Close closes the underlying data channel.
+func (s *DataChannelStream) Close() error {
+	s.cancel()
+	if s.subscription != nil {
+		s.subscription.Close()
+	}
+	s.channel.Close()
+	return nil
+}
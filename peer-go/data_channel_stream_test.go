@@ -0,0 +1,75 @@
+package thingrtc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDataChannelStream(t *testing.T) {
+	for _, detach := range []bool{false, true} {
+		name := "Messages"
+		if detach {
+			name = "Detached"
+		}
+		t.Run(name, func(t *testing.T) {
+			initiator, responder := createConnectedPeers(WithDetachDataChannels(detach))
+			defer initiator.Close()
+			defer responder.Close()
+			connectPeers(t, initiator, responder)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			local, remote := createOpenDataChannels(t, initiator, responder)
+			localStream, err := OpenDataChannelStream(ctx, local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			remoteStream, err := OpenDataChannelStream(ctx, remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Larger than a single message, and read in small pieces.
+			sent := make([]byte, 100*1024)
+			for i := range sent {
+				sent[i] = byte(i)
+			}
+			go localStream.Write(sent)
+
+			received := make([]byte, 0, len(sent))
+			buffer := make([]byte, 1000)
+			for len(received) < len(sent) {
+				n, err := remoteStream.Read(buffer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				received = append(received, buffer[:n]...)
+			}
+			if !bytes.Equal(sent, received) {
+				t.Error("received data does not match")
+			}
+
+			// Messages are kept whole.
+			err = remoteStream.WriteMessage([]byte("datagram"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := localStream.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) != "datagram" {
+				t.Errorf("expected datagram, got %v", string(message))
+			}
+
+			localStream.Close()
+			if _, err := remoteStream.Read(buffer); err != io.EOF {
+				t.Errorf("expected io.EOF, got %v", err)
+			}
+		})
+	}
+}
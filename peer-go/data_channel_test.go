@@ -0,0 +1,299 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Creates a data channel on the initiator, and waits for both ends to open.
+func createOpenDataChannels(t *testing.T, initiator Peer, responder Peer) (local DataChannel, remote DataChannel) {
+	t.Helper()
+
+	received := make(chan DataChannel, 1)
+	responder.OnDataChannel(func(dataChannel DataChannel) {
+		received <- dataChannel
+	})
+
+	local, err := initiator.CreateDataChannel("test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan interface{}, 1)
+	local.OnOpen(func() {
+		opened <- nil
+	})
+
+	select {
+	case <-opened:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel did not open")
+	}
+
+	select {
+	case remote = <-received:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel was not received")
+	}
+
+	return local, remote
+}
+
+func TestDataChannelOpenAndCloseEvents(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	local, remote := createOpenDataChannels(t, initiator, responder)
+
+	// Received channels are already open, so the listener is called straight
+	// away.
+	remoteOpened := make(chan interface{}, 1)
+	remote.OnOpen(func() {
+		remoteOpened <- nil
+	})
+	select {
+	case <-remoteOpened:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote OnOpen was not called")
+	}
+
+	closed := make(chan interface{}, 1)
+	remote.OnClose(func() {
+		closed <- nil
+	})
+	local.Close()
+
+	select {
+	case <-closed:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote OnClose was not called")
+	}
+
+	err := remote.SendStringMessage("message")
+	if err != ErrDataChannelClosed {
+		t.Fatalf("expected ErrDataChannelClosed, got %v", err)
+	}
+}
+
+func TestDataChannelSendIsPaced(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	local, remote := createOpenDataChannels(t, initiator, responder)
+
+	const messageSize = 16 * 1024
+	const messageCount = 256
+	const threshold = 64 * 1024
+
+	received := make(chan int, messageCount)
+	remote.OnBinaryMessage(func(message []byte) {
+		received <- len(message)
+	})
+
+	local.SetBufferedAmountLowThreshold(threshold)
+	message := make([]byte, messageSize)
+	for i := 0; i < messageCount; i++ {
+		err := local.Send(context.Background(), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buffered := local.BufferedAmount(); buffered > threshold+messageSize {
+			t.Fatalf("buffered amount %v exceeds threshold", buffered)
+		}
+	}
+
+	for i := 0; i < messageCount; i++ {
+		select {
+		case <-received:
+			// Continue
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received %v of %v messages", i, messageCount)
+		}
+	}
+}
+
+func TestDataChannelSendRespectsContext(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	local, _ := createOpenDataChannels(t, initiator, responder)
+
+	// Fill the buffer past the threshold without waiting.
+	local.SetBufferedAmountLowThreshold(0)
+	message := make([]byte, 64*1024)
+	for i := 0; i < 64; i++ {
+		err := local.SendBinaryMessage(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := local.Send(ctx, message)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestPersistentDataChannelSendErrors(t *testing.T) {
+	peer, _ := createTestPeer()
+	defer peer.Close()
+
+	failing, err := peer.DeclareDataChannel("failing", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = failing.SendStringMessage("message")
+	if err != ErrDataChannelClosed {
+		t.Fatalf("expected ErrDataChannelClosed, got %v", err)
+	}
+
+	buffering, err := peer.DeclareDataChannel("buffering", true, BufferWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxBufferedMessages; i++ {
+		err = buffering.Send(context.Background(), []byte("message"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = buffering.SendBinaryMessage([]byte("message"))
+	if err != ErrSendBufferFull {
+		t.Fatalf("expected ErrSendBufferFull, got %v", err)
+	}
+}
+
+func TestDataChannelsAreRoutedByPrefix(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	received := make(chan string, 10)
+	route := func(name string) func(dataChannel DataChannel) {
+		return func(dataChannel DataChannel) {
+			received <- name + ":" + dataChannel.GetLabel()
+		}
+	}
+	responder.OnDataChannel(route("default"))
+	responder.OnDataChannelWithPrefix("app/", route("app"))
+	responder.OnDataChannelWithPrefix("app/special/", route("special"))
+	responder.OnDataChannelWithPrefix("removed/", route("removed"))
+	responder.OnDataChannelWithPrefix("removed/", nil)
+
+	expected := map[string]string{
+		"other":          "default:other",
+		"app/one":        "app:app/one",
+		"app/special/to": "special:app/special/to",
+		"removed/one":    "default:removed/one",
+	}
+	for label, want := range expected {
+		_, err := initiator.CreateDataChannel(label, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("data channel %v was not received", label)
+		}
+	}
+}
+
+func TestOwnDataChannelsAreNotRouted(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	local := make(chan string, 10)
+	initiator.OnDataChannel(func(dataChannel DataChannel) {
+		local <- "default:" + dataChannel.GetLabel()
+	})
+	initiator.OnDataChannelWithPrefix("app/", func(dataChannel DataChannel) {
+		local <- "app:" + dataChannel.GetLabel()
+	})
+	remote := make(chan string, 10)
+	responder.OnDataChannelWithPrefix("app/", func(dataChannel DataChannel) {
+		remote <- dataChannel.GetLabel()
+	})
+
+	_, err := initiator.CreateDataChannel("app/one", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-remote:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel was not received by the remote peer")
+	}
+
+	// Give any local delivery time to happen.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case got := <-local:
+		t.Fatalf("own data channel was delivered locally to %v", got)
+	default:
+	}
+}
+
+func TestFirstMessageIsNotLost(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+
+	received := make(chan DataChannel, 1)
+	responder.OnDataChannel(func(dataChannel DataChannel) {
+		received <- dataChannel
+	})
+	connectPeers(t, initiator, responder)
+
+	local, err := initiator.CreateDataChannel("test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.OnOpen(func() {
+		local.SendStringMessage("first")
+		local.SendStringMessage("second")
+	})
+
+	var remote DataChannel
+	select {
+	case remote = <-received:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel was not received")
+	}
+
+	// Subscribe well after the messages have arrived.
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, expected := range []string{"first", "second"} {
+		message, err := remote.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Text() != expected {
+			t.Fatalf("expected message %q, got %q", expected, message.Text())
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/mediadevices"
+	mdcodec "github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// A track captured from a camera or microphone, which is encoded once for
+// every peer and recording it is sent to. The device is only encoded while
+// the track is sent to a peer or recorded.
+type deviceTrack struct {
+	*tappedTrack
+	device    mediadevices.Track
+	mimeType  string
+	clockRate uint32
+	// The logger of the source the track belongs to.
+	logger *atomic.Pointer[slog.Logger]
+
+	// Guards all fields below.
+	mutex sync.Mutex
+	// The number of peers and recordings the track is sent to.
+	users int
+	// Encodes the device while there are users, or nil.
+	reader mediadevices.EncodedReadCloser
+	// Stops the goroutine reading from reader.
+	stop   context.CancelFunc
+	closed bool
+}
+
+// Chooses the first codec which device can be encoded with. Encoding starts
+// once the track is used.
+func newDeviceTrack(device mediadevices.Track, logger *atomic.Pointer[slog.Logger]) (*deviceTrack, error) {
+	clockRate := uint32(90000)
+	mimeTypes := []string{webrtc.MimeTypeH264, webrtc.MimeTypeVP8, webrtc.MimeTypeVP9}
+	if device.Kind() == webrtc.RTPCodecTypeAudio {
+		clockRate = 48000
+		mimeTypes = []string{webrtc.MimeTypeOpus}
+	}
+
+	var errs []error
+	for _, mimeType := range mimeTypes {
+		reader, err := device.NewEncodedReader(mimeType)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		reader.Close()
+		output, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType:  mimeType,
+			ClockRate: clockRate,
+		}, device.ID(), device.StreamID())
+		if err != nil {
+			return nil, err
+		}
+		return &deviceTrack{
+			tappedTrack: newTappedTrack(output),
+			device:      device,
+			mimeType:    mimeType,
+			clockRate:   clockRate,
+			logger:      logger,
+		}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Bind sends a key frame to each new peer, so that it can start decoding
+// straight away, and again whenever the peer asks for one.
+func (t *deviceTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	params, err := t.tappedTrack.Bind(ctx)
+	if err != nil {
+		return params, err
+	}
+	t.addUser()
+	t.requestKeyFrame()
+	go t.readRTCP(ctx.RTCPReader())
+	return params, nil
+}
+
+func (t *deviceTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	err := t.tappedTrack.Unbind(ctx)
+	if err != nil {
+		return err
+	}
+	t.removeUser()
+	return nil
+}
+
+// Adds a tap, encoding the device until it is removed.
+func (t *deviceTrack) addTap(tap func(sample media.Sample)) func() {
+	t.addUser()
+	removeTap := t.tappedTrack.addTap(tap)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			removeTap()
+			t.removeUser()
+		})
+	}
+}
+
+// Starts encoding the device for its first user.
+func (t *deviceTrack) addUser() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.users++
+	if t.users > 1 || t.closed {
+		return
+	}
+
+	reader, err := t.device.NewEncodedReader(t.mimeType)
+	if err != nil {
+		t.logger.Load().Warn("failed to start encoding device", "error", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.reader = reader
+	t.stop = cancel
+	go t.encode(ctx, reader)
+}
+
+// Stops encoding the device once it has no users.
+func (t *deviceTrack) removeUser() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.users--
+	if t.users == 0 {
+		t.stopEncoding()
+	}
+}
+
+// Must be called with mutex held.
+func (t *deviceTrack) stopEncoding() {
+	if t.stop != nil {
+		t.stop()
+		t.stop = nil
+		t.reader = nil
+	}
+}
+
+// Stops encoding and releases the device.
+func (t *deviceTrack) close() {
+	t.mutex.Lock()
+	t.closed = true
+	t.stopEncoding()
+	t.mutex.Unlock()
+
+	t.device.Close()
+}
+
+// Forces a key frame, if the device is being encoded and the encoder supports
+// it.
+func (t *deviceTrack) requestKeyFrame() error {
+	t.mutex.Lock()
+	reader := t.reader
+	t.mutex.Unlock()
+
+	if reader == nil {
+		return nil
+	}
+	controller, ok := reader.Controller().(mdcodec.KeyFrameController)
+	if !ok {
+		return nil
+	}
+	return controller.ForceKeyFrame()
+}
+
+// Forces a key frame whenever the peer reports picture loss, until the track
+// is unbound.
+func (t *deviceTrack) readRTCP(reader interceptor.RTCPReader) {
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := reader.Read(buffer, interceptor.Attributes{})
+		if err != nil {
+			return
+		}
+		packets, err := rtcp.Unmarshal(buffer[:n])
+		if err != nil {
+			continue
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				t.requestKeyFrame()
+			}
+		}
+	}
+}
+
+// Writes encoded samples to the track until ctx is cancelled or the device is
+// closed. Reads can't be interrupted, so the encoder is closed here once the
+// next sample arrives.
+func (t *deviceTrack) encode(ctx context.Context, reader mediadevices.EncodedReadCloser) {
+	defer reader.Close()
+	for {
+		buffer, release, err := reader.Read()
+		if err != nil {
+			if ctx.Err() == nil {
+				t.logger.Load().Warn("device capture stopped", "error", err)
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			release()
+			return
+		}
+		// Taps may keep the sample after the buffer is released.
+		data := append([]byte{}, buffer.Data...)
+		release()
+
+		err = t.WriteSample(media.Sample{
+			Data:     data,
+			Duration: time.Duration(buffer.Samples) * time.Second / time.Duration(t.clockRate),
+		})
+		if err != nil {
+			t.logger.Load().Debug("failed to write device sample", "error", err)
+		}
+	}
+}
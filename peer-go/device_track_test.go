@@ -0,0 +1,125 @@
+package thingrtc
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/webrtc/v3"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+// A camera which can only be encoded in VP8, by readers from newReader. Counts
+// the readers which are open.
+type testDevice struct {
+	mediadevices.Track
+	newReader func() mediadevices.EncodedReadCloser
+	open      atomic.Int32
+}
+
+func (d *testDevice) ID() string {
+	return "video"
+}
+
+func (d *testDevice) StreamID() string {
+	return "device"
+}
+
+func (d *testDevice) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeVideo
+}
+
+func (d *testDevice) Close() error {
+	return nil
+}
+
+func (d *testDevice) NewEncodedReader(codecName string) (mediadevices.EncodedReadCloser, error) {
+	if codecName != webrtc.MimeTypeVP8 {
+		return nil, errors.New("codec not supported")
+	}
+	d.open.Add(1)
+	return &testDeviceReader{EncodedReadCloser: d.newReader(), device: d}, nil
+}
+
+type testDeviceReader struct {
+	mediadevices.EncodedReadCloser
+	device    *testDevice
+	closeOnce sync.Once
+}
+
+func (r *testDeviceReader) Close() error {
+	r.closeOnce.Do(func() {
+		r.device.open.Add(-1)
+	})
+	return r.EncodedReadCloser.Close()
+}
+
+// An encoder which produces a VP8 key frame every 10ms.
+type tickingEncodedReader struct {
+	testEncodedReader
+}
+
+func (r *tickingEncodedReader) Read() (mediadevices.EncodedBuffer, func(), error) {
+	time.Sleep(10 * time.Millisecond)
+	return mediadevices.EncodedBuffer{Data: createTestVP8Frames(1, 1)[0], Samples: 900}, func() {}, nil
+}
+
+// Waits for the number of open readers of device to reach count.
+func waitForEncoders(t *testing.T, device *testDevice, count int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for device.open.Load() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v encoders, got %v", count, device.open.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeviceTrackOnlyEncodesWhileUsed(t *testing.T) {
+	device := &testDevice{newReader: func() mediadevices.EncodedReadCloser { return &tickingEncodedReader{} }}
+	source, err := newDeviceMediaSource([]mediadevices.Track{device})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	waitForEncoders(t, device, 0)
+
+	url := createRelayServer()
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiator := New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, WithICEServers(), WithMediaSources(source))
+	defer initiator.Close()
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responder := New(url, MockServerAuth{Token: "responder"}, responderConfig, WithICEServers())
+	defer responder.Close()
+
+	tracks := make(chan RemoteTrack, 1)
+	responder.OnTrack(func(track RemoteTrack) {
+		tracks <- track
+	})
+	connectPeers(t, initiator, responder)
+	waitForTrack(t, tracks)
+	waitForEncoders(t, device, 1)
+
+	// A recording shares the encoder, and keeps it running without the peer.
+	recording, err := RecordLocalTrack(source.Tracks()[0], filepath.Join(t.TempDir(), "recording.ivf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiator.Close()
+	time.Sleep(100 * time.Millisecond)
+	waitForEncoders(t, device, 1)
+
+	err = recording.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForEncoders(t, device, 0)
+}
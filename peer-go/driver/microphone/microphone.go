@@ -0,0 +1,5 @@
+package microphone
+
+import _ "github.com/pion/mediadevices/pkg/driver/microphone"
+
+// This file exists just to wrap the side-effect of importing microphone from Pion.
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/pion/webrtc/v3"
 	"github.com/urfave/cli/v2"
 
 	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
 	"github.com/thingify-app/thing-rtc/peer-go/codec/x264"
+	"github.com/thingify-app/thing-rtc/peer-go/filetransfer"
 	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+	"github.com/thingify-app/thing-rtc/peer-go/tunnel"
 
 	_ "github.com/pion/mediadevices/pkg/driver/videotest"
 	// Uncomment below and comment above to use the camera.
@@ -26,21 +32,57 @@ func main() {
 			{
 				Name:  "connect",
 				Usage: "Connect to a peer",
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:     "secret",
-						Usage:    "shared secret of the peer to connect to",
-						Required: true,
+				Flags: connectionFlags(),
+				Action: func(ctx *cli.Context) error {
+					options := append(iceOptions(ctx), loggerOption(ctx))
+					return connect(ctx.String("secret"), ctx.String("role"), options...)
+				},
+			},
+			{
+				Name:  "forward",
+				Usage: "Forward ports to, and serve forwarded ports for, a peer",
+				Flags: append(connectionFlags(),
+					&cli.StringSliceFlag{
+						Name:  "tcp",
+						Usage: "forward a local TCP port to an address reachable by the peer, e.g. 127.0.0.1:2222=127.0.0.1:22 (may be repeated)",
 					},
-					&cli.StringFlag{
-						Name:  "role",
-						Usage: "role to assume (either initiator or responder)",
-
-						Required: true,
+					&cli.StringSliceFlag{
+						Name:  "udp",
+						Usage: "forward a local UDP port to an address reachable by the peer (may be repeated)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "allow",
+						Usage: "address which the peer may forward ports to (may be repeated)",
 					},
+				),
+				Action: func(ctx *cli.Context) error {
+					options := append(iceOptions(ctx), loggerOption(ctx))
+					return forward(ctx.String("secret"), ctx.String("role"), ctx.StringSlice("tcp"), ctx.StringSlice("udp"), ctx.StringSlice("allow"), options...)
+				},
+			},
+			{
+				Name:      "send",
+				Usage:     "Send files to a peer which is receiving",
+				ArgsUsage: "FILE...",
+				Flags:     connectionFlags(),
+				Action: func(ctx *cli.Context) error {
+					options := append(iceOptions(ctx), loggerOption(ctx))
+					return send(ctx.String("secret"), ctx.String("role"), ctx.Args().Slice(), options...)
 				},
+			},
+			{
+				Name:  "receive",
+				Usage: "Receive files sent by a peer",
+				Flags: append(connectionFlags(),
+					&cli.StringFlag{
+						Name:  "dir",
+						Usage: "directory to save files in",
+						Value: ".",
+					},
+				),
 				Action: func(ctx *cli.Context) error {
-					return connect(ctx.String("secret"), ctx.String("role"))
+					options := append(iceOptions(ctx), loggerOption(ctx))
+					return receive(ctx.String("secret"), ctx.String("role"), ctx.String("dir"), options...)
 				},
 			},
 		},
@@ -51,6 +93,42 @@ func main() {
 	}
 }
 
+func connectionFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:     "secret",
+			Usage:    "shared secret of the peer to connect to",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "role",
+			Usage: "role to assume (either initiator or responder)",
+
+			Required: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "turn",
+			Usage: "TURN server URL, e.g. turn:host:3478?transport=tcp (may be repeated)",
+		},
+		&cli.StringFlag{
+			Name:  "turn-username",
+			Usage: "username for the TURN servers",
+		},
+		&cli.StringFlag{
+			Name:  "turn-credential",
+			Usage: "credential for the TURN servers",
+		},
+		&cli.BoolFlag{
+			Name:  "relay-only",
+			Usage: "only connect via TURN relays",
+		},
+		&cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "log debug messages",
+		},
+	}
+}
+
 func createVideoSource() *thingrtc.MediaSource {
 	codec, err := x264.NewCodec(500_000)
 	if err != nil {
@@ -63,44 +141,34 @@ func createVideoSource() *thingrtc.MediaSource {
 	return videoSource
 }
 
-func connect(sharedSecretBase64 string, role string) error {
-	var peerConfig *peerconfig.PeerConfig
-	var err error
+func iceOptions(ctx *cli.Context) []thingrtc.Option {
+	var options []thingrtc.Option
+	if turnUrls := ctx.StringSlice("turn"); len(turnUrls) > 0 {
+		turnServer := thingrtc.NewTURNServer(ctx.String("turn-username"), ctx.String("turn-credential"), turnUrls...)
+		options = append(options, thingrtc.WithICEServers(turnServer))
+	}
+	if ctx.Bool("relay-only") {
+		options = append(options, thingrtc.WithICETransportPolicy(webrtc.ICETransportPolicyRelay))
+	}
+	return options
+}
 
-	switch role {
-	case "initiator":
-		peerConfig, err = peerconfig.CreateInitiatorConfigWithSecret(sharedSecretBase64)
-	case "responder":
-		peerConfig, err = peerconfig.CreateResponderConfig(sharedSecretBase64)
-	default:
-		return fmt.Errorf("Invalid role type, expected initiator/responder")
+func loggerOption(ctx *cli.Context) thingrtc.Option {
+	level := slog.LevelInfo
+	if ctx.Bool("verbose") {
+		level = slog.LevelDebug
 	}
+	handler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	return thingrtc.WithLogger(slog.New(handler))
+}
 
+func connect(sharedSecretBase64 string, role string, extraOptions ...thingrtc.Option) error {
+	options := append([]thingrtc.Option{thingrtc.WithMediaSources(createVideoSource())}, extraOptions...)
+	peer, err := createPeer(sharedSecretBase64, role, options...)
 	if err != nil {
 		return err
 	}
 
-	serverAuth := thingrtc.CreateInsecureServerAuth(peerConfig.PairingId, peerConfig.Role)
-	peer := thingrtc.NewPeerWithMedia(SIGNALLING_SERVER_URL, serverAuth, peerConfig, false, createVideoSource())
-
-	peer.OnConnectionStateChange(func(connectionState int) {
-		switch connectionState {
-		case thingrtc.Disconnected:
-			fmt.Println("Disconnected")
-		case thingrtc.Connecting:
-			fmt.Println("Connecting...")
-		case thingrtc.Connected:
-			fmt.Println("Connected.")
-			dataChannel, err := peer.CreateDataChannel("tick", true)
-			if err != nil {
-				fmt.Printf("Failed to create data channel: %v\n", err)
-			} else {
-				for range time.Tick(time.Second) {
-					dataChannel.SendStringMessage("Tick")
-				}
-			}
-		}
-	})
 	peer.OnDataChannel(func(dataChannel thingrtc.DataChannel) {
 		fmt.Printf("New data channel received: %v\n", dataChannel.GetLabel())
 
@@ -111,12 +179,168 @@ func connect(sharedSecretBase64 string, role string) error {
 			fmt.Printf("Binary message received: %v\n", message)
 		})
 	})
-	peer.OnError(func(err error) {
-		fmt.Printf("Peer error: %v\n", err)
+
+	// Declared channels are re-opened after every reconnection, so we can keep
+	// ticking on the same handle.
+	tickChannel, err := peer.DeclareDataChannel("tick", true, thingrtc.FailWhileClosed)
+	if err != nil {
+		return err
+	}
+	tickChannel.OnReopen(func() {
+		fmt.Println("Tick channel opened")
+	})
+	go func() {
+		for range time.Tick(time.Second) {
+			tickChannel.SendStringMessage("Tick")
+		}
+	}()
+
+	err = peer.Connect(context.Background())
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	select {}
+}
+
+// Forwards each LOCAL=REMOTE port in tcpPorts and udpPorts to the peer, and
+// serves ports forwarded by the peer to the allowed addresses.
+func forward(sharedSecretBase64 string, role string, tcpPorts []string, udpPorts []string, allowed []string, extraOptions ...thingrtc.Option) error {
+	peer, err := createPeer(sharedSecretBase64, role, append(extraOptions, thingrtc.WithDetachDataChannels(true))...)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	server := tunnel.Serve(peer, tunnel.AllowAddresses(allowed...))
+	defer server.Close()
+
+	forwards := []struct {
+		ports   []string
+		forward func(peer thingrtc.Peer, localAddress string, remoteAddress string, opts ...tunnel.Option) (*tunnel.Forwarder, error)
+	}{
+		{tcpPorts, tunnel.ForwardTCP},
+		{udpPorts, tunnel.ForwardUDP},
+	}
+	for _, f := range forwards {
+		for _, port := range f.ports {
+			localAddress, remoteAddress, ok := strings.Cut(port, "=")
+			if !ok {
+				return fmt.Errorf("Invalid port %v, expected LOCAL=REMOTE", port)
+			}
+			forwarder, err := f.forward(peer, localAddress, remoteAddress)
+			if err != nil {
+				return err
+			}
+			defer forwarder.Close()
+			fmt.Printf("Forwarding %v to %v\n", forwarder.Addr(), remoteAddress)
+		}
+	}
+
+	err = peer.Connect(context.Background())
+	if err != nil {
+		return err
+	}
+
+	select {}
+}
+
+// Sends each file in turn, resuming across reconnections, then exits.
+func send(sharedSecretBase64 string, role string, paths []string, extraOptions ...thingrtc.Option) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("No files to send")
+	}
+
+	peer, err := createPeer(sharedSecretBase64, role, extraOptions...)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	err = peer.Connect(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		err := filetransfer.Send(context.Background(), peer, path, filetransfer.WithProgress(func(info filetransfer.FileInfo, transferred int64) {
+			fmt.Printf("Sending %v: %v/%v bytes\n", info.Name, transferred, info.Size)
+		}))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Sent %v\n", path)
+	}
+	return nil
+}
+
+// Saves files sent by the peer into dir until interrupted.
+func receive(sharedSecretBase64 string, role string, dir string, extraOptions ...thingrtc.Option) error {
+	peer, err := createPeer(sharedSecretBase64, role, extraOptions...)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	receiver := filetransfer.Receive(peer, dir)
+	defer receiver.Close()
+	receiver.OnOffer(func(info filetransfer.FileInfo) bool {
+		fmt.Printf("Receiving %v (%v bytes)\n", info.Name, info.Size)
+		return true
+	})
+	receiver.OnComplete(func(info filetransfer.FileInfo, path string, err error) {
+		if err != nil {
+			fmt.Printf("Failed to receive %v: %v\n", info.Name, err)
+		} else {
+			fmt.Printf("Received %v\n", path)
+		}
 	})
 
-	peer.Connect()
-	defer peer.Disconnect()
+	err = peer.Connect(context.Background())
+	if err != nil {
+		return err
+	}
 
 	select {}
 }
+
+// Creates a peer which reconnects with backoff and prints its events.
+func createPeer(sharedSecretBase64 string, role string, extraOptions ...thingrtc.Option) (thingrtc.Peer, error) {
+	var peerConfig *peerconfig.PeerConfig
+	var err error
+
+	switch role {
+	case "initiator":
+		peerConfig, err = peerconfig.CreateInitiatorConfigWithSecret(sharedSecretBase64)
+	case "responder":
+		peerConfig, err = peerconfig.CreateResponderConfig(sharedSecretBase64)
+	default:
+		return nil, fmt.Errorf("Invalid role type, expected initiator/responder")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	serverAuth := thingrtc.CreateInsecureServerAuth(peerConfig.PairingId, peerConfig.Role)
+	options := []thingrtc.Option{
+		thingrtc.WithRetryPolicy(thingrtc.NewExponentialBackoffRetryPolicy(time.Second, 30*time.Second)),
+	}
+	peer := thingrtc.New(SIGNALLING_SERVER_URL, serverAuth, peerConfig, append(options, extraOptions...)...)
+
+	peer.OnConnectionStateChange(func(state thingrtc.ConnectionState, reason error) {
+		if reason != nil {
+			fmt.Printf("%v (%v)\n", state, reason)
+		} else {
+			fmt.Println(state)
+		}
+	})
+	peer.OnError(func(err error) {
+		fmt.Printf("Peer error: %v\n", err)
+	})
+	peer.OnRetry(func(attempt int, delay time.Duration) {
+		fmt.Printf("Reconnecting in %v (attempt %v)...\n", delay, attempt+1)
+	})
+	return peer, nil
+}
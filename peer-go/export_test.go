@@ -0,0 +1,9 @@
+package thingrtc
+
+import "net"
+
+// NewDataChannelConn lets external tests create a conn over any stream, such
+// as one over a testutil.Pipe.
+func NewDataChannelConn(stream *DataChannelStream, label string) net.Conn {
+	return newDataChannelConn(stream, Addr{Label: label}, Addr{Label: label})
+}
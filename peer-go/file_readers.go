@@ -0,0 +1,400 @@
+package thingrtc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+// A sample read from a media file.
+type fileSample struct {
+	data []byte
+	// From the start of the file.
+	timestamp time.Duration
+	duration  time.Duration
+	// Whether playback can start from this sample, which is true of every
+	// audio sample.
+	keyFrame bool
+}
+
+// Reads the samples of one track of a media file, in order, returning io.EOF
+// after the last.
+type fileTrackReader interface {
+	next() (*fileSample, error)
+	Close() error
+}
+
+// A track of a media file, which can be read any number of times.
+type fileTrack struct {
+	capability webrtc.RTPCodecCapability
+	// Opens a new reader from the start of the track.
+	open func() (fileTrackReader, error)
+}
+
+// Opens an IVF file of VP8 or VP9 frames.
+func openIVF(path string) ([]fileTrack, error) {
+	reader, err := newIVFTrackReader(path)
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+
+	return []fileTrack{{
+		capability: webrtc.RTPCodecCapability{MimeType: reader.mimeType},
+		open: func() (fileTrackReader, error) {
+			return newIVFTrackReader(path)
+		},
+	}}, nil
+}
+
+type ivfTrackReader struct {
+	file     *os.File
+	reader   *ivfreader.IVFReader
+	mimeType string
+	// Timestamps are in units of numerator/denominator seconds.
+	numerator   uint32
+	denominator uint32
+	// The next frame, read ahead to find the duration of the one before it.
+	pending      *fileSample
+	lastDuration time.Duration
+	done         bool
+}
+
+func newIVFTrackReader(path string) (*ivfTrackReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, header, err := ivfreader.NewWith(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: %w", ErrUnsupportedFile, err)
+	}
+
+	var mimeType string
+	switch header.FourCC {
+	case "VP80":
+		mimeType = webrtc.MimeTypeVP8
+	case "VP90":
+		mimeType = webrtc.MimeTypeVP9
+	default:
+		file.Close()
+		return nil, fmt.Errorf("%w: IVF codec %v", ErrUnsupportedCodec, header.FourCC)
+	}
+	if header.TimebaseNumerator == 0 || header.TimebaseDenominator == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%w: invalid IVF timebase", ErrUnsupportedFile)
+	}
+
+	return &ivfTrackReader{
+		file:        file,
+		reader:      reader,
+		mimeType:    mimeType,
+		numerator:   header.TimebaseNumerator,
+		denominator: header.TimebaseDenominator,
+	}, nil
+}
+
+func (r *ivfTrackReader) read() (*fileSample, error) {
+	frame, header, err := r.reader.ParseNextFrame()
+	if err != nil {
+		return nil, err
+	}
+	keyFrame := isVP8KeyFrame(frame)
+	if r.mimeType == webrtc.MimeTypeVP9 {
+		keyFrame = isVP9KeyFrame(frame)
+	}
+	return &fileSample{
+		data:      frame,
+		timestamp: time.Duration(header.Timestamp) * time.Second * time.Duration(r.numerator) / time.Duration(r.denominator),
+		keyFrame:  keyFrame,
+	}, nil
+}
+
+func (r *ivfTrackReader) next() (*fileSample, error) {
+	if r.pending == nil {
+		if r.done {
+			return nil, io.EOF
+		}
+		sample, err := r.read()
+		if err != nil {
+			return nil, err
+		}
+		r.pending = sample
+	}
+
+	sample := r.pending
+	r.pending = nil
+	following, err := r.read()
+	switch {
+	case err == nil:
+		sample.duration = following.timestamp - sample.timestamp
+		r.pending = following
+	case errors.Is(err, io.EOF):
+		// The last frame lasts as long as the one before it, or one unit of
+		// the timebase if it is the only one.
+		sample.duration = r.lastDuration
+		if sample.duration == 0 {
+			sample.duration = time.Second * time.Duration(r.numerator) / time.Duration(r.denominator)
+		}
+		r.done = true
+	default:
+		return nil, err
+	}
+	r.lastDuration = sample.duration
+	return sample, nil
+}
+
+func (r *ivfTrackReader) Close() error {
+	return r.file.Close()
+}
+
+func isVP8KeyFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&0x01 == 0
+}
+
+// Reads the start of a VP9 frame's uncompressed header.
+func isVP9KeyFrame(frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	// Bits from the most significant: frame marker (2), profile low bit,
+	// profile high bit, a reserved bit for profile 3, show existing frame,
+	// then frame type, which is 0 for a key frame.
+	b := frame[0]
+	profile := (b>>5)&1 | (b>>4)&1<<1
+	bit := 4
+	if profile == 3 {
+		bit++
+	}
+	if (b>>(7-bit))&1 == 1 {
+		return false
+	}
+	bit++
+	return (b>>(7-bit))&1 == 0
+}
+
+// Opens a raw H264 Annex-B file, which has no timestamps, so is played at
+// frameRate.
+func openH264(path string, frameRate int) ([]fileTrack, error) {
+	if frameRate <= 0 {
+		return nil, fmt.Errorf("%w: invalid frame rate %v", ErrUnsupportedFile, frameRate)
+	}
+	reader, err := newH264TrackReader(path, frameRate)
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+
+	return []fileTrack{{
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+		open: func() (fileTrackReader, error) {
+			return newH264TrackReader(path, frameRate)
+		},
+	}}, nil
+}
+
+type h264TrackReader struct {
+	file          *os.File
+	reader        *h264reader.H264Reader
+	frameDuration time.Duration
+	timestamp     time.Duration
+	// The first NAL unit of the next frame, read to find the end of the
+	// current one.
+	pending *h264reader.NAL
+}
+
+func newH264TrackReader(path string, frameRate int) (*h264TrackReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := h264reader.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: %w", ErrUnsupportedFile, err)
+	}
+	return &h264TrackReader{
+		file:          file,
+		reader:        reader,
+		frameDuration: time.Second / time.Duration(frameRate),
+	}, nil
+}
+
+// Returns each frame as a sample: the NAL units of a picture, along with any
+// parameter sets and other NAL units preceding it.
+func (r *h264TrackReader) next() (*fileSample, error) {
+	var frame []byte
+	hasPicture := false
+	keyFrame := false
+	for {
+		nal := r.pending
+		r.pending = nil
+		if nal == nil {
+			var err error
+			nal, err = r.reader.NextNAL()
+			if errors.Is(err, io.EOF) && hasPicture {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		picture := nal.UnitType == h264reader.NalUnitTypeCodedSliceNonIdr || nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr
+		// Any NAL unit other than a further slice of the same picture
+		// starts the next frame. The first slice of a picture starts at
+		// macroblock 0, encoded as a single 1 bit.
+		firstSlice := len(nal.Data) > 1 && nal.Data[1]&0x80 != 0
+		if hasPicture && (!picture || firstSlice) {
+			r.pending = nal
+			break
+		}
+
+		frame = append(frame, annexBStartCode...)
+		frame = append(frame, nal.Data...)
+		if picture {
+			hasPicture = true
+			keyFrame = keyFrame || nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr
+		}
+	}
+
+	sample := &fileSample{
+		data:      frame,
+		timestamp: r.timestamp,
+		duration:  r.frameDuration,
+		keyFrame:  keyFrame,
+	}
+	r.timestamp += r.frameDuration
+	return sample, nil
+}
+
+func (r *h264TrackReader) Close() error {
+	return r.file.Close()
+}
+
+// Opens an OGG file containing an Opus stream, with one packet on each page
+// (as written by pion's oggwriter). Files with several packets on a page are
+// rejected when the page is read.
+func openOGG(path string) ([]fileTrack, error) {
+	reader, err := newOGGTrackReader(path)
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+
+	return []fileTrack{{
+		capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		open: func() (fileTrackReader, error) {
+			return newOGGTrackReader(path)
+		},
+	}}, nil
+}
+
+type oggTrackReader struct {
+	file   *os.File
+	reader *oggreader.OggReader
+	// The granule position of the last audio page, or zero before the first.
+	granulePosition uint64
+	timestamp       time.Duration
+}
+
+func newOGGTrackReader(path string) (*oggTrackReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// Checks that the stream starts with an Opus identification header.
+	reader, _, err := oggreader.NewWith(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w: not an OGG Opus stream: %w", ErrUnsupportedFile, err)
+	}
+	return &oggTrackReader{
+		file:   file,
+		reader: reader,
+	}, nil
+}
+
+func (r *oggTrackReader) next() (*fileSample, error) {
+	for {
+		packet, header, err := r.reader.ParseNextPage()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnsupportedFile, err)
+		}
+		// Pages of the comment header have a granule position of zero.
+		if header.GranulePosition == 0 {
+			continue
+		}
+
+		// Granule positions count 48kHz samples, so pages holding several
+		// packets can be spotted by how far they advance (other than the
+		// first, which may start anywhere).
+		duration := opusPacketDuration(packet)
+		if r.granulePosition != 0 {
+			samples := header.GranulePosition - r.granulePosition
+			if header.GranulePosition < r.granulePosition || samples > uint64(duration*48000/time.Second) {
+				return nil, fmt.Errorf("%w: OGG page does not hold a single Opus packet", ErrUnsupportedFile)
+			}
+		}
+		r.granulePosition = header.GranulePosition
+
+		sample := &fileSample{
+			data:      packet,
+			timestamp: r.timestamp,
+			duration:  duration,
+			keyFrame:  true,
+		}
+		r.timestamp += duration
+		return sample, nil
+	}
+}
+
+func (r *oggTrackReader) Close() error {
+	return r.file.Close()
+}
+
+// Returns the duration of an Opus packet from its TOC byte, as in RFC 6716.
+func opusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+
+	var frameDuration time.Duration
+	switch {
+	case config < 12:
+		// SILK
+		frameDuration = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		// Hybrid
+		frameDuration = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// CELT
+		frameDuration = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frameDuration * time.Duration(frames)
+}
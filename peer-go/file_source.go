@@ -0,0 +1,452 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+var ErrUnsupportedFile = errors.New("unsupported media file")
+
+// Returned internally when playback is interrupted by a seek.
+var errSeeked = errors.New("playback seeked")
+
+type FileOption func(options *fileOptions)
+
+type fileOptions struct {
+	loop      bool
+	frameRate int
+	paused    bool
+}
+
+func defaultFileOptions() *fileOptions {
+	return &fileOptions{
+		frameRate: 30,
+	}
+}
+
+// WithFileLoop plays the file again from the start each time it ends.
+func WithFileLoop() FileOption {
+	return func(options *fileOptions) {
+		options.loop = true
+	}
+}
+
+// WithFileFrameRate sets the frame rate of raw H264 files, which have no
+// timestamps. Defaults to 30 frames per second.
+func WithFileFrameRate(fps int) FileOption {
+	return func(options *fileOptions) {
+		options.frameRate = fps
+	}
+}
+
+// WithFileStartPaused creates the source paused, so that playback starts
+// when Resume is called.
+func WithFileStartPaused() FileOption {
+	return func(options *fileOptions) {
+		options.paused = true
+	}
+}
+
+// FileMediaSource is a MediaSource playing a media file, in real time
+// according to its timestamps.
+type FileMediaSource struct {
+	*MediaSource
+
+	clock *playbackClock
+	// Guards endListener.
+	mutex       sync.Mutex
+	endListener func()
+}
+
+// CreateFileMediaSource plays the media file at path, which may be:
+//   - IVF (.ivf) containing VP8 or VP9.
+//   - Raw H264 in Annex-B format (.h264 or .264), played at the frame rate set
+//     by WithFileFrameRate.
+//   - OGG (.ogg or .opus) containing Opus, with one packet on each page.
+//   - Fragmented MP4 (.mp4, .m4v or .m4a) containing any of H264, H265, VP8,
+//     VP9 and Opus. Tracks in other codecs are skipped.
+//
+// Media is sent without transcoding, so the file must be in codecs the peer
+// supports. Playback starts immediately (unless WithFileStartPaused is given)
+// and continues until the end of the file, whether or not a peer is connected.
+// Errors reading the file are reported to the error listener of each peer
+// using the source.
+func CreateFileMediaSource(path string, opts ...FileOption) (*FileMediaSource, error) {
+	options := defaultFileOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	var fileTracks []fileTrack
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ivf":
+		fileTracks, err = openIVF(path)
+	case ".h264", ".264":
+		fileTracks, err = openH264(path, options.frameRate)
+	case ".ogg", ".opus":
+		fileTracks, err = openOGG(path)
+	case ".mp4", ".m4v", ".m4a":
+		fileTracks, err = openMP4(path)
+	default:
+		err = fmt.Errorf("%w: %v", ErrUnsupportedFile, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tracks []webrtc.TrackLocal
+	var outputs []sampleTrack
+	for i, fileTrack := range fileTracks {
+		id := fmt.Sprintf("file-%v", i)
+		var output sampleTrack
+		if fileTrack.capability.MimeType == webrtc.MimeTypeH265 {
+			output, err = newH265Track(id, "file")
+		} else {
+			output, err = webrtc.NewTrackLocalStaticSample(fileTrack.capability, id, "file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		output = newTappedTrack(output)
+		tracks = append(tracks, output)
+		outputs = append(outputs, output)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := &FileMediaSource{
+		MediaSource: newMediaSource(tracks),
+		clock:       newPlaybackClock(len(fileTracks), options.paused),
+		endListener: func() {},
+	}
+	source.cancel = cancel
+	for i, fileTrack := range fileTracks {
+		go source.play(ctx, fileTrack, outputs[i], options.loop)
+	}
+
+	return source, nil
+}
+
+// OnEnd sets a listener called each time playback reaches the end of the
+// file, including before playing it again when looping.
+func (f *FileMediaSource) OnEnd(listener func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.endListener = listener
+}
+
+func (f *FileMediaSource) getEndListener() func() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.endListener
+}
+
+// Pause stops playback at the current position.
+func (f *FileMediaSource) Pause() {
+	f.clock.pause()
+}
+
+// Resume continues playback from the current position.
+func (f *FileMediaSource) Resume() {
+	f.clock.resume()
+}
+
+// Seek moves playback to position from the start of the file, which also
+// plays the file again if it has ended. Video restarts from the last key frame
+// at or before position, so that it can be decoded.
+func (f *FileMediaSource) Seek(position time.Duration) error {
+	if position < 0 {
+		return fmt.Errorf("invalid seek position: %v", position)
+	}
+	f.clock.seek(position)
+	return nil
+}
+
+// Position returns the current position of playback from the start of the
+// file.
+func (f *FileMediaSource) Position() time.Duration {
+	return f.clock.now()
+}
+
+// Plays a track of the file until the source is closed, starting again
+// whenever it is seeked.
+func (f *FileMediaSource) play(ctx context.Context, track fileTrack, output sampleTrack, loop bool) {
+	for {
+		generation, position := f.clock.start()
+		err := f.playFrom(ctx, track, output, generation, position)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errSeeked) {
+			continue
+		}
+		if err != nil {
+			f.logger.Load().Error("failed to play media file", "error", err)
+			f.updateState(func(state *MediaSourceState) {
+				state.LastError = err
+			})
+			f.reportError(err)
+		}
+
+		ended, looped := f.clock.finish(generation, err != nil, loop)
+		if ended {
+			f.getEndListener()()
+		}
+		if looped {
+			continue
+		}
+		if !f.clock.waitForSeek(ctx, generation) {
+			return
+		}
+	}
+}
+
+// Plays a track from position, until it ends or the clock's generation
+// changes.
+func (f *FileMediaSource) playFrom(ctx context.Context, track fileTrack, output sampleTrack, generation int, position time.Duration) error {
+	reader, err := track.open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Skip to the last key frame at or before position. The samples from
+	// there until position are due immediately.
+	var due []*fileSample
+	var sample *fileSample
+	for {
+		sample, err = reader.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sample.timestamp > position {
+			break
+		}
+		if sample.keyFrame {
+			due = due[:0]
+		}
+		if sample.keyFrame || len(due) > 0 {
+			due = append(due, sample)
+		}
+	}
+	due = append(due, sample)
+
+	// When the last sample written finishes.
+	var end time.Duration
+	for {
+		for _, sample := range due {
+			err := f.clock.waitUntil(ctx, generation, sample.timestamp)
+			if err != nil {
+				return err
+			}
+			// Writes only fail for individual connections, which have
+			// their own error handling, so they must not stop playback.
+			err = output.WriteSample(media.Sample{Data: sample.data, Duration: sample.duration})
+			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				f.logger.Load().Debug("failed to write file sample", "error", err)
+			}
+			end = sample.timestamp + sample.duration
+		}
+
+		sample, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			// The track ends once its last sample has been played.
+			return f.clock.waitUntil(ctx, generation, end)
+		}
+		if err != nil {
+			return err
+		}
+		due = []*fileSample{sample}
+	}
+}
+
+// The position of playback, shared by the tracks of a file. Each seek starts
+// a new generation, which the tracks play from the start of.
+type playbackClock struct {
+	mutex sync.Mutex
+	// The position at since, after which the clock runs unless paused or
+	// ended.
+	position time.Duration
+	since    time.Time
+	paused   bool
+	ended    bool
+
+	generation int
+	tracks     int
+	// Tracks which have finished playing in this generation, and whether any
+	// of them failed.
+	finished int
+	failed   bool
+	// Closed and replaced whenever the clock changes.
+	changed chan struct{}
+}
+
+func newPlaybackClock(tracks int, paused bool) *playbackClock {
+	return &playbackClock{
+		since:   time.Now(),
+		paused:  paused,
+		tracks:  tracks,
+		changed: make(chan struct{}),
+	}
+}
+
+// Must be called with the mutex held.
+func (c *playbackClock) current() time.Duration {
+	if c.paused || c.ended {
+		return c.position
+	}
+	return c.position + time.Since(c.since)
+}
+
+// Must be called with the mutex held.
+func (c *playbackClock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *playbackClock) now() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current()
+}
+
+// Returns the current generation, and the position it started from.
+func (c *playbackClock) start() (int, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation, c.position
+}
+
+func (c *playbackClock) pause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.paused {
+		return
+	}
+	c.position = c.current()
+	c.paused = true
+	c.notify()
+}
+
+func (c *playbackClock) resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.paused {
+		return
+	}
+	c.since = time.Now()
+	c.paused = false
+	c.notify()
+}
+
+func (c *playbackClock) seek(position time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.restart(position)
+}
+
+// Must be called with the mutex held.
+func (c *playbackClock) restart(position time.Duration) {
+	c.position = position
+	c.since = time.Now()
+	c.ended = false
+	c.generation++
+	c.finished = 0
+	c.failed = false
+	c.notify()
+}
+
+// Records that a track has finished playing generation. Returns whether
+// every track has now finished, and if so whether playback was restarted from
+// the start, which it is when looping unless a track failed.
+func (c *playbackClock) finish(generation int, failed bool, loop bool) (bool, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return false, false
+	}
+	c.finished++
+	c.failed = c.failed || failed
+	if c.finished < c.tracks {
+		return false, false
+	}
+
+	if loop && !c.failed {
+		c.restart(0)
+		return true, true
+	}
+	c.position = c.current()
+	c.ended = true
+	return true, false
+}
+
+// Waits until the clock reaches timestamp. Returns errSeeked if the clock
+// moves on from generation first.
+func (c *playbackClock) waitUntil(ctx context.Context, generation int, timestamp time.Duration) error {
+	for {
+		c.mutex.Lock()
+		if c.generation != generation {
+			c.mutex.Unlock()
+			return errSeeked
+		}
+		delay := timestamp - c.current()
+		paused := c.paused
+		changed := c.changed
+		c.mutex.Unlock()
+
+		if !paused && delay <= 0 {
+			return nil
+		}
+
+		// While paused, only a change to the clock can make the sample due.
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !paused {
+			timer = time.NewTimer(delay)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Waits until the clock moves on from generation, returning false if ctx is
+// cancelled first.
+func (c *playbackClock) waitForSeek(ctx context.Context, generation int) bool {
+	for {
+		c.mutex.Lock()
+		seeked := c.generation != generation
+		changed := c.changed
+		c.mutex.Unlock()
+		if seeked {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,686 @@
+package thingrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Writes an IVF file of frames, each lasting frameDuration milliseconds.
+func writeTestIVF(t *testing.T, fourCC string, frames [][]byte, frameDuration int) string {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourCC)
+	// A timebase of 1/1000 seconds.
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(frames)))
+
+	data := header
+	for i, frame := range frames {
+		frameHeader := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frameHeader, uint32(len(frame)))
+		binary.LittleEndian.PutUint64(frameHeader[4:], uint64(i*frameDuration))
+		data = append(data, frameHeader...)
+		data = append(data, frame...)
+	}
+	return writeTestFile(t, "test.ivf", data)
+}
+
+// Creates VP8 frames which are all key frames, each filled with its number.
+func createTestFrames(count int) [][]byte {
+	var frames [][]byte
+	for i := 0; i < count; i++ {
+		frames = append(frames, bytes.Repeat([]byte{byte(i * 2)}, 100))
+	}
+	return frames
+}
+
+// Reads every sample from the first track of a file.
+func readTestSamples(t *testing.T, tracks []fileTrack) []*fileSample {
+	t.Helper()
+	reader, err := tracks[0].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var samples []*fileSample
+	for {
+		sample, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			return samples
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, sample)
+	}
+}
+
+func TestIVFReader(t *testing.T) {
+	frames := [][]byte{{0x00, 0x01}, {0x01, 0x02}, {0x01, 0x03}}
+	tracks, err := openIVF(writeTestIVF(t, "VP80", frames, 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0].capability.MimeType != webrtc.MimeTypeVP8 {
+		t.Fatalf("expected a VP8 track, got %v", tracks)
+	}
+
+	samples := readTestSamples(t, tracks)
+	if len(samples) != 3 {
+		t.Fatalf("expected 3 samples, got %v", len(samples))
+	}
+	for i, sample := range samples {
+		if !bytes.Equal(sample.data, frames[i]) {
+			t.Errorf("expected %v, got %v", frames[i], sample.data)
+		}
+		if sample.timestamp != time.Duration(i)*40*time.Millisecond {
+			t.Errorf("unexpected timestamp %v of sample %v", sample.timestamp, i)
+		}
+		if sample.duration != 40*time.Millisecond {
+			t.Errorf("unexpected duration %v of sample %v", sample.duration, i)
+		}
+		if sample.keyFrame != (i == 0) {
+			t.Errorf("unexpected key frame flag of sample %v", i)
+		}
+	}
+
+	_, err = openIVF(writeTestIVF(t, "AV01", frames, 40))
+	if !errors.Is(err, ErrUnsupportedCodec) {
+		t.Errorf("expected ErrUnsupportedCodec, got %v", err)
+	}
+}
+
+func TestVP9KeyFrame(t *testing.T) {
+	for frame, expected := range map[byte]bool{
+		0x80: true,  // Profile 0 key frame.
+		0x84: false, // Profile 0 inter frame.
+		0x88: false, // Profile 0 showing an existing frame.
+		0xb0: true,  // Profile 3 key frame.
+		0xb2: false, // Profile 3 inter frame.
+	} {
+		if isVP9KeyFrame([]byte{frame}) != expected {
+			t.Errorf("expected key frame %v for %#x", expected, frame)
+		}
+	}
+}
+
+func TestH264Reader(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84}
+	inter := []byte{0x41, 0x9a, 0x02}
+	// A picture in two slices, the second not starting at macroblock 0.
+	first := []byte{0x41, 0x9a, 0x03}
+	second := []byte{0x41, 0x12, 0x04}
+
+	var data []byte
+	for _, nal := range [][]byte{sps, pps, idr, inter, first, second} {
+		data = append(data, annexBStartCode...)
+		data = append(data, nal...)
+	}
+	tracks, err := openH264(writeTestFile(t, "test.h264", data), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := readTestSamples(t, tracks)
+	expected := [][][]byte{{sps, pps, idr}, {inter}, {first, second}}
+	if len(samples) != len(expected) {
+		t.Fatalf("expected %v frames, got %v", len(expected), len(samples))
+	}
+	for i, sample := range samples {
+		var frame []byte
+		for _, nal := range expected[i] {
+			frame = append(frame, annexBStartCode...)
+			frame = append(frame, nal...)
+		}
+		if !bytes.Equal(sample.data, frame) {
+			t.Errorf("expected frame %v to be %v, got %v", i, frame, sample.data)
+		}
+		if sample.timestamp != time.Duration(i)*40*time.Millisecond || sample.duration != 40*time.Millisecond {
+			t.Errorf("unexpected timing of frame %v: %v for %v", i, sample.timestamp, sample.duration)
+		}
+		if sample.keyFrame != (i == 0) {
+			t.Errorf("unexpected key frame flag of frame %v", i)
+		}
+	}
+}
+
+// Writes an OGG file with each packet in a page of its own.
+func writeTestOGG(t *testing.T, packets [][]byte) string {
+	var pages [][][]byte
+	for _, packet := range packets {
+		pages = append(pages, [][]byte{packet})
+	}
+	return writeTestFile(t, "test.ogg", createTestOGG(pages))
+}
+
+// Creates an OGG file with the given packets on each page. The first page
+// starts the stream, the first two have a granule position of zero as
+// headers do, and the rest are timed as Opus packets.
+func createTestOGG(pages [][][]byte) []byte {
+	var data []byte
+	var granulePosition uint64
+	for i, packets := range pages {
+		var lacing, payload []byte
+		for _, packet := range packets {
+			remaining := len(packet)
+			for remaining >= 255 {
+				lacing = append(lacing, 255)
+				remaining -= 255
+			}
+			lacing = append(lacing, byte(remaining))
+			payload = append(payload, packet...)
+			if i >= 2 {
+				granulePosition += uint64(opusPacketDuration(packet) * 48000 / time.Second)
+			}
+		}
+
+		page := make([]byte, 27)
+		copy(page, "OggS")
+		if i == 0 {
+			page[5] = 0x02
+		}
+		binary.LittleEndian.PutUint64(page[6:], granulePosition)
+		binary.LittleEndian.PutUint32(page[18:], uint32(i))
+		page[26] = byte(len(lacing))
+		page = append(page, lacing...)
+		page = append(page, payload...)
+		binary.LittleEndian.PutUint32(page[22:], oggTestChecksum(page))
+		data = append(data, page...)
+	}
+	return data
+}
+
+// The CRC of an OGG page, whose checksum field is zero.
+func oggTestChecksum(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Opus identification and comment headers.
+var (
+	oggTestIDHeader      = append([]byte("OpusHead\x01\x02"), make([]byte, 9)...)
+	oggTestCommentHeader = []byte("OpusTags")
+)
+
+func TestOGGReader(t *testing.T) {
+	// CELT packets of one and two 20ms frames, the second long enough to
+	// need several segments.
+	single := []byte{31 << 3, 0x01}
+	double := append([]byte{31<<3 | 1}, bytes.Repeat([]byte{0x02}, 300)...)
+	exact := append([]byte{31 << 3}, bytes.Repeat([]byte{0x03}, 254)...)
+	packets := [][]byte{oggTestIDHeader, oggTestCommentHeader, single, double, exact}
+
+	tracks, err := openOGG(writeTestOGG(t, packets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracks[0].capability.MimeType != webrtc.MimeTypeOpus {
+		t.Errorf("expected Opus, got %v", tracks[0].capability.MimeType)
+	}
+
+	samples := readTestSamples(t, tracks)
+	if len(samples) != 3 {
+		t.Fatalf("expected 3 samples, got %v", len(samples))
+	}
+	timestamps := []time.Duration{0, 20 * time.Millisecond, 60 * time.Millisecond}
+	durations := []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 20 * time.Millisecond}
+	for i, sample := range samples {
+		if !bytes.Equal(sample.data, packets[i+2]) {
+			t.Errorf("unexpected data of packet %v", i)
+		}
+		if sample.timestamp != timestamps[i] || sample.duration != durations[i] {
+			t.Errorf("unexpected timing of packet %v: %v for %v", i, sample.timestamp, sample.duration)
+		}
+	}
+}
+
+func TestOGGReaderUnsupportedFile(t *testing.T) {
+	packet := []byte{31 << 3, 0x01}
+
+	_, err := openOGG(writeTestOGG(t, [][]byte{[]byte("\x80theora"), {0x01}}))
+	if !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("expected ErrUnsupportedFile for Theora, got %v", err)
+	}
+
+	corrupt := createTestOGG([][][]byte{{oggTestIDHeader}, {oggTestCommentHeader}, {packet}})
+	corrupt[len(corrupt)-1] ^= 0xff
+	tracks, err := openOGG(writeTestFile(t, "test.ogg", corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := tracks[0].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	_, err = reader.next()
+	if !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("expected ErrUnsupportedFile for a bad checksum, got %v", err)
+	}
+
+	// The second page holds two packets, which can't be told apart.
+	tracks, err = openOGG(writeTestFile(t, "test.ogg", createTestOGG([][][]byte{
+		{oggTestIDHeader}, {oggTestCommentHeader}, {packet}, {packet, packet},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err = tracks[0].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	_, err = reader.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.next()
+	if !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("expected ErrUnsupportedFile for a page of two packets, got %v", err)
+	}
+}
+
+func mp4TestBox(boxType string, contents ...[]byte) []byte {
+	var data []byte
+	for _, content := range contents {
+		data = append(data, content...)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(data)))
+	box = append(box, boxType...)
+	return append(box, data...)
+}
+
+func mp4TestUint32(values ...uint32) []byte {
+	var data []byte
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return data
+}
+
+// Writes a fragmented MP4 file with an H264 track, in a fragment of two
+// samples each lasting 1/30 seconds, the first of which is a sync sample.
+func writeTestMP4(t *testing.T, sps, pps []byte, samples [][]byte, fragmented bool) string {
+	return writeTestFile(t, "test.mp4", createTestMP4(sps, pps, samples, fragmented))
+}
+
+func createTestMP4(sps, pps []byte, samples [][]byte, fragmented bool) []byte {
+	avcC := []byte{1, 0x42, 0xc0, 0x1e, 0xff, 0xe1}
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(sps)))
+	avcC = append(avcC, sps...)
+	avcC = append(avcC, 1)
+	avcC = binary.BigEndian.AppendUint16(avcC, uint16(len(pps)))
+	avcC = append(avcC, pps...)
+
+	trak := mp4TestBox("trak",
+		// Version 0 with the track ID after the creation and modification
+		// times.
+		mp4TestBox("tkhd", mp4TestUint32(0, 0, 0, 1), make([]byte, 68)),
+		mp4TestBox("mdia",
+			mp4TestBox("mdhd", mp4TestUint32(0, 0, 0, 90000, 0, 0)),
+			mp4TestBox("hdlr", mp4TestUint32(0, 0), []byte("vide"), make([]byte, 13)),
+			mp4TestBox("minf", mp4TestBox("stbl", mp4TestBox("stsd", mp4TestUint32(0, 1),
+				mp4TestBox("avc1", make([]byte, mp4VisualSampleEntrySize), mp4TestBox("avcC", avcC)),
+			))),
+		),
+	)
+	moovBoxes := [][]byte{mp4TestBox("mvhd", make([]byte, 100)), trak}
+	if fragmented {
+		// Samples default to being non-sync samples.
+		moovBoxes = append(moovBoxes, mp4TestBox("mvex", mp4TestBox("trex", mp4TestUint32(0, 1, 1, 3000, 0, 0x10000))))
+	}
+	moov := mp4TestBox("moov", moovBoxes...)
+
+	var mdat []byte
+	for _, sample := range samples {
+		mdat = append(mdat, mp4TestUint32(uint32(len(sample)))...)
+		mdat = append(mdat, sample...)
+	}
+
+	// A run with sample sizes and the first sample's flags, at a data
+	// offset from the start of the moof box.
+	trun := func(dataOffset uint32) []byte {
+		fields := mp4TestUint32(0x000205, uint32(len(samples)), dataOffset, 0)
+		for _, sample := range samples {
+			fields = append(fields, mp4TestUint32(uint32(4+len(sample)))...)
+		}
+		return mp4TestBox("trun", fields)
+	}
+	moof := func(dataOffset uint32) []byte {
+		return mp4TestBox("moof",
+			mp4TestBox("mfhd", mp4TestUint32(0, 1)),
+			mp4TestBox("traf",
+				mp4TestBox("tfhd", mp4TestUint32(0x020000, 1)),
+				mp4TestBox("tfdt", mp4TestUint32(0x01000000, 0, 9000)),
+				trun(dataOffset),
+			),
+		)
+	}
+	fragment := moof(uint32(len(moof(0)) + 8))
+
+	var data []byte
+	data = append(data, mp4TestBox("ftyp", []byte("iso5"), mp4TestUint32(0))...)
+	data = append(data, moov...)
+	data = append(data, fragment...)
+	data = append(data, mp4TestBox("mdat", mdat)...)
+	return data
+}
+
+func TestMP4Reader(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84}
+	inter := []byte{0x41, 0x9a, 0x02}
+
+	tracks, err := openMP4(writeTestMP4(t, sps, pps, [][]byte{idr, inter}, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 || tracks[0].capability.MimeType != webrtc.MimeTypeH264 {
+		t.Fatalf("expected an H264 track, got %v", tracks)
+	}
+
+	samples := readTestSamples(t, tracks)
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 samples, got %v", len(samples))
+	}
+	expected := [][][]byte{{sps, pps, idr}, {inter}}
+	for i, sample := range samples {
+		var frame []byte
+		for _, nal := range expected[i] {
+			frame = append(frame, annexBStartCode...)
+			frame = append(frame, nal...)
+		}
+		if !bytes.Equal(sample.data, frame) {
+			t.Errorf("expected sample %v to be %v, got %v", i, frame, sample.data)
+		}
+		// The fragment starts 100ms in, at 90kHz.
+		timestamp := 100*time.Millisecond + time.Duration(i)*time.Second/30
+		if sample.timestamp != timestamp || sample.duration != time.Second/30 {
+			t.Errorf("unexpected timing of sample %v: %v for %v", i, sample.timestamp, sample.duration)
+		}
+		if sample.keyFrame != (i == 0) {
+			t.Errorf("unexpected key frame flag of sample %v", i)
+		}
+	}
+
+	_, err = openMP4(writeTestMP4(t, sps, pps, [][]byte{idr, inter}, false))
+	if !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("expected ErrUnsupportedFile for a non-fragmented file, got %v", err)
+	}
+}
+
+func TestMP4ReaderMalformedFile(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	samples := [][]byte{{0x65, 0x88, 0x84}, {0x41, 0x9a, 0x02}}
+
+	// Each case corrupts a field of the test file, found by its offset from
+	// the start of a box's type.
+	cases := []struct {
+		name    string
+		boxType string
+		offset  int
+		value   uint32
+	}{
+		{"BoxLargerThanFile", "moov", -4, 0x7fffffff},
+		{"TooManySamples", "trun", 8, 0xffffffff},
+		{"SamplesWithoutSize", "trun", 4, 0x000001},
+		{"SampleLargerThanFile", "trun", 20, 0x7fffffff},
+		{"SampleBeforeFile", "trun", 12, 0x80000000},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data := createTestMP4(sps, pps, samples, true)
+			offset := bytes.Index(data, []byte(c.boxType)) + c.offset
+			binary.BigEndian.PutUint32(data[offset:], c.value)
+
+			_, err := openMP4(writeTestFile(t, "test.mp4", data))
+			if !errors.Is(err, ErrUnsupportedFile) {
+				t.Errorf("expected ErrUnsupportedFile, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileSourceUnsupportedFile(t *testing.T) {
+	_, err := CreateFileMediaSource(writeTestFile(t, "test.avi", []byte("RIFF")))
+	if !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("expected ErrUnsupportedFile, got %v", err)
+	}
+	_, err = CreateFileMediaSource(writeTestFile(t, "test.ivf", []byte("RIFF")))
+	if !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("expected ErrUnsupportedFile, got %v", err)
+	}
+}
+
+func waitForEnd(t *testing.T, ended <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for playback to end")
+	}
+}
+
+func createTestFileSource(t *testing.T, opts ...FileOption) (*FileMediaSource, <-chan struct{}) {
+	t.Helper()
+	// 200ms of video.
+	source, err := CreateFileMediaSource(writeTestIVF(t, "VP80", createTestFrames(10), 20), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		source.Close()
+	})
+
+	ended := make(chan struct{}, 10)
+	source.OnEnd(func() {
+		ended <- struct{}{}
+	})
+	return source, ended
+}
+
+func TestFileSourcePlayback(t *testing.T) {
+	start := time.Now()
+	source, ended := createTestFileSource(t)
+
+	waitForEnd(t, ended)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected playback to be paced, but it ended after %v", elapsed)
+	}
+
+	// The position stays at the end, until seeked.
+	position := source.Position()
+	if position < 200*time.Millisecond {
+		t.Errorf("expected position to be at the end, got %v", position)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if source.Position() != position {
+		t.Errorf("expected position to stay at %v, got %v", position, source.Position())
+	}
+
+	err := source.Seek(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	waitForEnd(t, ended)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected playback from the seek position, but it ended after %v", elapsed)
+	}
+
+	err = source.Seek(-time.Second)
+	if err == nil {
+		t.Error("expected a negative position to be rejected")
+	}
+}
+
+func TestFileSourcePause(t *testing.T) {
+	source, ended := createTestFileSource(t, WithFileStartPaused())
+
+	time.Sleep(300 * time.Millisecond)
+	if source.Position() != 0 {
+		t.Errorf("expected position 0 while paused, got %v", source.Position())
+	}
+	select {
+	case <-ended:
+		t.Fatal("expected playback not to end while paused")
+	default:
+	}
+
+	source.Resume()
+	time.Sleep(50 * time.Millisecond)
+	source.Pause()
+	position := source.Position()
+	if position < 50*time.Millisecond || position >= 200*time.Millisecond {
+		t.Errorf("expected position to have advanced, got %v", position)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if source.Position() != position {
+		t.Errorf("expected position to stay at %v while paused, got %v", position, source.Position())
+	}
+
+	source.Resume()
+	waitForEnd(t, ended)
+}
+
+func TestFileSourceLoop(t *testing.T) {
+	source, ended := createTestFileSource(t, WithFileLoop())
+	for i := 0; i < 3; i++ {
+		waitForEnd(t, ended)
+	}
+	if source.Position() >= 200*time.Millisecond {
+		t.Errorf("expected position to restart when looping, got %v", source.Position())
+	}
+}
+
+func TestFileSourceReadError(t *testing.T) {
+	// A frame header promising more data than the file contains.
+	path := writeTestIVF(t, "VP80", createTestFrames(2), 20)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(mp4TestUint32(0xffff))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := CreateFileMediaSource(path, WithFileLoop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	errs := make(chan error, 10)
+	source.addErrorListener(func(err error) {
+		errs <- err
+	})
+	ended := make(chan struct{}, 10)
+	source.OnEnd(func() {
+		ended <- struct{}{}
+	})
+
+	// The error is reported, and the file is not looped.
+	waitForEnd(t, ended)
+	select {
+	case err := <-errs:
+		if source.State().LastError != err {
+			t.Errorf("expected last error to be %v, got %v", err, source.State().LastError)
+		}
+	default:
+		t.Error("expected an error to be reported")
+	}
+	select {
+	case <-ended:
+		t.Error("expected a failed file not to loop")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestFileSourceToPeer(t *testing.T) {
+	frames := createTestFrames(10)
+	source, err := CreateFileMediaSource(writeTestIVF(t, "VP80", frames, 20), WithFileLoop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	url := createRelayServer()
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiator := New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, WithICEServers(), WithMediaSources(source.MediaSource))
+	defer initiator.Close()
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responder := New(url, MockServerAuth{Token: "responder"}, responderConfig, WithICEServers())
+	defer responder.Close()
+
+	tracks := make(chan RemoteTrack, 1)
+	responder.OnTrack(func(track RemoteTrack) {
+		tracks <- track
+	})
+
+	connectPeers(t, initiator, responder)
+	track := waitForTrack(t, tracks)
+	if track.Codec().MimeType != webrtc.MimeTypeVP8 {
+		t.Errorf("expected VP8, got %v", track.Codec().MimeType)
+	}
+
+	// Frames arrive in the order of the file, which starts again when it
+	// ends.
+	track.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var previous []byte
+	for i := 0; i < 15; i++ {
+		sample, err := track.ReadSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sample.Data) != 100 || sample.Data[0]%2 != 0 || sample.Data[0] >= 20 {
+			t.Fatalf("unexpected sample %v", sample.Data)
+		}
+		if previous != nil {
+			next := (previous[0] + 2) % 20
+			if sample.Data[0] != next {
+				t.Errorf("expected frame %v to follow %v, got %v", next, previous[0], sample.Data[0])
+			}
+		}
+		previous = sample.Data
+	}
+}
@@ -0,0 +1,216 @@
+package filetransfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+	"github.com/thingify-app/thing-rtc/peer-go/internal/testutil"
+)
+
+// Counts the data channels created, one per transfer attempt.
+type countingPeer struct {
+	*testutil.Peer
+	attempts atomic.Int32
+}
+
+func (p *countingPeer) CreateDataChannelWithOptions(label string, options thingrtc.DataChannelOptions) (thingrtc.DataChannel, error) {
+	p.attempts.Add(1)
+	return p.Peer.CreateDataChannelWithOptions(label, options)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func writeTestFile(t *testing.T, name string, size int) (string, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func checkReceived(t *testing.T, path string, expected []byte) {
+	t.Helper()
+	received, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, expected) {
+		t.Errorf("received file does not match, got %v bytes, expected %v", len(received), len(expected))
+	}
+}
+
+func TestSendAndReceive(t *testing.T) {
+	sender, peer := testutil.ConnectedPeers()
+	dir := t.TempDir()
+	receiver := receive(peer, dir)
+	defer receiver.Close()
+
+	completed := make(chan string, 1)
+	receiver.OnComplete(func(info FileInfo, path string, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		completed <- path
+	})
+
+	path, data := writeTestFile(t, "snapshot.jpg", 1024*1024+123)
+	var progress []int64
+	err := send(testContext(t), sender, path, WithProgress(func(info FileInfo, transferred int64) {
+		progress = append(progress, transferred)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receivedPath := <-completed
+	if receivedPath != filepath.Join(dir, "snapshot.jpg") {
+		t.Errorf("unexpected path %v", receivedPath)
+	}
+	checkReceived(t, receivedPath, data)
+
+	// Starts at 0, is acknowledged along the way and finishes at the size.
+	if len(progress) < 3 || progress[0] != 0 || progress[len(progress)-1] != int64(len(data)) {
+		t.Errorf("unexpected progress %v", progress)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".*.part")); len(matches) != 0 {
+		t.Errorf("partial files were left behind: %v", matches)
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	sender, peer := testutil.ConnectedPeers()
+	dir := t.TempDir()
+	receive(peer, dir)
+
+	path, data := writeTestFile(t, "empty.log", 0)
+	err := send(testContext(t), sender, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, filepath.Join(dir, "empty.log"), data)
+}
+
+func TestResumeAfterDisconnect(t *testing.T) {
+	local, peer := testutil.ConnectedPeers()
+	sender := &countingPeer{Peer: local}
+	dir := t.TempDir()
+	receiver := receive(peer, dir, WithAckInterval(64*1024))
+	// Disconnect once part of the file has been written, before the receiver
+	// reads any more of it.
+	var disconnectOnce sync.Once
+	receiver.OnProgress(func(info FileInfo, n int64) {
+		if n >= 512*1024 {
+			disconnectOnce.Do(peer.Disconnect)
+		}
+	})
+
+	path, data := writeTestFile(t, "firmware.bin", 2*1024*1024)
+
+	var offsets []int64
+	err := send(testContext(t), sender, path, WithRetryDelay(10*time.Millisecond), WithAckInterval(64*1024), WithProgress(func(info FileInfo, transferred int64) {
+		offsets = append(offsets, transferred)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, filepath.Join(dir, "firmware.bin"), data)
+
+	if attempts := sender.attempts.Load(); attempts < 2 {
+		t.Errorf("expected transfer to be retried, got %v attempts", attempts)
+	}
+	// Each attempt reports the offset it starts from, so the retry resumed
+	// part way through rather than from 0.
+	for _, offset := range offsets[1:] {
+		if offset == 0 {
+			t.Errorf("transfer restarted from 0: %v", offsets)
+			break
+		}
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	sender, peer := testutil.ConnectedPeers()
+	dir := t.TempDir()
+	receive(peer, dir)
+
+	path, _ := writeTestFile(t, "log.txt", 100*1024)
+	file, _ := os.Open(path)
+	info, err := describeFile(file, "log.txt")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt partial file from an earlier attempt.
+	partialPath := filepath.Join(dir, "."+info.ID+".part")
+	os.WriteFile(partialPath, bytes.Repeat([]byte{0xff}, 1000), 0o644)
+
+	err = send(testContext(t), sender, path)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Error("expected corrupt partial file to be removed")
+	}
+
+	// The next attempt starts again, and succeeds.
+	err = send(testContext(t), sender, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRejectedFiles(t *testing.T) {
+	sender, peer := testutil.ConnectedPeers()
+	receiver := receive(peer, t.TempDir())
+	receiver.OnOffer(func(info FileInfo) bool {
+		return info.Name != "secret.txt"
+	})
+
+	path, _ := writeTestFile(t, "secret.txt", 10)
+	err := send(testContext(t), sender, path)
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected ErrRejected, got %v", err)
+	}
+}
+
+func TestValidateOffer(t *testing.T) {
+	id := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	valid := control{Type: controlOffer, ID: id, SHA256: id, Name: "file.txt"}
+	if err := validateOffer(&valid); err != nil {
+		t.Errorf("expected offer to be valid, got %v", err)
+	}
+
+	for _, name := range []string{"", ".", "..", "../file.txt", "dir/file.txt"} {
+		offer := valid
+		offer.Name = name
+		if err := validateOffer(&offer); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("expected name %q to be invalid, got %v", name, err)
+		}
+	}
+	for _, id := range []string{"", "../", "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855"} {
+		offer := valid
+		offer.ID = id
+		offer.SHA256 = id
+		if err := validateOffer(&offer); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("expected id %q to be invalid, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Package filetransfer sends files between peers over data channels, with
+// progress reporting, SHA-256 verification, and resumption of interrupted
+// transfers across reconnections.
+//
+// Each attempt at a transfer uses a new reliable data channel, labelled
+// LabelPrefix followed by the transfer ID, which is the hex SHA-256 of the
+// file. Every message is binary, starting with a type byte: 0 for a JSON
+// control message and 1 for a chunk of file data.
+//
+//	sender:   {"type": "offer", "id": "...", "name": "...", "size": 123, "sha256": "..."}
+//	receiver: {"type": "accept", "offset": 0} or {"type": "reject", "reason": "..."}
+//	sender:   data chunks, from offset to the end of the file
+//	receiver: {"type": "ack", "offset": 16383}, periodically as data is written
+//	receiver: {"type": "complete"} or {"type": "error", "reason": "..."}
+//
+// The receiver keeps the data it has written, and accepts a later offer of
+// the same transfer from the end of it, so only the remainder is sent again.
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// LabelPrefix starts the label of every data channel used by a transfer.
+const LabelPrefix = "file/"
+
+// The largest chunk of file data which fits in a message of
+// thingrtc.MaxStreamMessageSize, after its type byte.
+const MaxChunkSize = thingrtc.MaxStreamMessageSize - 1
+
+// The default number of bytes the receiver writes between acknowledgements.
+const DefaultAckInterval = 256 * 1024
+
+// The default delay before retrying an interrupted transfer.
+const DefaultRetryDelay = time.Second
+
+// The default time allowed for a transfer's data channel to open.
+const DefaultOpenTimeout = 10 * time.Second
+
+var (
+	ErrRejected         = errors.New("transfer rejected")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrInvalidMessage   = errors.New("invalid transfer message")
+)
+
+// FileInfo describes a file being transferred.
+type FileInfo struct {
+	// The hex SHA-256 of the file, which identifies the transfer.
+	ID   string
+	Name string
+	Size int64
+}
+
+type Option func(options *options)
+
+type options struct {
+	logger      *slog.Logger
+	chunkSize   int
+	ackInterval int64
+	retryDelay  time.Duration
+	openTimeout time.Duration
+	progress    func(info FileInfo, transferred int64)
+}
+
+func defaultOptions(opts []Option) *options {
+	options := &options{
+		logger:      slog.Default(),
+		chunkSize:   MaxChunkSize,
+		ackInterval: DefaultAckInterval,
+		retryDelay:  DefaultRetryDelay,
+		openTimeout: DefaultOpenTimeout,
+		progress:    func(info FileInfo, transferred int64) {},
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithLogger sets the logger used to report interrupted transfers.
+func WithLogger(logger *slog.Logger) Option {
+	return func(options *options) {
+		options.logger = logger
+	}
+}
+
+// WithChunkSize sets the number of bytes of file data sent in each message,
+// up to MaxChunkSize.
+func WithChunkSize(size int) Option {
+	return func(options *options) {
+		options.chunkSize = min(size, MaxChunkSize)
+	}
+}
+
+// WithAckInterval sets how many bytes the receiver writes between
+// acknowledgements, which bounds how often progress is reported to the
+// sender.
+func WithAckInterval(interval int64) Option {
+	return func(options *options) {
+		options.ackInterval = interval
+	}
+}
+
+// WithRetryDelay sets how long Send waits before retrying an interrupted
+// transfer.
+func WithRetryDelay(delay time.Duration) Option {
+	return func(options *options) {
+		options.retryDelay = delay
+	}
+}
+
+// WithProgress sets a function which Send calls with the number of bytes the
+// receiver has acknowledged.
+func WithProgress(f func(info FileInfo, transferred int64)) Option {
+	return func(options *options) {
+		options.progress = f
+	}
+}
+
+const (
+	messageControl byte = 0
+	messageData    byte = 1
+)
+
+const (
+	controlOffer    = "offer"
+	controlAccept   = "accept"
+	controlReject   = "reject"
+	controlAck      = "ack"
+	controlComplete = "complete"
+	controlError    = "error"
+)
+
+type control struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func sendControl(stream *thingrtc.DataChannelStream, message control) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return stream.WriteMessage(append([]byte{messageControl}, encoded...))
+}
+
+// Reads the next message, returning either a control message or data.
+func readMessage(stream *thingrtc.DataChannelStream) (*control, []byte, error) {
+	message, err := stream.ReadMessage()
+	if err != nil {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if len(message) == 0 {
+		return nil, nil, fmt.Errorf("%w: empty message", ErrInvalidMessage)
+	}
+
+	switch message[0] {
+	case messageControl:
+		var c control
+		err := json.Unmarshal(message[1:], &c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+		}
+		return &c, nil, nil
+	case messageData:
+		return nil, message[1:], nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown type %v", ErrInvalidMessage, message[0])
+	}
+}
+
+// Reads the next message, which must be a control message.
+func readControl(stream *thingrtc.DataChannelStream) (*control, error) {
+	c, _, err := readMessage(stream)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%w: unexpected data", ErrInvalidMessage)
+	}
+	return c, nil
+}
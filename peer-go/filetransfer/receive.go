@@ -0,0 +1,264 @@
+package filetransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// The subset of Peer used to receive files.
+type channelHandler interface {
+	OnDataChannelWithPrefix(prefix string, f func(dataChannel thingrtc.DataChannel))
+}
+
+// Receiver saves files sent by the remote peer into a directory.
+type Receiver struct {
+	peer    channelHandler
+	dir     string
+	options *options
+
+	// Guards all fields below.
+	mutex     sync.Mutex
+	listeners receiverListeners
+	// Held while a transfer is being written, keyed by ID, so that a resumed
+	// attempt waits for the interrupted one to finish.
+	transfers map[string]*sync.Mutex
+}
+
+type receiverListeners struct {
+	offer    func(info FileInfo) bool
+	progress func(info FileInfo, received int64)
+	complete func(info FileInfo, path string, err error)
+}
+
+// Receive starts accepting files from the remote peer, saving them in dir.
+// Data is kept in a hidden partial file until the whole file has been
+// received and verified, when it is moved to its name in dir, replacing any
+// existing file.
+func Receive(peer thingrtc.Peer, dir string, opts ...Option) *Receiver {
+	return receive(peer, dir, opts...)
+}
+
+func receive(peer channelHandler, dir string, opts ...Option) *Receiver {
+	r := &Receiver{
+		peer:    peer,
+		dir:     dir,
+		options: defaultOptions(opts),
+		listeners: receiverListeners{
+			offer:    func(info FileInfo) bool { return true },
+			progress: func(info FileInfo, received int64) {},
+			complete: func(info FileInfo, path string, err error) {},
+		},
+		transfers: map[string]*sync.Mutex{},
+	}
+	peer.OnDataChannelWithPrefix(LabelPrefix, r.handle)
+	return r
+}
+
+// OnOffer sets a function deciding whether to accept each file offered. All
+// files are accepted by default.
+func (r *Receiver) OnOffer(f func(info FileInfo) bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners.offer = f
+}
+
+// OnProgress is called as each file's data is written.
+func (r *Receiver) OnProgress(f func(info FileInfo, received int64)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners.progress = f
+}
+
+// OnComplete is called when a file has been received and verified, with its
+// path, or when its data failed verification.
+func (r *Receiver) OnComplete(f func(info FileInfo, path string, err error)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners.complete = f
+}
+
+// Close stops accepting files. Transfers in progress continue.
+func (r *Receiver) Close() error {
+	r.peer.OnDataChannelWithPrefix(LabelPrefix, nil)
+	return nil
+}
+
+func (r *Receiver) getListeners() receiverListeners {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.listeners
+}
+
+// Locks the transfer with the given ID, returning a function to unlock it.
+func (r *Receiver) lockTransfer(id string) func() {
+	r.mutex.Lock()
+	lock, ok := r.transfers[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.transfers[id] = lock
+	}
+	r.mutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (r *Receiver) handle(channel thingrtc.DataChannel) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.openTimeout)
+	defer cancel()
+	stream, err := thingrtc.OpenDataChannelStream(ctx, channel)
+	if err != nil {
+		r.options.logger.Warn("could not accept file transfer", "label", channel.GetLabel(), "error", err)
+		return
+	}
+	defer stream.Close()
+
+	err = r.receive(stream)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		r.options.logger.Warn("file transfer failed", "label", channel.GetLabel(), "error", err)
+	}
+}
+
+func (r *Receiver) receive(stream *thingrtc.DataChannelStream) error {
+	offer, err := readControl(stream)
+	if err != nil {
+		return err
+	}
+	if offer.Type != controlOffer {
+		return fmt.Errorf("%w: unexpected %v", ErrInvalidMessage, offer.Type)
+	}
+
+	info := FileInfo{ID: offer.ID, Name: offer.Name, Size: offer.Size}
+	if err := validateOffer(offer); err != nil {
+		sendControl(stream, control{Type: controlReject, Reason: err.Error()})
+		return err
+	}
+	if !r.getListeners().offer(info) {
+		return sendControl(stream, control{Type: controlReject, Reason: "not accepted"})
+	}
+
+	unlock := r.lockTransfer(info.ID)
+	defer unlock()
+
+	partialPath := filepath.Join(r.dir, "."+info.ID+".part")
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		sendControl(stream, control{Type: controlReject, Reason: "cannot write file"})
+		return err
+	}
+	defer file.Close()
+
+	// Resume from whatever was written by an earlier attempt.
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > info.Size {
+		offset = 0
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+	}
+
+	err = sendControl(stream, control{Type: controlAccept, Offset: offset})
+	if err != nil {
+		return err
+	}
+
+	lastAck := offset
+	for offset < info.Size {
+		_, data, err := readMessage(stream)
+		if err != nil {
+			return err
+		}
+		if data == nil || offset+int64(len(data)) > info.Size {
+			sendControl(stream, control{Type: controlError, Reason: "unexpected message"})
+			return fmt.Errorf("%w: unexpected message at offset %v", ErrInvalidMessage, offset)
+		}
+
+		_, err = file.Write(data)
+		if err != nil {
+			sendControl(stream, control{Type: controlError, Reason: "cannot write file"})
+			return err
+		}
+		offset += int64(len(data))
+		r.getListeners().progress(info, offset)
+
+		if offset-lastAck >= r.options.ackInterval && offset < info.Size {
+			// Only acknowledge what will survive a crash.
+			if err := file.Sync(); err != nil {
+				return err
+			}
+			if err := sendControl(stream, control{Type: controlAck, Offset: offset}); err != nil {
+				return err
+			}
+			lastAck = offset
+		}
+	}
+
+	err = r.finish(file, partialPath, info)
+	r.getListeners().complete(info, filepath.Join(r.dir, info.Name), err)
+	if err != nil {
+		sendControl(stream, control{Type: controlError, Reason: err.Error()})
+		return err
+	}
+	return sendControl(stream, control{Type: controlComplete})
+}
+
+// Verifies the partial file, and moves it into place if it is correct.
+// Otherwise it is removed, so that the next attempt starts again.
+func (r *Receiver) finish(file *os.File, partialPath string, info FileInfo) error {
+	err := file.Close()
+	if err != nil {
+		return err
+	}
+
+	sum, err := hashFile(partialPath)
+	if err != nil {
+		return err
+	}
+	if sum != info.ID {
+		os.Remove(partialPath)
+		return ErrChecksumMismatch
+	}
+	return os.Rename(partialPath, filepath.Join(r.dir, info.Name))
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Checks an offer is safe to act on, as the name and ID are used in paths.
+func validateOffer(offer *control) error {
+	id, err := hex.DecodeString(offer.ID)
+	if err != nil || len(id) != sha256.Size || hex.EncodeToString(id) != offer.ID || offer.SHA256 != offer.ID {
+		return fmt.Errorf("%w: invalid id", ErrInvalidMessage)
+	}
+	if offer.Name == "" || offer.Name != filepath.Base(offer.Name) || offer.Name == "." || offer.Name == ".." {
+		return fmt.Errorf("%w: invalid name", ErrInvalidMessage)
+	}
+	if offer.Size < 0 {
+		return fmt.Errorf("%w: invalid size", ErrInvalidMessage)
+	}
+	return nil
+}
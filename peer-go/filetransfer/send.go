@@ -0,0 +1,183 @@
+package filetransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// The subset of Peer used to send files.
+type channelCreator interface {
+	CreateDataChannelWithOptions(label string, options thingrtc.DataChannelOptions) (thingrtc.DataChannel, error)
+}
+
+// Send sends the file at path to the remote peer, which must be receiving
+// files (see Receive). If the transfer is interrupted, for example by the peer
+// disconnecting, it is retried until ctx is done, resuming from where the
+// receiver got to. It returns once the receiver has verified the file.
+func Send(ctx context.Context, peer thingrtc.Peer, path string, opts ...Option) error {
+	return send(ctx, peer, path, opts...)
+}
+
+func send(ctx context.Context, creator channelCreator, path string, opts ...Option) error {
+	options := defaultOptions(opts)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := describeFile(file, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	logger := options.logger.With("id", info.ID, "name", info.Name)
+
+	for {
+		err := sendAttempt(ctx, creator, file, info, options)
+		if err == nil || !isRetriable(err) || ctx.Err() != nil {
+			return err
+		}
+		logger.Warn("file transfer interrupted, retrying", "error", err, "delay", options.retryDelay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(options.retryDelay):
+		}
+	}
+}
+
+// Hashes file, leaving it positioned at the start.
+func describeFile(file *os.File, name string) (FileInfo, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{ID: hex.EncodeToString(hash.Sum(nil)), Name: name, Size: size}, nil
+}
+
+// Whether an attempt failed for a reason which trying again may fix.
+func isRetriable(err error) bool {
+	var pathErr *os.PathError
+	return !errors.Is(err, ErrRejected) &&
+		!errors.Is(err, ErrChecksumMismatch) &&
+		!errors.Is(err, ErrInvalidMessage) &&
+		!errors.As(err, &pathErr)
+}
+
+func sendAttempt(ctx context.Context, creator channelCreator, file *os.File, info FileInfo, options *options) error {
+	channel, err := creator.CreateDataChannelWithOptions(LabelPrefix+info.ID, thingrtc.ReliableDataChannelOptions())
+	if err != nil {
+		return err
+	}
+	openCtx, cancel := context.WithTimeout(ctx, options.openTimeout)
+	defer cancel()
+	stream, err := thingrtc.OpenDataChannelStream(openCtx, channel)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// Closing the stream stops any read or write in progress.
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	defer stop()
+
+	err = sendControl(stream, control{Type: controlOffer, ID: info.ID, Name: info.Name, Size: info.Size, SHA256: info.ID})
+	if err != nil {
+		return err
+	}
+	reply, err := readControl(stream)
+	if err != nil {
+		return err
+	}
+	switch reply.Type {
+	case controlAccept:
+		// Continue
+	case controlReject:
+		return fmt.Errorf("%w: %v", ErrRejected, reply.Reason)
+	default:
+		return fmt.Errorf("%w: unexpected %v", ErrInvalidMessage, reply.Type)
+	}
+	if reply.Offset < 0 || reply.Offset > info.Size {
+		return fmt.Errorf("%w: offset %v out of range", ErrInvalidMessage, reply.Offset)
+	}
+	options.progress(info, reply.Offset)
+
+	// Acknowledgements and the final result arrive while we are sending.
+	result := make(chan error, 1)
+	go func() {
+		result <- readAcks(stream, info, options)
+	}()
+
+	_, err = file.Seek(reply.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 1+options.chunkSize)
+	buffer[0] = messageData
+	for {
+		n, err := file.Read(buffer[1:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = stream.WriteMessage(buffer[:1+n])
+		if err != nil {
+			// Sends only fail once the channel has closed, so the reader
+			// ends too. Prefer the receiver's reason for closing it, if it
+			// sent one.
+			if resultErr := <-result; !errors.Is(resultErr, io.ErrUnexpectedEOF) {
+				return resultErr
+			}
+			return err
+		}
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reports acknowledgements as progress until the receiver sends its result.
+func readAcks(stream *thingrtc.DataChannelStream, info FileInfo, options *options) error {
+	for {
+		message, err := readControl(stream)
+		if err != nil {
+			return err
+		}
+		switch message.Type {
+		case controlAck:
+			options.progress(info, message.Offset)
+		case controlComplete:
+			options.progress(info, info.Size)
+			return nil
+		case controlError:
+			if message.Reason == ErrChecksumMismatch.Error() {
+				return ErrChecksumMismatch
+			}
+			return fmt.Errorf("%w: %v", ErrRejected, message.Reason)
+		default:
+			return fmt.Errorf("%w: unexpected %v", ErrInvalidMessage, message.Type)
+		}
+	}
+}
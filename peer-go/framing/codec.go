@@ -0,0 +1,70 @@
+package framing
+
+import (
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts values of type T to and from bytes.
+type Codec[T any] interface {
+	Marshal(value T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+type jsonCodec[T any] struct{}
+
+// JSON returns a Codec which encodes values with encoding/json.
+func JSON[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+func (jsonCodec[T]) Marshal(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec[T]) Unmarshal(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+type cborCodec[T any] struct{}
+
+// CBOR returns a Codec which encodes values as CBOR (RFC 8949), which is more
+// compact than JSON and supports binary data directly.
+func CBOR[T any]() Codec[T] {
+	return cborCodec[T]{}
+}
+
+func (cborCodec[T]) Marshal(value T) ([]byte, error) {
+	return cbor.Marshal(value)
+}
+
+func (cborCodec[T]) Unmarshal(data []byte) (T, error) {
+	var value T
+	err := cbor.Unmarshal(data, &value)
+	return value, err
+}
+
+type protobufCodec[T proto.Message] struct{}
+
+// Protobuf returns a Codec for a generated protobuf message type, e.g.
+// Protobuf[*pb.Reading]().
+func Protobuf[T proto.Message]() Codec[T] {
+	return protobufCodec[T]{}
+}
+
+func (protobufCodec[T]) Marshal(value T) ([]byte, error) {
+	return proto.Marshal(value)
+}
+
+func (protobufCodec[T]) Unmarshal(data []byte) (T, error) {
+	// Generated message types support ProtoReflect on a nil pointer, which lets
+	// us create a new instance of T.
+	var zero T
+	value := zero.ProtoReflect().New().Interface().(T)
+	err := proto.Unmarshal(data, value)
+	return value, err
+}
@@ -0,0 +1,112 @@
+package framing
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Each data channel message is a frame, holding one fragment of an encoded
+// message:
+//
+//	frame   = format (1 byte) | flags (1 byte) | fragment
+//	message = uvarint(len(type)) | type | uvarint(version) | payload
+//
+// Fragments of a message are sent consecutively, so can simply be
+// concatenated on receipt.
+const frameFormat = 1
+
+const (
+	flagFirst = 1 << iota
+	flagFinal
+)
+
+const frameHeaderSize = 2
+
+var (
+	ErrInvalidFrame   = errors.New("invalid frame")
+	ErrSchemaMismatch = errors.New("message schema mismatch")
+)
+
+// Schema identifies the type of messages on a TypedChannel, and the version of
+// that type. Both are sent in the header of every message.
+type Schema struct {
+	Type    string
+	Version uint32
+}
+
+func (s Schema) String() string {
+	return fmt.Sprintf("%v (version %v)", s.Type, s.Version)
+}
+
+// SchemaMismatchError is returned when a message with a different schema is
+// received. It matches ErrSchemaMismatch with errors.Is.
+type SchemaMismatchError struct {
+	Expected Schema
+	Received Schema
+}
+
+func (e *SchemaMismatchError) Error() string {
+	return fmt.Sprintf("%v: expected %v, received %v", ErrSchemaMismatch, e.Expected, e.Received)
+}
+
+func (e *SchemaMismatchError) Is(target error) bool {
+	return target == ErrSchemaMismatch
+}
+
+func encodeMessage(schema Schema, payload []byte) []byte {
+	message := make([]byte, 0, 2*binary.MaxVarintLen32+len(schema.Type)+len(payload))
+	message = binary.AppendUvarint(message, uint64(len(schema.Type)))
+	message = append(message, schema.Type...)
+	message = binary.AppendUvarint(message, uint64(schema.Version))
+	return append(message, payload...)
+}
+
+func decodeMessage(message []byte) (Schema, []byte, error) {
+	typeLength, n := binary.Uvarint(message)
+	if n <= 0 || typeLength > uint64(len(message)-n) {
+		return Schema{}, nil, fmt.Errorf("%w: bad type in header", ErrInvalidFrame)
+	}
+	message = message[n:]
+	messageType := string(message[:typeLength])
+	message = message[typeLength:]
+
+	version, n := binary.Uvarint(message)
+	if n <= 0 || version > 0xffffffff {
+		return Schema{}, nil, fmt.Errorf("%w: bad version in header", ErrInvalidFrame)
+	}
+
+	return Schema{Type: messageType, Version: uint32(version)}, message[n:], nil
+}
+
+// Splits an encoded message into frames with at most maxFragmentSize bytes of
+// the message each.
+func splitFrames(message []byte, maxFragmentSize int) [][]byte {
+	var frames [][]byte
+	for offset := 0; offset == 0 || offset < len(message); offset += maxFragmentSize {
+		end := min(offset+maxFragmentSize, len(message))
+
+		var flags byte
+		if offset == 0 {
+			flags |= flagFirst
+		}
+		if end == len(message) {
+			flags |= flagFinal
+		}
+
+		frame := make([]byte, 0, frameHeaderSize+end-offset)
+		frame = append(frame, frameFormat, flags)
+		frames = append(frames, append(frame, message[offset:end]...))
+	}
+	return frames
+}
+
+func parseFrame(frame []byte) (flags byte, fragment []byte, err error) {
+	if len(frame) < frameHeaderSize {
+		return 0, nil, fmt.Errorf("%w: too short", ErrInvalidFrame)
+	}
+	if frame[0] != frameFormat {
+		return 0, nil, fmt.Errorf("%w: unsupported format %v", ErrInvalidFrame, frame[0])
+	}
+	return frame[1], frame[frameHeaderSize:], nil
+}
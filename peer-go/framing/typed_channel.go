@@ -0,0 +1,198 @@
+// Package framing sends and receives typed messages over a ThingRTC
+// DataChannel, using a pluggable Codec. Each message carries a header naming
+// its type and version, and messages too large for a single data channel
+// message are fragmented and reassembled.
+package framing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// The default size of each fragment. Browsers only guarantee support for
+// data channel messages up to 16KiB.
+const DefaultMaxFragmentSize = 16 * 1024
+
+// The default limit on the size of a reassembled message, to bound how much
+// memory a remote peer can make us use.
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+
+var (
+	ErrMessageTooLarge = errors.New("message too large")
+	// Fragments rely on being delivered reliably and in order.
+	ErrFragmentationUnsupported = errors.New("message must be fragmented, but channel is not reliable and ordered")
+)
+
+// TypedChannel sends and receives messages of type T over a DataChannel. It
+// should be the only consumer of the channel's messages.
+type TypedChannel[T any] struct {
+	channel      thingrtc.DataChannel
+	codec        Codec[T]
+	schema       Schema
+	subscription *thingrtc.Subscription
+
+	maxFragmentSize int
+	maxMessageSize  int
+
+	// Keeps the fragments of each message together.
+	sendMutex sync.Mutex
+
+	// Guards the partially reassembled message.
+	recvMutex sync.Mutex
+	partial   []byte
+	// Whether we are skipping the rest of a message which was too large.
+	discarding bool
+}
+
+type Option func(options *options)
+
+type options struct {
+	maxFragmentSize int
+	maxMessageSize  int
+}
+
+// WithMaxFragmentSize sets the maximum number of message bytes sent in each
+// data channel message. Sizes below 1 are ignored, keeping the default.
+func WithMaxFragmentSize(size int) Option {
+	return func(options *options) {
+		options.maxFragmentSize = size
+	}
+}
+
+// WithMaxMessageSize sets the maximum size of a received message, after
+// reassembly.
+func WithMaxMessageSize(size int) Option {
+	return func(options *options) {
+		options.maxMessageSize = size
+	}
+}
+
+// New creates a TypedChannel which encodes messages with codec, and only
+// accepts received messages with the given schema. It subscribes to channel
+// straight away, so no messages are missed.
+func New[T any](channel thingrtc.DataChannel, codec Codec[T], schema Schema, opts ...Option) *TypedChannel[T] {
+	options := &options{
+		maxFragmentSize: DefaultMaxFragmentSize,
+		maxMessageSize:  DefaultMaxMessageSize,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	// Smaller fragments could never carry the whole message.
+	if options.maxFragmentSize < 1 {
+		options.maxFragmentSize = DefaultMaxFragmentSize
+	}
+
+	return &TypedChannel[T]{
+		channel:      channel,
+		codec:        codec,
+		schema:       schema,
+		subscription: channel.Subscribe(thingrtc.SubscribeOptions{}),
+
+		maxFragmentSize: options.maxFragmentSize,
+		maxMessageSize:  options.maxMessageSize,
+	}
+}
+
+// Schema returns the schema of messages sent and accepted on this channel.
+func (c *TypedChannel[T]) Schema() Schema {
+	return c.schema
+}
+
+// Send encodes and sends a message, waiting for room in the channel's send
+// buffer as DataChannel.Send does.
+func (c *TypedChannel[T]) Send(ctx context.Context, value T) error {
+	payload, err := c.codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding %v: %w", c.schema, err)
+	}
+
+	frames := splitFrames(encodeMessage(c.schema, payload), c.maxFragmentSize)
+	if len(frames) > 1 && !isReliableAndOrdered(c.channel.Options()) {
+		return ErrFragmentationUnsupported
+	}
+
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	for _, frame := range frames {
+		err := c.channel.Send(ctx, frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isReliableAndOrdered(options thingrtc.DataChannelOptions) bool {
+	return !options.Unordered && options.MaxRetransmits == nil && options.MaxPacketLifeTime == nil
+}
+
+// Recv waits for the next complete message and decodes it. A message with a
+// different schema is skipped, returning a *SchemaMismatchError, and the next
+// call continues with the following message.
+func (c *TypedChannel[T]) Recv(ctx context.Context) (T, error) {
+	c.recvMutex.Lock()
+	defer c.recvMutex.Unlock()
+
+	var zero T
+	for {
+		message, err := c.subscription.Recv(ctx)
+		if err != nil {
+			return zero, err
+		}
+		if message.IsString {
+			return zero, fmt.Errorf("%w: unexpected string message", ErrInvalidFrame)
+		}
+
+		flags, fragment, err := parseFrame(message.Data)
+		if err != nil {
+			return zero, err
+		}
+
+		if flags&flagFirst != 0 {
+			// Discards any message the sender gave up on part way through.
+			c.partial = nil
+			c.discarding = false
+		} else if c.discarding || c.partial == nil {
+			// The rest of a message we are skipping, or which started before
+			// we subscribed.
+			continue
+		}
+		if len(c.partial)+len(fragment) > c.maxMessageSize {
+			c.partial = nil
+			c.discarding = flags&flagFinal == 0
+			return zero, ErrMessageTooLarge
+		}
+		c.partial = append(c.partial, fragment...)
+
+		if flags&flagFinal == 0 {
+			continue
+		}
+		complete := c.partial
+		c.partial = nil
+
+		schema, payload, err := decodeMessage(complete)
+		if err != nil {
+			return zero, err
+		}
+		if schema != c.schema {
+			return zero, &SchemaMismatchError{Expected: c.schema, Received: schema}
+		}
+
+		value, err := c.codec.Unmarshal(payload)
+		if err != nil {
+			return zero, fmt.Errorf("decoding %v: %w", c.schema, err)
+		}
+		return value, nil
+	}
+}
+
+// Close stops receiving messages, without closing the underlying channel.
+func (c *TypedChannel[T]) Close() {
+	c.subscription.Close()
+}
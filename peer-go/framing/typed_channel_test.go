@@ -0,0 +1,227 @@
+package framing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+	"github.com/thingify-app/thing-rtc/peer-go/internal/testutil"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type reading struct {
+	Sensor string
+	Value  float64
+	Raw    []byte
+}
+
+var readingSchema = Schema{Type: "reading", Version: 1}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func testRoundTrip[T any](t *testing.T, codec Codec[T], value T, check func(received T)) {
+	t.Helper()
+	a, b := testutil.Pipe("test")
+	sender := New(a, codec, readingSchema)
+	receiver := New(b, codec, readingSchema)
+
+	err := sender.Send(testContext(t), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := receiver.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(received)
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	value := reading{Sensor: "temperature", Value: 21.5, Raw: []byte{1, 2, 3}}
+	check := func(received reading) {
+		if received.Sensor != value.Sensor || received.Value != value.Value || !bytes.Equal(received.Raw, value.Raw) {
+			t.Errorf("expected %v, received %v", value, received)
+		}
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		testRoundTrip(t, JSON[reading](), value, check)
+	})
+	t.Run("CBOR", func(t *testing.T) {
+		testRoundTrip(t, CBOR[reading](), value, check)
+	})
+	t.Run("Protobuf", func(t *testing.T) {
+		testRoundTrip(t, Protobuf[*wrapperspb.StringValue](), wrapperspb.String("hello"), func(received *wrapperspb.StringValue) {
+			if received.GetValue() != "hello" {
+				t.Errorf("expected hello, received %v", received.GetValue())
+			}
+		})
+	})
+}
+
+func TestLargeMessagesAreFragmented(t *testing.T) {
+	a, b := testutil.Pipe("test")
+	sender := New(a, CBOR[reading](), readingSchema, WithMaxFragmentSize(1024))
+	receiver := New(b, CBOR[reading](), readingSchema)
+
+	// Count the frames actually sent.
+	frames := b.Subscribe(thingrtc.SubscribeOptions{QueueSize: 1000})
+
+	raw := make([]byte, 100*1024)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	// Delivery on a pipe blocks once the receiver's queue is full, so send
+	// concurrently.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sender.Send(testContext(t), reading{Sensor: "camera", Raw: raw})
+	}()
+
+	received, err := receiver.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received.Raw, raw) {
+		t.Error("reassembled message does not match")
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if count := len(frames.Messages()); count <= 100 {
+		t.Errorf("expected message to be split into over 100 frames, got %v", count)
+	}
+}
+
+func TestInvalidFragmentSizesAreIgnored(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		a, b := testutil.Pipe("test")
+		sender := New(a, CBOR[reading](), readingSchema, WithMaxFragmentSize(size))
+		receiver := New(b, CBOR[reading](), readingSchema)
+
+		value := reading{Sensor: "temperature", Raw: []byte{1, 2, 3}}
+		err := sender.Send(testContext(t), value)
+		if err != nil {
+			t.Fatalf("size %v: %v", size, err)
+		}
+		received, err := receiver.Recv(testContext(t))
+		if err != nil {
+			t.Fatalf("size %v: %v", size, err)
+		}
+		if !bytes.Equal(received.Raw, value.Raw) {
+			t.Errorf("size %v: expected %v, received %v", size, value, received)
+		}
+	}
+}
+
+func TestSchemaMismatch(t *testing.T) {
+	a, b := testutil.Pipe("test")
+	sender := New(a, JSON[reading](), Schema{Type: "reading", Version: 2})
+	receiver := New(b, JSON[reading](), readingSchema)
+
+	sender.Send(testContext(t), reading{Sensor: "old"})
+
+	_, err := receiver.Recv(testContext(t))
+	if !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("expected ErrSchemaMismatch, got %v", err)
+	}
+	var mismatch *SchemaMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Received.Version != 2 {
+		t.Fatalf("expected received version 2, got %v", err)
+	}
+
+	// The channel can still be used after a mismatch.
+	New(a, JSON[reading](), readingSchema).Send(testContext(t), reading{Sensor: "new"})
+	received, err := receiver.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Sensor != "new" {
+		t.Errorf("expected sensor new, got %v", received.Sensor)
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	a, b := testutil.Pipe("test")
+	sender := New(a, JSON[reading](), readingSchema, WithMaxFragmentSize(100))
+	receiver := New(b, JSON[reading](), readingSchema, WithMaxMessageSize(1000))
+
+	sender.Send(testContext(t), reading{Raw: make([]byte, 2000)})
+
+	_, err := receiver.Recv(testContext(t))
+	if err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+
+	// The rest of the large message is skipped.
+	sender.Send(testContext(t), reading{Sensor: "small"})
+	received, err := receiver.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Sensor != "small" {
+		t.Errorf("expected sensor small, got %v", received.Sensor)
+	}
+}
+
+func TestInvalidFrames(t *testing.T) {
+	a, b := testutil.Pipe("test")
+	receiver := New(b, JSON[reading](), readingSchema)
+
+	invalid := [][]byte{
+		{},
+		{frameFormat},
+		{99, flagFirst | flagFinal},
+		// Type length longer than the message.
+		{frameFormat, flagFirst | flagFinal, 10, 'a'},
+	}
+	for _, frame := range invalid {
+		a.SendBinaryMessage(frame)
+		_, err := receiver.Recv(testContext(t))
+		if !errors.Is(err, ErrInvalidFrame) {
+			t.Errorf("expected ErrInvalidFrame for %v, got %v", frame, err)
+		}
+	}
+}
+
+func TestIncompleteMessageIsDiscarded(t *testing.T) {
+	a, b := testutil.Pipe("test")
+	receiver := New(b, JSON[reading](), readingSchema)
+
+	// The first fragment of a message which is never finished.
+	a.SendBinaryMessage([]byte{frameFormat, flagFirst, 'x'})
+	New(a, JSON[reading](), readingSchema).Send(testContext(t), reading{Sensor: "complete"})
+
+	received, err := receiver.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Sensor != "complete" {
+		t.Errorf("expected sensor complete, got %v", received.Sensor)
+	}
+}
+
+func TestFragmentsWithoutFirstAreDiscarded(t *testing.T) {
+	a, b := testutil.Pipe("test")
+	receiver := New(b, JSON[reading](), readingSchema)
+
+	// The end of a message whose first fragment was never received.
+	a.SendBinaryMessage([]byte{frameFormat, 0, 'x'})
+	a.SendBinaryMessage([]byte{frameFormat, flagFinal, 'y'})
+	New(a, JSON[reading](), readingSchema).Send(testContext(t), reading{Sensor: "complete"})
+
+	received, err := receiver.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Sensor != "complete" {
+		t.Errorf("expected sensor complete, got %v", received.Sensor)
+	}
+}
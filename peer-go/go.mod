@@ -1,10 +1,43 @@
 module github.com/thingify-app/thing-rtc/peer-go
 
-go 1.16
+go 1.21
 
 require (
 	github.com/deepch/vdk v0.0.0-20211113104208-022deeb641f7
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/gorilla/websocket v1.5.0
+	github.com/hashicorp/yamux v0.1.2
+	github.com/pion/interceptor v0.1.17
 	github.com/pion/mediadevices v0.3.12
+	github.com/pion/rtcp v1.2.10
+	github.com/pion/rtp v1.7.13
+	github.com/pion/stun v0.6.1
 	github.com/pion/webrtc/v3 v3.2.12
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/blackjack/webcam v0.0.0-20220329180758-ba064708e165 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gen2brain/malgo v0.11.10 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/pion/datachannel v1.5.5 // indirect
+	github.com/pion/dtls/v2 v2.2.7 // indirect
+	github.com/pion/ice/v2 v2.3.9 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/mdns v0.0.7 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/sctp v1.8.7 // indirect
+	github.com/pion/sdp/v3 v3.0.6 // indirect
+	github.com/pion/srtp/v2 v2.0.15 // indirect
+	github.com/pion/transport/v2 v2.2.1 // indirect
+	github.com/pion/turn/v2 v2.1.2 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/testify v1.8.4 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.10.0 // indirect
+	golang.org/x/image v0.1.0 // indirect
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,111 @@
+package thingrtc
+
+import (
+	"sync"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	h265ClockRate   = 90000
+	h265PayloadType = 117
+	// Matches the MTU pion uses for its own sample tracks.
+	h265MTU = 1200
+
+	h265FragmentationUnit = 49
+)
+
+// The H265 codec registered alongside pion's defaults, which do not include
+// it, so that H265 video can be sent to peers which support it.
+var h265Codec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: h265ClockRate},
+	PayloadType:        h265PayloadType,
+}
+
+// A track of H265 samples. pion has no H265 payloader, so unlike a
+// TrackLocalStaticSample the samples are packetized here.
+type h265Track struct {
+	*webrtc.TrackLocalStaticRTP
+
+	// Guards packetizer.
+	mutex      sync.Mutex
+	packetizer rtp.Packetizer
+}
+
+func newH265Track(id, streamID string) (*h265Track, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(h265Codec.RTPCodecCapability, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The payload type and SSRC are set for each connection the track is
+	// bound to when written.
+	packetizer := rtp.NewPacketizer(h265MTU, 0, 0, &h265Payloader{}, rtp.NewRandomSequencer(), h265ClockRate)
+	return &h265Track{
+		TrackLocalStaticRTP: track,
+		packetizer:          packetizer,
+	}, nil
+}
+
+// WriteSample writes a sample of Annex-B NAL units to every connection the
+// track is bound to.
+func (t *h265Track) WriteSample(sample media.Sample) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	samples := uint32(sample.Duration.Seconds() * h265ClockRate)
+	for _, packet := range t.packetizer.Packetize(sample.Data, samples) {
+		err := t.WriteRTP(packet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Packetizes Annex-B H265 NAL units as in RFC 7798, sending each NAL unit in
+// a packet of its own, or fragmented across several if it is too large.
+type h265Payloader struct{}
+
+func (p *h265Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	nalus, _ := h264parser.SplitNALUs(payload)
+
+	var payloads [][]byte
+	for _, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+		if len(nalu) <= int(mtu) {
+			payloads = append(payloads, nalu)
+			continue
+		}
+
+		// The payload header keeps the NAL unit's F bit, layer ID and TID,
+		// with the fragmentation unit type.
+		header := []byte{nalu[0]&0x81 | h265FragmentationUnit<<1, nalu[1]}
+		naluType := (nalu[0] >> 1) & 0x3f
+		data := nalu[2:]
+		maxFragment := int(mtu) - len(header) - 1
+		for start := 0; start < len(data); start += maxFragment {
+			end := min(start+maxFragment, len(data))
+
+			fuHeader := naluType
+			if start == 0 {
+				fuHeader |= 0x80
+			}
+			if end == len(data) {
+				fuHeader |= 0x40
+			}
+
+			fragment := make([]byte, 0, len(header)+1+end-start)
+			fragment = append(fragment, header...)
+			fragment = append(fragment, fuHeader)
+			fragment = append(fragment, data[start:end]...)
+			payloads = append(payloads, fragment)
+		}
+	}
+	return payloads
+}
@@ -0,0 +1,446 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/thingify-app/thing-rtc/peer-go/codec"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+var (
+	ErrNotInitiator = errors.New("only an initiator can host viewers")
+	ErrHostClosed   = errors.New("host has been closed")
+)
+
+// Host serves any number of viewers (responders) of a single initiator
+// pairing at once, e.g. a camera streaming to several browsers. Each viewer
+// has an independent connection, with its own signalling session and nonces,
+// and all of them are sent the same media tracks.
+//
+// The signalling server matches each responder with one waiting initiator
+// session, so while there is room for another viewer, the Host keeps a session
+// waiting for it, and opens the next as soon as a viewer claims it. Viewers
+// do not reconnect - a viewer which disconnects joins again as a new Viewer.
+type Host struct {
+	serverUrl  string
+	serverAuth ServerAuth
+	peerConfig *peerconfig.PeerConfig
+	options    *peerOptions
+	codecs     []*codec.Codec
+	tracks     []webrtc.TrackLocal
+	logger     *slog.Logger
+	// The most viewers served at once, or 0 for no limit.
+	maxViewers int
+	// Removes our listeners from the media sources once closed.
+	removeErrorListeners []func()
+
+	// Signalled whenever a viewer leaves, so that a session can be opened for
+	// the next.
+	left chan struct{}
+	// Tracks the goroutines of all sessions.
+	wg sync.WaitGroup
+
+	// Guards all fields below.
+	mutex sync.Mutex
+	// Viewers which have claimed a session, whether or not they have finished
+	// connecting.
+	viewers map[*Viewer]struct{}
+	nextID  int
+	closed  bool
+	// Cancels the running accept loop, or nil if there is none.
+	cancel context.CancelFunc
+	// Closed once the running accept loop has exited.
+	done      chan struct{}
+	listeners hostListeners
+
+	// Delivers viewer events to listeners in order.
+	eventExecutor serialExecutor
+}
+
+type hostListeners struct {
+	viewerConnected    func(viewer *Viewer)
+	viewerDisconnected func(viewer *Viewer, reason error)
+	dataChannel        func(viewer *Viewer, dataChannel DataChannel)
+	track              func(viewer *Viewer, track RemoteTrack)
+	err                func(err error)
+}
+
+// Viewer is a responder connected (or connecting) to a Host.
+type Viewer struct {
+	id   int
+	task *peerTask
+	// Ends the viewer's session.
+	cancel context.CancelFunc
+	// Closed once a viewer has claimed the session.
+	claimed   chan struct{}
+	claimOnce sync.Once
+
+	// Guards state.
+	mutex sync.Mutex
+	state ConnectionState
+}
+
+// NewHost creates a Host for an initiator pairing, which connects via the
+// signalling server at serverUrl, configured by any number of options. Each
+// viewer's connection is configured as a Peer's would be. At most maxViewers
+// are served at once, where 0 means no limit, and further viewers wait until
+// one leaves.
+func NewHost(serverUrl string, serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, maxViewers int, opts ...Option) (*Host, error) {
+	if peerConfig.Role != peerconfig.Initiator {
+		return nil, ErrNotInitiator
+	}
+
+	options := defaultPeerOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	logger := options.logger.With("pairingId", peerConfig.PairingId, "role", peerConfig.Role)
+
+	// Tracks are shared by every viewer's connection.
+	codecs, tracks := sourcesToCodecsTracks(options.sources)
+	h := &Host{
+		serverUrl:  serverUrl,
+		serverAuth: serverAuth,
+		peerConfig: peerConfig,
+		options:    options,
+		codecs:     codecs,
+		tracks:     tracks,
+		logger:     logger,
+		maxViewers: maxViewers,
+		left:       make(chan struct{}, 1),
+		viewers:    make(map[*Viewer]struct{}),
+
+		// Initialise listeners as empty functions to allow them to be optional.
+		listeners: hostListeners{
+			viewerConnected:    func(viewer *Viewer) {},
+			viewerDisconnected: func(viewer *Viewer, reason error) {},
+			dataChannel:        func(viewer *Viewer, dataChannel DataChannel) {},
+			track:              func(viewer *Viewer, track RemoteTrack) {},
+			err:                func(err error) {},
+		},
+	}
+
+	for _, source := range options.sources {
+		source.setLogger(logger)
+		remove := source.addErrorListener(func(err error) { go h.getListeners().err(err) })
+		h.removeErrorListeners = append(h.removeErrorListeners, remove)
+	}
+	return h, nil
+}
+
+// Connect starts waiting for viewers in the background, until ctx is
+// cancelled or Close is called. It is a no-op if the host is already running.
+func (h *Host) Connect(ctx context.Context) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closed {
+		return ErrHostClosed
+	}
+
+	err := validateICEServers(h.options.iceServers)
+	if err != nil {
+		return err
+	}
+
+	if h.cancel != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	h.cancel = cancel
+	h.done = done
+
+	go h.acceptLoop(ctx, done)
+
+	return nil
+}
+
+// Close disconnects all viewers and stops waiting for more, returning once all
+// background goroutines have exited. The host cannot be connected again after
+// it has been closed.
+func (h *Host) Close() error {
+	h.mutex.Lock()
+	h.closed = true
+	for _, remove := range h.removeErrorListeners {
+		remove()
+	}
+	cancel := h.cancel
+	done := h.done
+	h.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// Viewers returns the viewers currently connected or connecting, in the order
+// they joined.
+func (h *Host) Viewers() []*Viewer {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	viewers := make([]*Viewer, 0, len(h.viewers))
+	for viewer := range h.viewers {
+		viewers = append(viewers, viewer)
+	}
+	slices.SortFunc(viewers, func(a *Viewer, b *Viewer) int {
+		return a.id - b.id
+	})
+	return viewers
+}
+
+// Keeps a session waiting for the next viewer while there is room for one,
+// until ctx is cancelled or the retry policy gives up, then waits for all
+// sessions to end and closes done.
+func (h *Host) acceptLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	// Consecutive sessions which ended without being claimed.
+	failures := 0
+	for h.waitForRoom(ctx) {
+		viewer, ended := h.startSession(ctx)
+
+		select {
+		case <-viewer.claimed:
+			failures = 0
+			continue
+		case <-ended:
+		case <-ctx.Done():
+			continue
+		}
+		if viewer.isClaimed() {
+			failures = 0
+			continue
+		}
+
+		failures++
+		delay, retry := h.options.retryPolicy.NextDelay(failures)
+		if !retry {
+			h.logger.Error("giving up waiting for viewers", "failures", failures)
+			h.getListeners().err(ErrRetriesExhausted)
+			break
+		}
+		h.logger.Info("waiting to reopen session", "failures", failures, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+
+	// Unless we were stopped by Close, allow Connect to be called again.
+	h.mutex.Lock()
+	if h.done == done {
+		h.cancel()
+		h.cancel = nil
+		h.done = nil
+	}
+	h.mutex.Unlock()
+
+	h.wg.Wait()
+}
+
+// Waits until fewer than the maximum number of viewers are connected,
+// returning false if ctx is done first.
+func (h *Host) waitForRoom(ctx context.Context) bool {
+	for ctx.Err() == nil {
+		h.mutex.Lock()
+		full := h.maxViewers > 0 && len(h.viewers) >= h.maxViewers
+		h.mutex.Unlock()
+		if !full {
+			return true
+		}
+
+		select {
+		case <-h.left:
+		case <-ctx.Done():
+		}
+	}
+	return false
+}
+
+// Starts a session waiting for a viewer, returning a channel which is closed
+// once the session has ended.
+func (h *Host) startSession(ctx context.Context) (*Viewer, <-chan struct{}) {
+	h.mutex.Lock()
+	h.nextID++
+	id := h.nextID
+	h.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	viewer := &Viewer{id: id, cancel: cancel, claimed: make(chan struct{})}
+	logger := h.logger.With("viewer", id)
+	viewer.task = &peerTask{
+		serverUrl:  h.serverUrl,
+		serverAuth: h.serverAuth,
+		peerConfig: h.peerConfig,
+		options:    h.options,
+		codecs:     h.codecs,
+		tracks:     h.tracks,
+		logger:     logger,
+
+		declaredChannels:              newDeclaredDataChannels(),
+		connectionStateListener:       func(state ConnectionState, reason error) { h.setViewerState(viewer, state) },
+		dataChannelListener:           func(dataChannel DataChannel) { go h.getListeners().dataChannel(viewer, dataChannel) },
+		configuredDataChannelListener: func(dataChannel DataChannel) { go h.getListeners().dataChannel(viewer, dataChannel) },
+		trackListener:                 func(track RemoteTrack) { go h.getListeners().track(viewer, track) },
+		errorListener:                 func(err error) { go h.getListeners().err(err) },
+	}
+
+	ended := make(chan struct{})
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer close(ended)
+		defer cancel()
+
+		logger.Info("waiting for viewer")
+		err := viewer.task.AttemptConnect(ctx)
+		reason := viewer.task.endReason
+		if err != nil {
+			logger.Error("session failed", "error", err)
+			h.getListeners().err(err)
+			reason = err
+		}
+		h.endSession(viewer, reason)
+	}()
+	return viewer, ended
+}
+
+func (h *Host) setViewerState(viewer *Viewer, state ConnectionState) {
+	viewer.mutex.Lock()
+	viewer.state = state
+	viewer.mutex.Unlock()
+
+	switch state {
+	case Negotiating:
+		// The signalling server only sends peerConnect once a viewer has
+		// claimed our session.
+		h.mutex.Lock()
+		h.viewers[viewer] = struct{}{}
+		h.mutex.Unlock()
+		viewer.claimOnce.Do(func() { close(viewer.claimed) })
+	case Connected:
+		h.eventExecutor.run(func() { h.getListeners().viewerConnected(viewer) })
+	}
+}
+
+func (h *Host) endSession(viewer *Viewer, reason error) {
+	viewer.mutex.Lock()
+	connected := viewer.task.connected.Load()
+	viewer.state = Disconnected
+	viewer.mutex.Unlock()
+
+	if !viewer.isClaimed() {
+		return
+	}
+
+	h.mutex.Lock()
+	delete(h.viewers, viewer)
+	h.mutex.Unlock()
+	select {
+	case h.left <- struct{}{}:
+	default:
+	}
+
+	h.logger.Info("viewer left", "viewer", viewer.id, "reason", reason)
+	if connected {
+		h.eventExecutor.run(func() { h.getListeners().viewerDisconnected(viewer, reason) })
+	}
+}
+
+func (h *Host) getListeners() hostListeners {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.listeners
+}
+
+// OnViewerConnected is called once each viewer has connected.
+func (h *Host) OnViewerConnected(f func(viewer *Viewer)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners.viewerConnected = f
+}
+
+// OnViewerDisconnected is called once a connected viewer has disconnected,
+// with the reason its connection ended (or nil if it was closed by us).
+func (h *Host) OnViewerDisconnected(f func(viewer *Viewer, reason error)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners.viewerDisconnected = f
+}
+
+// OnDataChannel is called with data channels opened by any viewer.
+func (h *Host) OnDataChannel(f func(viewer *Viewer, dataChannel DataChannel)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners.dataChannel = f
+}
+
+// OnTrack is called with media tracks received from any viewer, which are
+// offered to with WithReceiveTracks.
+func (h *Host) OnTrack(f func(viewer *Viewer, track RemoteTrack)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners.track = f
+}
+
+func (h *Host) OnError(f func(err error)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.listeners.err = f
+}
+
+// ID identifies the viewer among all those which have joined its Host.
+func (v *Viewer) ID() int {
+	return v.id
+}
+
+// State returns the current state of the viewer's connection.
+func (v *Viewer) State() ConnectionState {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.state
+}
+
+// CreateDataChannel creates a data channel to this viewer, which is either
+// ordered and reliable, or unordered and never retransmitted.
+func (v *Viewer) CreateDataChannel(label string, reliable bool) (DataChannel, error) {
+	return v.CreateDataChannelWithOptions(label, reliabilityOptions(reliable))
+}
+
+// CreateDataChannelWithOptions creates a data channel to this viewer,
+// configured by options.
+func (v *Viewer) CreateDataChannelWithOptions(label string, options DataChannelOptions) (DataChannel, error) {
+	if v.State() != Connected {
+		return nil, ErrNotConnected
+	}
+	return v.task.CreateDataChannel(label, options)
+}
+
+// Close disconnects the viewer, making room for another.
+func (v *Viewer) Close() {
+	v.cancel()
+}
+
+func (v *Viewer) isClaimed() bool {
+	select {
+	case <-v.claimed:
+		return true
+	default:
+		return false
+	}
+}
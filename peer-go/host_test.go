@@ -0,0 +1,150 @@
+package thingrtc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+// Creates a viewer of the pairing "camera" which connects to url.
+func createViewer(t *testing.T, url string) Peer {
+	serverAuth, config := createPairingConfig("camera", peerconfig.Responder)
+	viewer := New(url, serverAuth, config, WithICEServers())
+	t.Cleanup(func() { viewer.Close() })
+	return viewer
+}
+
+func createHost(t *testing.T, url string, maxViewers int, opts ...Option) (*Host, <-chan *Viewer, <-chan *Viewer) {
+	serverAuth, config := createPairingConfig("camera", peerconfig.Initiator)
+	host, err := NewHost(url, serverAuth, config, maxViewers, append([]Option{WithICEServers()}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { host.Close() })
+
+	connected := make(chan *Viewer, 10)
+	host.OnViewerConnected(func(viewer *Viewer) {
+		connected <- viewer
+	})
+	disconnected := make(chan *Viewer, 10)
+	host.OnViewerDisconnected(func(viewer *Viewer, reason error) {
+		disconnected <- viewer
+	})
+
+	err = host.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, connected, disconnected
+}
+
+func waitForViewer(t *testing.T, viewers <-chan *Viewer) *Viewer {
+	t.Helper()
+	select {
+	case viewer := <-viewers:
+		return viewer
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for viewer")
+		return nil
+	}
+}
+
+func TestHostServesMultipleViewers(t *testing.T) {
+	url := createRelayServer()
+	host, connected, disconnected := createHost(t, url, 0)
+
+	peers := make([]Peer, 3)
+	dataChannels := make(chan DataChannel, 3)
+	for i := range peers {
+		peers[i] = createViewer(t, url)
+		peers[i].OnDataChannel(func(dataChannel DataChannel) {
+			dataChannels <- dataChannel
+		})
+		err := peers[i].Connect(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range peers {
+		viewer := waitForViewer(t, connected)
+		if viewer.State() != Connected {
+			t.Errorf("expected viewer %v to be connected, got %v", viewer.ID(), viewer.State())
+		}
+		_, err := viewer.CreateDataChannel("hello", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range peers {
+		select {
+		case <-dataChannels:
+		case <-time.After(10 * time.Second):
+			t.Fatal("data channel not received by every viewer")
+		}
+	}
+
+	viewers := host.Viewers()
+	if len(viewers) != 3 {
+		t.Fatalf("expected 3 viewers, got %v", len(viewers))
+	}
+	for i := 1; i < len(viewers); i++ {
+		if viewers[i].ID() <= viewers[i-1].ID() {
+			t.Errorf("expected viewers in order, got IDs %v then %v", viewers[i-1].ID(), viewers[i].ID())
+		}
+	}
+
+	// Disconnecting a viewer leaves the others connected.
+	viewers[0].Close()
+	if viewer := waitForViewer(t, disconnected); viewer != viewers[0] {
+		t.Errorf("expected viewer %v to disconnect, got %v", viewers[0].ID(), viewer.ID())
+	}
+	for _, viewer := range viewers[1:] {
+		if viewer.State() != Connected {
+			t.Errorf("expected viewer %v to remain connected, got %v", viewer.ID(), viewer.State())
+		}
+	}
+}
+
+func TestHostLimitsViewers(t *testing.T) {
+	url := createRelayServer()
+	// Detect the first viewer leaving quickly.
+	timeouts := ICETimeouts{Disconnected: 200 * time.Millisecond, Failed: 200 * time.Millisecond, KeepAlive: 50 * time.Millisecond}
+	host, connected, disconnected := createHost(t, url, 1, WithICETimeouts(timeouts))
+
+	first := createViewer(t, url)
+	first.Connect(context.Background())
+	firstViewer := waitForViewer(t, connected)
+
+	second := createViewer(t, url)
+	second.Connect(context.Background())
+
+	select {
+	case <-connected:
+		t.Fatal("expected second viewer to wait")
+	case <-time.After(time.Second):
+	}
+	if second.State() == Connected {
+		t.Fatal("expected second viewer not to be connected")
+	}
+
+	// Once the first viewer leaves, the second takes its place.
+	first.Close()
+	if viewer := waitForViewer(t, disconnected); viewer != firstViewer {
+		t.Errorf("expected first viewer to disconnect, got %v", viewer.ID())
+	}
+	waitForViewer(t, connected)
+	if viewers := host.Viewers(); len(viewers) != 1 {
+		t.Errorf("expected 1 viewer, got %v", len(viewers))
+	}
+}
+
+func TestHostRequiresInitiator(t *testing.T) {
+	serverAuth, config := createPairingConfig("camera", peerconfig.Responder)
+	_, err := NewHost("ws://localhost", serverAuth, config, 0)
+	if err != ErrNotInitiator {
+		t.Errorf("expected ErrNotInitiator, got %v", err)
+	}
+}
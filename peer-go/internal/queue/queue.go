@@ -0,0 +1,270 @@
+// Package queue implements the queues of received messages behind
+// thingrtc.DataChannel, so that they can be shared with fakes in other
+// packages. Its types are re-exported by thingrtc, where they are documented.
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Returned by Subscription.Recv once there are no more messages, and
+// re-exported as thingrtc.ErrDataChannelClosed.
+var ErrClosed = errors.New("data channel is not open")
+
+type Message struct {
+	Data     []byte
+	IsString bool
+}
+
+func (m Message) Text() string {
+	return string(m.Data)
+}
+
+type OverflowPolicy int
+
+const (
+	Block OverflowPolicy = iota
+	DropNewest
+	DropOldest
+)
+
+const DefaultQueueSize = 64
+
+type SubscribeOptions struct {
+	QueueSize      int
+	OverflowPolicy OverflowPolicy
+}
+
+type Subscription struct {
+	messages       chan Message
+	overflowPolicy OverflowPolicy
+	unsubscribe    func(subscription *Subscription)
+
+	// Closed to unblock delivery when closing.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Guards closed and sends on messages, so they don't race with closing it.
+	mutex  sync.Mutex
+	closed bool
+}
+
+func newSubscription(options SubscribeOptions, unsubscribe func(subscription *Subscription)) *Subscription {
+	queueSize := options.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	return &Subscription{
+		messages:       make(chan Message, queueSize),
+		overflowPolicy: options.OverflowPolicy,
+		unsubscribe:    unsubscribe,
+		done:           make(chan struct{}),
+	}
+}
+
+// Messages returns a channel of received messages, which is closed once the
+// subscription or data channel is closed and all queued messages are read.
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Recv waits for the next message. It returns ErrClosed once the
+// subscription or data channel is closed and all queued messages are read, or
+// ctx.Err() if ctx is done first.
+func (s *Subscription) Recv(ctx context.Context) (Message, error) {
+	select {
+	case message, ok := <-s.messages:
+		if !ok {
+			return Message{}, ErrClosed
+		}
+		return message, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Close stops delivering messages to this subscription. Messages which are
+// already queued can still be read.
+func (s *Subscription) Close() {
+	s.close()
+	s.unsubscribe(s)
+}
+
+func (s *Subscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.closed = true
+		close(s.messages)
+	})
+}
+
+func (s *Subscription) deliver(message Message, overflowPolicy OverflowPolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	switch overflowPolicy {
+	case Block:
+		select {
+		case s.messages <- message:
+		case <-s.done:
+		}
+	case DropNewest:
+		select {
+		case s.messages <- message:
+		default:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.messages <- message:
+				return
+			default:
+			}
+			// Make room, unless the subscriber beat us to it.
+			select {
+			case <-s.messages:
+			default:
+			}
+		}
+	}
+}
+
+// Dispatcher fans received messages out to subscriptions, keeping them until
+// there are subscribers.
+type Dispatcher struct {
+	mutex         sync.Mutex
+	subscriptions []*Subscription
+	// Messages received before any subscriptions, which are given to each new
+	// subscription until a message is delivered to the subscriptions.
+	pending []Message
+	// Whether a message has been delivered to the subscriptions.
+	delivered bool
+	closed    bool
+}
+
+// Deliver delivers a message to all subscriptions, or keeps it if there are
+// none yet. Returns false if it had to be dropped because too many are kept.
+func (d *Dispatcher) Deliver(message Message) bool {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return true
+	}
+	if len(d.subscriptions) == 0 && !d.delivered {
+		if len(d.pending) >= DefaultQueueSize {
+			d.mutex.Unlock()
+			return false
+		}
+		d.pending = append(d.pending, message)
+		d.mutex.Unlock()
+		return true
+	}
+	d.pending = nil
+	d.delivered = true
+	subscriptions := append([]*Subscription(nil), d.subscriptions...)
+	d.mutex.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.deliver(message, subscription.overflowPolicy)
+	}
+	return true
+}
+
+func (d *Dispatcher) Subscribe(options SubscribeOptions) *Subscription {
+	subscription := newSubscription(options, d.unsubscribe)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed {
+		subscription.close()
+		return subscription
+	}
+
+	// Hand over messages which arrived before anyone was listening, without
+	// blocking while we hold the lock.
+	for _, message := range d.pending {
+		subscription.deliver(message, DropNewest)
+	}
+	d.subscriptions = append(d.subscriptions, subscription)
+
+	return subscription
+}
+
+func (d *Dispatcher) unsubscribe(subscription *Subscription) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i, s := range d.subscriptions {
+		if s == subscription {
+			d.subscriptions = append(d.subscriptions[:i], d.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close closes all subscriptions, once the data channel has closed.
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	d.closed = true
+	subscriptions := d.subscriptions
+	d.subscriptions = nil
+	d.pending = nil
+	d.mutex.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.close()
+	}
+}
+
+// Receiver implements the receiving side of thingrtc.DataChannel, shared by
+// all implementations.
+type Receiver struct {
+	Dispatcher Dispatcher
+
+	defaultOnce         sync.Once
+	defaultSubscription *Subscription
+	listenersOnce       sync.Once
+}
+
+func (r *Receiver) getDefaultSubscription() *Subscription {
+	r.defaultOnce.Do(func() {
+		r.defaultSubscription = r.Dispatcher.Subscribe(SubscribeOptions{})
+	})
+	return r.defaultSubscription
+}
+
+// StartListeners starts passing messages to listener, in order on a dedicated
+// goroutine, the first time it is called.
+func (r *Receiver) StartListeners(listener func(message Message)) {
+	r.listenersOnce.Do(func() {
+		subscription := r.Dispatcher.Subscribe(SubscribeOptions{})
+		go func() {
+			for message := range subscription.Messages() {
+				listener(message)
+			}
+		}()
+	})
+}
+
+func (r *Receiver) Messages() <-chan Message {
+	return r.getDefaultSubscription().Messages()
+}
+
+func (r *Receiver) Recv(ctx context.Context) (Message, error) {
+	return r.getDefaultSubscription().Recv(ctx)
+}
+
+func (r *Receiver) Subscribe(options SubscribeOptions) *Subscription {
+	return r.Dispatcher.Subscribe(options)
+}
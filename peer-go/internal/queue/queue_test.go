@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func textMessage(text string) Message {
+	return Message{Data: []byte(text), IsString: true}
+}
+
+func expectQueued(t *testing.T, subscription *Subscription, expected ...string) {
+	t.Helper()
+	for _, text := range expected {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		message, err := subscription.Recv(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("expected message %q, got error %v", text, err)
+		}
+		if message.Text() != text {
+			t.Fatalf("expected message %q, got %q", text, message.Text())
+		}
+	}
+}
+
+func TestDispatcherKeepsMessagesForFirstSubscribers(t *testing.T) {
+	dispatcher := Dispatcher{}
+	dispatcher.Deliver(textMessage("first"))
+	dispatcher.Deliver(textMessage("second"))
+
+	first := dispatcher.Subscribe(SubscribeOptions{})
+	second := dispatcher.Subscribe(SubscribeOptions{})
+	dispatcher.Deliver(textMessage("third"))
+	// Subscribing after a message has been delivered would leave a gap, so
+	// only later messages are received.
+	third := dispatcher.Subscribe(SubscribeOptions{})
+	dispatcher.Deliver(textMessage("fourth"))
+
+	expectQueued(t, first, "first", "second", "third", "fourth")
+	expectQueued(t, second, "first", "second", "third", "fourth")
+	expectQueued(t, third, "fourth")
+}
+
+func TestDispatcherReportsDroppedMessages(t *testing.T) {
+	dispatcher := Dispatcher{}
+	for i := 0; i < DefaultQueueSize; i++ {
+		if !dispatcher.Deliver(textMessage("kept")) {
+			t.Fatalf("message %v should have been kept", i)
+		}
+	}
+	if dispatcher.Deliver(textMessage("dropped")) {
+		t.Fatal("expected message to be dropped once too many are kept")
+	}
+
+	subscription := dispatcher.Subscribe(SubscribeOptions{QueueSize: DefaultQueueSize + 1})
+	if !dispatcher.Deliver(textMessage("delivered")) {
+		t.Fatal("expected message to be delivered")
+	}
+	for i := 0; i < DefaultQueueSize; i++ {
+		expectQueued(t, subscription, "kept")
+	}
+	expectQueued(t, subscription, "delivered")
+}
+
+func TestDispatcherOverflowPolicies(t *testing.T) {
+	dispatcher := Dispatcher{}
+	dropNewest := dispatcher.Subscribe(SubscribeOptions{QueueSize: 2, OverflowPolicy: DropNewest})
+	dropOldest := dispatcher.Subscribe(SubscribeOptions{QueueSize: 2, OverflowPolicy: DropOldest})
+
+	for _, text := range []string{"1", "2", "3"} {
+		dispatcher.Deliver(textMessage(text))
+	}
+
+	expectQueued(t, dropNewest, "1", "2")
+	expectQueued(t, dropOldest, "2", "3")
+}
+
+func TestDispatcherBlocksUntilRead(t *testing.T) {
+	dispatcher := Dispatcher{}
+	subscription := dispatcher.Subscribe(SubscribeOptions{QueueSize: 1, OverflowPolicy: Block})
+
+	delivered := make(chan interface{})
+	go func() {
+		dispatcher.Deliver(textMessage("1"))
+		dispatcher.Deliver(textMessage("2"))
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+		t.Fatal("delivery should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+		// Continue
+	}
+
+	expectQueued(t, subscription, "1", "2")
+	<-delivered
+}
+
+func TestClosingSubscriptionUnblocksDelivery(t *testing.T) {
+	dispatcher := Dispatcher{}
+	subscription := dispatcher.Subscribe(SubscribeOptions{QueueSize: 1, OverflowPolicy: Block})
+	other := dispatcher.Subscribe(SubscribeOptions{})
+
+	dispatcher.Deliver(textMessage("1"))
+	delivered := make(chan interface{})
+	go func() {
+		dispatcher.Deliver(textMessage("2"))
+		close(delivered)
+	}()
+
+	subscription.Close()
+	<-delivered
+
+	// Queued messages are still readable after closing.
+	expectQueued(t, subscription, "1")
+	_, err := subscription.Recv(context.Background())
+	if err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	expectQueued(t, other, "1", "2")
+}
+
+func TestDispatcherCloseEndsSubscriptions(t *testing.T) {
+	dispatcher := Dispatcher{}
+	subscription := dispatcher.Subscribe(SubscribeOptions{})
+	dispatcher.Deliver(textMessage("last"))
+	dispatcher.Close()
+
+	var received []string
+	for message := range subscription.Messages() {
+		received = append(received, message.Text())
+	}
+	if len(received) != 1 || received[0] != "last" {
+		t.Fatalf("unexpected messages: %v", received)
+	}
+
+	late := dispatcher.Subscribe(SubscribeOptions{})
+	if _, ok := <-late.Messages(); ok {
+		t.Fatal("subscriptions after closing should be closed")
+	}
+}
@@ -0,0 +1,100 @@
+package testutil
+
+import (
+	"strings"
+	"sync"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// Peer fakes the data channel parts of a connected thingrtc.Peer. Data
+// channels it creates are pipes, whose other end is routed to the remote
+// Peer's listeners as a real peer would: to the handler for the longest
+// matching label prefix, or else the OnDataChannel listener. Nothing is
+// delivered to the listeners of the Peer which created the channel.
+type Peer struct {
+	remote *Peer
+	// Shared by both peers, so that either can close every channel.
+	channels *channels
+
+	mutex       sync.Mutex
+	dataChannel func(dataChannel thingrtc.DataChannel)
+	prefixed    map[string]func(dataChannel thingrtc.DataChannel)
+}
+
+type channels struct {
+	mutex    sync.Mutex
+	channels []thingrtc.DataChannel
+}
+
+// ConnectedPeers returns a pair of fake peers connected to each other.
+func ConnectedPeers() (*Peer, *Peer) {
+	shared := &channels{}
+	a := &Peer{channels: shared, prefixed: map[string]func(dataChannel thingrtc.DataChannel){}}
+	b := &Peer{channels: shared, prefixed: map[string]func(dataChannel thingrtc.DataChannel){}}
+	a.remote = b
+	b.remote = a
+	return a, b
+}
+
+// CreateDataChannelWithOptions ignores options, as pipes are always reliable
+// and ordered.
+func (p *Peer) CreateDataChannelWithOptions(label string, options thingrtc.DataChannelOptions) (thingrtc.DataChannel, error) {
+	local, remote := Pipe(label)
+
+	p.channels.mutex.Lock()
+	p.channels.channels = append(p.channels.channels, local)
+	p.channels.mutex.Unlock()
+
+	go p.remote.dataChannelListener(label)(remote)
+	return local, nil
+}
+
+func (p *Peer) OnDataChannel(f func(dataChannel thingrtc.DataChannel)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.dataChannel = f
+}
+
+func (p *Peer) OnDataChannelWithPrefix(prefix string, f func(dataChannel thingrtc.DataChannel)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if f == nil {
+		delete(p.prefixed, prefix)
+	} else {
+		p.prefixed[prefix] = f
+	}
+}
+
+// Disconnect closes every data channel created by either peer, as losing the
+// connection would.
+func (p *Peer) Disconnect() {
+	p.channels.mutex.Lock()
+	channels := p.channels.channels
+	p.channels.channels = nil
+	p.channels.mutex.Unlock()
+
+	for _, channel := range channels {
+		channel.Close()
+	}
+}
+
+func (p *Peer) dataChannelListener(label string) func(dataChannel thingrtc.DataChannel) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	listener := p.dataChannel
+	longest := -1
+	for prefix, f := range p.prefixed {
+		if strings.HasPrefix(label, prefix) && len(prefix) > longest {
+			listener = f
+			longest = len(prefix)
+		}
+	}
+	if listener == nil {
+		// As a real peer has nobody to hand the channel to.
+		return func(dataChannel thingrtc.DataChannel) {}
+	}
+	return listener
+}
@@ -0,0 +1,218 @@
+// Package testutil provides fakes for testing packages built on thingrtc
+// without a network connection.
+package testutil
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+	"github.com/thingify-app/thing-rtc/peer-go/internal/queue"
+)
+
+// Pipe returns a pair of connected in-memory DataChannels with the given
+// label, which are already open. Messages sent on one are received on the
+// other, and closing either end closes both.
+func Pipe(label string) (thingrtc.DataChannel, thingrtc.DataChannel) {
+	shared := &pipeShared{}
+	a := &pipeChannel{label: label, shared: shared, listeners: emptyPipeListeners()}
+	b := &pipeChannel{label: label, shared: shared, listeners: emptyPipeListeners()}
+	a.remote = b
+	b.remote = a
+	return a, b
+}
+
+// State shared by both ends of a pipe.
+type pipeShared struct {
+	mutex  sync.Mutex
+	closed bool
+}
+
+type pipeListeners struct {
+	stringMessage func(message string)
+	binaryMessage func(message []byte)
+	close         func()
+}
+
+func emptyPipeListeners() pipeListeners {
+	return pipeListeners{
+		stringMessage: func(message string) {},
+		binaryMessage: func(message []byte) {},
+		close:         func() {},
+	}
+}
+
+type pipeChannel struct {
+	queue.Receiver
+
+	label  string
+	shared *pipeShared
+	remote *pipeChannel
+
+	mutex     sync.Mutex
+	listeners pipeListeners
+	threshold uint64
+}
+
+func (dc *pipeChannel) isClosed() bool {
+	dc.shared.mutex.Lock()
+	defer dc.shared.mutex.Unlock()
+	return dc.shared.closed
+}
+
+func (dc *pipeChannel) getListeners() pipeListeners {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return dc.listeners
+}
+
+func (dc *pipeChannel) send(message thingrtc.DataChannelMessage) error {
+	if dc.isClosed() {
+		return thingrtc.ErrDataChannelClosed
+	}
+	// Copy, as callers may reuse their buffer.
+	message.Data = append([]byte(nil), message.Data...)
+	dc.remote.Dispatcher.Deliver(message)
+	return nil
+}
+
+func (dc *pipeChannel) SendStringMessage(message string) error {
+	return dc.send(thingrtc.DataChannelMessage{Data: []byte(message), IsString: true})
+}
+
+func (dc *pipeChannel) SendBinaryMessage(message []byte) error {
+	return dc.send(thingrtc.DataChannelMessage{Data: message})
+}
+
+// Send never waits, as nothing is buffered, although delivery may block on a
+// full Subscription.
+func (dc *pipeChannel) Send(ctx context.Context, message []byte) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return dc.SendBinaryMessage(message)
+}
+
+func (dc *pipeChannel) dispatch(message thingrtc.DataChannelMessage) {
+	listeners := dc.getListeners()
+	if message.IsString {
+		listeners.stringMessage(message.Text())
+	} else {
+		listeners.binaryMessage(message.Data)
+	}
+}
+
+func (dc *pipeChannel) OnStringMessage(listener func(message string)) {
+	dc.mutex.Lock()
+	dc.listeners.stringMessage = listener
+	dc.mutex.Unlock()
+
+	dc.StartListeners(dc.dispatch)
+}
+
+func (dc *pipeChannel) OnBinaryMessage(listener func(message []byte)) {
+	dc.mutex.Lock()
+	dc.listeners.binaryMessage = listener
+	dc.mutex.Unlock()
+
+	dc.StartListeners(dc.dispatch)
+}
+
+func (dc *pipeChannel) OnOpen(listener func()) {
+	if !dc.isClosed() {
+		go listener()
+	}
+}
+
+func (dc *pipeChannel) OnClose(listener func()) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.close = listener
+}
+
+// OnError is never called, as pipes have no transport to fail and never drop
+// messages.
+func (dc *pipeChannel) OnError(listener func(err error)) {}
+
+func (dc *pipeChannel) BufferedAmount() uint64 {
+	return 0
+}
+
+func (dc *pipeChannel) BufferedAmountLowThreshold() uint64 {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return dc.threshold
+}
+
+func (dc *pipeChannel) SetBufferedAmountLowThreshold(threshold uint64) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.threshold = threshold
+}
+
+// OnBufferedAmountLow is never called, as nothing is buffered.
+func (dc *pipeChannel) OnBufferedAmountLow(listener func()) {}
+
+// Close closes both ends of the pipe.
+func (dc *pipeChannel) Close() {
+	dc.shared.mutex.Lock()
+	if dc.shared.closed {
+		dc.shared.mutex.Unlock()
+		return
+	}
+	dc.shared.closed = true
+	dc.shared.mutex.Unlock()
+
+	for _, end := range []*pipeChannel{dc, dc.remote} {
+		end.Dispatcher.Close()
+		go end.getListeners().close()
+	}
+}
+
+func (dc *pipeChannel) GetLabel() string {
+	return dc.label
+}
+
+func (dc *pipeChannel) Options() thingrtc.DataChannelOptions {
+	return thingrtc.ReliableDataChannelOptions()
+}
+
+func (dc *pipeChannel) Protocol() string {
+	return ""
+}
+
+// AsStream returns a stream which, like a detached data channel, reads one
+// message at a time.
+func (dc *pipeChannel) AsStream() (io.ReadWriteCloser, error) {
+	return &pipeStream{channel: dc, subscription: dc.Subscribe(thingrtc.SubscribeOptions{})}, nil
+}
+
+type pipeStream struct {
+	channel      *pipeChannel
+	subscription *thingrtc.Subscription
+}
+
+func (s *pipeStream) Read(p []byte) (int, error) {
+	message, err := s.subscription.Recv(context.Background())
+	if err != nil {
+		return 0, io.EOF
+	}
+	if len(message.Data) > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(p, message.Data), nil
+}
+
+func (s *pipeStream) Write(p []byte) (int, error) {
+	err := s.channel.SendBinaryMessage(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *pipeStream) Close() error {
+	s.channel.Close()
+	return nil
+}
@@ -0,0 +1,52 @@
+package testutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+func TestPipeDeliversMessagesBothWays(t *testing.T) {
+	a, b := Pipe("test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a.SendStringMessage("to b")
+	b.SendBinaryMessage([]byte("to a"))
+
+	message, err := b.Recv(ctx)
+	if err != nil || message.Text() != "to b" || !message.IsString {
+		t.Fatalf("unexpected message %v, error %v", message, err)
+	}
+	message, err = a.Recv(ctx)
+	if err != nil || message.Text() != "to a" || message.IsString {
+		t.Fatalf("unexpected message %v, error %v", message, err)
+	}
+}
+
+func TestPipeCloseClosesBothEnds(t *testing.T) {
+	a, b := Pipe("test")
+
+	closed := make(chan interface{}, 1)
+	b.OnClose(func() {
+		closed <- nil
+	})
+	a.Close()
+
+	select {
+	case <-closed:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+
+	if err := b.SendStringMessage("message"); err != thingrtc.ErrDataChannelClosed {
+		t.Fatalf("expected ErrDataChannelClosed, got %v", err)
+	}
+	if _, err := b.Recv(context.Background()); err != thingrtc.ErrDataChannelClosed {
+		t.Fatalf("expected ErrDataChannelClosed, got %v", err)
+	}
+}
@@ -1,26 +1,126 @@
 package thingrtc
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/deepch/vdk/av"
-	"github.com/deepch/vdk/codec/h264parser"
-	"github.com/deepch/vdk/format/rtsp"
 	"github.com/pion/mediadevices"
 	"github.com/pion/mediadevices/pkg/frame"
 	"github.com/pion/mediadevices/pkg/prop"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 
 	"github.com/thingify-app/thing-rtc/peer-go/codec"
 )
 
 type MediaSource struct {
 	tracks []webrtc.TrackLocal
-	codec  *codec.Codec
+	// Codecs used to encode the tracks, or none if they are encoded remotely.
+	codecs []*codec.Codec
+	// Replaced with the peer's logger once the source is added to a peer.
+	logger atomic.Pointer[slog.Logger]
+	// Stops any background work feeding the tracks.
+	cancel context.CancelFunc
+
+	// Guards state and errorListeners.
+	mutex sync.Mutex
+	state MediaSourceState
+	// Called with errors from background work, by each peer the source is
+	// added to.
+	errorListeners []*func(err error)
+}
+
+// MediaSourceState describes the health of a source which receives media from
+// elsewhere, such as an RTSP camera. Sources capturing from local devices do
+// not report state.
+type MediaSourceState struct {
+	// Whether the source is currently receiving media.
+	Connected bool
+	// Media received, in bits per second, over roughly the last second.
+	Bitrate int
+	// When the last video key frame was received, or zero if none has been.
+	LastKeyFrame time.Time
+	// Why the source last disconnected, or nil if it has not.
+	LastError error
+}
+
+func newMediaSource(tracks []webrtc.TrackLocal, codecs ...*codec.Codec) *MediaSource {
+	source := &MediaSource{
+		tracks: tracks,
+		codecs: codecs,
+	}
+	source.logger.Store(slog.Default())
+	return source
+}
+
+func (m *MediaSource) setLogger(logger *slog.Logger) {
+	m.logger.Store(logger)
+}
+
+// Adds a listener for errors, returning a function which removes it again.
+func (m *MediaSource) addErrorListener(f func(err error)) (remove func()) {
+	listener := &f
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.errorListeners = append(m.errorListeners, listener)
+
+	return func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		// DeleteFunc shifts elements in place, so copy first to leave any
+		// slice taken by reportError untouched.
+		m.errorListeners = slices.DeleteFunc(slices.Clone(m.errorListeners), func(l *func(err error)) bool {
+			return l == listener
+		})
+	}
+}
+
+// Reports an error to every peer the source has been added to.
+func (m *MediaSource) reportError(err error) {
+	m.mutex.Lock()
+	listeners := m.errorListeners
+	m.mutex.Unlock()
+
+	for _, listener := range listeners {
+		(*listener)(err)
+	}
+}
+
+// Tracks returns the tracks of the source, e.g. for recording with
+// RecordLocalTrack.
+func (m *MediaSource) Tracks() []webrtc.TrackLocal {
+	return m.tracks
+}
+
+// State returns the current state of the source.
+func (m *MediaSource) State() MediaSourceState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state
+}
+
+func (m *MediaSource) updateState(update func(state *MediaSourceState)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	update(&m.state)
+}
+
+// Close stops the source, releasing any devices or connections it uses. Peers
+// using the source stop receiving media from it.
+func (m *MediaSource) Close() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	for _, track := range m.tracks {
+		if track, ok := track.(*deviceTrack); ok {
+			track.close()
+		}
+	}
+	return nil
 }
 
 func CreateVideoMediaSource(codec *codec.Codec, width, height int) (*MediaSource, error) {
@@ -28,24 +128,55 @@ func CreateVideoMediaSource(codec *codec.Codec, width, height int) (*MediaSource
 	if err != nil {
 		return nil, err
 	}
-	return &MediaSource{
-		tracks: []webrtc.TrackLocal{track},
-		codec:  codec,
-	}, nil
+	return newDeviceMediaSource([]mediadevices.Track{track}, codec)
 }
 
-func CreateRtspMediaSource(rtspUrl string) (*MediaSource, error) {
-	track, err := createRtspTrack(rtspUrl)
+// CreateAudioMediaSource captures audio from a microphone, encoded with codec
+// (e.g. from codec/opus). A microphone driver must be registered, e.g. by
+// importing driver/microphone.
+func CreateAudioMediaSource(codec *codec.Codec) (*MediaSource, error) {
+	track, err := createAudioTrack(codec)
 	if err != nil {
 		return nil, err
 	}
-	return &MediaSource{
-		tracks: []webrtc.TrackLocal{track},
-		codec:  nil,
-	}, nil
+	return newDeviceMediaSource([]mediadevices.Track{track}, codec)
+}
+
+// CreateAudioVideoMediaSource captures both video from a camera and audio from
+// a microphone, sent to the peer as tracks of the same stream.
+func CreateAudioVideoMediaSource(videoCodec *codec.Codec, audioCodec *codec.Codec, width, height int) (*MediaSource, error) {
+	videoTrack, err := createVideoTrack(videoCodec, width, height)
+	if err != nil {
+		return nil, err
+	}
+	audioTrack, err := createAudioTrack(audioCodec)
+	if err != nil {
+		// Release the camera, as the source will not be used.
+		videoTrack.Close()
+		return nil, err
+	}
+	return newDeviceMediaSource([]mediadevices.Track{videoTrack, audioTrack}, videoCodec, audioCodec)
+}
+
+// Creates a source which encodes each device once, however many peers and
+// recordings it is sent to. The devices are closed if none of their codecs can
+// be encoded.
+func newDeviceMediaSource(devices []mediadevices.Track, codecs ...*codec.Codec) (*MediaSource, error) {
+	source := newMediaSource(nil, codecs...)
+	for _, device := range devices {
+		track, err := newDeviceTrack(device, &source.logger)
+		if err != nil {
+			for _, device := range devices {
+				device.Close()
+			}
+			return nil, err
+		}
+		source.tracks = append(source.tracks, track)
+	}
+	return source, nil
 }
 
-func createVideoTrack(codec *codec.Codec, width, height int) (webrtc.TrackLocal, error) {
+func createVideoTrack(codec *codec.Codec, width, height int) (mediadevices.Track, error) {
 	mediaStream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
 		Video: func(c *mediadevices.MediaTrackConstraints) {
 			c.FrameFormat = prop.FrameFormat(frame.FormatI420)
@@ -67,78 +198,20 @@ func createVideoTrack(codec *codec.Codec, width, height int) (webrtc.TrackLocal,
 	return tracks[0], nil
 }
 
-func createRtspTrack(rtspUrl string) (webrtc.TrackLocal, error) {
-	outboundVideoTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
-		MimeType: "video/h264",
-	}, "pion-rtsp", "pion-rtsp")
+func createAudioTrack(codec *codec.Codec) (mediadevices.Track, error) {
+	mediaStream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
+		Audio: func(c *mediadevices.MediaTrackConstraints) {},
+		Codec: codec.CodecSelector,
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	go rtspConsumer(rtspUrl, outboundVideoTrack)
-
-	return outboundVideoTrack, nil
-}
-
-func rtspConsumer(rtspUrl string, outboundVideoTrack *webrtc.TrackLocalStaticSample) {
-	annexbNALUStartCode := func() []byte { return []byte{0x00, 0x00, 0x00, 0x01} }
-
-	for {
-		session, err := rtsp.Dial(rtspUrl)
-		if err != nil {
-			panic(err)
-		}
-		session.RtpKeepAliveTimeout = 10 * time.Second
-
-		codecs, err := session.Streams()
-		if err != nil {
-			panic(err)
-		}
-		for i, t := range codecs {
-			log.Println("Stream", i, "is of type", t.Type().String())
-		}
-		if codecs[0].Type() != av.H264 {
-			panic("RTSP feed must begin with a H264 codec")
-		}
-		if len(codecs) != 1 {
-			log.Println("Ignoring all but the first stream.")
-		}
-
-		var previousTime time.Duration
-		for {
-			pkt, err := session.ReadPacket()
-			if err != nil {
-				break
-			}
-
-			if pkt.Idx != 0 {
-				//audio or other stream, skip it
-				continue
-			}
-
-			pkt.Data = pkt.Data[4:]
-
-			// For every key-frame pre-pend the SPS and PPS
-			if pkt.IsKeyFrame {
-				pkt.Data = append(annexbNALUStartCode(), pkt.Data...)
-				pkt.Data = append(codecs[0].(h264parser.CodecData).PPS(), pkt.Data...)
-				pkt.Data = append(annexbNALUStartCode(), pkt.Data...)
-				pkt.Data = append(codecs[0].(h264parser.CodecData).SPS(), pkt.Data...)
-				pkt.Data = append(annexbNALUStartCode(), pkt.Data...)
-			}
-
-			bufferDuration := pkt.Time - previousTime
-			previousTime = pkt.Time
-			if err = outboundVideoTrack.WriteSample(media.Sample{Data: pkt.Data, Duration: bufferDuration}); err != nil && err != io.ErrClosedPipe {
-				panic(err)
-			}
-		}
-
-		if err = session.Close(); err != nil {
-			log.Println("session Close error", err)
-		}
-
-		time.Sleep(5 * time.Second)
+	tracks := mediaStream.GetAudioTracks()
+	if len(tracks) != 1 {
+		return nil, fmt.Errorf("only one audio track expected")
 	}
+
+	return tracks[0], nil
 }
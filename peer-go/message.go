@@ -0,0 +1,66 @@
+package thingrtc
+
+import (
+	"errors"
+
+	"github.com/thingify-app/thing-rtc/peer-go/internal/queue"
+)
+
+// ErrMessageDropped is reported to the OnError listener of a DataChannel when
+// a message arrives before anything has subscribed to it, and
+// DefaultMessageQueueSize messages are already waiting.
+var ErrMessageDropped = errors.New("message dropped before anything subscribed")
+
+// DataChannelMessage is a message received on a DataChannel. Its Text method
+// returns the message data as a string.
+type DataChannelMessage = queue.Message
+
+// OverflowPolicy decides what happens when a message is received for a
+// Subscription whose queue is full.
+type OverflowPolicy = queue.OverflowPolicy
+
+const (
+	// Wait for the subscriber to make room. This pauses delivery to all
+	// subscribers of the channel, and eventually applies backpressure to the
+	// remote peer, so a subscriber which stops reading stalls the channel.
+	Block = queue.Block
+	// Discard the message that was just received.
+	DropNewest = queue.DropNewest
+	// Discard the oldest queued message to make room.
+	DropOldest = queue.DropOldest
+)
+
+// The default queue size of a Subscription, and the number of messages kept
+// for the first subscribers before there are any.
+const DefaultMessageQueueSize = queue.DefaultQueueSize
+
+// SubscribeOptions configures a Subscription. QueueSize is the number of
+// messages which may be queued before OverflowPolicy applies, and defaults to
+// DefaultMessageQueueSize. OverflowPolicy defaults to Block.
+type SubscribeOptions = queue.SubscribeOptions
+
+// Subscription is a queue of messages received on a DataChannel. Each
+// subscription receives every message received after it was created.
+// Messages which arrive before there are any subscriptions are kept, and
+// given to every subscription (including that used by OnStringMessage and
+// OnBinaryMessage) created before the next message arrives.
+//
+// Messages returns a channel of received messages, which is closed once the
+// subscription or data channel is closed and all queued messages are read.
+// Recv waits for the next message, returning ErrDataChannelClosed once there
+// are no more. Close stops delivering messages to the subscription, although
+// messages already queued can still be read.
+type Subscription = queue.Subscription
+
+// Returns a function which passes each message to the current message
+// listener.
+func messageListener(getListeners func() dataChannelListeners) func(message DataChannelMessage) {
+	return func(message DataChannelMessage) {
+		listeners := getListeners()
+		if message.IsString {
+			listeners.stringMessage(string(message.Data))
+		} else {
+			listeners.binaryMessage(message.Data)
+		}
+	}
+}
@@ -0,0 +1,688 @@
+package thingrtc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// A box of an MP4 file, as in ISO/IEC 14496-12.
+type mp4Box struct {
+	boxType string
+	data    []byte
+}
+
+// Splits data into the boxes it contains.
+func parseMP4Boxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: truncated MP4 box", ErrUnsupportedFile)
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("%w: truncated MP4 box", ErrUnsupportedFile)
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: invalid size of MP4 %v box", ErrUnsupportedFile, boxType)
+		}
+
+		boxes = append(boxes, mp4Box{
+			boxType: boxType,
+			data:    data[headerSize:size],
+		})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// Returns the first box of boxType in boxes, or nil if there is none.
+func findMP4Box(boxes []mp4Box, boxType string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].boxType == boxType {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// Returns the box found by following path from data, or nil if there is none.
+func findMP4Path(data []byte, path ...string) (*mp4Box, error) {
+	var box *mp4Box
+	for _, boxType := range path {
+		boxes, err := parseMP4Boxes(data)
+		if err != nil {
+			return nil, err
+		}
+		box = findMP4Box(boxes, boxType)
+		if box == nil {
+			return nil, nil
+		}
+		data = box.data
+	}
+	return box, nil
+}
+
+// Reads fields of a box in order, recording whether any were missing.
+type mp4FieldReader struct {
+	data      []byte
+	truncated bool
+}
+
+func (r *mp4FieldReader) bytes(n int) []byte {
+	if n > len(r.data) {
+		r.truncated = true
+		r.data = nil
+		return make([]byte, n)
+	}
+	field := r.data[:n]
+	r.data = r.data[n:]
+	return field
+}
+
+func (r *mp4FieldReader) uint8() uint8 {
+	return r.bytes(1)[0]
+}
+
+func (r *mp4FieldReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.bytes(2))
+}
+
+func (r *mp4FieldReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.bytes(4))
+}
+
+func (r *mp4FieldReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(r.bytes(8))
+}
+
+// Reads the version and flags starting a full box.
+func (r *mp4FieldReader) versionFlags() (uint8, uint32) {
+	value := r.uint32()
+	return uint8(value >> 24), value & 0xffffff
+}
+
+func (r *mp4FieldReader) err(boxType string) error {
+	if r.truncated {
+		return fmt.Errorf("%w: truncated MP4 %v box", ErrUnsupportedFile, boxType)
+	}
+	return nil
+}
+
+// Where a sample is found in the file, and when it is decoded.
+type mp4Sample struct {
+	offset int64
+	size   uint32
+	// In units of the track's timescale.
+	decodeTime uint64
+	duration   uint32
+	sync       bool
+}
+
+type mp4Track struct {
+	id        uint32
+	timescale uint32
+	mimeType  string
+	// For H264 and H265, the size of the length preceding each NAL unit, and
+	// the parameter sets in Annex-B, sent before each sync sample.
+	lengthSize    int
+	parameterSets []byte
+	// Defaults from the trex box.
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+	samples         []mp4Sample
+}
+
+// A sample whose flags do not have sample_is_non_sync_sample set.
+func isMP4SyncSample(flags uint32) bool {
+	return flags&0x10000 == 0
+}
+
+// Opens a fragmented MP4 file, such as those written by recorders and media
+// servers. Tracks in codecs which cannot be sent to a peer without
+// transcoding, such as AAC, are skipped. Non-fragmented MP4 files are not
+// supported.
+func openMP4(path string) ([]fileTrack, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tracks, err := readMP4Index(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileTracks []fileTrack
+	for _, track := range tracks {
+		if track.mimeType == "" {
+			continue
+		}
+		track := track
+		fileTracks = append(fileTracks, fileTrack{
+			capability: webrtc.RTPCodecCapability{MimeType: track.mimeType},
+			open: func() (fileTrackReader, error) {
+				file, err := os.Open(path)
+				if err != nil {
+					return nil, err
+				}
+				return &mp4TrackReader{file: file, track: track}, nil
+			},
+		})
+	}
+	if len(fileTracks) == 0 {
+		return nil, fmt.Errorf("%w: no supported tracks in MP4 file", ErrUnsupportedCodec)
+	}
+	return fileTracks, nil
+}
+
+// Reads the tracks of an MP4 file, with the samples of each from every
+// fragment. The media data itself is skipped over.
+func readMP4Index(file *os.File) ([]*mp4Track, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := info.Size()
+
+	var tracks []*mp4Track
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		n, err := io.ReadFull(file, header[:8])
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated MP4 box", ErrUnsupportedFile)
+		}
+
+		size := int64(binary.BigEndian.Uint32(header))
+		boxType := string(header[4:8])
+		headerSize := int64(n)
+		switch size {
+		case 0:
+			size = fileSize - offset
+		case 1:
+			_, err := io.ReadFull(file, header[8:16])
+			if err != nil {
+				return nil, fmt.Errorf("%w: truncated MP4 box", ErrUnsupportedFile)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			headerSize = 16
+		}
+		// Checked before anything is allocated, as sizes may be corrupt.
+		if size < headerSize || size > fileSize-offset {
+			return nil, fmt.Errorf("%w: invalid size of MP4 %v box", ErrUnsupportedFile, boxType)
+		}
+
+		switch boxType {
+		case "moov", "moof":
+			data := make([]byte, size-headerSize)
+			_, err := io.ReadFull(file, data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: truncated MP4 %v box", ErrUnsupportedFile, boxType)
+			}
+			if boxType == "moov" {
+				tracks, err = parseMP4Movie(data)
+			} else {
+				err = parseMP4Fragment(data, offset, fileSize, tracks)
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			// Skip media data, and any other boxes.
+			_, err := file.Seek(size-headerSize, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+		}
+		offset += size
+	}
+
+	if tracks == nil {
+		return nil, fmt.Errorf("%w: no moov box in MP4 file", ErrUnsupportedFile)
+	}
+	return tracks, nil
+}
+
+// Reads the tracks from the moov box.
+func parseMP4Movie(data []byte) ([]*mp4Track, error) {
+	boxes, err := parseMP4Boxes(data)
+	if err != nil {
+		return nil, err
+	}
+	mvex := findMP4Box(boxes, "mvex")
+	if mvex == nil {
+		return nil, fmt.Errorf("%w: MP4 file is not fragmented", ErrUnsupportedFile)
+	}
+
+	var tracks []*mp4Track
+	for _, box := range boxes {
+		if box.boxType != "trak" {
+			continue
+		}
+		track, err := parseMP4Track(box.data)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+	}
+
+	extends, err := parseMP4Boxes(mvex.data)
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range extends {
+		if box.boxType != "trex" {
+			continue
+		}
+		r := &mp4FieldReader{data: box.data}
+		r.versionFlags()
+		id := r.uint32()
+		r.uint32() // default_sample_description_index
+		defaultDuration := r.uint32()
+		defaultSize := r.uint32()
+		defaultFlags := r.uint32()
+		err := r.err(box.boxType)
+		if err != nil {
+			return nil, err
+		}
+		for _, track := range tracks {
+			if track.id == id {
+				track.defaultDuration = defaultDuration
+				track.defaultSize = defaultSize
+				track.defaultFlags = defaultFlags
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// Reads a trak box. The track's mime type is left empty if its codec is not
+// supported.
+func parseMP4Track(data []byte) (*mp4Track, error) {
+	track := &mp4Track{}
+
+	tkhd, err := findMP4Path(data, "tkhd")
+	if err != nil {
+		return nil, err
+	}
+	if tkhd == nil {
+		return nil, fmt.Errorf("%w: MP4 track has no tkhd box", ErrUnsupportedFile)
+	}
+	r := &mp4FieldReader{data: tkhd.data}
+	version, _ := r.versionFlags()
+	if version == 1 {
+		r.bytes(16) // creation_time, modification_time
+	} else {
+		r.bytes(8)
+	}
+	track.id = r.uint32()
+	err = r.err(tkhd.boxType)
+	if err != nil {
+		return nil, err
+	}
+
+	mdhd, err := findMP4Path(data, "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+	if mdhd == nil {
+		return nil, fmt.Errorf("%w: MP4 track has no mdhd box", ErrUnsupportedFile)
+	}
+	r = &mp4FieldReader{data: mdhd.data}
+	version, _ = r.versionFlags()
+	if version == 1 {
+		r.bytes(16)
+	} else {
+		r.bytes(8)
+	}
+	track.timescale = r.uint32()
+	err = r.err(mdhd.boxType)
+	if err != nil {
+		return nil, err
+	}
+	if track.timescale == 0 {
+		return nil, fmt.Errorf("%w: MP4 track timescale is zero", ErrUnsupportedFile)
+	}
+
+	stsd, err := findMP4Path(data, "mdia", "minf", "stbl", "stsd")
+	if err != nil {
+		return nil, err
+	}
+	if stsd == nil {
+		return nil, fmt.Errorf("%w: MP4 track has no stsd box", ErrUnsupportedFile)
+	}
+	if len(stsd.data) < 8 {
+		return nil, fmt.Errorf("%w: truncated MP4 stsd box", ErrUnsupportedFile)
+	}
+	// Only the first sample description is used.
+	entries, err := parseMP4Boxes(stsd.data[8:])
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: MP4 track has no sample description", ErrUnsupportedFile)
+	}
+	err = parseMP4SampleEntry(track, entries[0])
+	if err != nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+const (
+	// Sizes of the fields of a visual or audio sample entry, before its
+	// child boxes.
+	mp4VisualSampleEntrySize = 78
+	mp4AudioSampleEntrySize  = 28
+)
+
+func parseMP4SampleEntry(track *mp4Track, entry mp4Box) error {
+	switch entry.boxType {
+	case "vp08":
+		track.mimeType = webrtc.MimeTypeVP8
+	case "vp09":
+		track.mimeType = webrtc.MimeTypeVP9
+	case "Opus":
+		track.mimeType = webrtc.MimeTypeOpus
+	case "avc1", "avc3", "hvc1", "hev1":
+		if len(entry.data) < mp4VisualSampleEntrySize {
+			return fmt.Errorf("%w: truncated MP4 %v box", ErrUnsupportedFile, entry.boxType)
+		}
+		children, err := parseMP4Boxes(entry.data[mp4VisualSampleEntrySize:])
+		if err != nil {
+			return err
+		}
+		if entry.boxType == "avc1" || entry.boxType == "avc3" {
+			track.mimeType = webrtc.MimeTypeH264
+			config := findMP4Box(children, "avcC")
+			if config == nil {
+				return fmt.Errorf("%w: MP4 H264 track has no avcC box", ErrUnsupportedFile)
+			}
+			return parseAVCConfig(track, config.data)
+		}
+		track.mimeType = webrtc.MimeTypeH265
+		config := findMP4Box(children, "hvcC")
+		if config == nil {
+			return fmt.Errorf("%w: MP4 H265 track has no hvcC box", ErrUnsupportedFile)
+		}
+		return parseHEVCConfig(track, config.data)
+	}
+	return nil
+}
+
+// Reads an AVCDecoderConfigurationRecord, as in ISO/IEC 14496-15.
+func parseAVCConfig(track *mp4Track, data []byte) error {
+	r := &mp4FieldReader{data: data}
+	r.bytes(4) // version, profile, compatibility, level
+	track.lengthSize = int(r.uint8()&0x03) + 1
+
+	var nalus [][]byte
+	spsCount := int(r.uint8() & 0x1f)
+	for i := 0; i < spsCount; i++ {
+		nalus = append(nalus, r.bytes(int(r.uint16())))
+	}
+	ppsCount := int(r.uint8())
+	for i := 0; i < ppsCount; i++ {
+		nalus = append(nalus, r.bytes(int(r.uint16())))
+	}
+	err := r.err("avcC")
+	if err != nil {
+		return err
+	}
+
+	for _, nalu := range nalus {
+		track.parameterSets = append(track.parameterSets, annexBStartCode...)
+		track.parameterSets = append(track.parameterSets, nalu...)
+	}
+	return nil
+}
+
+// Reads an HEVCDecoderConfigurationRecord, as in ISO/IEC 14496-15.
+func parseHEVCConfig(track *mp4Track, data []byte) error {
+	r := &mp4FieldReader{data: data}
+	r.bytes(21) // profile, level and format fields
+	track.lengthSize = int(r.uint8()&0x03) + 1
+
+	arrays := int(r.uint8())
+	for i := 0; i < arrays; i++ {
+		r.uint8() // NAL unit type
+		count := int(r.uint16())
+		for j := 0; j < count; j++ {
+			nalu := r.bytes(int(r.uint16()))
+			track.parameterSets = append(track.parameterSets, annexBStartCode...)
+			track.parameterSets = append(track.parameterSets, nalu...)
+		}
+	}
+	return r.err("hvcC")
+}
+
+// Adds the samples of a moof box, at moofOffset in a file of fileSize bytes,
+// to their tracks.
+func parseMP4Fragment(moof []byte, moofOffset int64, fileSize int64, tracks []*mp4Track) error {
+	boxes, err := parseMP4Boxes(moof)
+	if err != nil {
+		return err
+	}
+	for _, traf := range boxes {
+		if traf.boxType != "traf" {
+			continue
+		}
+		err := parseMP4TrackFragment(traf.data, moofOffset, fileSize, tracks)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseMP4TrackFragment(data []byte, moofOffset int64, fileSize int64, tracks []*mp4Track) error {
+	boxes, err := parseMP4Boxes(data)
+	if err != nil {
+		return err
+	}
+
+	tfhd := findMP4Box(boxes, "tfhd")
+	if tfhd == nil {
+		return fmt.Errorf("%w: MP4 track fragment has no tfhd box", ErrUnsupportedFile)
+	}
+	r := &mp4FieldReader{data: tfhd.data}
+	_, flags := r.versionFlags()
+	id := r.uint32()
+	var track *mp4Track
+	for _, t := range tracks {
+		if t.id == id {
+			track = t
+		}
+	}
+	if track == nil {
+		return fmt.Errorf("%w: MP4 fragment of unknown track %v", ErrUnsupportedFile, id)
+	}
+
+	// Samples are found relative to the start of the moof box, unless a
+	// base offset is given.
+	baseOffset := moofOffset
+	if flags&0x01 != 0 {
+		baseOffset = int64(r.uint64())
+	}
+	if flags&0x02 != 0 {
+		r.uint32() // sample_description_index
+	}
+	defaultDuration := track.defaultDuration
+	if flags&0x08 != 0 {
+		defaultDuration = r.uint32()
+	}
+	defaultSize := track.defaultSize
+	if flags&0x10 != 0 {
+		defaultSize = r.uint32()
+	}
+	defaultFlags := track.defaultFlags
+	if flags&0x20 != 0 {
+		defaultFlags = r.uint32()
+	}
+	err = r.err(tfhd.boxType)
+	if err != nil {
+		return err
+	}
+
+	// Without a tfdt box, the fragment follows on from the previous one.
+	var decodeTime uint64
+	if len(track.samples) > 0 {
+		last := track.samples[len(track.samples)-1]
+		decodeTime = last.decodeTime + uint64(last.duration)
+	}
+	if tfdt := findMP4Box(boxes, "tfdt"); tfdt != nil {
+		r := &mp4FieldReader{data: tfdt.data}
+		version, _ := r.versionFlags()
+		if version == 1 {
+			decodeTime = r.uint64()
+		} else {
+			decodeTime = uint64(r.uint32())
+		}
+		err := r.err(tfdt.boxType)
+		if err != nil {
+			return err
+		}
+	}
+
+	dataOffset := baseOffset
+	for _, trun := range boxes {
+		if trun.boxType != "trun" {
+			continue
+		}
+		r := &mp4FieldReader{data: trun.data}
+		_, flags := r.versionFlags()
+		count := r.uint32()
+		if flags&0x01 != 0 {
+			dataOffset = baseOffset + int64(int32(r.uint32()))
+		}
+		firstFlags, hasFirstFlags := defaultFlags, false
+		if flags&0x04 != 0 {
+			firstFlags, hasFirstFlags = r.uint32(), true
+		}
+
+		// Check the count against the fields of each sample, if any, before
+		// allocating anything.
+		sampleFieldsSize := 0
+		for _, flag := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if flags&flag != 0 {
+				sampleFieldsSize += 4
+			}
+		}
+		if sampleFieldsSize > 0 && uint64(count) > uint64(len(r.data)/sampleFieldsSize) {
+			return fmt.Errorf("%w: truncated MP4 %v box", ErrUnsupportedFile, trun.boxType)
+		}
+		if sampleFieldsSize == 0 && count > 0 && defaultSize == 0 {
+			return fmt.Errorf("%w: MP4 samples have no size", ErrUnsupportedFile)
+		}
+
+		for i := uint32(0); i < count && !r.truncated; i++ {
+			sample := mp4Sample{
+				offset:     dataOffset,
+				size:       defaultSize,
+				decodeTime: decodeTime,
+				duration:   defaultDuration,
+			}
+			sampleFlags := defaultFlags
+			if i == 0 && hasFirstFlags {
+				sampleFlags = firstFlags
+			}
+			if flags&0x100 != 0 {
+				sample.duration = r.uint32()
+			}
+			if flags&0x200 != 0 {
+				sample.size = r.uint32()
+			}
+			if flags&0x400 != 0 {
+				sampleFlags = r.uint32()
+			}
+			if flags&0x800 != 0 {
+				// Samples are sent in decode order, so the composition
+				// offset is not needed.
+				r.uint32()
+			}
+			sample.sync = isMP4SyncSample(sampleFlags)
+			if sample.offset < 0 || sample.offset > fileSize-int64(sample.size) {
+				return fmt.Errorf("%w: MP4 sample is outside the file", ErrUnsupportedFile)
+			}
+
+			track.samples = append(track.samples, sample)
+			dataOffset += int64(sample.size)
+			decodeTime += uint64(sample.duration)
+		}
+		err := r.err(trun.boxType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Converts a time in units of timescale to a duration, without overflowing
+// for long files.
+func mp4Duration(value uint64, timescale uint32) time.Duration {
+	seconds := value / uint64(timescale)
+	remainder := value % uint64(timescale)
+	return time.Duration(seconds)*time.Second + time.Duration(remainder)*time.Second/time.Duration(timescale)
+}
+
+type mp4TrackReader struct {
+	file  *os.File
+	track *mp4Track
+	index int
+}
+
+func (r *mp4TrackReader) next() (*fileSample, error) {
+	if r.index >= len(r.track.samples) {
+		return nil, io.EOF
+	}
+	sample := r.track.samples[r.index]
+	r.index++
+
+	data := make([]byte, sample.size)
+	_, err := r.file.ReadAt(data, sample.offset)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading sample: %w", ErrUnsupportedFile, err)
+	}
+
+	if r.track.lengthSize > 0 {
+		annexB, err := avccToAnnexB(data, r.track.lengthSize)
+		if err != nil {
+			return nil, err
+		}
+		if sample.sync {
+			annexB = append(append([]byte{}, r.track.parameterSets...), annexB...)
+		}
+		data = annexB
+	}
+
+	return &fileSample{
+		data:      data,
+		timestamp: mp4Duration(sample.decodeTime, r.track.timescale),
+		duration:  mp4Duration(uint64(sample.duration), r.track.timescale),
+		keyFrame:  sample.sync || r.track.mimeType == webrtc.MimeTypeOpus,
+	}, nil
+}
+
+func (r *mp4TrackReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,283 @@
+package thingrtc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mp4VideoTimescale = 90000
+	mp4AudioTimescale = 48000
+	// Audio is written in fragments of at least this long. Video is written
+	// in a fragment for each key frame.
+	mp4FragmentDuration = time.Second
+
+	// Sample flags, as in ISO/IEC 14496-12: a sync sample depends on no
+	// others, and other samples depend on others and are non-sync.
+	mp4SyncSampleFlags    = 0x02000000
+	mp4NonSyncSampleFlags = 0x01010000
+)
+
+// Writes H264 or Opus samples to a fragmented MP4 file, which can be played
+// back up to the last complete fragment even if recording stops without it
+// being closed.
+type mp4Writer struct {
+	file      *segmentFile
+	mimeType  string
+	timescale uint32
+	started   bool
+
+	// Samples of the fragment being built, and when it starts.
+	fragment      []mp4WriterSample
+	fragmentStart time.Duration
+	sequence      uint32
+}
+
+type mp4WriterSample struct {
+	data     []byte
+	duration uint32
+	keyFrame bool
+}
+
+func newMP4Writer(file *segmentFile, mimeType string) *mp4Writer {
+	timescale := uint32(mp4VideoTimescale)
+	if mimeType == webrtc.MimeTypeOpus {
+		timescale = mp4AudioTimescale
+	}
+	return &mp4Writer{
+		file:      file,
+		mimeType:  mimeType,
+		timescale: timescale,
+	}
+}
+
+func mp4Uint32s(values ...uint32) []byte {
+	var data []byte
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return data
+}
+
+func encodeMP4Box(boxType string, contents ...[]byte) []byte {
+	size := 8
+	for _, content := range contents {
+		size += len(content)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(size))
+	box = append(box, boxType...)
+	for _, content := range contents {
+		box = append(box, content...)
+	}
+	return box
+}
+
+// The unity transformation matrix of movie and track headers.
+var mp4Matrix = mp4Uint32s(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000)
+
+// Writes the file type and movie boxes, using the first sample to find the
+// H264 parameter sets.
+func (w *mp4Writer) writeHeader(first []byte) error {
+	var sampleEntry []byte
+	var handler string
+	var mediaHeader []byte
+	width, height := 0, 0
+	switch w.mimeType {
+	case webrtc.MimeTypeH264:
+		var sps, pps []byte
+		nalus, _ := h264parser.SplitNALUs(first)
+		for _, nalu := range nalus {
+			switch {
+			case len(nalu) == 0:
+			case nalu[0]&0x1f == 7 && sps == nil:
+				sps = nalu
+			case nalu[0]&0x1f == 8 && pps == nil:
+				pps = nalu
+			}
+		}
+		if sps == nil || pps == nil {
+			return fmt.Errorf("%w: H264 key frame has no parameter sets", ErrInvalidNALU)
+		}
+		codecData, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidNALU, err)
+		}
+		width, height = codecData.Width(), codecData.Height()
+
+		visual := make([]byte, 0, mp4VisualSampleEntrySize)
+		// Reserved, and the data reference index.
+		visual = append(visual, 0, 0, 0, 0, 0, 0, 0, 1)
+		visual = append(visual, make([]byte, 16)...)
+		visual = binary.BigEndian.AppendUint16(visual, uint16(width))
+		visual = binary.BigEndian.AppendUint16(visual, uint16(height))
+		// 72 dpi resolution, reserved, and a frame count of 1.
+		visual = append(visual, mp4Uint32s(0x00480000, 0x00480000, 0)...)
+		visual = binary.BigEndian.AppendUint16(visual, 1)
+		// Compressor name, a depth of 24 and pre-defined -1.
+		visual = append(visual, make([]byte, 32)...)
+		visual = append(visual, 0x00, 0x18, 0xff, 0xff)
+		sampleEntry = encodeMP4Box("avc1", visual, encodeMP4Box("avcC", codecData.AVCDecoderConfRecordBytes()))
+
+		handler = "vide"
+		mediaHeader = encodeMP4Box("vmhd", mp4Uint32s(1, 0, 0))
+	case webrtc.MimeTypeOpus:
+		audio := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+		audio = append(audio, make([]byte, 8)...)
+		// Two channels of 16 bits, and the sample rate as 16.16 fixed point.
+		audio = append(audio, 0, 2, 0, 16, 0, 0, 0, 0)
+		audio = append(audio, mp4Uint32s(mp4AudioTimescale<<16)...)
+
+		// The Opus identification header, big-endian and without its magic
+		// signature, as in the Opus in ISO Base Media File Format spec.
+		dOps := []byte{0, 2}
+		dOps = binary.BigEndian.AppendUint16(dOps, 312)
+		dOps = binary.BigEndian.AppendUint32(dOps, 48000)
+		dOps = append(dOps, 0, 0, 0)
+		sampleEntry = encodeMP4Box("Opus", audio, encodeMP4Box("dOps", dOps))
+
+		handler = "soun"
+		mediaHeader = encodeMP4Box("smhd", mp4Uint32s(0, 0))
+	}
+
+	volume := uint32(0)
+	if handler == "soun" {
+		volume = 0x0100 << 16
+	}
+	// Version 0 headers, with zero creation times and durations as the
+	// durations are in the fragments.
+	trak := encodeMP4Box("trak",
+		encodeMP4Box("tkhd",
+			mp4Uint32s(0x000003, 0, 0, 1, 0, 0, 0, 0, 0, volume),
+			mp4Matrix,
+			mp4Uint32s(uint32(width)<<16, uint32(height)<<16),
+		),
+		encodeMP4Box("mdia",
+			// The language is "und".
+			encodeMP4Box("mdhd", mp4Uint32s(0, 0, 0, w.timescale, 0, 0x55c40000)),
+			encodeMP4Box("hdlr", mp4Uint32s(0, 0), []byte(handler), mp4Uint32s(0, 0, 0), []byte("thing-rtc\x00")),
+			encodeMP4Box("minf",
+				mediaHeader,
+				encodeMP4Box("dinf", encodeMP4Box("dref", mp4Uint32s(0, 1), encodeMP4Box("url ", mp4Uint32s(1)))),
+				encodeMP4Box("stbl",
+					encodeMP4Box("stsd", mp4Uint32s(0, 1), sampleEntry),
+					encodeMP4Box("stts", mp4Uint32s(0, 0)),
+					encodeMP4Box("stsc", mp4Uint32s(0, 0)),
+					encodeMP4Box("stsz", mp4Uint32s(0, 0, 0)),
+					encodeMP4Box("stco", mp4Uint32s(0, 0)),
+				),
+			),
+		),
+	)
+
+	header := encodeMP4Box("ftyp", []byte("iso5"), mp4Uint32s(0x200), []byte("iso5iso6mp41"))
+	header = append(header, encodeMP4Box("moov",
+		encodeMP4Box("mvhd",
+			mp4Uint32s(0, 0, 0, 1000, 0, 0x00010000, 0x01000000, 0, 0),
+			mp4Matrix,
+			mp4Uint32s(0, 0, 0, 0, 0, 0, 2),
+		),
+		trak,
+		encodeMP4Box("mvex", encodeMP4Box("trex", mp4Uint32s(0, 1, 1, 0, 0, 0))),
+	)...)
+
+	_, err := w.file.Write(header)
+	return err
+}
+
+func (w *mp4Writer) writeSample(sample recordedSample) error {
+	if !w.started {
+		err := w.writeHeader(sample.data)
+		if err != nil {
+			return err
+		}
+		w.started = true
+	}
+
+	video := w.mimeType != webrtc.MimeTypeOpus
+	if len(w.fragment) > 0 && ((video && sample.keyFrame) || (!video && sample.timestamp-w.fragmentStart >= mp4FragmentDuration)) {
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+	}
+	if len(w.fragment) == 0 {
+		w.fragmentStart = sample.timestamp
+	}
+
+	data := sample.data
+	if video {
+		// Samples are stored with lengths before each NAL unit rather than
+		// start codes, and parameter sets are in the sample entry.
+		nalus, _ := h264parser.SplitNALUs(sample.data)
+		data = nil
+		for _, nalu := range nalus {
+			if len(nalu) == 0 || nalu[0]&0x1f == 7 || nalu[0]&0x1f == 8 || nalu[0]&0x1f == 9 {
+				continue
+			}
+			data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+			data = append(data, nalu...)
+		}
+	}
+
+	w.fragment = append(w.fragment, mp4WriterSample{
+		data:     data,
+		duration: uint32(w.mediaTime(sample.timestamp+sample.duration) - w.mediaTime(sample.timestamp)),
+		keyFrame: sample.keyFrame,
+	})
+	return nil
+}
+
+// Converts a time to the nearest unit of the timescale. Durations are found
+// from the difference between times, so that they add up to each fragment's
+// start.
+func (w *mp4Writer) mediaTime(t time.Duration) uint64 {
+	timescale := time.Duration(w.timescale)
+	return uint64(t/time.Second*timescale + (t%time.Second*timescale+time.Second/2)/time.Second)
+}
+
+// Writes the fragment being built.
+func (w *mp4Writer) flush() error {
+	if len(w.fragment) == 0 {
+		return nil
+	}
+	w.sequence++
+
+	var entries []byte
+	var mdat []byte
+	for _, sample := range w.fragment {
+		flags := uint32(mp4NonSyncSampleFlags)
+		if sample.keyFrame {
+			flags = mp4SyncSampleFlags
+		}
+		entries = append(entries, mp4Uint32s(sample.duration, uint32(len(sample.data)), flags)...)
+		mdat = append(mdat, sample.data...)
+	}
+
+	decodeTime := w.mediaTime(w.fragmentStart)
+	// Samples are found relative to the start of the moof box, with each
+	// sample's duration, size and flags.
+	moof := func(dataOffset uint32) []byte {
+		return encodeMP4Box("moof",
+			encodeMP4Box("mfhd", mp4Uint32s(0, w.sequence)),
+			encodeMP4Box("traf",
+				encodeMP4Box("tfhd", mp4Uint32s(0x020000, 1)),
+				encodeMP4Box("tfdt", mp4Uint32s(0x01000000, uint32(decodeTime>>32), uint32(decodeTime))),
+				encodeMP4Box("trun", mp4Uint32s(0x000701, uint32(len(w.fragment)), dataOffset), entries),
+			),
+		)
+	}
+	fragment := moof(uint32(len(moof(0)) + 8))
+	fragment = append(fragment, encodeMP4Box("mdat", mdat)...)
+
+	w.fragment = nil
+	_, err := w.file.Write(fragment)
+	return err
+}
+
+func (w *mp4Writer) close() error {
+	return w.flush()
+}
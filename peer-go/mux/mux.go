@@ -0,0 +1,220 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// LabelPrefix starts the label of every data channel carrying a session.
+const LabelPrefix = "mux/"
+
+// The label of data channels carrying a session.
+const SessionLabel = LabelPrefix + "session"
+
+var ErrMuxClosed = errors.New("mux closed")
+
+// The subset of Peer used by a Mux.
+type channelPeer interface {
+	CreateDataChannelWithOptions(label string, options thingrtc.DataChannelOptions) (thingrtc.DataChannel, error)
+	OnDataChannelWithPrefix(prefix string, f func(dataChannel thingrtc.DataChannel))
+}
+
+// Mux provides sessions over the data channels of a Peer. Whichever peer
+// first needs a session on a connection opens it, and the session ends with
+// the connection. If both peers open one at once, both sessions are used, and
+// AcceptStream accepts streams from either.
+type Mux struct {
+	peer    channelPeer
+	opts    []Option
+	options *options
+
+	// Streams accepted from all sessions.
+	accepted chan *Stream
+	// Cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Held while opening a session, so that only one is opened at a time.
+	openMutex sync.Mutex
+
+	// Guards all fields below.
+	mutex    sync.Mutex
+	sessions map[*Session]struct{}
+	// The session used to open streams, or nil if there is none.
+	current *Session
+	closed  bool
+}
+
+// New starts accepting sessions from the remote peer. Both peers should call
+// it before connecting, so that no session is missed.
+func New(peer thingrtc.Peer, opts ...Option) *Mux {
+	return newMux(peer, opts...)
+}
+
+func newMux(peer channelPeer, opts ...Option) *Mux {
+	options := defaultOptions(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mux{
+		peer:     peer,
+		opts:     opts,
+		options:  options,
+		accepted: make(chan *Stream),
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: map[*Session]struct{}{},
+	}
+	peer.OnDataChannelWithPrefix(LabelPrefix, m.handleChannel)
+	return m
+}
+
+// Session returns the session on the current connection, opening one if
+// there is none yet. It is typically called once the peer is Connected.
+func (m *Mux) Session(ctx context.Context) (*Session, error) {
+	if session, err := m.currentSession(); session != nil || err != nil {
+		return session, err
+	}
+
+	m.openMutex.Lock()
+	defer m.openMutex.Unlock()
+
+	// The remote peer may have opened one in the meantime.
+	if session, err := m.currentSession(); session != nil || err != nil {
+		return session, err
+	}
+
+	channel, err := m.peer.CreateDataChannelWithOptions(SessionLabel, thingrtc.ReliableDataChannelOptions())
+	if err != nil {
+		return nil, err
+	}
+	session, err := m.startSession(ctx, channel, true)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// OpenStream opens a stream on the current session, opening a session first
+// if needed.
+func (m *Mux) OpenStream(ctx context.Context) (*Stream, error) {
+	session, err := m.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.OpenStream()
+}
+
+// AcceptStream waits for the remote peer to open a stream on any session.
+func (m *Mux) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case stream := <-m.accepted:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.ctx.Done():
+		return nil, ErrMuxClosed
+	}
+}
+
+// Close stops accepting sessions and closes all sessions.
+func (m *Mux) Close() error {
+	m.peer.OnDataChannelWithPrefix(LabelPrefix, nil)
+	m.cancel()
+
+	m.mutex.Lock()
+	m.closed = true
+	sessions := m.sessions
+	m.sessions = map[*Session]struct{}{}
+	m.current = nil
+	m.mutex.Unlock()
+
+	for session := range sessions {
+		session.Close()
+	}
+	return nil
+}
+
+// Returns the current session if it is still open.
+func (m *Mux) currentSession() (*Session, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil, ErrMuxClosed
+	}
+	if m.current != nil && !m.current.IsClosed() {
+		return m.current, nil
+	}
+	return nil, nil
+}
+
+func (m *Mux) handleChannel(channel thingrtc.DataChannel) {
+	if channel.GetLabel() != SessionLabel {
+		channel.Close()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, m.options.openTimeout)
+	defer cancel()
+	_, err := m.startSession(ctx, channel, false)
+	if err != nil {
+		m.options.logger.Warn("could not accept mux session", "error", err)
+	}
+}
+
+// Runs a session over channel, which we opened if client is set.
+func (m *Mux) startSession(ctx context.Context, channel thingrtc.DataChannel, client bool) (*Session, error) {
+	stream, err := thingrtc.OpenDataChannelStream(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	session, err := NewSession(stream, client, m.opts...)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		session.Close()
+		return nil, ErrMuxClosed
+	}
+	m.sessions[session] = struct{}{}
+	// Prefer sessions we opened, so that both peers settle on the same one.
+	if client || m.current == nil || m.current.IsClosed() {
+		m.current = session
+	}
+	m.mutex.Unlock()
+
+	go m.acceptLoop(session)
+	return session, nil
+}
+
+// Hands streams accepted from session to AcceptStream until it ends.
+func (m *Mux) acceptLoop(session *Session) {
+	defer func() {
+		m.mutex.Lock()
+		delete(m.sessions, session)
+		if m.current == session {
+			m.current = nil
+		}
+		m.mutex.Unlock()
+		session.Close()
+	}()
+
+	for {
+		stream, err := session.AcceptStream(m.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case m.accepted <- stream:
+		case <-m.ctx.Done():
+			stream.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+	"github.com/thingify-app/thing-rtc/peer-go/internal/testutil"
+)
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func createMuxes(t *testing.T) (*Mux, *Mux, *testutil.Peer) {
+	a, b := testutil.ConnectedPeers()
+	muxA := newMux(a)
+	muxB := newMux(b)
+	t.Cleanup(func() {
+		muxA.Close()
+		muxB.Close()
+	})
+	return muxA, muxB, a
+}
+
+func TestOpenAndAcceptStreams(t *testing.T) {
+	muxA, muxB, _ := createMuxes(t)
+
+	for i := 0; i < 3; i++ {
+		local, err := muxA.OpenStream(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = local.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remote, err := muxB.AcceptStream(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(remote, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer) != "hello" {
+			t.Errorf("expected hello, got %v", string(buffer))
+		}
+	}
+
+	// All streams share one session.
+	session, err := muxA.Session(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := session.NumStreams(); count != 3 {
+		t.Errorf("expected 3 streams, got %v", count)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	muxA, muxB, _ := createMuxes(t)
+
+	local, err := muxA.OpenStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.Write([]byte("request"))
+	local.CloseWrite()
+
+	remote, err := muxB.AcceptStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "request" {
+		t.Errorf("expected request, got %v", string(request))
+	}
+
+	// The other direction is still open.
+	remote.Write([]byte("response"))
+	remote.Close()
+	response, err := io.ReadAll(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "response" {
+		t.Errorf("expected response, got %v", string(response))
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	a, b := testutil.ConnectedPeers()
+	muxA := newMux(a)
+	muxB := newMux(b, WithMaxStreamWindowSize(256*1024))
+	defer muxA.Close()
+	defer muxB.Close()
+
+	local, err := muxA.OpenStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := muxB.AcceptStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make([]byte, 4*1024*1024)
+	for i := range sent {
+		sent[i] = byte(i)
+	}
+	go func() {
+		local.Write(sent)
+		local.CloseWrite()
+	}()
+
+	// The writer cannot get further ahead than the window, so an unread
+	// stream does not block others on the same session.
+	time.Sleep(50 * time.Millisecond)
+	other, err := muxA.OpenStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Write([]byte("x"))
+	otherRemote, err := muxB.AcceptStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRemote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := otherRemote.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("second stream was blocked: %v", err)
+	}
+
+	received, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Error("received data does not match")
+	}
+}
+
+func TestSimultaneousSessions(t *testing.T) {
+	muxA, muxB, _ := createMuxes(t)
+
+	// Both peers open a session at once, and streams flow both ways.
+	var sessionA, sessionB *Session
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sessionA, _ = muxA.Session(testContext(t))
+	}()
+	go func() {
+		defer wg.Done()
+		sessionB, _ = muxB.Session(testContext(t))
+	}()
+	wg.Wait()
+	if sessionA == nil || sessionB == nil {
+		t.Fatal("sessions were not opened")
+	}
+
+	for _, pair := range [][2]*Mux{{muxA, muxB}, {muxB, muxA}} {
+		stream, err := pair[0].OpenStream(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write([]byte("x"))
+		accepted, err := pair[1].AcceptStream(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := accepted.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSessionEndsWithConnection(t *testing.T) {
+	muxA, muxB, peerA := createMuxes(t)
+
+	session, err := muxA.Session(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := muxA.OpenStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := muxB.AcceptStream(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerA.Disconnect()
+
+	select {
+	case <-session.Done():
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Error("expected write to fail")
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	// A new session is opened on the next connection.
+	newSession, err := muxA.Session(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newSession == session {
+		t.Error("expected a new session")
+	}
+}
+
+func TestClose(t *testing.T) {
+	muxA, muxB, _ := createMuxes(t)
+
+	session, err := muxA.Session(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxA.Close()
+
+	<-session.Done()
+	if _, err := muxA.Session(testContext(t)); err != ErrMuxClosed {
+		t.Errorf("expected ErrMuxClosed, got %v", err)
+	}
+	if _, err := muxA.AcceptStream(testContext(t)); err != ErrMuxClosed {
+		t.Errorf("expected ErrMuxClosed, got %v", err)
+	}
+
+	muxB.Close()
+}
+
+func TestSessionPing(t *testing.T) {
+	a, b := testutil.Pipe("test")
+	streamA, err := thingrtc.OpenDataChannelStream(testContext(t), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamB, err := thingrtc.OpenDataChannelStream(testContext(t), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewSession(streamA, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := NewSession(streamB, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if _, err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	<-client.Done()
+	if _, err := client.Ping(); err != ErrSessionClosed {
+		t.Errorf("expected ErrSessionClosed, got %v", err)
+	}
+}
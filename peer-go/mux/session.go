@@ -0,0 +1,193 @@
+// Package mux multiplexes many streams over a single data channel, as opening
+// a data channel per stream is expensive on some browsers, and channel IDs are
+// limited. Each stream has its own flow control and can be half-closed, and
+// sessions are kept alive with pings. It speaks the yamux protocol.
+//
+// A Session runs over any byte stream, such as a thingrtc.DataChannelStream.
+// A Mux manages sessions over the data channels of a Peer, so that streams can
+// be opened as soon as it is connected.
+package mux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+var ErrSessionClosed = errors.New("mux session closed")
+
+type Option func(options *options)
+
+type options struct {
+	logger              *slog.Logger
+	keepAliveInterval   time.Duration
+	maxStreamWindowSize uint32
+	acceptBacklog       int
+	openTimeout         time.Duration
+}
+
+// The default time allowed for a Mux to open a session's data channel.
+const DefaultOpenTimeout = 10 * time.Second
+
+func defaultOptions(opts []Option) *options {
+	config := yamux.DefaultConfig()
+	options := &options{
+		logger:              slog.Default(),
+		keepAliveInterval:   config.KeepAliveInterval,
+		maxStreamWindowSize: config.MaxStreamWindowSize,
+		acceptBacklog:       config.AcceptBacklog,
+		openTimeout:         DefaultOpenTimeout,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithLogger sets the logger used to report protocol errors.
+func WithLogger(logger *slog.Logger) Option {
+	return func(options *options) {
+		options.logger = logger
+	}
+}
+
+// WithKeepAliveInterval sets how often the session is pinged, to detect a
+// remote peer which has gone away. Zero disables keepalives.
+func WithKeepAliveInterval(interval time.Duration) Option {
+	return func(options *options) {
+		options.keepAliveInterval = interval
+	}
+}
+
+// WithMaxStreamWindowSize sets how many bytes each stream may receive before
+// they are read, which bounds the memory used by a slow reader.
+func WithMaxStreamWindowSize(size uint32) Option {
+	return func(options *options) {
+		options.maxStreamWindowSize = size
+	}
+}
+
+// WithAcceptBacklog sets how many incoming streams may wait to be accepted,
+// after which the remote peer's attempts to open more are refused.
+func WithAcceptBacklog(backlog int) Option {
+	return func(options *options) {
+		options.acceptBacklog = backlog
+	}
+}
+
+// WithOpenTimeout sets the time a Mux allows to open a session's data
+// channel.
+func WithOpenTimeout(timeout time.Duration) Option {
+	return func(options *options) {
+		options.openTimeout = timeout
+	}
+}
+
+func (o *options) yamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.EnableKeepAlive = o.keepAliveInterval > 0
+	if config.EnableKeepAlive {
+		config.KeepAliveInterval = o.keepAliveInterval
+	}
+	config.MaxStreamWindowSize = o.maxStreamWindowSize
+	config.AcceptBacklog = o.acceptBacklog
+	config.LogOutput = nil
+	config.Logger = slog.NewLogLogger(o.logger.Handler(), slog.LevelWarn)
+	return config
+}
+
+// Session is a multiplexed connection, on which either side may open streams.
+type Session struct {
+	session *yamux.Session
+}
+
+// NewSession starts a session over conn. The two sides of a session must
+// pass different values of client, which decides how streams are numbered.
+func NewSession(conn io.ReadWriteCloser, client bool, opts ...Option) (*Session, error) {
+	config := defaultOptions(opts).yamuxConfig()
+
+	var session *yamux.Session
+	var err error
+	if client {
+		session, err = yamux.Client(conn, config)
+	} else {
+		session, err = yamux.Server(conn, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Session{session: session}, nil
+}
+
+// OpenStream opens a new stream to the remote peer. It does not wait for the
+// remote peer to accept it.
+func (s *Session) OpenStream() (*Stream, error) {
+	stream, err := s.session.OpenStream()
+	if err != nil {
+		return nil, toSessionError(err)
+	}
+	return &Stream{stream}, nil
+}
+
+// AcceptStream waits for the remote peer to open a stream.
+func (s *Session) AcceptStream(ctx context.Context) (*Stream, error) {
+	stream, err := s.session.AcceptStreamWithContext(ctx)
+	if err != nil {
+		return nil, toSessionError(err)
+	}
+	return &Stream{stream}, nil
+}
+
+// Ping measures the round trip time to the remote peer.
+func (s *Session) Ping() (time.Duration, error) {
+	rtt, err := s.session.Ping()
+	return rtt, toSessionError(err)
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	return s.session.NumStreams()
+}
+
+// Done returns a channel which is closed once the session has ended, either
+// by Close, the underlying connection closing or a keepalive failing.
+func (s *Session) Done() <-chan struct{} {
+	return s.session.CloseChan()
+}
+
+// IsClosed returns whether the session has ended.
+func (s *Session) IsClosed() bool {
+	return s.session.IsClosed()
+}
+
+// Close ends the session, closing all of its streams and the underlying
+// connection.
+func (s *Session) Close() error {
+	return s.session.Close()
+}
+
+func toSessionError(err error) error {
+	if errors.Is(err, yamux.ErrSessionShutdown) {
+		return ErrSessionClosed
+	}
+	return err
+}
+
+// Stream is a bidirectional stream within a Session, which implements
+// net.Conn, including deadlines.
+//
+// As in yamux, Close only closes our direction of the stream, as CloseWrite
+// does: the remote peer reads io.EOF once it has read everything sent, but
+// can keep sending. The stream is released once both sides have closed it.
+type Stream struct {
+	*yamux.Stream
+}
+
+// CloseWrite half-closes the stream, so the remote peer reads io.EOF.
+func (s *Stream) CloseWrite() error {
+	return s.Stream.Close()
+}
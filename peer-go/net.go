@@ -0,0 +1,353 @@
+package thingrtc
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+// The time allowed for a data channel accepted by a listener to open.
+const ListenOpenTimeout = 10 * time.Second
+
+// Addr is the address of one end of a data channel, as a net.Addr.
+type Addr struct {
+	PairingId string
+	Role      peerconfig.Role
+	Label     string
+}
+
+func (a Addr) Network() string {
+	return "thingrtc"
+}
+
+func (a Addr) String() string {
+	return a.PairingId + "/" + string(a.Role) + "/" + a.Label
+}
+
+func localAddr(peer Peer, label string) Addr {
+	return Addr{PairingId: peer.PairingId(), Role: peer.Role(), Label: label}
+}
+
+func remoteAddr(peer Peer, label string) Addr {
+	role := peerconfig.Initiator
+	if peer.Role() == peerconfig.Initiator {
+		role = peerconfig.Responder
+	}
+	return Addr{PairingId: peer.PairingId(), Role: role, Label: label}
+}
+
+// Listen returns a listener which accepts data channels opened by the remote
+// peer as connections, so that servers such as net/http can be run over a
+// peer. It receives every channel which is not declared or claimed by a
+// handler with a longer prefix, in place of the OnDataChannel listener, until
+// it is closed.
+func Listen(peer Peer) net.Listener {
+	return ListenWithPrefix(peer, "")
+}
+
+// ListenWithPrefix is as Listen, but only accepts data channels whose label
+// starts with prefix.
+func ListenWithPrefix(peer Peer, prefix string) net.Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	listener := &dataChannelListener{
+		peer:   peer,
+		prefix: prefix,
+		logger: peerLogger(peer),
+		conns:  make(chan net.Conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	peer.OnDataChannelWithPrefix(prefix, listener.handle)
+	return listener
+}
+
+type dataChannelListener struct {
+	peer   Peer
+	prefix string
+	logger *slog.Logger
+	conns  chan net.Conn
+	// Cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Returns the logger of peer, so that listeners log alongside it.
+func peerLogger(peer Peer) *slog.Logger {
+	if impl, ok := peer.(*peerImpl); ok {
+		return impl.logger
+	}
+	return slog.Default()
+}
+
+func (l *dataChannelListener) handle(channel DataChannel) {
+	ctx, cancel := context.WithTimeout(l.ctx, ListenOpenTimeout)
+	defer cancel()
+
+	label := channel.GetLabel()
+	stream, err := OpenDataChannelStream(ctx, channel)
+	if err != nil {
+		l.logger.Warn("could not accept data channel connection", "label", label, "error", err)
+		return
+	}
+	conn := newDataChannelConn(stream, localAddr(l.peer, label), remoteAddr(l.peer, label))
+
+	select {
+	case l.conns <- conn:
+	case <-l.ctx.Done():
+		conn.Close()
+	}
+}
+
+func (l *dataChannelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting data channels. Connections already accepted remain
+// open.
+func (l *dataChannelListener) Close() error {
+	l.peer.OnDataChannelWithPrefix(l.prefix, nil)
+	l.cancel()
+	return nil
+}
+
+func (l *dataChannelListener) Addr() net.Addr {
+	return localAddr(l.peer, l.prefix)
+}
+
+// Dial opens a reliable data channel with the given label to the remote peer,
+// and waits for it to open as a connection.
+func Dial(ctx context.Context, peer Peer, label string) (net.Conn, error) {
+	channel, err := peer.CreateDataChannel(label, true)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := OpenDataChannelStream(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	return newDataChannelConn(stream, localAddr(peer, label), remoteAddr(peer, label)), nil
+}
+
+// Adapts a DataChannelStream to a net.Conn with deadlines.
+type dataChannelConn struct {
+	stream     *DataChannelStream
+	localAddr  Addr
+	remoteAddr Addr
+
+	// Messages read from the stream in the background, so that reads can give
+	// up at their deadline without losing data. Closed once the stream ends.
+	messages      chan []byte
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	// Closed by Close.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Guards leftover, and keeps concurrent reads from interleaving.
+	readMutex sync.Mutex
+	// The unread part of the last message.
+	leftover []byte
+	// Keeps concurrent writes from interleaving.
+	writeMutex sync.Mutex
+}
+
+func newDataChannelConn(stream *DataChannelStream, local Addr, remote Addr) *dataChannelConn {
+	conn := &dataChannelConn{
+		stream:        stream,
+		localAddr:     local,
+		remoteAddr:    remote,
+		messages:      make(chan []byte),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+	go conn.readLoop()
+	return conn
+}
+
+func (c *dataChannelConn) readLoop() {
+	defer close(c.messages)
+	for {
+		message, err := c.stream.ReadMessage()
+		if err != nil {
+			return
+		}
+		select {
+		case c.messages <- message:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *dataChannelConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if len(c.leftover) == 0 {
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.leftover = message
+		case <-c.readDeadline.expired():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(p, c.leftover)
+	c.leftover = c.leftover[n:]
+	return n, nil
+}
+
+func (c *dataChannelConn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	expired := c.writeDeadline.expired()
+	select {
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	// Give up waiting for room to send at the deadline, or once closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-expired:
+		case <-c.closed:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	n, err := c.stream.write(ctx, p)
+	if err != nil && ctx.Err() != nil {
+		if c.isClosed() {
+			return n, net.ErrClosed
+		}
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *dataChannelConn) isClosed() bool {
+	return isClosed(c.closed)
+}
+
+// Close closes the underlying data channel.
+func (c *dataChannelConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.stream.Close()
+	})
+	return nil
+}
+
+func (c *dataChannelConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *dataChannelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *dataChannelConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *dataChannelConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *dataChannelConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// A deadline which can be changed while operations are waiting for it.
+type deadline struct {
+	mutex sync.Mutex
+	timer *time.Timer
+	// Closed once the deadline has passed, and replaced if it is moved into
+	// the future again.
+	passed chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{passed: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer has fired, so wait for it to close passed.
+		<-d.passed
+	}
+	d.timer = nil
+
+	passed := isClosed(d.passed)
+	if t.IsZero() {
+		if passed {
+			d.passed = make(chan struct{})
+		}
+		return
+	}
+
+	if delay := time.Until(t); delay > 0 {
+		if passed {
+			d.passed = make(chan struct{})
+		}
+		ch := d.passed
+		d.timer = time.AfterFunc(delay, func() { close(ch) })
+		return
+	}
+
+	if !passed {
+		close(d.passed)
+	}
+}
+
+// Returns a channel which is closed once the deadline passes.
+func (d *deadline) expired() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.passed
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
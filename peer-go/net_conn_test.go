@@ -0,0 +1,104 @@
+package thingrtc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+	"github.com/thingify-app/thing-rtc/peer-go/internal/testutil"
+)
+
+// Conns over pipes, which can't be used from within package thingrtc as
+// testutil imports it.
+func createPipeConns(t *testing.T) (net.Conn, net.Conn) {
+	a, b := testutil.Pipe("test")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamA, err := thingrtc.OpenDataChannelStream(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamB, err := thingrtc.OpenDataChannelStream(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connA := thingrtc.NewDataChannelConn(streamA, "test")
+	connB := thingrtc.NewDataChannelConn(streamB, "test")
+	t.Cleanup(func() {
+		connA.Close()
+		connB.Close()
+	})
+	return connA, connB
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	a, b := createPipeConns(t)
+
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := b.Read(make([]byte, 10))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("read returned after %v, before the deadline", elapsed)
+	}
+
+	// Data sent after a timeout is not lost, once the deadline is cleared.
+	a.Write([]byte("hello"))
+	b.SetReadDeadline(time.Time{})
+	buffer := make([]byte, 10)
+	n, err := b.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "hello" {
+		t.Errorf("expected hello, got %v", string(buffer[:n]))
+	}
+
+	// Moving the deadline unblocks a waiting read.
+	b.SetReadDeadline(time.Now().Add(time.Hour))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.SetReadDeadline(time.Now())
+	}()
+	if _, err := b.Read(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+}
+
+func TestConnWriteDeadline(t *testing.T) {
+	a, _ := createPipeConns(t)
+
+	a.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := a.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+
+	a.SetWriteDeadline(time.Time{})
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Errorf("expected write to succeed, got %v", err)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	a, b := createPipeConns(t)
+
+	a.Close()
+	if _, err := a.Read(make([]byte, 1)); err != net.ErrClosed {
+		t.Errorf("expected net.ErrClosed, got %v", err)
+	}
+	if _, err := a.Write([]byte("x")); err != net.ErrClosed {
+		t.Errorf("expected net.ErrClosed, got %v", err)
+	}
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package thingrtc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPOverPeer(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	listener := Listen(responder)
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %v", r.RemoteAddr)
+	}))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return Dial(ctx, initiator, "http")
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+	for i := 0; i < 3; i++ {
+		response, err := client.Get("http://device/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello pairingId/initiator/http" {
+			t.Errorf("unexpected response %v", string(body))
+		}
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	listener := ListenWithPrefix(responder, "net/")
+	if addr := listener.Addr().String(); addr != "pairingId/responder/net/" {
+		t.Errorf("unexpected listener address %v", addr)
+	}
+	listener.Close()
+
+	if _, err := listener.Accept(); err != net.ErrClosed {
+		t.Errorf("expected net.ErrClosed, got %v", err)
+	}
+
+	// Channels go to the OnDataChannel listener again.
+	received := make(chan DataChannel, 1)
+	responder.OnDataChannel(func(dataChannel DataChannel) {
+		received <- dataChannel
+	})
+	initiator.CreateDataChannel("net/test", true)
+	select {
+	case <-received:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel was not received")
+	}
+}
@@ -0,0 +1,177 @@
+package thingrtc
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+)
+
+// Option configures a Peer created with New.
+type Option func(options *peerOptions)
+
+type peerOptions struct {
+	sources            []*MediaSource
+	detachDataChannels bool
+	retryPolicy        RetryPolicy
+	iceServers         []webrtc.ICEServer
+	iceTransportPolicy webrtc.ICETransportPolicy
+	iceTimeouts        ICETimeouts
+	logger             *slog.Logger
+	dataChannels       []DataChannelConfig
+	receiveTracks      []webrtc.RTPCodecType
+}
+
+// DataChannelConfig describes a data channel declared with WithDataChannels.
+type DataChannelConfig struct {
+	Label string
+	// Whether the channel is ordered and reliable, or unordered and never
+	// retransmitted.
+	Reliable bool
+}
+
+// ICETimeouts configures how quickly ICE detects a lost connection.
+// See webrtc.SettingEngine.SetICETimeouts.
+type ICETimeouts struct {
+	// Time without network activity before the connection is considered
+	// disconnected.
+	Disconnected time.Duration
+	// Time after disconnection before the connection is considered failed,
+	// which triggers a reconnection attempt.
+	Failed time.Duration
+	// How often keepalive packets are sent when there is no other traffic.
+	KeepAlive time.Duration
+}
+
+func defaultPeerOptions() *peerOptions {
+	return &peerOptions{
+		detachDataChannels: false,
+		retryPolicy:        NewConstantRetryPolicy(time.Second),
+		iceServers: []webrtc.ICEServer{
+			{
+				URLs: []string{
+					"stun:stun1.l.google.com:19302",
+					"stun:stun2.l.google.com:19302",
+				},
+			},
+		},
+		iceTransportPolicy: webrtc.ICETransportPolicyAll,
+		iceTimeouts: ICETimeouts{
+			Disconnected: 5 * time.Second,
+			Failed:       5 * time.Second,
+			KeepAlive:    2 * time.Second,
+		},
+		logger: slog.Default(),
+	}
+}
+
+// WithMediaSources adds media sources whose tracks are sent to the peer.
+func WithMediaSources(sources ...*MediaSource) Option {
+	return func(options *peerOptions) {
+		options.sources = append(options.sources, sources...)
+	}
+}
+
+// WithDetachDataChannels sets whether data channels are created in detached
+// mode, which is required to use DataChannel.AsStream, but disables the
+// message listeners.
+func WithDetachDataChannels(detach bool) Option {
+	return func(options *peerOptions) {
+		options.detachDataChannels = detach
+	}
+}
+
+// WithRetryPolicy sets the policy deciding when to reconnect after a failed
+// connection attempt. Defaults to retrying forever every second.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(options *peerOptions) {
+		options.retryPolicy = policy
+	}
+}
+
+// WithICEServers replaces the default (public STUN) ICE servers. Use
+// NewTURNServer to add TURN servers with credentials.
+func WithICEServers(servers ...webrtc.ICEServer) Option {
+	return func(options *peerOptions) {
+		options.iceServers = servers
+	}
+}
+
+// WithICETransportPolicy restricts which ICE candidates may be used.
+// webrtc.ICETransportPolicyRelay only allows connections relayed via TURN,
+// which is useful for testing TURN configuration, or to avoid revealing local
+// addresses to the peer.
+func WithICETransportPolicy(policy webrtc.ICETransportPolicy) Option {
+	return func(options *peerOptions) {
+		options.iceTransportPolicy = policy
+	}
+}
+
+// WithICETimeouts replaces the default ICE timeouts.
+func WithICETimeouts(timeouts ICETimeouts) Option {
+	return func(options *peerOptions) {
+		options.iceTimeouts = timeouts
+	}
+}
+
+// WithLogger sets the logger used by the peer and its media sources. Defaults
+// to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(options *peerOptions) {
+		options.logger = logger
+	}
+}
+
+// WithDataChannels declares data channels which are created on every
+// connection before it is negotiated, so that they open along with the
+// connection rather than once it is established. They are delivered to the
+// OnDataChannel listener, as with channels received from the remote peer, but
+// never to an OnDataChannelWithPrefix handler.
+func WithDataChannels(channels ...DataChannelConfig) Option {
+	return func(options *peerOptions) {
+		options.dataChannels = append(options.dataChannels, channels...)
+	}
+}
+
+// WithReceiveTracks offers to receive a track of each of kinds from the remote
+// peer, delivered to OnTrack. It only applies to initiators, as a responder
+// receives whichever tracks the initiator offers.
+func WithReceiveTracks(kinds ...webrtc.RTPCodecType) Option {
+	return func(options *peerOptions) {
+		options.receiveTracks = append(options.receiveTracks, kinds...)
+	}
+}
+
+// NewTURNServer describes a TURN server authenticated with a username and
+// password. URLs take the form "turn:host:port" for UDP,
+// "turn:host:port?transport=tcp" for TCP, or "turns:host:port?transport=tcp"
+// for TLS.
+func NewTURNServer(username string, credential string, urls ...string) webrtc.ICEServer {
+	return webrtc.ICEServer{
+		URLs:           urls,
+		Username:       username,
+		Credential:     credential,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+}
+
+// Checks ICE servers up front, so that misconfiguration is reported once
+// rather than on every connection attempt.
+func validateICEServers(servers []webrtc.ICEServer) error {
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			uri, err := stun.ParseURI(url)
+			if err != nil {
+				return fmt.Errorf("invalid ICE server URL '%v': %w", url, err)
+			}
+
+			isTurn := uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS
+			if isTurn && (server.Username == "" || server.Credential == nil) {
+				return fmt.Errorf("invalid ICE server URL '%v': %w", url, webrtc.ErrNoTurnCredentials)
+			}
+		}
+	}
+	return nil
+}
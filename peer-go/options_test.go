@@ -0,0 +1,123 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	peer := New("ws://localhost", MockServerAuth{}, createTestPeerConfig()).(*peerImpl)
+
+	if peer.options.detachDataChannels {
+		t.Errorf("data channels should not be detached by default")
+	}
+	if len(peer.options.iceServers) != 1 {
+		t.Errorf("expected default STUN servers, got: %v", peer.options.iceServers)
+	}
+	if len(peer.tracks) != 0 {
+		t.Errorf("expected no tracks, got: %v", peer.tracks)
+	}
+}
+
+func TestOptionsAreApplied(t *testing.T) {
+	retryPolicy := NewConstantRetryPolicy(time.Minute)
+	iceServer := webrtc.ICEServer{URLs: []string{"stun:stun.example.com:3478"}}
+	timeouts := ICETimeouts{
+		Disconnected: time.Second,
+		Failed:       2 * time.Second,
+		KeepAlive:    3 * time.Second,
+	}
+
+	peer := New(
+		"ws://localhost",
+		MockServerAuth{},
+		createTestPeerConfig(),
+		WithDetachDataChannels(true),
+		WithRetryPolicy(retryPolicy),
+		WithICEServers(iceServer),
+		WithICETimeouts(timeouts),
+	).(*peerImpl)
+
+	if !peer.options.detachDataChannels {
+		t.Errorf("data channels should be detached")
+	}
+	if peer.options.retryPolicy != retryPolicy {
+		t.Errorf("retry policy was not applied")
+	}
+	if len(peer.options.iceServers) != 1 || peer.options.iceServers[0].URLs[0] != "stun:stun.example.com:3478" {
+		t.Errorf("ICE servers were not applied: %v", peer.options.iceServers)
+	}
+	if peer.options.iceTimeouts != timeouts {
+		t.Errorf("ICE timeouts were not applied: %v", peer.options.iceTimeouts)
+	}
+}
+
+func TestDataChannelsOption(t *testing.T) {
+	channels := []DataChannelConfig{
+		{Label: "control", Reliable: true},
+		{Label: "telemetry", Reliable: false},
+	}
+	peer := New("ws://localhost", MockServerAuth{}, createTestPeerConfig(), WithDataChannels(channels...)).(*peerImpl)
+
+	if len(peer.options.dataChannels) != 2 || peer.options.dataChannels[0] != channels[0] || peer.options.dataChannels[1] != channels[1] {
+		t.Errorf("data channels were not applied: %v", peer.options.dataChannels)
+	}
+}
+
+func TestNewPeerWithMedia(t *testing.T) {
+	peer := NewPeerWithMedia("ws://localhost", MockServerAuth{}, createTestPeerConfig(), true).(*peerImpl)
+
+	if !peer.options.detachDataChannels {
+		t.Errorf("data channels should be detached")
+	}
+	if len(peer.options.sources) != 0 {
+		t.Errorf("expected no sources, got: %v", peer.options.sources)
+	}
+}
+
+func TestTURNConfigurationIsApplied(t *testing.T) {
+	turnServer := NewTURNServer("user", "pass", "turn:turn.example.com:3478?transport=tcp", "turns:turn.example.com:5349?transport=tcp")
+	options := defaultPeerOptions()
+	WithICEServers(turnServer)(options)
+	WithICETransportPolicy(webrtc.ICETransportPolicyRelay)(options)
+
+	peerConnection, err := createPeerConnection(nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	config := peerConnection.GetConfiguration()
+	if config.ICETransportPolicy != webrtc.ICETransportPolicyRelay {
+		t.Errorf("expected relay-only transport policy, got: %v", config.ICETransportPolicy)
+	}
+	if len(config.ICEServers) != 1 || config.ICEServers[0].Username != "user" || config.ICEServers[0].Credential != "pass" {
+		t.Errorf("TURN server was not applied: %v", config.ICEServers)
+	}
+}
+
+func TestConnectRejectsTURNWithoutCredentials(t *testing.T) {
+	turnServer := webrtc.ICEServer{URLs: []string{"turn:turn.example.com:3478"}}
+	peer := New("ws://localhost", MockServerAuth{}, createTestPeerConfig(), WithICEServers(turnServer))
+	defer peer.Close()
+
+	err := peer.Connect(context.Background())
+	if !errors.Is(err, webrtc.ErrNoTurnCredentials) {
+		t.Fatalf("expected ErrNoTurnCredentials, got: %v", err)
+	}
+}
+
+func TestConnectRejectsInvalidICEServerURL(t *testing.T) {
+	iceServer := webrtc.ICEServer{URLs: []string{"http://example.com"}}
+	peer := New("ws://localhost", MockServerAuth{}, createTestPeerConfig(), WithICEServers(iceServer))
+	defer peer.Close()
+
+	err := peer.Connect(context.Background())
+	if err == nil {
+		t.Fatal("expected invalid URL to be rejected")
+	}
+}
@@ -1,7 +1,11 @@
 package thingrtc
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v3"
@@ -9,37 +13,119 @@ import (
 	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
 )
 
+var (
+	ErrPeerClosed   = errors.New("peer has been closed")
+	ErrNotConnected = errors.New("peer is not connected")
+)
+
 // Peer represents a connection (attempted or actual) to a ThingRTC peer.
 type Peer interface {
-	Connect()
+	// Connect starts attempting to connect to the peer in the background, and
+	// keeps reconnecting until ctx is cancelled or Close is called.
+	// It is a no-op if the peer is already connecting/connected.
+	Connect(ctx context.Context) error
+	// CreateDataChannel creates a data channel on the current connection,
+	// which is either ordered and reliable, or unordered and never
+	// retransmitted.
 	CreateDataChannel(label string, reliable bool) (DataChannel, error)
-	Disconnect()
+	// CreateDataChannelWithOptions creates a data channel on the current
+	// connection, configured by options.
+	CreateDataChannelWithOptions(label string, options DataChannelOptions) (DataChannel, error)
+	// DeclareDataChannel registers a data channel which is opened on every
+	// connection, now and after reconnecting, and returns a handle which
+	// remains valid for the lifetime of the peer. sendPolicy decides what
+	// happens to messages sent while the channel is not open. Closing the
+	// handle undeclares the channel.
+	DeclareDataChannel(label string, reliable bool, sendPolicy SendPolicy) (PersistentDataChannel, error)
+	// DeclareDataChannelWithOptions is as DeclareDataChannel, but configured
+	// by options. Pre-negotiated channels must be declared by both peers.
+	DeclareDataChannelWithOptions(label string, options DataChannelOptions, sendPolicy SendPolicy) (PersistentDataChannel, error)
+	// Close stops any connection attempts, tears down the current connection
+	// and closes all declared data channels, returning once all background
+	// goroutines have exited, including listeners. It must therefore not be
+	// called from within a listener. The peer cannot be connected again after
+	// it has been closed.
+	Close() error
 
-	OnConnectionStateChange(f func(connectionState int))
+	// State returns the current connection state.
+	State() ConnectionState
+	// PairingId returns the ID of the pairing this peer connects within.
+	PairingId() string
+	// Role returns whether this peer is the initiator or responder of its
+	// pairing.
+	Role() peerconfig.Role
+
+	// OnConnectionStateChange is called on every state transition, in order.
+	// reason explains why the previous connection attempt ended when moving to
+	// Reconnecting or Disconnected, and is nil otherwise.
+	OnConnectionStateChange(f func(state ConnectionState, reason error))
+	// OnDataChannel is called with data channels received from the remote
+	// peer, and those created for WithDataChannels. Channels created by
+	// CreateDataChannel are only returned from it.
 	OnDataChannel(f func(dataChannel DataChannel))
+	// OnDataChannelWithPrefix delivers data channels received from the remote
+	// peer whose label starts with prefix to f, instead of the OnDataChannel
+	// listener. This lets packages built on Peer claim their own channels. The
+	// longest matching prefix wins, and passing a nil f removes the handler.
+	OnDataChannelWithPrefix(prefix string, f func(dataChannel DataChannel))
+	// OnTrack is called with each media track received from the remote peer,
+	// on every connection. An initiator only receives tracks it has offered
+	// to, see WithReceiveTracks.
+	OnTrack(f func(track RemoteTrack))
 	OnError(f func(err error))
+	// OnRetry is called before waiting to reconnect, with the number of
+	// consecutive failed attempts so far and the delay before the next one.
+	OnRetry(f func(attempt int, delay time.Duration))
 }
 
-func NewPeer(serverUrl string, serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, detachDataChannels bool) Peer {
-	return NewPeerWithMedia(serverUrl, serverAuth, peerConfig, detachDataChannels)
-}
+// New creates a Peer which connects via the signalling server at serverUrl,
+// configured by any number of options.
+func New(serverUrl string, serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, opts ...Option) Peer {
+	options := defaultPeerOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	logger := options.logger.With("pairingId", peerConfig.PairingId, "role", peerConfig.Role)
 
-func NewPeerWithMedia(serverUrl string, serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, detachDataChannels bool, sources ...*MediaSource) Peer {
 	// Only map sources to tracks once at initialisation - otherwise we break Pion driver state.
-	codecs, tracks := sourcesToCodecsTracks(sources)
-	return &peerImpl{
-		serverUrl:          serverUrl,
-		serverAuth:         serverAuth,
-		peerConfig:         peerConfig,
-		detachDataChannels: detachDataChannels,
-		codecs:             codecs,
-		tracks:             tracks,
+	codecs, tracks := sourcesToCodecsTracks(options.sources)
+	p := &peerImpl{
+		serverUrl:  serverUrl,
+		serverAuth: serverAuth,
+		peerConfig: peerConfig,
+		options:    options,
+		codecs:     codecs,
+		tracks:     tracks,
+		logger:     logger,
+
+		declaredChannels: newDeclaredDataChannels(),
 
 		// Initialise listeners as empty functions to allow them to be optional.
-		connectionStateListener: func(connectionState int) {},
-		dataChannelListener:     func(dataChannel DataChannel) {},
-		errorListener:           func(err error) {},
+		listeners: peerListeners{
+			connectionState: func(state ConnectionState, reason error) {},
+			dataChannel:     func(dataChannel DataChannel) {},
+			prefixed:        map[string]func(dataChannel DataChannel){},
+			track:           func(track RemoteTrack) {},
+			err:             func(err error) {},
+			retry:           func(attempt int, delay time.Duration) {},
+		},
+	}
+
+	for _, source := range options.sources {
+		source.setLogger(logger)
+		remove := source.addErrorListener(func(err error) { p.goListener(func() { p.getListeners().err(err) }) })
+		p.removeErrorListeners = append(p.removeErrorListeners, remove)
 	}
+	return p
+}
+
+func NewPeer(serverUrl string, serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, detachDataChannels bool) Peer {
+	return New(serverUrl, serverAuth, peerConfig, WithDetachDataChannels(detachDataChannels))
+}
+
+func NewPeerWithMedia(serverUrl string, serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, detachDataChannels bool, sources ...*MediaSource) Peer {
+	return New(serverUrl, serverAuth, peerConfig, WithDetachDataChannels(detachDataChannels), WithMediaSources(sources...))
 }
 
 func sourcesToCodecsTracks(sources []*MediaSource) ([]*codec.Codec, []webrtc.TrackLocal) {
@@ -49,84 +135,353 @@ func sourcesToCodecsTracks(sources []*MediaSource) ([]*codec.Codec, []webrtc.Tra
 	for _, source := range sources {
 		tracks = append(tracks, source.tracks...)
 
-		if source.codec != nil {
-			codecs = append(codecs, source.codec)
-		}
+		codecs = append(codecs, source.codecs...)
 	}
 	return codecs, tracks
 }
 
 type peerImpl struct {
-	serverUrl          string
-	serverAuth         ServerAuth
-	peerConfig         *peerconfig.PeerConfig
-	detachDataChannels bool
-	codecs             []*codec.Codec
-	tracks             []webrtc.TrackLocal
-
-	peerTask  *peerTask
-	connected bool
-
-	connectionStateListener func(connectionState int)
-	dataChannelListener     func(dataChannel DataChannel)
-	errorListener           func(err error)
-}
-
-// Connection state.
-const (
-	Disconnected = iota
-	Connecting
-	Connected
-)
+	serverUrl  string
+	serverAuth ServerAuth
+	peerConfig *peerconfig.PeerConfig
+	options    *peerOptions
+	codecs     []*codec.Codec
+	tracks     []webrtc.TrackLocal
+	logger     *slog.Logger
+	// Removes our listeners from the media sources once closed.
+	removeErrorListeners []func()
+
+	declaredChannels *declaredDataChannels
+
+	// Guards all fields below.
+	mutex    sync.Mutex
+	peerTask *peerTask
+	state    ConnectionState
+	closed   bool
+	// Cancels the running connect loop, or nil if there is none.
+	cancel context.CancelFunc
+	// Closed once the running connect loop has exited.
+	done      chan struct{}
+	listeners peerListeners
+
+	// Delivers state changes to the listener in order.
+	stateExecutor serialExecutor
+
+	// Guards listenersStopped, which is set once Close has stopped starting
+	// listener goroutines.
+	listenerMutex    sync.Mutex
+	listenersStopped bool
+	// Tracks listener goroutines, so that Close can wait for them.
+	listenerWg sync.WaitGroup
+}
+
+type peerListeners struct {
+	connectionState func(state ConnectionState, reason error)
+	dataChannel     func(dataChannel DataChannel)
+	// Data channel listeners keyed by label prefix.
+	prefixed map[string]func(dataChannel DataChannel)
+	track    func(track RemoteTrack)
+	err      func(err error)
+	retry    func(attempt int, delay time.Duration)
+}
+
+func (p *peerImpl) Connect(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return ErrPeerClosed
+	}
+
+	err := validateICEServers(p.options.iceServers)
+	if err != nil {
+		return err
+	}
 
-func (p *peerImpl) Connect() {
 	// No-op if we're already connecting/connected.
-	if !p.connected {
-		p.connected = true
-		attempts := 0
-		go func() {
-			// Keep attempting to connect forever until connected is false.
-			for p.connected {
-				fmt.Printf("Attempting to connect (attempt %v)...\n", attempts)
-				attempts++
-				p.peerTask = &peerTask{
-					serverUrl: p.serverUrl,
-					codecs:    p.codecs,
-					tracks:    p.tracks,
-					// Wrap listeners so they can be dynamically updated, and run them in goroutines in case they block.
-					connectionStateListener: func(connectionState int) { go p.connectionStateListener(connectionState) },
-					dataChannelListener:     func(dataChannel DataChannel) { go p.dataChannelListener(dataChannel) },
-					errorListener:           func(err error) { go p.errorListener(err) },
-				}
-				err := p.peerTask.AttemptConnect(p.serverAuth, p.peerConfig, p.detachDataChannels)
-				if err != nil {
-					p.errorListener(err)
-				}
-				time.Sleep(time.Second)
-			}
-		}()
+	if p.cancel != nil {
+		return nil
 	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	p.cancel = cancel
+	p.done = done
+
+	go p.connectLoop(ctx, done)
+
+	return nil
+}
+
+// Keeps attempting to connect until ctx is cancelled or the retry policy gives
+// up, then tears down the current attempt and closes done.
+func (p *peerImpl) connectLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	// Consecutive failed attempts, reset whenever we successfully connect.
+	failures := 0
+	// Why we stopped, or nil if we were asked to.
+	var stopReason error
+	for ctx.Err() == nil {
+		logger := p.logger.With("attempt", failures+1)
+		logger.Info("attempting to connect")
+
+		task := &peerTask{
+			serverUrl:  p.serverUrl,
+			serverAuth: p.serverAuth,
+			peerConfig: p.peerConfig,
+			options:    p.options,
+			codecs:     p.codecs,
+			tracks:     p.tracks,
+			logger:     logger,
+
+			declaredChannels: p.declaredChannels,
+			// Wrap listeners so they can be dynamically updated, and run them in goroutines in case they block.
+			connectionStateListener: p.setState,
+			dataChannelListener: func(dataChannel DataChannel) {
+				p.goListener(func() { p.dataChannelListener(dataChannel.GetLabel())(dataChannel) })
+			},
+			configuredDataChannelListener: func(dataChannel DataChannel) {
+				p.goListener(func() { p.getListeners().dataChannel(dataChannel) })
+			},
+			trackListener: func(track RemoteTrack) { p.goListener(func() { p.getListeners().track(track) }) },
+			errorListener: func(err error) { p.goListener(func() { p.getListeners().err(err) }) },
+		}
+		p.setPeerTask(task)
+
+		err := task.AttemptConnect(ctx)
+		p.setPeerTask(nil)
+		if ctx.Err() != nil {
+			break
+		}
+
+		reason := task.endReason
+		if err != nil {
+			logger.Error("connection attempt failed", "error", err)
+			p.getListeners().err(err)
+			reason = err
+		}
+
+		if task.connected.Load() {
+			failures = 0
+		}
+		failures++
+
+		delay, retry := p.options.retryPolicy.NextDelay(failures)
+		if !retry {
+			logger.Error("giving up connecting", "failures", failures)
+			p.getListeners().err(ErrRetriesExhausted)
+			stopReason = ErrRetriesExhausted
+			break
+		}
+		logger.Info("waiting to reconnect", "failures", failures, "delay", delay, "reason", reason)
+		p.setState(Reconnecting, reason)
+		p.getListeners().retry(failures, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+
+	p.setState(Disconnected, stopReason)
+
+	// Unless we were stopped by Close, allow Connect to be called again.
+	p.mutex.Lock()
+	if p.done == done {
+		p.cancel()
+		p.cancel = nil
+		p.done = nil
+	}
+	p.mutex.Unlock()
+}
+
+func (p *peerImpl) setState(state ConnectionState, reason error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if state == p.state && reason == nil {
+		return
+	}
+	p.state = state
+	p.logger.Debug("connection state changed", "state", state, "reason", reason)
+
+	// Queue while holding the lock, so that listeners see the same order of
+	// changes as State.
+	p.stateExecutor.run(func() { p.getListeners().connectionState(state, reason) })
+}
+
+func (p *peerImpl) State() ConnectionState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state
+}
+
+func (p *peerImpl) PairingId() string {
+	return p.peerConfig.PairingId
+}
+
+func (p *peerImpl) Role() peerconfig.Role {
+	return p.peerConfig.Role
+}
+
+// Runs a listener on its own goroutine in case it blocks, unless the peer has
+// been closed.
+func (p *peerImpl) goListener(f func()) {
+	p.listenerMutex.Lock()
+	defer p.listenerMutex.Unlock()
+
+	if p.listenersStopped {
+		return
+	}
+	p.listenerWg.Add(1)
+	go func() {
+		defer p.listenerWg.Done()
+		f()
+	}()
+}
+
+func (p *peerImpl) getListeners() peerListeners {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.listeners
+}
+
+// Returns the listener for a received data channel: the handler for the
+// longest matching label prefix, or else the OnDataChannel listener.
+func (p *peerImpl) dataChannelListener(label string) func(dataChannel DataChannel) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	listener := p.listeners.dataChannel
+	longest := -1
+	for prefix, f := range p.listeners.prefixed {
+		if strings.HasPrefix(label, prefix) && len(prefix) > longest {
+			listener = f
+			longest = len(prefix)
+		}
+	}
+	return listener
+}
+
+func (p *peerImpl) setPeerTask(task *peerTask) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.peerTask = task
 }
 
 func (p *peerImpl) CreateDataChannel(label string, reliable bool) (DataChannel, error) {
-	return p.peerTask.CreateDataChannel(label, reliable)
+	return p.CreateDataChannelWithOptions(label, reliabilityOptions(reliable))
+}
+
+func (p *peerImpl) CreateDataChannelWithOptions(label string, options DataChannelOptions) (DataChannel, error) {
+	p.mutex.Lock()
+	task := p.peerTask
+	p.mutex.Unlock()
+
+	if task == nil {
+		return nil, ErrNotConnected
+	}
+	return task.CreateDataChannel(label, options)
 }
 
-func (p *peerImpl) OnConnectionStateChange(f func(connectionState int)) {
-	p.connectionStateListener = f
+func (p *peerImpl) DeclareDataChannel(label string, reliable bool, sendPolicy SendPolicy) (PersistentDataChannel, error) {
+	return p.DeclareDataChannelWithOptions(label, reliabilityOptions(reliable), sendPolicy)
+}
+
+func (p *peerImpl) DeclareDataChannelWithOptions(label string, options DataChannelOptions, sendPolicy SendPolicy) (PersistentDataChannel, error) {
+	channel, err := p.declaredChannels.declare(label, options, sendPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open it straight away if we are already connected (or connecting).
+	p.mutex.Lock()
+	task := p.peerTask
+	p.mutex.Unlock()
+
+	if task != nil {
+		task.openDeclaredChannel(channel)
+	}
+	return channel, nil
+}
+
+func (p *peerImpl) OnConnectionStateChange(f func(state ConnectionState, reason error)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.listeners.connectionState = f
 }
 
 func (p *peerImpl) OnDataChannel(f func(dataChannel DataChannel)) {
-	p.dataChannelListener = f
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.listeners.dataChannel = f
+}
+
+func (p *peerImpl) OnDataChannelWithPrefix(prefix string, f func(dataChannel DataChannel)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if f == nil {
+		delete(p.listeners.prefixed, prefix)
+	} else {
+		p.listeners.prefixed[prefix] = f
+	}
+}
+
+func (p *peerImpl) OnTrack(f func(track RemoteTrack)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.listeners.track = f
 }
 
 func (p *peerImpl) OnError(f func(err error)) {
-	p.errorListener = f
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.listeners.err = f
 }
 
-func (p *peerImpl) Disconnect() {
-	p.connected = false
-	if p.peerTask != nil {
-		p.peerTask.Disconnect()
+func (p *peerImpl) OnRetry(f func(attempt int, delay time.Duration)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.listeners.retry = f
+}
+
+func (p *peerImpl) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	for _, remove := range p.removeErrorListeners {
+		remove()
 	}
+	cancel := p.cancel
+	done := p.done
+	p.cancel = nil
+	p.done = nil
+	p.mutex.Unlock()
+
+	if cancel != nil {
+		// Cancelling the loop tears down the current peerTask, so wait for it to
+		// finish.
+		cancel()
+		<-done
+	}
+
+	// Ends any subscriptions to declared channels.
+	for _, channel := range p.declaredChannels.all() {
+		channel.Close()
+	}
+
+	p.listenerMutex.Lock()
+	p.listenersStopped = true
+	p.listenerMutex.Unlock()
+	p.listenerWg.Wait()
+	p.stateExecutor.wait()
+
+	return nil
 }
@@ -0,0 +1,402 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/thingify-app/thing-rtc/peer-go/pairing"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+var (
+	ErrPeerExists             = errors.New("a peer is already managed for this pairing")
+	ErrPeerNotFound           = errors.New("no peer is managed for this pairing")
+	ErrPeerManagerClosed      = errors.New("peer manager has been closed")
+	ErrDataChannelNotDeclared = errors.New("data channel label is not declared")
+)
+
+// PeerManager owns a Peer for each of any number of pairings, connecting each
+// as it is added and closing it as it is removed. Events from all peers are
+// delivered to the manager's listeners along with their pairingId.
+//
+// The manager sets each peer's OnConnectionStateChange, OnDataChannel and
+// OnError listeners, so they should not be replaced. Other setup, such as
+// claiming data channels by prefix, can be done in OnPeerAdded.
+type PeerManager struct {
+	serverUrl string
+	opts      []Option
+
+	// Parent of every peer's connection, cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Guards all fields below.
+	mutex     sync.Mutex
+	peers     map[string]*managedPeer
+	declared  []declaredChannel
+	listeners peerManagerListeners
+	closed    bool
+}
+
+type managedPeer struct {
+	peer     Peer
+	channels map[string]PersistentDataChannel
+}
+
+// A data channel declared on every managed peer.
+type declaredChannel struct {
+	label      string
+	options    DataChannelOptions
+	sendPolicy SendPolicy
+}
+
+type peerManagerListeners struct {
+	peerAdded       func(peer Peer)
+	peerRemoved     func(pairingId string)
+	connectionState func(pairingId string, state ConnectionState, reason error)
+	dataChannel     func(pairingId string, dataChannel DataChannel)
+	message         func(pairingId string, label string, message DataChannelMessage)
+	err             func(pairingId string, err error)
+}
+
+// NewPeerManager creates a PeerManager whose peers connect via the signalling
+// server at serverUrl, each configured by opts.
+func NewPeerManager(serverUrl string, opts ...Option) *PeerManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PeerManager{
+		serverUrl: serverUrl,
+		opts:      opts,
+		ctx:       ctx,
+		cancel:    cancel,
+		peers:     make(map[string]*managedPeer),
+
+		// Initialise listeners as empty functions to allow them to be optional.
+		listeners: peerManagerListeners{
+			peerAdded:       func(peer Peer) {},
+			peerRemoved:     func(pairingId string) {},
+			connectionState: func(pairingId string, state ConnectionState, reason error) {},
+			dataChannel:     func(pairingId string, dataChannel DataChannel) {},
+			message:         func(pairingId string, label string, message DataChannelMessage) {},
+			err:             func(pairingId string, err error) {},
+		},
+	}
+}
+
+// Add creates a peer for the pairing given by peerConfig, configured by the
+// manager's options followed by opts, and starts connecting it. It returns
+// ErrPeerExists if the pairing is already managed.
+func (m *PeerManager) Add(serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, opts ...Option) (Peer, error) {
+	pairingId := peerConfig.PairingId
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil, ErrPeerManagerClosed
+	}
+	if _, ok := m.peers[pairingId]; ok {
+		m.mutex.Unlock()
+		return nil, ErrPeerExists
+	}
+
+	peer := New(m.serverUrl, serverAuth, peerConfig, append(slices.Clone(m.opts), opts...)...)
+	managed := &managedPeer{peer: peer, channels: make(map[string]PersistentDataChannel)}
+	for _, declared := range m.declared {
+		err := m.declareOn(managed, declared)
+		if err != nil {
+			m.mutex.Unlock()
+			closeManagedPeer(managed)
+			return nil, err
+		}
+	}
+	m.peers[pairingId] = managed
+	m.mutex.Unlock()
+
+	peer.OnConnectionStateChange(func(state ConnectionState, reason error) {
+		m.getListeners().connectionState(pairingId, state, reason)
+	})
+	peer.OnDataChannel(func(dataChannel DataChannel) {
+		m.getListeners().dataChannel(pairingId, dataChannel)
+	})
+	peer.OnError(func(err error) {
+		m.getListeners().err(pairingId, err)
+	})
+	m.getListeners().peerAdded(peer)
+
+	err := peer.Connect(m.ctx)
+	if err != nil {
+		m.remove(pairingId, managed)
+		return nil, err
+	}
+	return peer, nil
+}
+
+// AddPairing adds a peer for a pairing stored by the pairing package, which
+// authenticates with the signalling server and signs messages using
+// tokenGenerator.
+func (m *PeerManager) AddPairing(tokenGenerator pairing.TokenGenerator, opts ...Option) (Peer, error) {
+	peerConfig := &peerconfig.PeerConfig{
+		PeerAuth:  tokenGenerator,
+		PairingId: tokenGenerator.GetPairingId(),
+		Role:      peerconfig.Role(tokenGenerator.GetRole()),
+	}
+	return m.Add(tokenGenerator, peerConfig, opts...)
+}
+
+// AddAllPairings adds a peer for every pairing in p which is not already
+// managed.
+func (m *PeerManager) AddAllPairings(p *pairing.Pairing, opts ...Option) error {
+	for _, pairingId := range p.GetAllPairingIds() {
+		tokenGenerator, err := p.GetTokenGenerator(pairingId)
+		if err != nil {
+			return err
+		}
+		_, err = m.AddPairing(tokenGenerator, opts...)
+		if err != nil && !errors.Is(err, ErrPeerExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove closes and forgets the peer for pairingId.
+func (m *PeerManager) Remove(pairingId string) error {
+	m.mutex.Lock()
+	managed, ok := m.peers[pairingId]
+	m.mutex.Unlock()
+	if !ok {
+		return ErrPeerNotFound
+	}
+
+	m.remove(pairingId, managed)
+	return nil
+}
+
+func (m *PeerManager) remove(pairingId string, managed *managedPeer) {
+	m.mutex.Lock()
+	if m.peers[pairingId] != managed {
+		// Already removed.
+		m.mutex.Unlock()
+		return
+	}
+	delete(m.peers, pairingId)
+	m.mutex.Unlock()
+
+	closeManagedPeer(managed)
+	m.getListeners().peerRemoved(pairingId)
+}
+
+func closeManagedPeer(managed *managedPeer) {
+	for _, channel := range managed.channels {
+		channel.Close()
+	}
+	managed.peer.Close()
+}
+
+// Peer returns the peer for pairingId, if it is managed.
+func (m *PeerManager) Peer(pairingId string) (Peer, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	managed, ok := m.peers[pairingId]
+	if !ok {
+		return nil, false
+	}
+	return managed.peer, true
+}
+
+// PairingIds returns the pairingIds of all managed peers, in sorted order.
+func (m *PeerManager) PairingIds() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pairingIds := make([]string, 0, len(m.peers))
+	for pairingId := range m.peers {
+		pairingIds = append(pairingIds, pairingId)
+	}
+	slices.Sort(pairingIds)
+	return pairingIds
+}
+
+// DeclareDataChannel declares a data channel on every managed peer, now and as
+// they are added. Messages received on it are delivered to OnMessage, and
+// Broadcast sends messages on it.
+func (m *PeerManager) DeclareDataChannel(label string, reliable bool, sendPolicy SendPolicy) error {
+	return m.DeclareDataChannelWithOptions(label, reliabilityOptions(reliable), sendPolicy)
+}
+
+// DeclareDataChannelWithOptions is as DeclareDataChannel, but configured by
+// options.
+func (m *PeerManager) DeclareDataChannelWithOptions(label string, options DataChannelOptions, sendPolicy SendPolicy) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return ErrPeerManagerClosed
+	}
+	for _, declared := range m.declared {
+		if declared.label == label {
+			return ErrDataChannelDeclared
+		}
+	}
+
+	declared := declaredChannel{label: label, options: options, sendPolicy: sendPolicy}
+	var done []*managedPeer
+	for _, managed := range m.peers {
+		err := m.declareOn(managed, declared)
+		if err != nil {
+			// Leave no peer with the channel declared.
+			for _, managed := range done {
+				managed.channels[label].Close()
+				delete(managed.channels, label)
+			}
+			return err
+		}
+		done = append(done, managed)
+	}
+	m.declared = append(m.declared, declared)
+	return nil
+}
+
+// Declares a channel on a peer, and forwards its messages to the message
+// listener. Must be called with mutex held.
+func (m *PeerManager) declareOn(managed *managedPeer, declared declaredChannel) error {
+	channel, err := managed.peer.DeclareDataChannelWithOptions(declared.label, declared.options, declared.sendPolicy)
+	if err != nil {
+		return err
+	}
+	managed.channels[declared.label] = channel
+
+	pairingId := managed.peer.PairingId()
+	subscription := channel.Subscribe(SubscribeOptions{})
+	go func() {
+		for message := range subscription.Messages() {
+			m.getListeners().message(pairingId, declared.label, message)
+		}
+	}()
+	return nil
+}
+
+// Broadcast sends a binary message on the channel declared with label to every
+// managed peer. Peers whose channel is not open are skipped, unless it was
+// declared with BufferWhileClosed, in which case the message is queued. Errors
+// sending to individual peers are joined, and do not stop the message being
+// sent to the rest.
+func (m *PeerManager) Broadcast(label string, message []byte) error {
+	return m.broadcast(label, func(channel PersistentDataChannel) error {
+		return channel.SendBinaryMessage(message)
+	})
+}
+
+// BroadcastString is as Broadcast, but sends a string message.
+func (m *PeerManager) BroadcastString(label string, message string) error {
+	return m.broadcast(label, func(channel PersistentDataChannel) error {
+		return channel.SendStringMessage(message)
+	})
+}
+
+func (m *PeerManager) broadcast(label string, send func(channel PersistentDataChannel) error) error {
+	m.mutex.Lock()
+	index := slices.IndexFunc(m.declared, func(declared declaredChannel) bool {
+		return declared.label == label
+	})
+	if index < 0 {
+		m.mutex.Unlock()
+		return ErrDataChannelNotDeclared
+	}
+	sendPolicy := m.declared[index].sendPolicy
+	channels := make(map[string]PersistentDataChannel, len(m.peers))
+	for pairingId, managed := range m.peers {
+		channels[pairingId] = managed.channels[label]
+	}
+	m.mutex.Unlock()
+
+	var errs []error
+	for pairingId, channel := range channels {
+		if sendPolicy == FailWhileClosed && !channel.IsOpen() {
+			continue
+		}
+		err := send(channel)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pairing %v: %w", pairingId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes all managed peers, returning once they have closed. The
+// manager cannot be used after it has been closed.
+func (m *PeerManager) Close() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	peers := m.peers
+	m.peers = make(map[string]*managedPeer)
+	m.mutex.Unlock()
+
+	m.cancel()
+	var wg sync.WaitGroup
+	for _, managed := range peers {
+		wg.Add(1)
+		go func(managed *managedPeer) {
+			defer wg.Done()
+			closeManagedPeer(managed)
+		}(managed)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (m *PeerManager) getListeners() peerManagerListeners {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.listeners
+}
+
+// OnPeerAdded is called with each peer as it is added, before it starts
+// connecting.
+func (m *PeerManager) OnPeerAdded(f func(peer Peer)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners.peerAdded = f
+}
+
+// OnPeerRemoved is called once a peer has been removed and closed.
+func (m *PeerManager) OnPeerRemoved(f func(pairingId string)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners.peerRemoved = f
+}
+
+// OnConnectionStateChange is called on every state transition of every peer,
+// in order for each peer.
+func (m *PeerManager) OnConnectionStateChange(f func(pairingId string, state ConnectionState, reason error)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners.connectionState = f
+}
+
+// OnDataChannel is called with data channels received from any peer which are
+// not claimed by a prefix handler or declared channel.
+func (m *PeerManager) OnDataChannel(f func(pairingId string, dataChannel DataChannel)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners.dataChannel = f
+}
+
+// OnMessage is called with each message received on channels declared by the
+// manager, in order for each peer and channel.
+func (m *PeerManager) OnMessage(f func(pairingId string, label string, message DataChannelMessage)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners.message = f
+}
+
+func (m *PeerManager) OnError(f func(pairingId string, err error)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners.err = f
+}
@@ -0,0 +1,157 @@
+package thingrtc
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+func createPairingConfig(pairingId string, role peerconfig.Role) (ServerAuth, *peerconfig.PeerConfig) {
+	config := createTestPeerConfig()
+	config.PairingId = pairingId
+	config.Role = role
+	return CreateInsecureServerAuth(pairingId, role), config
+}
+
+func TestPeerManager(t *testing.T) {
+	url := createRelayServer()
+	pairingIds := []string{"device1", "device2"}
+
+	hub := NewPeerManager(url, WithICEServers())
+	defer hub.Close()
+
+	connected := make(chan string, 10)
+	hub.OnConnectionStateChange(func(pairingId string, state ConnectionState, reason error) {
+		if state == Connected {
+			connected <- pairingId
+		}
+	})
+	received := make(chan string, 10)
+	hub.OnMessage(func(pairingId string, label string, message DataChannelMessage) {
+		received <- pairingId + ":" + label + ":" + string(message.Data)
+	})
+	removed := make(chan string, 10)
+	hub.OnPeerRemoved(func(pairingId string) {
+		removed <- pairingId
+	})
+
+	err := hub.DeclareDataChannel("events", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices := make(map[string]PersistentDataChannel)
+	for _, pairingId := range pairingIds {
+		_, err := hub.Add(createPairingConfig(pairingId, peerconfig.Initiator))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serverAuth, config := createPairingConfig(pairingId, peerconfig.Responder)
+		device := New(url, serverAuth, config, WithICEServers())
+		defer device.Close()
+		channel, err := device.DeclareDataChannel("events", true, FailWhileClosed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices[pairingId] = channel
+		channel.OnOpen(func() {
+			channel.SendStringMessage("ready")
+		})
+		err = device.Connect(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := hub.Add(createPairingConfig("device1", peerconfig.Initiator)); err != ErrPeerExists {
+		t.Errorf("expected ErrPeerExists, got %v", err)
+	}
+	if ids := hub.PairingIds(); !slices.Equal(ids, pairingIds) {
+		t.Errorf("expected pairingIds %v, got %v", pairingIds, ids)
+	}
+
+	var connectedIds, receivedMessages []string
+	for len(connectedIds) < 2 || len(receivedMessages) < 2 {
+		select {
+		case pairingId := <-connected:
+			connectedIds = append(connectedIds, pairingId)
+		case message := <-received:
+			receivedMessages = append(receivedMessages, message)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out, connected to %v and received %v", connectedIds, receivedMessages)
+		}
+	}
+	slices.Sort(connectedIds)
+	slices.Sort(receivedMessages)
+	if !slices.Equal(connectedIds, pairingIds) {
+		t.Errorf("expected %v to connect, got %v", pairingIds, connectedIds)
+	}
+	expected := []string{"device1:events:ready", "device2:events:ready"}
+	if !slices.Equal(receivedMessages, expected) {
+		t.Errorf("expected messages %v, got %v", expected, receivedMessages)
+	}
+
+	err = hub.BroadcastString("events", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pairingId, channel := range devices {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		message, err := channel.Recv(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%v did not receive broadcast: %v", pairingId, err)
+		}
+		if string(message.Data) != "hello" {
+			t.Errorf("expected hello, got %v", string(message.Data))
+		}
+	}
+
+	if err := hub.Broadcast("undeclared", []byte("hello")); err != ErrDataChannelNotDeclared {
+		t.Errorf("expected ErrDataChannelNotDeclared, got %v", err)
+	}
+
+	peer, _ := hub.Peer("device1")
+	err = hub.Remove("device1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairingId := <-removed; pairingId != "device1" {
+		t.Errorf("expected device1 to be removed, got %v", pairingId)
+	}
+	if peer.State() != Disconnected {
+		t.Errorf("expected removed peer to be disconnected, got %v", peer.State())
+	}
+	if _, ok := hub.Peer("device1"); ok {
+		t.Error("expected device1 to no longer be managed")
+	}
+	if err := hub.Remove("device1"); err != ErrPeerNotFound {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+	if ids := hub.PairingIds(); !slices.Equal(ids, []string{"device2"}) {
+		t.Errorf("expected only device2, got %v", ids)
+	}
+}
+
+func TestPeerManagerClose(t *testing.T) {
+	hub := NewPeerManager(createRelayServer(), WithICEServers())
+	peer, err := hub.Add(createPairingConfig("device", peerconfig.Initiator))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.Close()
+	if peer.State() != Disconnected {
+		t.Errorf("expected peer to be disconnected, got %v", peer.State())
+	}
+	if _, err := hub.Add(createPairingConfig("other", peerconfig.Initiator)); err != ErrPeerManagerClosed {
+		t.Errorf("expected ErrPeerManagerClosed, got %v", err)
+	}
+	if err := hub.DeclareDataChannel("events", true, FailWhileClosed); err != ErrPeerManagerClosed {
+		t.Errorf("expected ErrPeerManagerClosed, got %v", err)
+	}
+}
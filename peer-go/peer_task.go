@@ -1,9 +1,13 @@
 package thingrtc
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"time"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pion/webrtc/v3"
 
@@ -14,56 +18,113 @@ import (
 const DEFAULT_DATA_CHANNEL_NAME = "default"
 
 type peerTask struct {
-	serverUrl string
-	codecs    []*codec.Codec
-	tracks    []webrtc.TrackLocal
-
+	serverUrl  string
+	serverAuth ServerAuth
+	peerConfig *peerconfig.PeerConfig
+	options    *peerOptions
+	codecs     []*codec.Codec
+	tracks     []webrtc.TrackLocal
+	logger     *slog.Logger
+	// Data channels declared on the Peer, to be opened on this connection.
+	declaredChannels *declaredDataChannels
+
+	// Guards server, peerConnection, dataChannels and attachedChannels, which
+	// are only set once per attempt and are not reset on disconnection.
+	mutex          sync.Mutex
 	server         *SignallingServer
 	peerConnection *webrtc.PeerConnection
 	dataChannels   []DataChannel
-
-	connectionStateListener func(connectionState int)
-	dataChannelListener     func(dataChannel DataChannel)
-	errorListener           func(err error)
+	// Declared data channels which have been attached to this connection.
+	attachedChannels map[*persistentDataChannel]bool
+	// Whether the peer connection was ever established.
+	connected atomic.Bool
+	// Whether ICE has started checking connectivity, after which the
+	// signalling server is no longer needed.
+	iceChecking atomic.Bool
+	// Why the connection attempt ended, if it ended by itself.
+	endReason error
+
+	connectionStateListener func(state ConnectionState, reason error)
+	// Called with data channels received from the remote peer.
+	dataChannelListener func(dataChannel DataChannel)
+	// Called with the data channels created for WithDataChannels.
+	configuredDataChannelListener func(dataChannel DataChannel)
+	trackListener                 func(track RemoteTrack)
+	errorListener                 func(err error)
 }
 
-// Attempts to connect to a peer once, and blocks until the connection fails for any reason.
-// Must not be called again on the same instance.
-func (p *peerTask) AttemptConnect(serverAuth ServerAuth, peerConfig *peerconfig.PeerConfig, detachDataChannels bool) error {
-	serverFailed := make(chan interface{})
-	peerConnectionFailed := make(chan interface{})
-	peerConnectionSuccess := make(chan interface{})
-
-	server := NewSignallingServer(p.serverUrl, serverAuth, peerConfig.PeerAuth)
-	peerConnection, err := createPeerConnection(p.codecs, detachDataChannels)
+// Attempts to connect to a peer once, and blocks until the connection fails
+// for any reason or ctx is cancelled. All resources are released before
+// returning. Returns an error only if the attempt could not be started - the
+// reason an attempt ended is recorded in endReason. Must not be called again
+// on the same instance.
+func (p *peerTask) AttemptConnect(ctx context.Context) error {
+	// Buffered so that listeners firing after we stop waiting never block.
+	failed := make(chan error, 1)
+	peerConnectionSuccess := make(chan interface{}, 1)
+
+	server := NewSignallingServer(p.serverUrl, p.serverAuth, p.peerConfig.PeerAuth)
+	server.Logger = p.logger
+	peerConnection, err := createPeerConnection(p.codecs, p.options)
 	if err != nil {
 		return err
 	}
 
+	p.mutex.Lock()
 	p.server = &server
 	p.peerConnection = peerConnection
+	p.mutex.Unlock()
+	defer p.Disconnect()
 
+	// The other peer leaves the signalling server as soon as it has connected,
+	// which may be before we have, so once ICE is checking we leave it to ICE
+	// to decide whether the attempt has failed.
 	server.OnError(func(err error) {
-		fmt.Printf("Server error: %v\n", err)
-		serverFailed <- nil
+		if p.iceChecking.Load() {
+			p.logger.Debug("signalling server disconnected while ICE checking", "error", err)
+			return
+		}
+		p.logger.Warn("signalling server failed", "error", err)
+		notifyError(failed, fmt.Errorf("%w: %w", ErrSignallingFailed, err))
+	})
+
+	server.OnPeerDisconnect(func() {
+		if p.iceChecking.Load() {
+			p.logger.Debug("peer left the signalling server while ICE checking")
+			return
+		}
+		p.logger.Info("peer left the signalling server")
+		notifyError(failed, ErrPeerDisconnected)
+	})
+
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateChecking && !p.connected.Load() {
+			p.iceChecking.Store(true)
+			p.connectionStateListener(IceChecking, nil)
+		}
 	})
 
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		if state == webrtc.PeerConnectionStateConnected {
-			fmt.Printf("Peer connected.\n")
-			peerConnectionSuccess <- nil
-		} else if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
-			fmt.Printf("Peer failed.\n")
-			peerConnectionFailed <- nil
+		p.logger.Debug("peer connection state changed", "state", state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			p.logger.Info("peer connected")
+			notify(peerConnectionSuccess)
+		case webrtc.PeerConnectionStateFailed:
+			p.logger.Info("peer connection failed")
+			notifyError(failed, ErrIceFailed)
+		case webrtc.PeerConnectionStateClosed:
+			p.logger.Info("peer connection closed")
+			notifyError(failed, ErrPeerDisconnected)
 		}
 	})
 
-	err = p.setupListeners(string(peerConfig.Role))
+	err = p.setupListeners(string(p.peerConfig.Role))
 	if err != nil {
 		return err
 	}
 
-	p.connectionStateListener(Connecting)
+	p.connectionStateListener(SignallingConnecting, nil)
 
 	server.Connect()
 
@@ -71,90 +132,184 @@ func (p *peerTask) AttemptConnect(serverAuth ServerAuth, peerConfig *peerconfig.
 	select {
 	case <-peerConnectionSuccess:
 		// After the peer connection is established, disconnect from the signalling server.
-		server.Disconnect()
-		p.server = nil
-		p.connectionStateListener(Connected)
+		p.disconnectServer()
+		p.connected.Store(true)
+		p.connectionStateListener(Connected, nil)
 		// Now block until the peer connection fails.
-		<-peerConnectionFailed
-	case <-serverFailed:
-		p.Disconnect()
-	case <-peerConnectionFailed:
-		// Only disconnect from the server if the peer failed (don't try to disconnect the peer).
-		server.Disconnect()
-		p.server = nil
+		select {
+		case p.endReason = <-failed:
+		case <-ctx.Done():
+		}
+	case p.endReason = <-failed:
+	case <-ctx.Done():
 	}
 
-	p.connectionStateListener(Disconnected)
-
 	return nil
 }
 
-func (p *peerTask) CreateDataChannel(label string, reliable bool) (DataChannel, error) {
-	channelConfig := webrtc.DataChannelInit{}
-	if reliable {
-		ordered := true
-		channelConfig.Ordered = &ordered
-	} else {
-		ordered := false
-		maxRetransmits := uint16(0)
-		channelConfig.Ordered = &ordered
-		channelConfig.MaxRetransmits = &maxRetransmits
+// Sends a notification on a buffered channel without blocking if one is
+// already pending.
+func notify(c chan interface{}) {
+	select {
+	case c <- nil:
+	default:
+	}
+}
+
+// As notify, but sends an error. Only the first error sent is kept.
+func notifyError(c chan error, err error) {
+	select {
+	case c <- err:
+	default:
+	}
+}
+
+func (p *peerTask) CreateDataChannel(label string, options DataChannelOptions) (DataChannel, error) {
+	init, err := options.toInit()
+	if err != nil {
+		return nil, err
 	}
 
-	dataChannel, err := p.peerConnection.CreateDataChannel(label, &channelConfig)
+	p.mutex.Lock()
+	peerConnection := p.peerConnection
+	p.mutex.Unlock()
+
+	if peerConnection == nil {
+		return nil, ErrNotConnected
+	}
+
+	dataChannel, err := peerConnection.CreateDataChannel(label, init)
 	if err != nil {
 		return nil, err
 	}
 
+	return p.addDataChannel(dataChannel), nil
+}
+
+// Opens a declared data channel on this connection, unless it has already
+// been attached or the connection has not been created yet (in which case
+// setupCommon will open it).
+func (p *peerTask) openDeclaredChannel(channel *persistentDataChannel) {
+	p.mutex.Lock()
+	peerConnection := p.peerConnection
+	if peerConnection == nil || !p.markAttached(channel) {
+		p.mutex.Unlock()
+		return
+	}
+	p.mutex.Unlock()
+
+	// Options were validated when the channel was declared.
+	init, err := channel.options.toInit()
+	if err != nil {
+		p.errorListener(err)
+		return
+	}
+	dataChannel, err := peerConnection.CreateDataChannel(channel.label, init)
+	if err != nil {
+		p.logger.Warn("failed to open declared data channel", "label", channel.label, "error", err)
+		p.errorListener(err)
+		return
+	}
+	channel.attach(dataChannel)
+}
+
+// Records that channel is attached to this connection, returning false if it
+// already was. Must be called with the mutex held.
+func (p *peerTask) markAttached(channel *persistentDataChannel) bool {
+	if p.attachedChannels[channel] {
+		return false
+	}
+	if p.attachedChannels == nil {
+		p.attachedChannels = make(map[*persistentDataChannel]bool)
+	}
+	p.attachedChannels[channel] = true
+	return true
+}
+
+func (p *peerTask) addDataChannel(dataChannel *webrtc.DataChannel) DataChannel {
 	wrapped := createDataChannelWrapper(dataChannel)
+
+	p.mutex.Lock()
 	p.dataChannels = append(p.dataChannels, wrapped)
-	p.dataChannelListener(wrapped)
+	p.mutex.Unlock()
 
-	return wrapped, nil
+	return wrapped
 }
 
+// Tears down the signalling server connection and the peer connection,
+// waiting for their goroutines to exit. Safe to call more than once.
 func (p *peerTask) Disconnect() {
-	fmt.Printf("peerTask disconnecting...\n")
-	if p.server != nil {
-		p.server.Disconnect()
+	p.disconnectServer()
+
+	p.mutex.Lock()
+	peerConnection := p.peerConnection
+	attachedChannels := p.attachedChannels
+	p.dataChannels = nil
+	p.attachedChannels = nil
+	p.mutex.Unlock()
+
+	if peerConnection != nil {
+		p.logger.Debug("closing peer connection")
+		peerConnection.Close()
 	}
-	if p.peerConnection != nil {
-		p.peerConnection.Close()
+
+	// Declared channels outlive this connection, so release them for the next.
+	for channel := range attachedChannels {
+		channel.detachAll()
 	}
-	p.server = nil
-	p.peerConnection = nil
-	p.dataChannels = nil
 }
 
-func createPeerConnection(codecs []*codec.Codec, detachDataChannels bool) (*webrtc.PeerConnection, error) {
+func (p *peerTask) disconnectServer() {
+	p.mutex.Lock()
+	server := p.server
+	p.mutex.Unlock()
+
+	if server != nil {
+		server.Disconnect()
+	}
+}
+
+// Returns the distinct kinds of tracks, in the order they first appear.
+func trackKinds(tracks []webrtc.TrackLocal) []webrtc.RTPCodecType {
+	var kinds []webrtc.RTPCodecType
+	for _, track := range tracks {
+		if !slices.Contains(kinds, track.Kind()) {
+			kinds = append(kinds, track.Kind())
+		}
+	}
+	return kinds
+}
+
+func createPeerConnection(codecs []*codec.Codec, options *peerOptions) (*webrtc.PeerConnection, error) {
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{
-					"stun:stun1.l.google.com:19302",
-					"stun:stun2.l.google.com:19302",
-				},
-			},
-		},
+		ICEServers:         options.iceServers,
+		ICETransportPolicy: options.iceTransportPolicy,
 	}
 
 	settingEngine := webrtc.SettingEngine{}
-	settingEngine.SetICETimeouts(5*time.Second, 5*time.Second, 2*time.Second)
+	timeouts := options.iceTimeouts
+	settingEngine.SetICETimeouts(timeouts.Disconnected, timeouts.Failed, timeouts.KeepAlive)
 
-	if detachDataChannels {
+	if options.detachDataChannels {
 		// Required to allow us to "detach" a ReadWriteCloser from data channels.
 		settingEngine.DetachDataChannels()
 	}
 
 	mediaEngine := webrtc.MediaEngine{}
 
-	if len(codecs) == 0 {
-		// Need to register defaults if we have no codecs specified (i.e. we are
-		// using RTSP where the encoder is remote).
-		err := mediaEngine.RegisterDefaultCodecs()
-		if err != nil {
-			return nil, err
-		}
+	// Registered whatever our own encoders are, so that we can receive any
+	// codec from the remote peer. Encoder codecs with the same payload types as
+	// the defaults are ignored by the media engine.
+	err := mediaEngine.RegisterDefaultCodecs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Not one of pion's defaults, but needed to send H265 from cameras and
+	// files, including alongside locally encoded tracks, and to receive it.
+	err = mediaEngine.RegisterCodec(h265Codec, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, codec := range codecs {
@@ -188,18 +343,33 @@ func (p *peerTask) setupListeners(role string) error {
 
 func (p *peerTask) setupCommon() error {
 	p.peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil && p.server != nil {
+		// Sending fails harmlessly once we have disconnected from the server.
+		if candidate != nil {
 			p.server.SendIceCandidate(candidate.ToJSON())
 		}
 	})
 
 	p.peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
 		// Do not expose the default data channel to users.
-		if dc.Label() != DEFAULT_DATA_CHANNEL_NAME {
-			wrapped := createDataChannelWrapper(dc)
-			p.dataChannels = append(p.dataChannels, wrapped)
-			p.dataChannelListener(wrapped)
+		if dc.Label() == DEFAULT_DATA_CHANNEL_NAME {
+			return
+		}
+
+		// Deliver channels matching a declared label to its handle instead.
+		if channel := p.declaredChannels.get(dc.Label()); channel != nil {
+			p.mutex.Lock()
+			p.markAttached(channel)
+			p.mutex.Unlock()
+			channel.attach(dc)
+			return
 		}
+
+		p.dataChannelListener(p.addDataChannel(dc))
+	})
+
+	p.peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		p.logger.Info("remote track received", "kind", track.Kind(), "codec", track.Codec().MimeType)
+		p.trackListener(newRemoteTrack(track, receiver, p.peerConnection))
 	})
 
 	p.server.OnIceCandidate(func(candidate webrtc.ICECandidateInit) {
@@ -209,7 +379,9 @@ func (p *peerTask) setupCommon() error {
 		}
 	})
 
-	p.server.OnPeerDisconnect(func() {})
+	p.server.OnConnect(func() {
+		p.connectionStateListener(WaitingForPeer, nil)
+	})
 
 	for _, track := range p.tracks {
 		_, err := p.peerConnection.AddTrack(track)
@@ -217,13 +389,42 @@ func (p *peerTask) setupCommon() error {
 			return err
 		}
 	}
+
+	for _, channel := range p.options.dataChannels {
+		dataChannel, err := p.CreateDataChannel(channel.Label, reliabilityOptions(channel.Reliable))
+		if err != nil {
+			return err
+		}
+		p.configuredDataChannelListener(dataChannel)
+	}
+
+	for _, channel := range p.declaredChannels.all() {
+		p.openDeclaredChannel(channel)
+	}
 	return nil
 }
 
 func (p *peerTask) setupInitiator() error {
 	p.server.OnPeerConnect(func() {
-		if len(p.tracks) > 0 {
-			p.peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo)
+		p.connectionStateListener(Negotiating, nil)
+
+		// Offer a transceiver of each kind we send, so that the responder can
+		// send its own media back, e.g. for two-way audio.
+		for _, kind := range trackKinds(p.tracks) {
+			_, err := p.peerConnection.AddTransceiverFromKind(kind)
+			if err != nil {
+				p.errorListener(err)
+				return
+			}
+		}
+		for _, kind := range p.options.receiveTracks {
+			_, err := p.peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			})
+			if err != nil {
+				p.errorListener(err)
+				return
+			}
 		}
 
 		offer, err := p.peerConnection.CreateOffer(nil)
@@ -255,6 +456,10 @@ func (p *peerTask) setupInitiator() error {
 }
 
 func (p *peerTask) setupResponder() {
+	p.server.OnPeerConnect(func() {
+		p.connectionStateListener(Negotiating, nil)
+	})
+
 	p.server.OnOffer(func(offer webrtc.SessionDescription) {
 		err := p.peerConnection.SetRemoteDescription(offer)
 		if err != nil {
@@ -0,0 +1,179 @@
+package thingrtc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+func TestCloseDisconnectsFromServer(t *testing.T) {
+	peer, serverClosed := createTestPeer()
+
+	err := peer.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForServerConnection(t, serverClosed)
+
+	err = peer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-serverClosed:
+		// Continue
+	case <-time.After(time.Second):
+		t.Fatal("server connection was not closed")
+	}
+
+	err = peer.Connect(context.Background())
+	if err != ErrPeerClosed {
+		t.Fatalf("expected ErrPeerClosed after Close, got: %v", err)
+	}
+}
+
+func TestCancelledContextDisconnectsFromServer(t *testing.T) {
+	peer, serverClosed := createTestPeer()
+	defer peer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := peer.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForServerConnection(t, serverClosed)
+	cancel()
+
+	select {
+	case <-serverClosed:
+		// Continue
+	case <-time.After(time.Second):
+		t.Fatal("server connection was not closed")
+	}
+
+	// A peer stopped by its context can be connected again.
+	err = peer.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWithoutConnect(t *testing.T) {
+	peer, _ := createTestPeer()
+
+	err := peer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateDataChannelWhenNotConnected(t *testing.T) {
+	peer, _ := createTestPeer()
+	defer peer.Close()
+
+	_, err := peer.CreateDataChannel("test", true)
+	if err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got: %v", err)
+	}
+}
+
+func TestCloseWaitsForListeners(t *testing.T) {
+	source := newMediaSource(nil)
+	peer := New(createRelayServer(), MockServerAuth{}, createTestPeerConfig(), WithMediaSources(source))
+	called := make(chan interface{})
+	release := make(chan interface{})
+	peer.OnError(func(err error) {
+		close(called)
+		<-release
+	})
+	source.reportError(ErrRtspFailed)
+	<-called
+
+	closed := make(chan interface{})
+	go func() {
+		peer.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a listener was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Close")
+	}
+}
+
+func TestCloseEndsDeclaredChannels(t *testing.T) {
+	peer, _ := createTestPeer()
+	channel, err := peer.DeclareDataChannel("declared", true, BufferWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ended := make(chan interface{})
+	go func() {
+		for range channel.Messages() {
+		}
+		close(ended)
+	}()
+
+	peer.Close()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("messages of declared channel did not end")
+	}
+}
+
+// Creates a peer pointing at a server which accepts connections and waits for
+// them to be closed. Each connection sends nil on the returned channel once
+// established, and again once closed.
+func createTestPeer() (Peer, <-chan interface{}) {
+	serverEvents := make(chan interface{}, 10)
+	server := createWebsocketServer(func(conn *websocket.Conn) {
+		serverEvents <- nil
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		serverEvents <- nil
+	})
+	url := strings.Replace(server.URL, "http", "ws", 1)
+
+	peer := NewPeer(url, MockServerAuth{Token: "token"}, createTestPeerConfig(), false)
+
+	return peer, serverEvents
+}
+
+func createTestPeerConfig() *peerconfig.PeerConfig {
+	return &peerconfig.PeerConfig{
+		PeerAuth: MockPeerAuth{
+			Nonce:        "nonce",
+			Signature:    "signature",
+			VerifyResult: true,
+		},
+		PairingId: "pairingId",
+		Role:      peerconfig.Responder,
+	}
+}
+
+func waitForServerConnection(t *testing.T, serverEvents <-chan interface{}) {
+	select {
+	case <-serverEvents:
+		// Continue
+	case <-time.After(time.Second):
+		t.Fatal("peer did not connect to server")
+	}
+}
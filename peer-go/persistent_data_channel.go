@@ -0,0 +1,460 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/thingify-app/thing-rtc/peer-go/internal/queue"
+)
+
+// SendPolicy decides what happens to messages sent on a PersistentDataChannel
+// while it is not open, e.g. while the peer is reconnecting.
+type SendPolicy int
+
+const (
+	// Sending while the channel is not open fails with ErrDataChannelClosed.
+	FailWhileClosed SendPolicy = iota
+	// Messages sent while the channel is not open are queued (up to
+	// MaxBufferedMessages) and sent in order once it reopens.
+	BufferWhileClosed
+)
+
+// The maximum number of messages queued by BufferWhileClosed. Sending further
+// messages fails with ErrSendBufferFull.
+const MaxBufferedMessages = 1024
+
+var (
+	ErrDataChannelDeclared = errors.New("data channel label is already declared")
+	ErrSendBufferFull      = errors.New("too many messages buffered while data channel is closed")
+)
+
+// PersistentDataChannel is a DataChannel declared on a Peer, which is
+// transparently re-created on every new connection, so the same handle can be
+// used for the lifetime of the Peer. Listeners are kept across reconnections.
+//
+// The channel is opened by whichever peer declares it. If the remote peer opens
+// a channel with the same label, messages received on it are also delivered to
+// this handle rather than to Peer.OnDataChannel, so both sides may declare the
+// same label.
+type PersistentDataChannel interface {
+	DataChannel
+
+	// IsOpen returns whether the channel is currently open.
+	IsOpen() bool
+	// OnReopen is called each time the channel opens on a new connection,
+	// including the first. It is equivalent to OnOpen, and OnClose is called
+	// each time the connection is lost.
+	OnReopen(f func())
+}
+
+type bufferedMessage struct {
+	data     []byte
+	isString bool
+}
+
+type persistentDataChannel struct {
+	queue.Receiver
+
+	label        string
+	options      DataChannelOptions
+	sendPolicy   SendPolicy
+	undeclare    func()
+	backpressure *backpressure
+
+	mutex sync.Mutex
+	// Channels with our label on the current connection, and the open one we
+	// send on.
+	attached  []*webrtc.DataChannel
+	current   *webrtc.DataChannel
+	buffer    []bufferedMessage
+	closed    bool
+	threshold uint64
+	listeners dataChannelListeners
+}
+
+func newPersistentDataChannel(label string, options DataChannelOptions, sendPolicy SendPolicy, undeclare func()) *persistentDataChannel {
+	return &persistentDataChannel{
+		label:        label,
+		options:      options,
+		sendPolicy:   sendPolicy,
+		undeclare:    undeclare,
+		backpressure: newBackpressure(),
+		threshold:    DefaultBufferedAmountLowThreshold,
+		listeners:    emptyDataChannelListeners(),
+	}
+}
+
+// Attaches a channel from the current connection, either created by us or
+// received from the remote peer.
+func (dc *persistentDataChannel) attach(dataChannel *webrtc.DataChannel) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	if dc.closed {
+		dataChannel.Close()
+		return
+	}
+	dc.attached = append(dc.attached, dataChannel)
+	dataChannel.SetBufferedAmountLowThreshold(dc.threshold)
+
+	dataChannel.OnOpen(func() {
+		dc.opened(dataChannel)
+	})
+
+	dataChannel.OnClose(func() {
+		dc.detach(dataChannel)
+	})
+
+	dataChannel.OnError(func(err error) {
+		dc.getListeners().err(err)
+	})
+
+	dataChannel.OnBufferedAmountLow(func() {
+		dc.backpressure.notify()
+		dc.getListeners().bufferedAmountLow()
+	})
+
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !dc.Dispatcher.Deliver(DataChannelMessage{Data: msg.Data, IsString: msg.IsString}) {
+			dc.getListeners().err(ErrMessageDropped)
+		}
+	})
+}
+
+func (dc *persistentDataChannel) getListeners() dataChannelListeners {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return dc.listeners
+}
+
+func (dc *persistentDataChannel) opened(dataChannel *webrtc.DataChannel) {
+	dc.mutex.Lock()
+	if dc.current != nil || !dc.isAttached(dataChannel) {
+		dc.mutex.Unlock()
+		return
+	}
+	dc.current = dataChannel
+
+	var flushErr error
+	buffer := dc.buffer
+	dc.buffer = nil
+	for _, message := range buffer {
+		err := dc.sendLocked(message)
+		if err != nil && flushErr == nil {
+			flushErr = err
+		}
+	}
+
+	listeners := dc.listeners
+	dc.mutex.Unlock()
+
+	listeners.open()
+	if flushErr != nil {
+		listeners.err(flushErr)
+	}
+}
+
+func (dc *persistentDataChannel) isAttached(dataChannel *webrtc.DataChannel) bool {
+	for _, attached := range dc.attached {
+		if attached == dataChannel {
+			return true
+		}
+	}
+	return false
+}
+
+func (dc *persistentDataChannel) detach(dataChannel *webrtc.DataChannel) {
+	dc.mutex.Lock()
+	for i, attached := range dc.attached {
+		if attached == dataChannel {
+			dc.attached = append(dc.attached[:i], dc.attached[i+1:]...)
+			break
+		}
+	}
+
+	lost := false
+	if dc.current == dataChannel {
+		dc.current = nil
+		// Fall back to another open channel with our label, if there is one.
+		for _, attached := range dc.attached {
+			if attached.ReadyState() == webrtc.DataChannelStateOpen {
+				dc.current = attached
+				break
+			}
+		}
+		lost = dc.current == nil
+	}
+	listeners := dc.listeners
+	dc.mutex.Unlock()
+
+	// Wake up any blocked senders, so they apply the send policy.
+	dc.backpressure.notify()
+	if lost {
+		listeners.close()
+	}
+}
+
+// Detaches all channels, when their connection has ended.
+func (dc *persistentDataChannel) detachAll() {
+	dc.mutex.Lock()
+	lost := dc.current != nil
+	dc.attached = nil
+	dc.current = nil
+	listeners := dc.listeners
+	dc.mutex.Unlock()
+
+	dc.backpressure.notify()
+	if lost {
+		listeners.close()
+	}
+}
+
+func (dc *persistentDataChannel) send(message bufferedMessage) error {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return dc.sendLocked(message)
+}
+
+func (dc *persistentDataChannel) sendLocked(message bufferedMessage) error {
+	if dc.closed {
+		return ErrDataChannelClosed
+	}
+
+	if dc.current == nil {
+		if dc.sendPolicy != BufferWhileClosed {
+			return ErrDataChannelClosed
+		}
+		if len(dc.buffer) >= MaxBufferedMessages {
+			return ErrSendBufferFull
+		}
+		dc.buffer = append(dc.buffer, message)
+		return nil
+	}
+
+	var err error
+	if message.isString {
+		err = dc.current.SendText(string(message.data))
+	} else {
+		err = dc.current.Send(message.data)
+	}
+	if errors.Is(err, io.ErrClosedPipe) {
+		// The connection is being torn down.
+		return ErrDataChannelClosed
+	}
+	return err
+}
+
+func (dc *persistentDataChannel) SendStringMessage(message string) error {
+	return dc.send(bufferedMessage{[]byte(message), true})
+}
+
+func (dc *persistentDataChannel) SendBinaryMessage(message []byte) error {
+	return dc.send(bufferedMessage{message, false})
+}
+
+// Send waits for room on the current connection. If there is none, or it is
+// lost while waiting, the send policy applies instead.
+func (dc *persistentDataChannel) Send(ctx context.Context, message []byte) error {
+	dc.mutex.Lock()
+	current := dc.current
+	dc.mutex.Unlock()
+
+	if current != nil {
+		err := dc.backpressure.wait(ctx, current)
+		if err != nil && err != ErrDataChannelClosed {
+			return err
+		}
+	}
+
+	return dc.send(bufferedMessage{message, false})
+}
+
+func (dc *persistentDataChannel) OnStringMessage(listener func(message string)) {
+	dc.mutex.Lock()
+	dc.listeners.stringMessage = listener
+	dc.mutex.Unlock()
+
+	dc.StartListeners(messageListener(dc.getListeners))
+}
+
+func (dc *persistentDataChannel) OnBinaryMessage(listener func(message []byte)) {
+	dc.mutex.Lock()
+	dc.listeners.binaryMessage = listener
+	dc.mutex.Unlock()
+
+	dc.StartListeners(messageListener(dc.getListeners))
+}
+
+func (dc *persistentDataChannel) OnOpen(listener func()) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.open = listener
+
+	if dc.current != nil {
+		go listener()
+	}
+}
+
+func (dc *persistentDataChannel) OnReopen(listener func()) {
+	dc.OnOpen(listener)
+}
+
+func (dc *persistentDataChannel) OnClose(listener func()) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.close = listener
+}
+
+func (dc *persistentDataChannel) OnError(listener func(err error)) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.err = listener
+}
+
+func (dc *persistentDataChannel) BufferedAmount() uint64 {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	if dc.current == nil {
+		return 0
+	}
+	return dc.current.BufferedAmount()
+}
+
+func (dc *persistentDataChannel) BufferedAmountLowThreshold() uint64 {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return dc.threshold
+}
+
+// SetBufferedAmountLowThreshold applies to the current connection and all
+// future ones.
+func (dc *persistentDataChannel) SetBufferedAmountLowThreshold(threshold uint64) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	dc.threshold = threshold
+	for _, attached := range dc.attached {
+		attached.SetBufferedAmountLowThreshold(threshold)
+	}
+}
+
+func (dc *persistentDataChannel) OnBufferedAmountLow(listener func()) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.listeners.bufferedAmountLow = listener
+}
+
+func (dc *persistentDataChannel) IsOpen() bool {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	return dc.current != nil
+}
+
+func (dc *persistentDataChannel) GetLabel() string {
+	return dc.label
+}
+
+func (dc *persistentDataChannel) Options() DataChannelOptions {
+	return dc.options
+}
+
+func (dc *persistentDataChannel) Protocol() string {
+	return dc.options.Protocol
+}
+
+// Close closes the channel on the current connection and undeclares it, so it
+// is not re-created on future connections.
+func (dc *persistentDataChannel) Close() {
+	dc.mutex.Lock()
+	if dc.closed {
+		dc.mutex.Unlock()
+		return
+	}
+	dc.closed = true
+	attached := dc.attached
+	dc.attached = nil
+	dc.current = nil
+	dc.buffer = nil
+	dc.mutex.Unlock()
+
+	dc.undeclare()
+	dc.backpressure.notify()
+	// Subscriptions outlive individual connections, so only end them here.
+	dc.Dispatcher.Close()
+	for _, dataChannel := range attached {
+		dataChannel.Close()
+	}
+}
+
+// AsStream detaches the channel on the current connection. A new stream must
+// be obtained after each reconnection.
+func (dc *persistentDataChannel) AsStream() (io.ReadWriteCloser, error) {
+	dc.mutex.Lock()
+	current := dc.current
+	dc.mutex.Unlock()
+
+	if current == nil {
+		return nil, ErrNotConnected
+	}
+	return current.Detach()
+}
+
+// The set of data channels declared on a Peer.
+type declaredDataChannels struct {
+	mutex    sync.Mutex
+	channels map[string]*persistentDataChannel
+}
+
+func newDeclaredDataChannels() *declaredDataChannels {
+	return &declaredDataChannels{
+		channels: make(map[string]*persistentDataChannel),
+	}
+}
+
+func (d *declaredDataChannels) declare(label string, options DataChannelOptions, sendPolicy SendPolicy) (*persistentDataChannel, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, exists := d.channels[label]; exists || label == DEFAULT_DATA_CHANNEL_NAME {
+		return nil, ErrDataChannelDeclared
+	}
+
+	var channel *persistentDataChannel
+	channel = newPersistentDataChannel(label, options, sendPolicy, func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.channels[label] == channel {
+			delete(d.channels, label)
+		}
+	})
+	d.channels[label] = channel
+
+	return channel, nil
+}
+
+func (d *declaredDataChannels) get(label string) *persistentDataChannel {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.channels[label]
+}
+
+func (d *declaredDataChannels) all() []*persistentDataChannel {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var channels []*persistentDataChannel
+	for _, channel := range d.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
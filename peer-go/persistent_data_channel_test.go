@@ -0,0 +1,190 @@
+package thingrtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeclaredDataChannelSurvivesReconnection(t *testing.T) {
+	// Short ICE timeouts so the responder notices the dropped connection quickly.
+	initiator, responder := createConnectedPeers(
+		WithICETimeouts(ICETimeouts{Disconnected: 200 * time.Millisecond, Failed: 500 * time.Millisecond, KeepAlive: 50 * time.Millisecond}),
+		WithRetryPolicy(NewConstantRetryPolicy(10*time.Millisecond)),
+	)
+	defer initiator.Close()
+	defer responder.Close()
+
+	localChannel, err := initiator.DeclareDataChannel("control", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteChannel, err := responder.DeclareDataChannel("control", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := make(chan interface{}, 10)
+	localChannel.OnReopen(func() {
+		reopened <- nil
+	})
+	received := make(chan string, 10)
+	remoteChannel.OnStringMessage(func(message string) {
+		received <- message
+	})
+
+	connectPeers(t, initiator, responder)
+
+	for i := 0; i < 2; i++ {
+		expectReopen(t, reopened)
+
+		// Wait for the remote side too, so the message is not discarded.
+		waitForOpen(t, remoteChannel)
+		localChannel.SendStringMessage("hello")
+		expectMessage(t, received, "hello")
+
+		if i == 0 {
+			dropConnection(initiator)
+		}
+	}
+}
+
+func TestDeclaredDataChannelBuffersWhileClosed(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+
+	localChannel, err := initiator.DeclareDataChannel("control", true, BufferWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteChannel, err := responder.DeclareDataChannel("control", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 10)
+	remoteChannel.OnStringMessage(func(message string) {
+		received <- message
+	})
+
+	localChannel.SendStringMessage("first")
+	localChannel.SendStringMessage("second")
+	if localChannel.IsOpen() {
+		t.Fatal("channel should not be open before connecting")
+	}
+
+	connectPeers(t, initiator, responder)
+
+	expectMessage(t, received, "first")
+	expectMessage(t, received, "second")
+}
+
+func TestDeclaredDataChannelNotDeliveredToOnDataChannel(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+
+	dataChannels := make(chan DataChannel, 10)
+	responder.OnDataChannel(func(dataChannel DataChannel) {
+		dataChannels <- dataChannel
+	})
+
+	_, err := initiator.DeclareDataChannel("control", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteChannel, err := responder.DeclareDataChannel("control", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connectPeers(t, initiator, responder)
+	waitForOpen(t, remoteChannel)
+
+	// An undeclared channel is still delivered as normal.
+	_, err = initiator.CreateDataChannel("other", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case dataChannel := <-dataChannels:
+		if dataChannel.GetLabel() != "other" {
+			t.Fatalf("unexpected data channel delivered: %v", dataChannel.GetLabel())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel was not received")
+	}
+}
+
+func TestDeclareDataChannelRejectsDuplicateLabel(t *testing.T) {
+	peer, _ := createTestPeer()
+	defer peer.Close()
+
+	channel, err := peer.DeclareDataChannel("control", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = peer.DeclareDataChannel("control", false, FailWhileClosed)
+	if err != ErrDataChannelDeclared {
+		t.Fatalf("expected ErrDataChannelDeclared, got %v", err)
+	}
+
+	_, err = peer.DeclareDataChannel(DEFAULT_DATA_CHANNEL_NAME, true, FailWhileClosed)
+	if err != ErrDataChannelDeclared {
+		t.Fatalf("expected ErrDataChannelDeclared, got %v", err)
+	}
+
+	// Closing the handle frees up the label.
+	channel.Close()
+	_, err = peer.DeclareDataChannel("control", true, FailWhileClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tears down the peer's current connection, as if it had failed.
+func dropConnection(peer Peer) {
+	p := peer.(*peerImpl)
+	p.mutex.Lock()
+	task := p.peerTask
+	p.mutex.Unlock()
+
+	if task != nil {
+		task.Disconnect()
+	}
+}
+
+func expectReopen(t *testing.T, reopened <-chan interface{}) {
+	t.Helper()
+	select {
+	case <-reopened:
+		// Continue
+	case <-time.After(10 * time.Second):
+		t.Fatal("data channel did not reopen")
+	}
+}
+
+func waitForOpen(t *testing.T, channel PersistentDataChannel) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !channel.IsOpen() {
+		if time.Now().After(deadline) {
+			t.Fatal("data channel did not open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func expectMessage(t *testing.T, received <-chan string, expected string) {
+	t.Helper()
+	select {
+	case message := <-received:
+		if message != expected {
+			t.Fatalf("expected message %q, got %q", expected, message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message %q was not received", expected)
+	}
+}
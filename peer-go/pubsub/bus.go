@@ -0,0 +1,456 @@
+// Package pubsub implements a publish/subscribe topic bus between two peers.
+//
+// Either peer may publish to topics such as "sensors/temp", and subscribe to
+// topic filters with MQTT-style wildcards such as "sensors/+" or "sensors/#".
+// Messages are only sent to the remote peer if it has a matching
+// subscription.
+//
+// Each topic has a QoS, which decides whether its messages are sent over a
+// reliable, ordered data channel, or an unreliable one where a late reading is
+// worth less than the next. The last value published with retain set is kept
+// per topic, and sent to the remote peer when it subscribes to a matching
+// filter.
+//
+// Messages are JSON objects sent as string messages on either channel, so
+// that it interoperates with the TypeScript implementation in peer-web:
+//
+//	{"type": "subscribe", "filter": "sensors/+"}
+//	{"type": "unsubscribe", "filter": "sensors/+"}
+//	{"type": "publish", "topic": "sensors/temp", "payload": "<base64>", "retained": true}
+//
+// Subscriptions are only sent on the reliable channel. They are sent again
+// whenever it reopens, and subscribing to a filter twice has no further
+// effect, so a peer which restarts gets its subscriptions (and retained
+// values) back.
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// LabelPrefix starts the label of every data channel used by a bus.
+const LabelPrefix = "pubsub/"
+
+// The labels of the data channels declared by Open.
+const (
+	ReliableLabel   = LabelPrefix + "reliable"
+	UnreliableLabel = LabelPrefix + "unreliable"
+)
+
+var ErrBusClosed = errors.New("pubsub bus closed")
+
+// QoS decides how messages on a topic are delivered.
+type QoS int
+
+const (
+	// Messages are delivered in order, and retransmitted until received, as
+	// long as the connection lasts.
+	Reliable QoS = iota
+	// Messages may be lost or arrive out of order, but are never delayed
+	// behind a lost one.
+	BestEffort
+)
+
+const (
+	typeSubscribe   = "subscribe"
+	typeUnsubscribe = "unsubscribe"
+	typePublish     = "publish"
+)
+
+type message struct {
+	Type     string `json:"type"`
+	Filter   string `json:"filter,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Payload  []byte `json:"payload,omitempty"`
+	Retained bool   `json:"retained,omitempty"`
+}
+
+// Message is a message received on a topic.
+type Message struct {
+	Topic   string
+	Payload []byte
+	// Whether this is a retained value sent in response to subscribing,
+	// rather than a newly published message.
+	Retained bool
+}
+
+// Handler is called with each message received on a subscribed topic.
+type Handler func(message Message)
+
+type Option func(options *options)
+
+type options struct {
+	logger *slog.Logger
+}
+
+func defaultOptions(opts []Option) *options {
+	options := &options{
+		logger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithLogger sets the logger used to report invalid messages and failures to
+// send.
+func WithLogger(logger *slog.Logger) Option {
+	return func(options *options) {
+		options.logger = logger
+	}
+}
+
+type qosRule struct {
+	filter string
+	qos    QoS
+}
+
+// Bus publishes and subscribes to topics on the remote peer.
+type Bus struct {
+	reliable   thingrtc.DataChannel
+	unreliable thingrtc.DataChannel
+	options    *options
+	// Whether the channels were declared by Open, and so are closed with the
+	// bus.
+	owned bool
+
+	subscriptions []*thingrtc.Subscription
+	// Held while calling handlers, so that they are called one at a time.
+	handlerMutex sync.Mutex
+
+	// Guards all fields below.
+	mutex sync.Mutex
+	// Local subscriptions, by filter.
+	local map[string][]*Subscription
+	// Filters subscribed to by the remote peer.
+	remote   map[string]struct{}
+	retained map[string][]byte
+	qos      []qosRule
+	closed   bool
+}
+
+// Subscription is a handler subscribed to a topic filter.
+type Subscription struct {
+	bus     *Bus
+	filter  string
+	handler Handler
+}
+
+// Open runs a bus over data channels declared on peer, so that it carries on
+// across reconnections until it is closed. The remote peer should also call
+// Open, or attach to channels with the same labels.
+func Open(peer thingrtc.Peer, opts ...Option) (*Bus, error) {
+	reliable, err := peer.DeclareDataChannelWithOptions(ReliableLabel, thingrtc.ReliableDataChannelOptions(), thingrtc.FailWhileClosed)
+	if err != nil {
+		return nil, err
+	}
+	unreliable, err := peer.DeclareDataChannelWithOptions(UnreliableLabel, thingrtc.UnreliableDataChannelOptions(), thingrtc.FailWhileClosed)
+	if err != nil {
+		reliable.Close()
+		return nil, err
+	}
+
+	b := newBus(reliable, unreliable, opts...)
+	b.owned = true
+	return b, nil
+}
+
+// New runs a bus over reliable, which carries subscriptions and Reliable
+// messages, and unreliable, which carries BestEffort messages. If unreliable is
+// nil, all messages are sent on reliable. The bus takes over reliable's OnOpen
+// and OnClose listeners.
+func New(reliable thingrtc.DataChannel, unreliable thingrtc.DataChannel, opts ...Option) *Bus {
+	return newBus(reliable, unreliable, opts...)
+}
+
+func newBus(reliable thingrtc.DataChannel, unreliable thingrtc.DataChannel, opts ...Option) *Bus {
+	b := &Bus{
+		reliable:   reliable,
+		unreliable: unreliable,
+		options:    defaultOptions(opts),
+		local:      make(map[string][]*Subscription),
+		remote:     make(map[string]struct{}),
+		retained:   make(map[string][]byte),
+	}
+
+	channels := []thingrtc.DataChannel{reliable}
+	if unreliable != nil {
+		channels = append(channels, unreliable)
+	}
+	for _, channel := range channels {
+		subscription := channel.Subscribe(thingrtc.SubscribeOptions{})
+		b.subscriptions = append(b.subscriptions, subscription)
+		go b.readLoop(subscription)
+	}
+
+	reliable.OnOpen(b.resubscribe)
+	reliable.OnClose(b.forgetRemoteSubscriptions)
+	return b
+}
+
+// SetQoS sets the QoS of topics matching filter. If several filters match a
+// topic, the one set most recently wins. Topics which match none are Reliable.
+func (b *Bus) SetQoS(filter string, qos QoS) error {
+	if err := validateFilter(filter); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, rule := range b.qos {
+		if rule.filter == filter {
+			b.qos = append(b.qos[:i], b.qos[i+1:]...)
+			break
+		}
+	}
+	b.qos = append(b.qos, qosRule{filter: filter, qos: qos})
+	return nil
+}
+
+// Publish sends payload to topic, if the remote peer is subscribed to it. If
+// retain is set, payload is also kept as the topic's retained value, or the
+// retained value is cleared if payload is empty.
+func (b *Bus) Publish(topic string, payload []byte, retain bool) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrBusClosed
+	}
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = append([]byte(nil), payload...)
+		}
+	}
+	subscribed := b.remoteSubscribed(topic)
+	qos := b.topicQoS(topic)
+	b.mutex.Unlock()
+
+	if !subscribed {
+		return nil
+	}
+
+	channel := b.reliable
+	if qos == BestEffort && b.unreliable != nil {
+		channel = b.unreliable
+	}
+	return sendMessage(channel, message{Type: typePublish, Topic: topic, Payload: payload})
+}
+
+// Subscribe calls handler with each message received on topics matching
+// filter, starting with any retained values. Retained values are also
+// delivered again, to all subscriptions to filter, whenever the remote peer
+// resends them. Handlers are called one at a time, so should not block for
+// long.
+func (b *Bus) Subscribe(filter string, handler Handler) (*Subscription, error) {
+	if err := validateFilter(filter); err != nil {
+		return nil, err
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil, ErrBusClosed
+	}
+	subscription := &Subscription{bus: b, filter: filter, handler: handler}
+	b.local[filter] = append(b.local[filter], subscription)
+	b.mutex.Unlock()
+
+	// Sent even if we are already subscribed to filter, so that the remote
+	// peer sends its retained values again.
+	b.sendControl(typeSubscribe, filter)
+	return subscription, nil
+}
+
+// Unsubscribe stops calling the subscription's handler. The remote peer stops
+// sending messages once no subscriptions to the filter are left.
+func (s *Subscription) Unsubscribe() {
+	b := s.bus
+
+	b.mutex.Lock()
+	subscriptions := b.local[s.filter]
+	for i, subscription := range subscriptions {
+		if subscription == s {
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+	last := len(subscriptions) == 0 && len(b.local[s.filter]) > 0
+	if len(subscriptions) == 0 {
+		delete(b.local, s.filter)
+	} else {
+		b.local[s.filter] = subscriptions
+	}
+	closed := b.closed
+	b.mutex.Unlock()
+
+	if last && !closed {
+		b.sendControl(typeUnsubscribe, s.filter)
+	}
+}
+
+// Close stops the bus. Channels declared by Open are closed, while those
+// passed to New are left open.
+func (b *Bus) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.local = make(map[string][]*Subscription)
+	b.mutex.Unlock()
+
+	for _, subscription := range b.subscriptions {
+		subscription.Close()
+	}
+	if b.owned {
+		b.reliable.Close()
+		b.unreliable.Close()
+	}
+	return nil
+}
+
+// Must be called with mutex held.
+func (b *Bus) remoteSubscribed(topic string) bool {
+	for filter := range b.remote {
+		if Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called with mutex held.
+func (b *Bus) topicQoS(topic string) QoS {
+	for i := len(b.qos) - 1; i >= 0; i-- {
+		if Match(b.qos[i].filter, topic) {
+			return b.qos[i].qos
+		}
+	}
+	return Reliable
+}
+
+// Sends all our subscriptions, each time the reliable channel opens.
+func (b *Bus) resubscribe() {
+	b.mutex.Lock()
+	filters := make([]string, 0, len(b.local))
+	for filter := range b.local {
+		filters = append(filters, filter)
+	}
+	b.mutex.Unlock()
+
+	for _, filter := range filters {
+		b.sendControl(typeSubscribe, filter)
+	}
+}
+
+// Forgets the remote peer's subscriptions when the reliable channel closes,
+// as it sends them again when the channel reopens.
+func (b *Bus) forgetRemoteSubscriptions() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remote = make(map[string]struct{})
+}
+
+// Failures are only logged, as subscriptions are sent again when the channel
+// reopens.
+func (b *Bus) sendControl(messageType string, filter string) {
+	err := sendMessage(b.reliable, message{Type: messageType, Filter: filter})
+	if err != nil {
+		b.options.logger.Debug("failed to send pubsub subscription", "type", messageType, "filter", filter, "error", err)
+	}
+}
+
+func sendMessage(channel thingrtc.DataChannel, m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return channel.SendStringMessage(string(data))
+}
+
+func (b *Bus) readLoop(subscription *thingrtc.Subscription) {
+	for received := range subscription.Messages() {
+		var m message
+		err := json.Unmarshal(received.Data, &m)
+		if err != nil {
+			b.options.logger.Warn("invalid pubsub message received", "error", err)
+			continue
+		}
+
+		switch m.Type {
+		case typeSubscribe:
+			b.handleSubscribe(m.Filter)
+		case typeUnsubscribe:
+			b.mutex.Lock()
+			delete(b.remote, m.Filter)
+			b.mutex.Unlock()
+		case typePublish:
+			b.deliver(Message{Topic: m.Topic, Payload: m.Payload, Retained: m.Retained})
+		default:
+			b.options.logger.Warn("unknown pubsub message received", "type", m.Type)
+		}
+	}
+}
+
+func (b *Bus) handleSubscribe(filter string) {
+	if err := validateFilter(filter); err != nil {
+		b.options.logger.Warn("invalid pubsub subscription received", "filter", filter)
+		return
+	}
+
+	b.mutex.Lock()
+	b.remote[filter] = struct{}{}
+	var retained []message
+	for topic, payload := range b.retained {
+		if Match(filter, topic) {
+			retained = append(retained, message{Type: typePublish, Topic: topic, Payload: payload, Retained: true})
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, m := range retained {
+		err := sendMessage(b.reliable, m)
+		if err != nil {
+			b.options.logger.Debug("failed to send retained message", "topic", m.Topic, "error", err)
+			return
+		}
+	}
+}
+
+func (b *Bus) deliver(message Message) {
+	if validateTopic(message.Topic) != nil {
+		b.options.logger.Warn("message received on invalid topic", "topic", message.Topic)
+		return
+	}
+
+	b.handlerMutex.Lock()
+	defer b.handlerMutex.Unlock()
+
+	b.mutex.Lock()
+	var handlers []Handler
+	for filter, subscriptions := range b.local {
+		if Match(filter, message.Topic) {
+			for _, subscription := range subscriptions {
+				handlers = append(handlers, subscription.handler)
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
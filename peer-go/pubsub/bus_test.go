@@ -0,0 +1,323 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+	"github.com/thingify-app/thing-rtc/peer-go/internal/testutil"
+)
+
+type testBus struct {
+	*Bus
+	// The remote ends of the bus's channels.
+	remoteReliable   thingrtc.DataChannel
+	remoteUnreliable thingrtc.DataChannel
+}
+
+func createBuses(t *testing.T) (*testBus, *testBus) {
+	reliableA, reliableB := testutil.Pipe(ReliableLabel)
+	unreliableA, unreliableB := testutil.Pipe(UnreliableLabel)
+	a := New(reliableA, unreliableA)
+	b := New(reliableB, unreliableB)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return &testBus{a, reliableB, unreliableB}, &testBus{b, reliableA, unreliableA}
+}
+
+// Waits until a subscription to filter has reached b.
+func waitForRemoteSubscription(t *testing.T, b *testBus, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mutex.Lock()
+		_, ok := b.remote[filter]
+		b.mutex.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("subscription to %v not received", filter)
+}
+
+func subscribe(t *testing.T, b *testBus, filter string) <-chan Message {
+	t.Helper()
+	received := make(chan Message, 10)
+	_, err := b.Subscribe(filter, func(message Message) {
+		received <- message
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+func expectMessage(t *testing.T, received <-chan Message, topic string, payload string) Message {
+	t.Helper()
+	select {
+	case message := <-received:
+		if message.Topic != topic || string(message.Payload) != payload {
+			t.Fatalf("expected %v on %v, got %v on %v", payload, topic, string(message.Payload), message.Topic)
+		}
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %v", topic)
+		return Message{}
+	}
+}
+
+func expectNoMessage(t *testing.T, received <-chan Message) {
+	t.Helper()
+	select {
+	case message := <-received:
+		t.Fatalf("unexpected message on %v", message.Topic)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	device, browser := createBuses(t)
+
+	received := subscribe(t, browser, "sensors/+")
+	waitForRemoteSubscription(t, device, "sensors/+")
+
+	device.Publish("sensors/temp", []byte("21.5"), false)
+	device.Publish("sensors/temp/outside", []byte("12.0"), false)
+	device.Publish("sensors/humidity", []byte("40"), false)
+
+	message := expectMessage(t, received, "sensors/temp", "21.5")
+	if message.Retained {
+		t.Error("expected message not to be retained")
+	}
+	expectMessage(t, received, "sensors/humidity", "40")
+	expectNoMessage(t, received)
+}
+
+func TestSubscriptionsWorkInBothDirections(t *testing.T) {
+	a, b := createBuses(t)
+
+	receivedA := subscribe(t, a, "to/a")
+	receivedB := subscribe(t, b, "to/b")
+	waitForRemoteSubscription(t, a, "to/b")
+	waitForRemoteSubscription(t, b, "to/a")
+
+	a.Publish("to/b", []byte("hello b"), false)
+	b.Publish("to/a", []byte("hello a"), false)
+
+	expectMessage(t, receivedA, "to/a", "hello a")
+	expectMessage(t, receivedB, "to/b", "hello b")
+}
+
+func TestMessagesAreOnlySentToSubscribers(t *testing.T) {
+	device, browser := createBuses(t)
+	sent := device.remoteReliable.Subscribe(thingrtc.SubscribeOptions{})
+
+	device.Publish("sensors/temp", []byte("21.5"), false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if message, err := sent.Recv(ctx); err == nil {
+		t.Errorf("unexpected message sent: %v", string(message.Data))
+	}
+
+	// Nothing is received by a later subscription either.
+	received := subscribe(t, browser, "sensors/#")
+	expectNoMessage(t, received)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	device, browser := createBuses(t)
+
+	received := make(chan Message, 10)
+	first, _ := browser.Subscribe("sensors/temp", func(message Message) {
+		received <- message
+	})
+	second, _ := browser.Subscribe("sensors/temp", func(message Message) {
+		received <- message
+	})
+	waitForRemoteSubscription(t, device, "sensors/temp")
+
+	// The remote peer keeps sending while any subscription is left.
+	first.Unsubscribe()
+	device.Publish("sensors/temp", []byte("1"), false)
+	expectMessage(t, received, "sensors/temp", "1")
+	expectNoMessage(t, received)
+
+	second.Unsubscribe()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		device.mutex.Lock()
+		subscribed := device.remoteSubscribed("sensors/temp")
+		device.mutex.Unlock()
+		if !subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unsubscribe not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	device.Publish("sensors/temp", []byte("2"), false)
+	expectNoMessage(t, received)
+}
+
+func TestRetainedValuesAreSentOnSubscribe(t *testing.T) {
+	device, browser := createBuses(t)
+
+	device.Publish("sensors/temp", []byte("21.5"), true)
+	device.Publish("sensors/humidity", []byte("40"), true)
+	device.Publish("sensors/humidity", []byte("41"), true)
+	device.Publish("sensors/pressure", []byte("1000"), true)
+	// An empty payload clears the retained value.
+	device.Publish("sensors/pressure", nil, true)
+	device.Publish("status", []byte("ok"), true)
+
+	received := subscribe(t, browser, "sensors/#")
+	// Retained values may be sent more than once, if the subscription is also
+	// resent as the channel opens.
+	values := make(map[string]string)
+	timeout := time.After(5 * time.Second)
+	for len(values) < 2 {
+		select {
+		case message := <-received:
+			if !message.Retained {
+				t.Errorf("expected %v to be retained", message.Topic)
+			}
+			values[message.Topic] = string(message.Payload)
+		case <-timeout:
+			t.Fatalf("timed out waiting for retained values, got %v", values)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(received) > 0 {
+		message := <-received
+		values[message.Topic] = string(message.Payload)
+	}
+	if len(values) != 2 || values["sensors/temp"] != "21.5" || values["sensors/humidity"] != "41" {
+		t.Errorf("unexpected retained values: %v", values)
+	}
+}
+
+func TestRetainedValuesAreResentWhenChannelReopens(t *testing.T) {
+	device, browser := createBuses(t)
+	device.Publish("status", []byte("ok"), true)
+
+	received := subscribe(t, browser, "status")
+	expectMessage(t, received, "status", "ok")
+
+	// As a persistent channel would on reconnecting.
+	browser.resubscribe()
+	expectMessage(t, received, "status", "ok")
+}
+
+func TestRemoteSubscriptionsAreForgottenWhenChannelCloses(t *testing.T) {
+	device, browser := createBuses(t)
+	subscribe(t, browser, "sensors/temp")
+	waitForRemoteSubscription(t, device, "sensors/temp")
+
+	// Closes both ends, as losing the connection would.
+	device.reliable.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		device.mutex.Lock()
+		subscribed := device.remoteSubscribed("sensors/temp")
+		device.mutex.Unlock()
+		if !subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("remote subscription was not forgotten")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQoSSelectsChannel(t *testing.T) {
+	device, browser := createBuses(t)
+	err := device.SetQoS("video/#", BestEffort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.SetQoS("video/keyframes", Reliable)
+
+	unreliable := device.remoteUnreliable.Subscribe(thingrtc.SubscribeOptions{QueueSize: 10})
+	received := subscribe(t, browser, "video/#")
+	waitForRemoteSubscription(t, device, "video/#")
+
+	device.Publish("video/stats", []byte("30fps"), false)
+	expectMessage(t, received, "video/stats", "30fps")
+	device.Publish("video/keyframes", []byte("1"), false)
+	expectMessage(t, received, "video/keyframes", "1")
+
+	messages := unreliable.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message on the unreliable channel, got %v", len(messages))
+	}
+	var m message
+	json.Unmarshal((<-messages).Data, &m)
+	if m.Topic != "video/stats" {
+		t.Errorf("expected video/stats on the unreliable channel, got %v", m.Topic)
+	}
+}
+
+func TestClose(t *testing.T) {
+	device, _ := createBuses(t)
+	device.Close()
+
+	if err := device.Publish("sensors/temp", []byte("1"), false); err != ErrBusClosed {
+		t.Errorf("expected ErrBusClosed, got %v", err)
+	}
+	if _, err := device.Subscribe("sensors/temp", func(Message) {}); err != ErrBusClosed {
+		t.Errorf("expected ErrBusClosed, got %v", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sensors/temp", "sensors/temp", true},
+		{"sensors/temp", "sensors/humidity", false},
+		{"sensors/+", "sensors/temp", true},
+		{"sensors/+", "sensors", false},
+		{"sensors/+", "sensors/temp/outside", false},
+		{"+/temp", "sensors/temp", true},
+		{"+/+", "sensors/temp", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/temp/outside", true},
+		{"sensors/#", "status", false},
+		{"#", "sensors/temp", true},
+		{"sensors/+/outside", "sensors/temp/outside", true},
+		{"sensors/+/outside", "sensors/temp/inside", false},
+	}
+	for _, test := range tests {
+		if match := Match(test.filter, test.topic); match != test.match {
+			t.Errorf("Match(%q, %q) = %v, expected %v", test.filter, test.topic, match, test.match)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	valid := []string{"sensors/temp", "sensors/+", "#", "+/temp/#", "/"}
+	for _, filter := range valid {
+		if err := validateFilter(filter); err != nil {
+			t.Errorf("expected %q to be valid, got %v", filter, err)
+		}
+	}
+	invalid := []string{"", "sensors/#/temp", "sensors/temp#", "sensors/te+", "##"}
+	for _, filter := range invalid {
+		if err := validateFilter(filter); err != ErrInvalidFilter {
+			t.Errorf("expected %q to be invalid, got %v", filter, err)
+		}
+	}
+	if err := validateTopic("sensors/+"); err != ErrInvalidTopic {
+		t.Errorf("expected wildcard topic to be invalid, got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidTopic  = errors.New("invalid topic")
+	ErrInvalidFilter = errors.New("invalid topic filter")
+)
+
+// Match reports whether topic matches filter. Levels of both are separated by
+// "/". In filter, "+" matches exactly one level, and "#" (only allowed as the
+// last level) matches any number of levels, including none, so "sensors/#"
+// matches both "sensors" and "sensors/temp/outside".
+func Match(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func validateTopic(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+func validateFilter(filter string) error {
+	if filter == "" {
+		return ErrInvalidFilter
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i == len(levels)-1 || level == "+" {
+			continue
+		}
+		if strings.ContainsAny(level, "+#") {
+			return ErrInvalidFilter
+		}
+	}
+	return nil
+}
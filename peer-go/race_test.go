@@ -0,0 +1,166 @@
+package thingrtc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// These tests are most useful when run with -race.
+
+func TestConcurrentPeerOperations(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer responder.Close()
+	connectPeers(t, initiator, responder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				initiator.Connect(ctx)
+				initiator.CreateDataChannel("test", j%2 == 0)
+				initiator.State()
+				initiator.OnConnectionStateChange(func(state ConnectionState, reason error) {})
+				initiator.OnDataChannel(func(dataChannel DataChannel) {})
+				initiator.OnError(func(err error) {})
+				initiator.OnRetry(func(attempt int, delay time.Duration) {})
+			}
+		}()
+	}
+
+	// Close while other operations are still in progress.
+	time.Sleep(10 * time.Millisecond)
+	initiator.Close()
+	wg.Wait()
+
+	if initiator.State() != Disconnected {
+		t.Errorf("expected Disconnected after Close, got: %v", initiator.State())
+	}
+}
+
+func TestConcurrentConnectAndClose(t *testing.T) {
+	peer, _ := createTestPeer()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			peer.Connect(ctx)
+			cancel()
+			peer.Connect(context.Background())
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		peer.Close()
+	}()
+
+	wg.Wait()
+	peer.Close()
+}
+
+func TestConcurrentSignallingServerOperations(t *testing.T) {
+	actions := func(conn *websocket.Conn) {
+		// Consume auth message
+		conn.ReadMessage()
+
+		peerConnect := PeerConnectMessage{
+			Type:  "peerConnect",
+			Nonce: "myNonce",
+		}
+		conn.WriteJSON(&peerConnect)
+
+		candidate := Message{
+			Type: "iceCandidate",
+			Data: "{\"nonce\": \"nonce\"}",
+		}
+		for i := 0; i < 100; i++ {
+			conn.WriteJSON(&candidate)
+		}
+
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+	}
+
+	server := createWebsocketServer(actions)
+	url := strings.Replace(server.URL, "http", "ws", 1)
+	signallingServer := NewSignallingServer(url, MockServerAuth{}, MockPeerAuth{Nonce: "nonce", VerifyResult: true})
+	signallingServer.Connect()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				signallingServer.OnIceCandidate(func(candidate webrtc.ICECandidateInit) {})
+				signallingServer.OnPeerConnect(func() {})
+				signallingServer.OnError(func(err error) {})
+				signallingServer.SendIceCandidate(webrtc.ICECandidateInit{})
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	signallingServer.Disconnect()
+	wg.Wait()
+}
+
+func TestConcurrentDataChannelListenerSwap(t *testing.T) {
+	initiator, responder := createConnectedPeers()
+	defer initiator.Close()
+	defer responder.Close()
+
+	received := make(chan DataChannel, 1)
+	responder.OnDataChannel(func(dataChannel DataChannel) {
+		received <- dataChannel
+	})
+	connectPeers(t, initiator, responder)
+
+	dataChannel, err := initiator.CreateDataChannel("test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remoteChannel DataChannel
+	select {
+	case remoteChannel = <-received:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("data channel was not received")
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			dataChannel.SendStringMessage("message")
+			dataChannel.SendBinaryMessage([]byte("message"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			remoteChannel.OnStringMessage(func(message string) {})
+			remoteChannel.OnBinaryMessage(func(message []byte) {})
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,475 @@
+package thingrtc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+var ErrNotRecordable = errors.New("track cannot be recorded")
+
+// How many samples are queued for writing to disk before further samples are
+// dropped.
+const recordingQueueSize = 256
+
+type RecordingOption func(options *recordingOptions)
+
+type recordingOptions struct {
+	maxSegmentSize     int64
+	maxSegmentDuration time.Duration
+}
+
+// WithMaxSegmentSize starts a new file once the current one reaches size
+// bytes.
+func WithMaxSegmentSize(size int64) RecordingOption {
+	return func(options *recordingOptions) {
+		options.maxSegmentSize = size
+	}
+}
+
+// WithMaxSegmentDuration starts a new file once the current one reaches
+// duration.
+func WithMaxSegmentDuration(duration time.Duration) RecordingOption {
+	return func(options *recordingOptions) {
+		options.maxSegmentDuration = duration
+	}
+}
+
+// A sample to be recorded.
+type recordedSample struct {
+	data []byte
+	// From the start of the file being written.
+	timestamp time.Duration
+	duration  time.Duration
+	keyFrame  bool
+}
+
+// Writes samples of a single track to a file in some format.
+type recordingWriter interface {
+	writeSample(sample recordedSample) error
+	// Finishes the file, without closing it.
+	close() error
+}
+
+// A file being recorded to, which counts the bytes written.
+type segmentFile struct {
+	*os.File
+	size int64
+}
+
+func (f *segmentFile) Write(data []byte) (int, error) {
+	n, err := f.File.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Recording is a track being recorded to disk.
+type Recording struct {
+	path     string
+	mimeType string
+	options  *recordingOptions
+	// Creates a writer for each file of the recording.
+	newWriter func(file *segmentFile) (recordingWriter, error)
+	// Asks the sender for a key frame, if possible.
+	requestKeyFrame func() error
+
+	samples chan recordedSample
+	// Set when a sample is dropped, so that recording skips to the next key
+	// frame.
+	dropped   atomic.Bool
+	removeTap func()
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+	// Why recording stopped early, set before done is closed.
+	err error
+
+	// Guards segmentListener.
+	mutex           sync.Mutex
+	segmentListener func(path string)
+}
+
+// RecordLocalTrack records a track of a MediaSource (see MediaSource.Tracks)
+// to the file at path, whose extension sets the format:
+//   - WebM (.webm) for VP8, VP9 and Opus.
+//   - Fragmented MP4 (.mp4) for H264 and Opus.
+//   - IVF (.ivf) for VP8 and VP9.
+//
+// Recording starts at the next key frame, and continues until Stop is called.
+// If segments are limited by WithMaxSegmentSize or WithMaxSegmentDuration,
+// each segment is written to a file named from path with a number appended,
+// e.g. camera-0001.webm, and starts at a key frame.
+//
+// Samples are recorded as they are sent, so recording a track does not encode
+// it again.
+//
+// Timestamps in each file start from zero, and are the sum of the durations
+// of the samples before them, so recordings of tracks started at different
+// times are not aligned with each other. Samples dropped because the disk
+// cannot keep up are left out of the timeline rather than leaving a gap.
+func RecordLocalTrack(track webrtc.TrackLocal, path string, opts ...RecordingOption) (*Recording, error) {
+	switch track := track.(type) {
+	case *tappedTrack:
+		return recordTappedTrack(track, nil, path, opts...)
+	case *deviceTrack:
+		return recordTappedTrack(track, track.requestKeyFrame, path, opts...)
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNotRecordable, track.ID())
+}
+
+// RecordRemoteTrack records a track received from the remote peer to the file
+// at path, in the same way as RecordLocalTrack. Samples are recorded as they
+// are read from the track by ReadRTP or ReadSample, so the track must be read
+// (and the samples discarded, if not needed) for recording to progress. A key
+// frame is requested from the sender whenever a new file is started.
+//
+// As with RecordLocalTrack, timestamps are the sum of sample durations rather
+// than taken from the RTP timestamps, so samples which cannot be reassembled
+// because packets were lost are left out of the timeline, and the recording
+// gradually falls behind the sender's clock.
+func RecordRemoteTrack(track RemoteTrack, path string, opts ...RecordingOption) (*Recording, error) {
+	remote, ok := track.(*remoteTrack)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotRecordable, track.ID())
+	}
+	recording, err := newRecording(track.Codec().MimeType, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	builder, err := newSampleBuilder(track.Codec())
+	if err != nil {
+		return nil, err
+	}
+
+	// Packets are read by the application, so may be read on any goroutine.
+	var mutex sync.Mutex
+	recording.removeTap = remote.addTap(func(packet *rtp.Packet) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		builder.Push(packet.Clone())
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			recording.push(sample.Data, sample.Duration)
+		}
+	})
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		recording.requestKeyFrame = track.RequestKeyFrame
+	}
+	go recording.run()
+	return recording, nil
+}
+
+// Records the samples written to track, using requestKeyFrame (if not nil) to
+// start each file promptly.
+func recordTappedTrack(track tappableTrack, requestKeyFrame func() error, path string, opts ...RecordingOption) (*Recording, error) {
+	recording, err := newRecording(track.Codec().MimeType, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	recording.requestKeyFrame = requestKeyFrame
+	recording.removeTap = track.addTap(func(sample media.Sample) {
+		recording.push(sample.Data, sample.Duration)
+	})
+	go recording.run()
+	return recording, nil
+}
+
+func newRecording(mimeType string, path string, opts ...RecordingOption) (*Recording, error) {
+	options := &recordingOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	var newWriter func(file *segmentFile) (recordingWriter, error)
+	var mimeTypes []string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".webm":
+		newWriter = func(file *segmentFile) (recordingWriter, error) {
+			return newWebMWriter(file, mimeType), nil
+		}
+		mimeTypes = []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeOpus}
+	case ".mp4":
+		newWriter = func(file *segmentFile) (recordingWriter, error) {
+			return newMP4Writer(file, mimeType), nil
+		}
+		mimeTypes = []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}
+	case ".ivf":
+		newWriter = func(file *segmentFile) (recordingWriter, error) {
+			return newIVFWriter(file, mimeType)
+		}
+		mimeTypes = []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9}
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFile, path)
+	}
+	supported := false
+	for _, supportedType := range mimeTypes {
+		if strings.EqualFold(mimeType, supportedType) {
+			// The writers expect the mime type as in the constant.
+			mimeType = supportedType
+			supported = true
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("%w: %v in %v", ErrUnsupportedCodec, mimeType, filepath.Ext(path))
+	}
+
+	return &Recording{
+		path:            path,
+		mimeType:        mimeType,
+		options:         options,
+		newWriter:       newWriter,
+		samples:         make(chan recordedSample, recordingQueueSize),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+		segmentListener: func(path string) {},
+	}, nil
+}
+
+// OnSegment sets a listener called with the path of each file once it has
+// been completely written.
+func (r *Recording) OnSegment(listener func(path string)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.segmentListener = listener
+}
+
+func (r *Recording) getSegmentListener() func(path string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.segmentListener
+}
+
+// Stop stops recording and finishes the file being written. It returns the
+// error which stopped recording early, if any, such as the disk being full.
+func (r *Recording) Stop() error {
+	r.stopOnce.Do(func() {
+		r.removeTap()
+		close(r.stop)
+	})
+	<-r.done
+	return r.err
+}
+
+// Queues a sample to be written, without blocking the track.
+func (r *Recording) push(data []byte, duration time.Duration) {
+	sample := recordedSample{
+		data:     data,
+		duration: duration,
+		keyFrame: isKeyFrame(r.mimeType, data),
+	}
+	select {
+	case r.samples <- sample:
+	default:
+		r.dropped.Store(true)
+	}
+}
+
+// Returns the path of the numbered segment, or path itself if the recording
+// is not segmented.
+func (r *Recording) segmentPath(index int) string {
+	if r.options.maxSegmentSize <= 0 && r.options.maxSegmentDuration <= 0 {
+		return r.path
+	}
+	ext := filepath.Ext(r.path)
+	return fmt.Sprintf("%v-%04d%v", strings.TrimSuffix(r.path, ext), index, ext)
+}
+
+// Writes queued samples until stopped, starting each file at a key frame.
+func (r *Recording) run() {
+	defer close(r.done)
+
+	var file *segmentFile
+	var writer recordingWriter
+	index := 0
+	// How far into the current file the next sample is. Samples skipped
+	// while waiting for a key frame within a file are counted, so that they
+	// leave a gap, but those dropped from the queue are not (see
+	// RecordLocalTrack).
+	var position time.Duration
+	waitForKeyFrame := true
+	rotate := false
+
+	finish := func() error {
+		if file == nil {
+			return nil
+		}
+		err := errors.Join(writer.close(), file.Close())
+		path := file.Name()
+		file = nil
+		if err != nil {
+			return err
+		}
+		r.getSegmentListener()(path)
+		return nil
+	}
+	fail := func(err error) {
+		r.err = errors.Join(err, finish())
+		r.stopOnce.Do(r.removeTap)
+	}
+
+	if r.requestKeyFrame != nil {
+		r.requestKeyFrame()
+	}
+	for {
+		// Samples queued before Stop removed the tap are still written, so
+		// take them in preference to stopping.
+		var sample recordedSample
+		select {
+		case sample = <-r.samples:
+		default:
+			select {
+			case <-r.stop:
+				r.err = finish()
+				return
+			case sample = <-r.samples:
+			}
+		}
+
+		if r.dropped.Swap(false) {
+			waitForKeyFrame = true
+		}
+		if waitForKeyFrame {
+			if !sample.keyFrame {
+				position += sample.duration
+				continue
+			}
+			waitForKeyFrame = false
+		}
+
+		if rotate && sample.keyFrame {
+			err := finish()
+			if err != nil {
+				fail(err)
+				return
+			}
+			rotate = false
+		}
+		if file == nil {
+			index++
+			created, err := os.Create(r.segmentPath(index))
+			if err != nil {
+				fail(err)
+				return
+			}
+			file = &segmentFile{File: created}
+			writer, err = r.newWriter(file)
+			if err != nil {
+				fail(err)
+				return
+			}
+			position = 0
+		}
+
+		sample.timestamp = position
+		err := writer.writeSample(sample)
+		if err != nil {
+			fail(err)
+			return
+		}
+		position += sample.duration
+
+		if !rotate && ((r.options.maxSegmentSize > 0 && file.size >= r.options.maxSegmentSize) ||
+			(r.options.maxSegmentDuration > 0 && position >= r.options.maxSegmentDuration)) {
+			rotate = true
+			if r.requestKeyFrame != nil {
+				r.requestKeyFrame()
+			}
+		}
+	}
+}
+
+// Returns whether a sample in the codec can be decoded without those before
+// it.
+func isKeyFrame(mimeType string, data []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8KeyFrame(data)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9KeyFrame(data)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		nalus, _ := h264parser.SplitNALUs(data)
+		for _, nalu := range nalus {
+			if len(nalu) > 0 && nalu[0]&0x1f == 5 {
+				return true
+			}
+		}
+		return false
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		nalus, _ := h264parser.SplitNALUs(data)
+		for _, nalu := range nalus {
+			// IRAP pictures, from BLA_W_LP to CRA_NUT.
+			if len(nalu) > 0 && (nalu[0]>>1)&0x3f >= 16 && (nalu[0]>>1)&0x3f <= 21 {
+				return true
+			}
+		}
+		return false
+	}
+	// Audio samples are all independent.
+	return true
+}
+
+// A local track whose samples can be recorded.
+type tappableTrack interface {
+	Codec() webrtc.RTPCodecCapability
+	addTap(tap func(sample media.Sample)) func()
+}
+
+// A sample track which passes each sample written to it to any taps, so that
+// it can be recorded.
+type tappedTrack struct {
+	sampleTrack
+	taps taps[media.Sample]
+}
+
+func newTappedTrack(track sampleTrack) *tappedTrack {
+	return &tappedTrack{sampleTrack: track}
+}
+
+func (t *tappedTrack) addTap(tap func(sample media.Sample)) func() {
+	return t.taps.add(tap)
+}
+
+func (t *tappedTrack) WriteSample(sample media.Sample) error {
+	t.taps.call(sample)
+	return t.sampleTrack.WriteSample(sample)
+}
+
+// Functions which are each called with values as they pass through a track.
+// The zero value has no taps.
+type taps[T any] struct {
+	mutex sync.Mutex
+	taps  map[*func(value T)]struct{}
+}
+
+// Adds a tap, returning a function which removes it.
+func (t *taps[T]) add(tap func(value T)) func() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.taps == nil {
+		t.taps = make(map[*func(value T)]struct{})
+	}
+	t.taps[&tap] = struct{}{}
+	return func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		delete(t.taps, &tap)
+	}
+}
+
+// Calls each tap, which must not block.
+func (t *taps[T]) call(value T) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for tap := range t.taps {
+		(*tap)(value)
+	}
+}
@@ -0,0 +1,447 @@
+package thingrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+	mdcodec "github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/webrtc/v3"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+// Creates VP8 frames of 320x240 video, with a key frame every keyFrameInterval
+// frames, and each frame's number in its last byte.
+func createTestVP8Frames(count int, keyFrameInterval int) [][]byte {
+	var frames [][]byte
+	for i := 0; i < count; i++ {
+		frame := []byte{0x01, 0x00, 0x00}
+		if i%keyFrameInterval == 0 {
+			frame = []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}
+			frame = binary.LittleEndian.AppendUint16(frame, 320)
+			frame = binary.LittleEndian.AppendUint16(frame, 240)
+		}
+		frames = append(frames, append(frame, bytes.Repeat([]byte{0xaa}, 50)...))
+		frames[i] = append(frames[i], byte(i))
+	}
+	return frames
+}
+
+// Creates a paused source playing frames from a file, to record from.
+func createRecordingSource(t *testing.T, path string) (*FileMediaSource, <-chan struct{}) {
+	t.Helper()
+	source, err := CreateFileMediaSource(path, WithFileStartPaused())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		source.Close()
+	})
+	ended := make(chan struct{}, 1)
+	source.OnEnd(func() {
+		ended <- struct{}{}
+	})
+	return source, ended
+}
+
+// Records the only track of source until it ends, returning the paths of the
+// files written.
+func recordSource(t *testing.T, source *FileMediaSource, ended <-chan struct{}, path string, opts ...RecordingOption) []string {
+	t.Helper()
+	recording, err := RecordLocalTrack(source.Tracks()[0], path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	var segments []string
+	recording.OnSegment(func(path string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		segments = append(segments, path)
+	})
+
+	source.Resume()
+	waitForEnd(t, ended)
+	err = recording.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return segments
+}
+
+func TestRecordIVF(t *testing.T) {
+	frames := createTestVP8Frames(10, 5)
+	source, ended := createRecordingSource(t, writeTestIVF(t, "VP80", frames, 20))
+
+	path := filepath.Join(t.TempDir(), "recording.ivf")
+	segments := recordSource(t, source, ended, path)
+	if len(segments) != 1 || segments[0] != path {
+		t.Fatalf("expected a single file, got %v", segments)
+	}
+
+	tracks, err := openIVF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := readTestSamples(t, tracks)
+	if len(samples) != len(frames) {
+		t.Fatalf("expected %v frames, got %v", len(frames), len(samples))
+	}
+	for i, sample := range samples {
+		if !bytes.Equal(sample.data, frames[i]) {
+			t.Errorf("unexpected frame %v", i)
+		}
+		if sample.timestamp != time.Duration(i)*20*time.Millisecond {
+			t.Errorf("unexpected timestamp %v of frame %v", sample.timestamp, i)
+		}
+	}
+}
+
+func TestRecordSegmentSize(t *testing.T) {
+	frames := createTestVP8Frames(10, 5)
+	source, ended := createRecordingSource(t, writeTestIVF(t, "VP80", frames, 20))
+
+	// Each file is started at the key frame after reaching 100 bytes.
+	dir := t.TempDir()
+	segments := recordSource(t, source, ended, filepath.Join(dir, "recording.ivf"), WithMaxSegmentSize(100))
+	expected := []string{filepath.Join(dir, "recording-0001.ivf"), filepath.Join(dir, "recording-0002.ivf")}
+	if len(segments) != 2 || segments[0] != expected[0] || segments[1] != expected[1] {
+		t.Fatalf("expected %v, got %v", expected, segments)
+	}
+
+	for i, segment := range segments {
+		tracks, err := openIVF(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := readTestSamples(t, tracks)
+		if len(samples) != 5 {
+			t.Fatalf("expected 5 frames in segment %v, got %v", i, len(samples))
+		}
+		if !bytes.Equal(samples[0].data, frames[i*5]) || samples[0].timestamp != 0 {
+			t.Errorf("expected segment %v to start with key frame %v at 0", i, i*5)
+		}
+	}
+}
+
+// Reads the video width and the blocks of the first track from a WebM file.
+func readTestWebM(t *testing.T, path string) (uint64, []byte, [][]byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readVint := func(keepMarker bool) uint64 {
+		length := 1
+		for data[0]&(0x80>>(length-1)) == 0 {
+			length++
+		}
+		value := uint64(data[0])
+		if !keepMarker {
+			value &= 0xff >> length
+		}
+		for _, b := range data[1:length] {
+			value = value<<8 | uint64(b)
+		}
+		data = data[length:]
+		return value
+	}
+
+	var width uint64
+	var codecID []byte
+	var blocks [][]byte
+	for len(data) > 0 {
+		id := readVint(true)
+		size := readVint(false)
+		switch id {
+		case ebmlHeaderID, webmSegmentID, webmTracksID, webmTrackEntryID, webmVideoID, webmClusterID:
+			// Read the children.
+			continue
+		case webmPixelWidthID:
+			width = readUint(data[:size])
+		case webmCodecIDID:
+			codecID = data[:size]
+		case webmSimpleBlockID:
+			blocks = append(blocks, data[:size])
+		}
+		data = data[size:]
+	}
+	return width, codecID, blocks
+}
+
+// Reads a big-endian integer.
+func readUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func TestRecordWebM(t *testing.T) {
+	frames := createTestVP8Frames(10, 5)
+	source, ended := createRecordingSource(t, writeTestIVF(t, "VP80", frames, 20))
+
+	path := filepath.Join(t.TempDir(), "recording.webm")
+	recordSource(t, source, ended, path)
+
+	width, codecID, blocks := readTestWebM(t, path)
+	if width != 320 {
+		t.Errorf("expected width 320, got %v", width)
+	}
+	if string(codecID) != "V_VP8" {
+		t.Errorf("expected V_VP8, got %v", string(codecID))
+	}
+	if len(blocks) != len(frames) {
+		t.Fatalf("expected %v blocks, got %v", len(frames), len(blocks))
+	}
+	for i, block := range blocks {
+		// Each key frame starts a cluster.
+		timestamp := time.Duration(binary.BigEndian.Uint16(block[1:])) * time.Millisecond
+		if timestamp != time.Duration(i%5)*20*time.Millisecond {
+			t.Errorf("unexpected timestamp %v of block %v", timestamp, i)
+		}
+		if keyFrame := block[3]&0x80 != 0; keyFrame != (i%5 == 0) {
+			t.Errorf("unexpected key frame flag of block %v", i)
+		}
+		if !bytes.Equal(block[4:], frames[i]) {
+			t.Errorf("unexpected data of block %v", i)
+		}
+	}
+}
+
+func TestRecordMP4(t *testing.T) {
+	// 320x240 baseline video, with an IDR frame followed by two P frames,
+	// three times.
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x05, 0x07, 0xe4}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	var data []byte
+	var frames [][][]byte
+	for i := 0; i < 9; i++ {
+		frame := [][]byte{{0x41, 0x9a, byte(i + 1)}}
+		if i%3 == 0 {
+			frame = [][]byte{sps, pps, {0x65, 0x88, byte(i + 1)}}
+		}
+		for _, nal := range frame {
+			data = append(data, annexBStartCode...)
+			data = append(data, nal...)
+		}
+		frames = append(frames, frame)
+	}
+	source, ended := createRecordingSource(t, writeTestFile(t, "test.h264", data))
+
+	// Each file is started at the key frame after reaching 50ms.
+	segments := recordSource(t, source, ended, filepath.Join(t.TempDir(), "recording.mp4"), WithMaxSegmentDuration(50*time.Millisecond))
+	if len(segments) != 3 {
+		t.Fatalf("expected 3 files, got %v", segments)
+	}
+	for i, segment := range segments {
+		tracks, err := openMP4(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples := readTestSamples(t, tracks)
+		if len(samples) != 3 {
+			t.Fatalf("expected 3 samples in file %v, got %v", i, len(samples))
+		}
+		for j, sample := range samples {
+			var expected []byte
+			for _, nal := range frames[i*3+j] {
+				expected = append(expected, annexBStartCode...)
+				expected = append(expected, nal...)
+			}
+			if !bytes.Equal(sample.data, expected) {
+				t.Errorf("expected sample %v of file %v to be %v, got %v", j, i, expected, sample.data)
+			}
+			if sample.keyFrame != (j == 0) {
+				t.Errorf("unexpected key frame flag of sample %v of file %v", j, i)
+			}
+			if sample.timestamp != time.Duration(j)*time.Second/30 {
+				t.Errorf("unexpected timestamp %v of sample %v of file %v", sample.timestamp, j, i)
+			}
+		}
+	}
+}
+
+// An encoder which produces the frames sent to it, until frames is closed.
+type testEncodedReader struct {
+	frames    chan []byte
+	keyFrames chan struct{}
+}
+
+func (r *testEncodedReader) Read() (mediadevices.EncodedBuffer, func(), error) {
+	frame, ok := <-r.frames
+	if !ok {
+		return mediadevices.EncodedBuffer{}, nil, io.EOF
+	}
+	// Each frame lasts 20ms at 90kHz.
+	return mediadevices.EncodedBuffer{Data: frame, Samples: 1800}, func() {}, nil
+}
+
+func (r *testEncodedReader) Close() error {
+	return nil
+}
+
+func (r *testEncodedReader) Controller() mdcodec.EncoderController {
+	return r
+}
+
+func (r *testEncodedReader) ForceKeyFrame() error {
+	select {
+	case r.keyFrames <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func TestRecordDeviceTrack(t *testing.T) {
+	reader := &testEncodedReader{frames: make(chan []byte), keyFrames: make(chan struct{}, 1)}
+	device := &testDevice{newReader: func() mediadevices.EncodedReadCloser { return reader }}
+	source, err := newDeviceMediaSource([]mediadevices.Track{device})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	path := filepath.Join(t.TempDir(), "recording.ivf")
+	recording, err := RecordLocalTrack(source.Tracks()[0], path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recording asks the encoder for a key frame to start from.
+	select {
+	case <-reader.keyFrames:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for key frame request")
+	}
+
+	frames := createTestVP8Frames(10, 5)
+	for _, frame := range frames {
+		reader.frames <- frame
+	}
+	// Once the encoder ends, every frame has been written.
+	close(reader.frames)
+	waitForEncoders(t, device, 0)
+	err = recording.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks, err := openIVF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := readTestSamples(t, tracks)
+	if len(samples) != len(frames) {
+		t.Fatalf("expected %v frames, got %v", len(frames), len(samples))
+	}
+	for i, sample := range samples {
+		if !bytes.Equal(sample.data, frames[i]) {
+			t.Errorf("unexpected frame %v", i)
+		}
+		if sample.timestamp != time.Duration(i)*20*time.Millisecond {
+			t.Errorf("unexpected timestamp %v of frame %v", sample.timestamp, i)
+		}
+	}
+}
+
+func TestRecordUnsupported(t *testing.T) {
+	source, _ := createRecordingSource(t, writeTestIVF(t, "VP80", createTestVP8Frames(1, 1), 20))
+	dir := t.TempDir()
+
+	_, err := RecordLocalTrack(source.Tracks()[0], filepath.Join(dir, "recording.mp4"))
+	if !errors.Is(err, ErrUnsupportedCodec) {
+		t.Errorf("expected ErrUnsupportedCodec, got %v", err)
+	}
+	_, err = RecordLocalTrack(source.Tracks()[0], filepath.Join(dir, "recording.avi"))
+	if !errors.Is(err, ErrUnsupportedFile) {
+		t.Errorf("expected ErrUnsupportedFile, got %v", err)
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RecordLocalTrack(track, filepath.Join(dir, "recording.ivf"))
+	if !errors.Is(err, ErrNotRecordable) {
+		t.Errorf("expected ErrNotRecordable, got %v", err)
+	}
+}
+
+func TestRecordRemoteTrack(t *testing.T) {
+	frames := createTestVP8Frames(10, 5)
+	source, err := CreateFileMediaSource(writeTestIVF(t, "VP80", frames, 20), WithFileLoop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	url := createRelayServer()
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiator := New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, WithICEServers(), WithMediaSources(source.MediaSource))
+	defer initiator.Close()
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responder := New(url, MockServerAuth{Token: "responder"}, responderConfig, WithICEServers())
+	defer responder.Close()
+
+	tracks := make(chan RemoteTrack, 1)
+	responder.OnTrack(func(track RemoteTrack) {
+		tracks <- track
+	})
+
+	connectPeers(t, initiator, responder)
+	track := waitForTrack(t, tracks)
+
+	path := filepath.Join(t.TempDir(), "recording.ivf")
+	recording, err := RecordRemoteTrack(track, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The track is read as a viewer would, for recording to progress.
+	track.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 20; i++ {
+		_, err := track.ReadSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = recording.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileTracks, err := openIVF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := readTestSamples(t, fileTracks)
+	if len(samples) == 0 {
+		t.Fatal("expected frames to be recorded")
+	}
+	// Recording starts at a key frame, and continues in order.
+	number := int(samples[0].data[len(samples[0].data)-1])
+	if number%5 != 0 {
+		t.Errorf("expected recording to start at a key frame, got frame %v", number)
+	}
+	for i, sample := range samples {
+		expected := frames[(number+i)%len(frames)]
+		if !bytes.Equal(sample.data, expected) {
+			t.Errorf("expected frame %v to be frame %v of the file", i, (number+i)%len(frames))
+		}
+	}
+}
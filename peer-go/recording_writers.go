@@ -0,0 +1,355 @@
+package thingrtc
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Writes VP8 or VP9 frames to an IVF file, with timestamps in milliseconds.
+type ivfWriter struct {
+	file   *segmentFile
+	frames uint32
+}
+
+func newIVFWriter(file *segmentFile, mimeType string) (*ivfWriter, error) {
+	fourCC := "VP80"
+	if mimeType == webrtc.MimeTypeVP9 {
+		fourCC = "VP90"
+	}
+
+	// The frame size is not known in advance, and is not needed by
+	// decoders, so is left as zero.
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourCC)
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	_, err := file.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &ivfWriter{file: file}, nil
+}
+
+func (w *ivfWriter) writeSample(sample recordedSample) error {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header, uint32(len(sample.data)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(sample.timestamp.Milliseconds()))
+	_, err := w.file.Write(append(header, sample.data...))
+	if err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+// Fills in the frame count of the header.
+func (w *ivfWriter) close() error {
+	count := binary.LittleEndian.AppendUint32(nil, w.frames)
+	_, err := w.file.WriteAt(count, 24)
+	return err
+}
+
+// EBML element IDs used in WebM files, from the Matroska specification.
+const (
+	ebmlHeaderID          = 0x1a45dfa3
+	ebmlVersionID         = 0x4286
+	ebmlReadVersionID     = 0x42f7
+	ebmlMaxIDLengthID     = 0x42f2
+	ebmlMaxSizeLengthID   = 0x42f3
+	ebmlDocTypeID         = 0x4282
+	ebmlDocTypeVersionID  = 0x4287
+	ebmlDocTypeReadVerID  = 0x4285
+	webmSegmentID         = 0x18538067
+	webmInfoID            = 0x1549a966
+	webmTimecodeScaleID   = 0x2ad7b1
+	webmMuxingAppID       = 0x4d80
+	webmWritingAppID      = 0x5741
+	webmTracksID          = 0x1654ae6b
+	webmTrackEntryID      = 0xae
+	webmTrackNumberID     = 0xd7
+	webmTrackUIDID        = 0x73c5
+	webmTrackTypeID       = 0x83
+	webmCodecIDID         = 0x86
+	webmCodecPrivateID    = 0x63a2
+	webmVideoID           = 0xe0
+	webmPixelWidthID      = 0xb0
+	webmPixelHeightID     = 0xba
+	webmAudioID           = 0xe1
+	webmSamplingFreqID    = 0xb5
+	webmChannelsID        = 0x9f
+	webmClusterID         = 0x1f43b675
+	webmClusterTimecodeID = 0xe7
+	webmSimpleBlockID     = 0xa3
+)
+
+const (
+	// Clusters start a new cluster at each video key frame, and at least this
+	// often, as block timestamps are relative to their cluster.
+	webmMaxClusterDuration = 5 * time.Second
+	webmTrackTypeVideo     = 1
+	webmTrackTypeAudio     = 2
+	// The size of an element written before its contents are known.
+	webmUnknownSize = 0x01ffffffffffffff
+)
+
+// Encodes an EBML element. IDs already include their length marker.
+func ebmlElement(id uint32, data ...[]byte) []byte {
+	var element []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(element) > 0 {
+			element = append(element, b)
+		}
+	}
+
+	size := 0
+	for _, d := range data {
+		size += len(d)
+	}
+	element = append(element, ebmlSize(uint64(size))...)
+	for _, d := range data {
+		element = append(element, d...)
+	}
+	return element
+}
+
+// Encodes a size as a variable length integer of as few bytes as possible.
+func ebmlSize(size uint64) []byte {
+	length := 1
+	// All ones is reserved for an unknown size.
+	for size >= 1<<(7*length)-1 {
+		length++
+	}
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = byte(size)
+		size >>= 8
+	}
+	encoded[0] |= 0x80 >> (length - 1)
+	return encoded
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	data := binary.BigEndian.AppendUint64(nil, value)
+	for len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+	return ebmlElement(id, data)
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+// The start of an element whose contents are written after it, and whose size
+// is not known in advance.
+func ebmlUnknownSizeElement(id uint32) []byte {
+	header := binary.BigEndian.AppendUint32(nil, id)
+	return binary.BigEndian.AppendUint64(header, webmUnknownSize)
+}
+
+// Writes VP8, VP9 or Opus samples to a WebM file. The segment and its clusters
+// are written with unknown sizes, so that the file can be played even if
+// recording stops without it being closed.
+type webmWriter struct {
+	file     *segmentFile
+	mimeType string
+	started  bool
+	// The timestamp of the current cluster.
+	clusterStart time.Duration
+	hasCluster   bool
+}
+
+func newWebMWriter(file *segmentFile, mimeType string) *webmWriter {
+	return &webmWriter{
+		file:     file,
+		mimeType: mimeType,
+	}
+}
+
+// Writes the header, using the first sample to find the video size.
+func (w *webmWriter) writeHeader(first []byte) error {
+	header := ebmlElement(ebmlHeaderID,
+		ebmlUint(ebmlVersionID, 1),
+		ebmlUint(ebmlReadVersionID, 1),
+		ebmlUint(ebmlMaxIDLengthID, 4),
+		ebmlUint(ebmlMaxSizeLengthID, 8),
+		ebmlString(ebmlDocTypeID, "webm"),
+		ebmlUint(ebmlDocTypeVersionID, 4),
+		ebmlUint(ebmlDocTypeReadVerID, 2),
+	)
+	header = append(header, ebmlUnknownSizeElement(webmSegmentID)...)
+	header = append(header, ebmlElement(webmInfoID,
+		// Timestamps are in milliseconds.
+		ebmlUint(webmTimecodeScaleID, uint64(time.Millisecond)),
+		ebmlString(webmMuxingAppID, "thing-rtc"),
+		ebmlString(webmWritingAppID, "thing-rtc"),
+	)...)
+
+	track := [][]byte{
+		ebmlUint(webmTrackNumberID, 1),
+		ebmlUint(webmTrackUIDID, 1),
+	}
+	switch w.mimeType {
+	case webrtc.MimeTypeOpus:
+		track = append(track,
+			ebmlUint(webmTrackTypeID, webmTrackTypeAudio),
+			ebmlString(webmCodecIDID, "A_OPUS"),
+			ebmlElement(webmCodecPrivateID, opusHead()),
+			ebmlElement(webmAudioID,
+				ebmlFloat(webmSamplingFreqID, 48000),
+				ebmlUint(webmChannelsID, 2),
+			),
+		)
+	default:
+		codecID := "V_VP8"
+		width, height, ok := vp8FrameSize(first)
+		if w.mimeType == webrtc.MimeTypeVP9 {
+			codecID = "V_VP9"
+			width, height, ok = vp9FrameSize(first)
+		}
+		track = append(track,
+			ebmlUint(webmTrackTypeID, webmTrackTypeVideo),
+			ebmlString(webmCodecIDID, codecID),
+		)
+		// Decoders find the size from the stream itself if it is missing.
+		if ok {
+			track = append(track, ebmlElement(webmVideoID,
+				ebmlUint(webmPixelWidthID, uint64(width)),
+				ebmlUint(webmPixelHeightID, uint64(height)),
+			))
+		}
+	}
+	header = append(header, ebmlElement(webmTracksID, ebmlElement(webmTrackEntryID, track...))...)
+
+	_, err := w.file.Write(header)
+	return err
+}
+
+func (w *webmWriter) writeSample(sample recordedSample) error {
+	if !w.started {
+		err := w.writeHeader(sample.data)
+		if err != nil {
+			return err
+		}
+		w.started = true
+	}
+
+	video := w.mimeType != webrtc.MimeTypeOpus
+	if !w.hasCluster || (video && sample.keyFrame) || sample.timestamp-w.clusterStart >= webmMaxClusterDuration {
+		cluster := ebmlUnknownSizeElement(webmClusterID)
+		cluster = append(cluster, ebmlUint(webmClusterTimecodeID, uint64(sample.timestamp.Milliseconds()))...)
+		_, err := w.file.Write(cluster)
+		if err != nil {
+			return err
+		}
+		w.clusterStart = sample.timestamp
+		w.hasCluster = true
+	}
+
+	// The track number, timestamp relative to the cluster, and flags.
+	block := []byte{0x81}
+	block = binary.BigEndian.AppendUint16(block, uint16((sample.timestamp - w.clusterStart).Milliseconds()))
+	flags := byte(0)
+	if sample.keyFrame {
+		flags |= 0x80
+	}
+	block = append(block, flags)
+	_, err := w.file.Write(ebmlElement(webmSimpleBlockID, block, sample.data))
+	return err
+}
+
+func (w *webmWriter) close() error {
+	return nil
+}
+
+// Returns the Opus identification header for stereo at 48kHz, as in RFC 7845.
+func opusHead() []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, 2)
+	// Pre-skip, as used by libopus.
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	// Output gain, and channel mapping family.
+	head = binary.LittleEndian.AppendUint16(head, 0)
+	return append(head, 0)
+}
+
+// Reads the size of a VP8 key frame, as in RFC 6386.
+func vp8FrameSize(frame []byte) (int, int, bool) {
+	if len(frame) < 10 || !isVP8KeyFrame(frame) || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0, false
+	}
+	width := int(binary.LittleEndian.Uint16(frame[6:]) & 0x3fff)
+	height := int(binary.LittleEndian.Uint16(frame[8:]) & 0x3fff)
+	return width, height, true
+}
+
+// Reads the size of a VP9 key frame from its uncompressed header.
+func vp9FrameSize(frame []byte) (int, int, bool) {
+	if !isVP9KeyFrame(frame) {
+		return 0, 0, false
+	}
+	r := &bitReader{data: frame}
+	r.read(2) // frame_marker
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1)
+	}
+	r.read(1) // show_existing_frame
+	r.read(1) // frame_type
+	r.read(1) // show_frame
+	r.read(1) // error_resilient_mode
+	if r.read(24) != 0x498342 {
+		return 0, 0, false
+	}
+
+	if profile >= 2 {
+		r.read(1) // ten_or_twelve_bit
+	}
+	const colorSpaceRGB = 7
+	if r.read(3) != colorSpaceRGB {
+		r.read(1) // color_range
+		if profile == 1 || profile == 3 {
+			r.read(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1) // reserved_zero
+	}
+
+	width := int(r.read(16)) + 1
+	height := int(r.read(16)) + 1
+	if r.overrun {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// Reads bits from the most significant.
+type bitReader struct {
+	data    []byte
+	offset  int
+	overrun bool
+}
+
+func (r *bitReader) read(bits int) uint32 {
+	var value uint32
+	for i := 0; i < bits; i++ {
+		if r.offset >= len(r.data)*8 {
+			r.overrun = true
+			return 0
+		}
+		bit := (r.data[r.offset/8] >> (7 - r.offset%8)) & 1
+		value = value<<1 | uint32(bit)
+		r.offset++
+	}
+	return value
+}
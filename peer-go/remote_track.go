@@ -0,0 +1,161 @@
+package thingrtc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+var ErrUnsupportedCodec = errors.New("codec not supported")
+
+// How many packets the sample builder waits for a missing packet before
+// giving up on its sample. Video frames span many packets, so need longer.
+const (
+	videoSampleMaxLate = 256
+	audioSampleMaxLate = 16
+)
+
+// RemoteTrack is a media track received from the remote peer.
+type RemoteTrack interface {
+	// ID and StreamID are the track and stream IDs set by the sender.
+	ID() string
+	StreamID() string
+	Kind() webrtc.RTPCodecType
+	// Codec returns the codec negotiated for the track, whose MimeType is
+	// one of the webrtc.MimeType constants.
+	Codec() webrtc.RTPCodecParameters
+
+	// ReadRTP reads the next RTP packet received on the track.
+	ReadRTP() (*rtp.Packet, error)
+	// ReadSample reads the next complete sample (a video frame, or an audio
+	// packet), reassembled from RTP packets. It supports H264, VP8, VP9 and
+	// Opus, and returns ErrUnsupportedCodec for other codecs. Samples whose
+	// packets are lost are skipped. ReadRTP and ReadSample should not both be
+	// used on the same track.
+	ReadSample() (*media.Sample, error)
+	// RequestKeyFrame asks the sender for a new video key frame, e.g. when
+	// starting to record part way through a stream.
+	RequestKeyFrame() error
+	// SetReadDeadline sets the deadline for ReadRTP and ReadSample.
+	SetReadDeadline(deadline time.Time) error
+}
+
+type remoteTrack struct {
+	track          *webrtc.TrackRemote
+	peerConnection *webrtc.PeerConnection
+
+	// Guards builder, which is created on first use.
+	mutex   sync.Mutex
+	builder *samplebuilder.SampleBuilder
+	// Passed each packet read, for recording.
+	taps taps[*rtp.Packet]
+}
+
+func newRemoteTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, peerConnection *webrtc.PeerConnection) RemoteTrack {
+	// RTCP must be read for interceptors such as NACK to work. Reading fails
+	// once the connection closes.
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			if _, _, err := receiver.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	return &remoteTrack{
+		track:          track,
+		peerConnection: peerConnection,
+	}
+}
+
+func (t *remoteTrack) ID() string {
+	return t.track.ID()
+}
+
+func (t *remoteTrack) StreamID() string {
+	return t.track.StreamID()
+}
+
+func (t *remoteTrack) Kind() webrtc.RTPCodecType {
+	return t.track.Kind()
+}
+
+func (t *remoteTrack) Codec() webrtc.RTPCodecParameters {
+	return t.track.Codec()
+}
+
+func (t *remoteTrack) ReadRTP() (*rtp.Packet, error) {
+	packet, _, err := t.track.ReadRTP()
+	if err != nil {
+		return nil, err
+	}
+	t.taps.call(packet)
+	return packet, nil
+}
+
+func (t *remoteTrack) ReadSample() (*media.Sample, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.builder == nil {
+		builder, err := newSampleBuilder(t.track.Codec())
+		if err != nil {
+			return nil, err
+		}
+		t.builder = builder
+	}
+
+	for {
+		if sample := t.builder.Pop(); sample != nil {
+			return sample, nil
+		}
+		packet, err := t.ReadRTP()
+		if err != nil {
+			return nil, err
+		}
+		t.builder.Push(packet)
+	}
+}
+
+func newSampleBuilder(codec webrtc.RTPCodecParameters) (*samplebuilder.SampleBuilder, error) {
+	var depacketizer rtp.Depacketizer
+	maxLate := uint16(videoSampleMaxLate)
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		depacketizer = &codecs.H264Packet{}
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		depacketizer = &codecs.VP8Packet{}
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		depacketizer = &codecs.VP9Packet{}
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		depacketizer = &codecs.OpusPacket{}
+		maxLate = audioSampleMaxLate
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCodec, codec.MimeType)
+	}
+	return samplebuilder.New(maxLate, depacketizer, codec.ClockRate), nil
+}
+
+func (t *remoteTrack) addTap(tap func(packet *rtp.Packet)) func() {
+	return t.taps.add(tap)
+}
+
+func (t *remoteTrack) RequestKeyFrame() error {
+	return t.peerConnection.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(t.track.SSRC())},
+	})
+}
+
+func (t *remoteTrack) SetReadDeadline(deadline time.Time) error {
+	return t.track.SetReadDeadline(deadline)
+}
@@ -0,0 +1,240 @@
+package thingrtc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+	mdcodec "github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	"github.com/thingify-app/thing-rtc/peer-go/codec"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+// Creates a source with a track of each of mimeTypes (with the mime type as
+// its ID), and starts writing numbered frames to them until the test ends.
+func createTestSource(t *testing.T, mimeTypes ...string) *MediaSource {
+	var tracks []webrtc.TrackLocal
+	var samples []*webrtc.TrackLocalStaticSample
+	for _, mimeType := range mimeTypes {
+		track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, mimeType, "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracks = append(tracks, track)
+		samples = append(samples, track)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			frame := bytes.Repeat([]byte{byte(i)}, 100)
+			for _, track := range samples {
+				track.WriteSample(media.Sample{Data: frame, Duration: 10 * time.Millisecond})
+			}
+		}
+	}()
+
+	return newMediaSource(tracks)
+}
+
+func waitForTrack(t *testing.T, tracks <-chan RemoteTrack) RemoteTrack {
+	t.Helper()
+	select {
+	case track := <-tracks:
+		return track
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for track")
+		return nil
+	}
+}
+
+// Checks that track is the mimeType track of a test source, and receives
+// consecutive frames.
+func checkSamples(t *testing.T, track RemoteTrack, mimeType string) {
+	t.Helper()
+
+	if track.Codec().MimeType != mimeType {
+		t.Errorf("expected %v, got %v", mimeType, track.Codec().MimeType)
+	}
+	if track.ID() != mimeType || track.StreamID() != "stream" {
+		t.Errorf("expected track %v in stream, got %v in %v", mimeType, track.ID(), track.StreamID())
+	}
+
+	track.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var previous *media.Sample
+	for i := 0; i < 5; i++ {
+		sample, err := track.ReadSample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sample.Data) != 100 || !bytes.Equal(sample.Data, bytes.Repeat(sample.Data[:1], 100)) {
+			t.Fatalf("unexpected sample %v", sample.Data)
+		}
+		if previous != nil && sample.Data[0] != previous.Data[0]+1 {
+			t.Errorf("expected frame %v to follow %v", sample.Data[0], previous.Data[0])
+		}
+		previous = sample
+	}
+
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		err := track.RequestKeyFrame()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOnTrack(t *testing.T) {
+	url := createRelayServer()
+
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiator := New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, WithICEServers(), WithMediaSources(createTestSource(t, webrtc.MimeTypeVP8)))
+	defer initiator.Close()
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responder := New(url, MockServerAuth{Token: "responder"}, responderConfig, WithICEServers())
+	defer responder.Close()
+
+	tracks := make(chan RemoteTrack, 1)
+	responder.OnTrack(func(track RemoteTrack) {
+		tracks <- track
+	})
+
+	connectPeers(t, initiator, responder)
+	checkSamples(t, waitForTrack(t, tracks), webrtc.MimeTypeVP8)
+}
+
+func TestHostOnTrack(t *testing.T) {
+	url := createRelayServer()
+	host, _, _ := createHost(t, url, 0, WithReceiveTracks(webrtc.RTPCodecTypeVideo))
+
+	tracks := make(chan RemoteTrack, 1)
+	host.OnTrack(func(viewer *Viewer, track RemoteTrack) {
+		tracks <- track
+	})
+
+	serverAuth, config := createPairingConfig("camera", peerconfig.Responder)
+	viewer := New(url, serverAuth, config, WithICEServers(), WithMediaSources(createTestSource(t, webrtc.MimeTypeVP8)))
+	defer viewer.Close()
+	err := viewer.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSamples(t, waitForTrack(t, tracks), webrtc.MimeTypeVP8)
+}
+
+func TestTwoWayAudio(t *testing.T) {
+	url := createRelayServer()
+
+	// The initiator sends audio and video from a single source, and the
+	// responder sends back audio.
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiatorSource := createTestSource(t, webrtc.MimeTypeVP8, webrtc.MimeTypeOpus)
+	initiator := New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, WithICEServers(), WithMediaSources(initiatorSource))
+	defer initiator.Close()
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responderSource := createTestSource(t, webrtc.MimeTypeOpus)
+	responder := New(url, MockServerAuth{Token: "responder"}, responderConfig, WithICEServers(), WithMediaSources(responderSource))
+	defer responder.Close()
+
+	initiatorTracks := make(chan RemoteTrack, 2)
+	initiator.OnTrack(func(track RemoteTrack) {
+		initiatorTracks <- track
+	})
+	responderTracks := make(chan RemoteTrack, 2)
+	responder.OnTrack(func(track RemoteTrack) {
+		responderTracks <- track
+	})
+
+	connectPeers(t, initiator, responder)
+
+	received := make(map[webrtc.RTPCodecType]RemoteTrack)
+	for i := 0; i < 2; i++ {
+		track := waitForTrack(t, responderTracks)
+		received[track.Kind()] = track
+	}
+	if received[webrtc.RTPCodecTypeVideo] == nil || received[webrtc.RTPCodecTypeAudio] == nil {
+		t.Fatalf("expected audio and video tracks, got %v", received)
+	}
+	checkSamples(t, received[webrtc.RTPCodecTypeVideo], webrtc.MimeTypeVP8)
+	checkSamples(t, received[webrtc.RTPCodecTypeAudio], webrtc.MimeTypeOpus)
+
+	checkSamples(t, waitForTrack(t, initiatorTracks), webrtc.MimeTypeOpus)
+}
+
+// Describes an encoder without being able to build one, to give a source the
+// codecs of a local encoder.
+type testEncoderBuilder struct {
+	codec *mdcodec.RTPCodec
+}
+
+func (b testEncoderBuilder) RTPCodec() *mdcodec.RTPCodec {
+	return b.codec
+}
+
+func (b testEncoderBuilder) BuildVideoEncoder(r video.Reader, p prop.Media) (mdcodec.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestReceiveWithEncoderCodecs(t *testing.T) {
+	url := createRelayServer()
+
+	// The initiator only encodes VP8 video, but can still receive audio.
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiatorSource := createTestSource(t, webrtc.MimeTypeVP8)
+	initiatorSource.codecs = []*codec.Codec{{
+		CodecSelector: mediadevices.NewCodecSelector(mediadevices.WithVideoEncoders(testEncoderBuilder{mdcodec.NewRTPVP8Codec(90000)})),
+	}}
+	initiator := New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, WithICEServers(), WithMediaSources(initiatorSource), WithReceiveTracks(webrtc.RTPCodecTypeAudio))
+	defer initiator.Close()
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responder := New(url, MockServerAuth{Token: "responder"}, responderConfig, WithICEServers(), WithMediaSources(createTestSource(t, webrtc.MimeTypeOpus)))
+	defer responder.Close()
+
+	initiatorTracks := make(chan RemoteTrack, 1)
+	initiator.OnTrack(func(track RemoteTrack) {
+		initiatorTracks <- track
+	})
+	responderTracks := make(chan RemoteTrack, 1)
+	responder.OnTrack(func(track RemoteTrack) {
+		responderTracks <- track
+	})
+
+	connectPeers(t, initiator, responder)
+	checkSamples(t, waitForTrack(t, responderTracks), webrtc.MimeTypeVP8)
+	checkSamples(t, waitForTrack(t, initiatorTracks), webrtc.MimeTypeOpus)
+}
+
+func TestReadSampleUnsupportedCodec(t *testing.T) {
+	_, err := newSampleBuilder(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000},
+	})
+	if !errors.Is(err, ErrUnsupportedCodec) {
+		t.Errorf("expected ErrUnsupportedCodec, got %v", err)
+	}
+}
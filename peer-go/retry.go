@@ -0,0 +1,107 @@
+package thingrtc
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrRetriesExhausted = errors.New("retry policy exhausted - no more connection attempts")
+
+// RetryPolicy decides how long a Peer waits before reconnecting after a failed
+// connection attempt.
+type RetryPolicy interface {
+	// NextDelay returns the delay before the given retry attempt, where attempt
+	// counts the consecutive failures so far (starting at 1). Returns false if
+	// no further attempts should be made.
+	NextDelay(attempt int) (time.Duration, bool)
+}
+
+// NewConstantRetryPolicy retries forever with the same delay between attempts.
+func NewConstantRetryPolicy(delay time.Duration) RetryPolicy {
+	return &constantRetryPolicy{delay}
+}
+
+type constantRetryPolicy struct {
+	delay time.Duration
+}
+
+func (c *constantRetryPolicy) NextDelay(attempt int) (time.Duration, bool) {
+	return c.delay, true
+}
+
+// ExponentialBackoffRetryPolicy retries forever, multiplying the delay after
+// each failed attempt up to a maximum. Jitter randomises each delay so that
+// many peers failing at once do not all retry in lockstep.
+type ExponentialBackoffRetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// Multiplier of the delay after each attempt. Values of 1 or less (which
+	// would never back off) are treated as 2.
+	Multiplier float64
+	// Fraction (0 to 1) of each delay which is randomised, e.g. 0.5 results in
+	// a delay uniformly distributed between 50% and 100% of the backoff value.
+	Jitter float64
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// NewExponentialBackoffRetryPolicy creates an ExponentialBackoffRetryPolicy
+// which doubles the delay on each attempt, with 50% jitter.
+func NewExponentialBackoffRetryPolicy(initialDelay time.Duration, maxDelay time.Duration) *ExponentialBackoffRetryPolicy {
+	return &ExponentialBackoffRetryPolicy{
+		InitialDelay: initialDelay,
+		MaxDelay:     maxDelay,
+		Multiplier:   2,
+		Jitter:       0.5,
+	}
+}
+
+func (e *ExponentialBackoffRetryPolicy) NextDelay(attempt int) (time.Duration, bool) {
+	multiplier := e.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+	backoff := float64(e.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if backoff > float64(e.MaxDelay) || math.IsInf(backoff, 0) || math.IsNaN(backoff) {
+		backoff = float64(e.MaxDelay)
+	}
+
+	jitter := math.Min(math.Max(e.Jitter, 0), 1)
+	delay := backoff * (1 - jitter*e.random())
+
+	return time.Duration(delay), true
+}
+
+func (e *ExponentialBackoffRetryPolicy) random() float64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// Seed explicitly, as the global source is not guaranteed to be seeded
+	// differently on every device.
+	if e.rand == nil {
+		e.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return e.rand.Float64()
+}
+
+// NewMaxAttemptsRetryPolicy wraps another policy, giving up after maxAttempts
+// consecutive failed attempts.
+func NewMaxAttemptsRetryPolicy(policy RetryPolicy, maxAttempts int) RetryPolicy {
+	return &maxAttemptsRetryPolicy{policy, maxAttempts}
+}
+
+type maxAttemptsRetryPolicy struct {
+	policy      RetryPolicy
+	maxAttempts int
+}
+
+func (m *maxAttemptsRetryPolicy) NextDelay(attempt int) (time.Duration, bool) {
+	if attempt >= m.maxAttempts {
+		return 0, false
+	}
+	return m.policy.NextDelay(attempt)
+}
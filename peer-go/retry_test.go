@@ -0,0 +1,122 @@
+package thingrtc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConstantRetryPolicy(t *testing.T) {
+	policy := NewConstantRetryPolicy(time.Second)
+
+	for attempt := 1; attempt < 100; attempt++ {
+		delay, retry := policy.NextDelay(attempt)
+		if !retry || delay != time.Second {
+			t.Fatalf("unexpected delay %v (retry %v) on attempt %v", delay, retry, attempt)
+		}
+	}
+}
+
+func TestExponentialBackoffRetryPolicy(t *testing.T) {
+	policy := NewExponentialBackoffRetryPolicy(time.Second, 10*time.Second)
+	policy.Jitter = 0
+
+	expected := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for i, expectedDelay := range expected {
+		delay, retry := policy.NextDelay(i + 1)
+		if !retry || delay != expectedDelay {
+			t.Errorf("expected delay %v on attempt %v, got %v", expectedDelay, i+1, delay)
+		}
+	}
+
+	// Large attempt counts must not overflow.
+	delay, _ := policy.NextDelay(10000)
+	if delay != 10*time.Second {
+		t.Errorf("expected maximum delay, got %v", delay)
+	}
+}
+
+func TestExponentialBackoffRetryPolicyZeroMultiplier(t *testing.T) {
+	policy := &ExponentialBackoffRetryPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	// A literal without a multiplier still backs off, rather than retrying
+	// straight away.
+	delay, _ := policy.NextDelay(2)
+	if delay != 2*time.Second {
+		t.Errorf("expected delay of 2s, got %v", delay)
+	}
+}
+
+func TestExponentialBackoffRetryPolicyJitter(t *testing.T) {
+	policy := NewExponentialBackoffRetryPolicy(time.Second, 10*time.Second)
+
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		delay, _ := policy.NextDelay(3)
+		if delay < 2*time.Second || delay > 4*time.Second {
+			t.Fatalf("delay %v outside of jitter range", delay)
+		}
+		distinct[delay] = true
+	}
+
+	if len(distinct) < 2 {
+		t.Errorf("expected jitter to vary delays")
+	}
+}
+
+func TestMaxAttemptsRetryPolicy(t *testing.T) {
+	policy := NewMaxAttemptsRetryPolicy(NewConstantRetryPolicy(time.Second), 3)
+
+	for attempt := 1; attempt < 3; attempt++ {
+		_, retry := policy.NextDelay(attempt)
+		if !retry {
+			t.Fatalf("expected retry on attempt %v", attempt)
+		}
+	}
+
+	_, retry := policy.NextDelay(3)
+	if retry {
+		t.Fatalf("expected no retry after max attempts")
+	}
+}
+
+func TestPeerStopsWhenRetriesExhausted(t *testing.T) {
+	// Nothing is listening on this address, so every attempt fails.
+	retryPolicy := NewMaxAttemptsRetryPolicy(NewConstantRetryPolicy(time.Millisecond), 3)
+	peer := New("ws://127.0.0.1:1", MockServerAuth{}, createTestPeerConfig(), WithRetryPolicy(retryPolicy))
+	defer peer.Close()
+
+	retries := make(chan int, 10)
+	errs := make(chan error, 10)
+	peer.OnRetry(func(attempt int, delay time.Duration) {
+		retries <- attempt
+	})
+	peer.OnError(func(err error) {
+		if err == ErrRetriesExhausted {
+			errs <- err
+		}
+	})
+
+	err := peer.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-errs:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("retries were not exhausted")
+	}
+
+	if len(retries) != 2 {
+		t.Errorf("expected 2 retries, got %v", len(retries))
+	}
+}
@@ -0,0 +1,484 @@
+// Package rpc implements request/response calls, in both directions, over a
+// ThingRTC DataChannel.
+//
+// Messages are JSON objects sent as string messages, so that it interoperates
+// with the TypeScript implementation in peer-web:
+//
+//	{"type": "request", "id": 1, "method": "m", "params": ..., "timeoutMs": 500}
+//	{"type": "response", "id": 1, "result": ...}
+//	{"type": "error", "id": 1, "error": {"code": "...", "message": "...", "data": ...}}
+//	{"type": "cancel", "id": 1}
+//	{"type": "stream", "id": 1, "result": ...}
+//	{"type": "end", "id": 1}
+//
+// Request IDs are chosen by the caller, and are only unique per direction.
+// Calls to a streaming method receive any number of "stream" messages,
+// followed by "end" or "error".
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+var (
+	ErrConnClosed   = errors.New("rpc connection closed")
+	ErrStreamClosed = errors.New("rpc stream closed")
+)
+
+// The number of stream results queued for a caller before delivery of further
+// messages on the connection waits for it to catch up.
+const StreamBufferSize = 64
+
+const (
+	typeRequest  = "request"
+	typeResponse = "response"
+	typeError    = "error"
+	typeCancel   = "cancel"
+	typeStream   = "stream"
+	typeEnd      = "end"
+)
+
+type message struct {
+	Type      string          `json:"type"`
+	ID        uint64          `json:"id"`
+	Method    string          `json:"method,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	TimeoutMs int64           `json:"timeoutMs,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *Error          `json:"error,omitempty"`
+}
+
+// Conn serves registered methods to, and calls methods on, the remote peer
+// over a single DataChannel.
+type Conn struct {
+	channel      thingrtc.DataChannel
+	subscription *thingrtc.Subscription
+
+	// Parent of all handler contexts, cancelled once the connection closes.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed once the read loop has exited.
+	done chan struct{}
+
+	// Guards all fields below.
+	mutex          sync.Mutex
+	handlers       map[string]Handler
+	streamHandlers map[string]StreamHandler
+	nextID         uint64
+	calls          map[uint64]*pendingCall
+	serving        map[uint64]context.CancelFunc
+	closed         bool
+}
+
+// An outgoing call, awaiting responses.
+type pendingCall struct {
+	responses chan message
+	// Closed once the caller stops waiting, so responses are discarded.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewConn starts handling messages on channel. Methods should be registered
+// before the remote peer starts calling them.
+func NewConn(channel thingrtc.DataChannel) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		channel:      channel,
+		subscription: channel.Subscribe(thingrtc.SubscribeOptions{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+
+		handlers:       make(map[string]Handler),
+		streamHandlers: make(map[string]StreamHandler),
+		calls:          make(map[uint64]*pendingCall),
+		serving:        make(map[uint64]context.CancelFunc),
+	}
+
+	go c.readLoop()
+	return c
+}
+
+// Register serves method with handler, replacing any existing handler.
+func (c *Conn) Register(method string, handler Handler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.streamHandlers, method)
+	c.handlers[method] = handler
+}
+
+// RegisterStream serves the server-streaming method with handler, replacing
+// any existing handler.
+func (c *Conn) RegisterStream(method string, handler StreamHandler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.handlers, method)
+	c.streamHandlers[method] = handler
+}
+
+// Done is closed once the connection has closed, either by Close or because
+// the data channel closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close stops handling messages, cancelling in-flight handlers and failing
+// outstanding calls with ErrConnClosed. The data channel is left open.
+func (c *Conn) Close() error {
+	c.subscription.Close()
+	<-c.done
+	return nil
+}
+
+// Call calls method on the remote peer, and unmarshals its result into result
+// (unless it is nil). If ctx is done first, the call is cancelled on the remote
+// peer and ctx.Err() is returned. ctx's deadline is also sent to the remote
+// peer. Errors returned by the remote peer are *Error.
+func (c *Conn) Call(ctx context.Context, method string, params any, result any) error {
+	id, call, err := c.startCall(ctx, method, params, 1)
+	if err != nil {
+		return err
+	}
+	defer c.endCall(id, call)
+
+	select {
+	case response, ok := <-call.responses:
+		if !ok {
+			return ErrConnClosed
+		}
+		switch response.Type {
+		case typeResponse:
+			if result == nil || len(response.Result) == 0 {
+				return nil
+			}
+			return json.Unmarshal(response.Result, result)
+		case typeError:
+			return response.Error
+		default:
+			return fmt.Errorf("unexpected %v message in response to %v", response.Type, method)
+		}
+	case <-ctx.Done():
+		c.sendCancel(id)
+		return ctx.Err()
+	}
+}
+
+// CallStream calls a server-streaming method on the remote peer. ctx applies
+// to the whole stream.
+func (c *Conn) CallStream(ctx context.Context, method string, params any) (*Stream, error) {
+	id, call, err := c.startCall(ctx, method, params, StreamBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{conn: c, ctx: ctx, id: id, call: call, method: method}, nil
+}
+
+func (c *Conn) startCall(ctx context.Context, method string, params any, bufferSize int) (uint64, *pendingCall, error) {
+	request := message{Type: typeRequest, Method: method}
+
+	if params != nil {
+		rawParams, err := json.Marshal(params)
+		if err != nil {
+			return 0, nil, err
+		}
+		request.Params = rawParams
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// Never send 0, which means no timeout.
+		request.TimeoutMs = max(time.Until(deadline).Milliseconds(), 1)
+	}
+
+	call := &pendingCall{
+		responses: make(chan message, bufferSize),
+		done:      make(chan struct{}),
+	}
+
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return 0, nil, ErrConnClosed
+	}
+	c.nextID++
+	id := c.nextID
+	c.calls[id] = call
+	c.mutex.Unlock()
+
+	request.ID = id
+	err := c.send(request)
+	if err != nil {
+		c.endCall(id, call)
+		return 0, nil, err
+	}
+	return id, call, nil
+}
+
+func (c *Conn) endCall(id uint64, call *pendingCall) {
+	call.doneOnce.Do(func() { close(call.done) })
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.calls[id] == call {
+		delete(c.calls, id)
+	}
+}
+
+func (c *Conn) sendCancel(id uint64) {
+	// Best effort - if this fails the connection is closing anyway.
+	c.send(message{Type: typeCancel, ID: id})
+}
+
+func (c *Conn) send(msg message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.channel.SendStringMessage(string(data))
+}
+
+func (c *Conn) readLoop() {
+	defer c.shutdown()
+
+	for {
+		received, err := c.subscription.Recv(context.Background())
+		if err != nil {
+			return
+		}
+		if !received.IsString {
+			continue
+		}
+
+		var msg message
+		err = json.Unmarshal(received.Data, &msg)
+		if err != nil {
+			continue
+		}
+
+		switch msg.Type {
+		case typeRequest:
+			c.handleRequest(msg)
+		case typeCancel:
+			c.handleCancel(msg.ID)
+		case typeResponse, typeError, typeStream, typeEnd:
+			c.deliverResponse(msg)
+		}
+	}
+}
+
+// Cancels handlers and fails outstanding calls, once the read loop has exited.
+func (c *Conn) shutdown() {
+	c.mutex.Lock()
+	c.closed = true
+	calls := c.calls
+	c.calls = make(map[uint64]*pendingCall)
+	c.mutex.Unlock()
+
+	c.cancel()
+	// Only the read loop sends on responses, so it is safe to close them now.
+	for _, call := range calls {
+		close(call.responses)
+	}
+	close(c.done)
+}
+
+func (c *Conn) deliverResponse(msg message) {
+	c.mutex.Lock()
+	call, ok := c.calls[msg.ID]
+	c.mutex.Unlock()
+
+	if !ok {
+		// The caller has already given up.
+		return
+	}
+
+	select {
+	case call.responses <- msg:
+	case <-call.done:
+	}
+}
+
+func (c *Conn) handleCancel(id uint64) {
+	c.mutex.Lock()
+	cancel, ok := c.serving[id]
+	c.mutex.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+func (c *Conn) handleRequest(request message) {
+	c.mutex.Lock()
+	handler, isUnary := c.handlers[request.Method]
+	streamHandler, isStream := c.streamHandlers[request.Method]
+	if !isUnary && !isStream {
+		c.mutex.Unlock()
+		c.send(message{Type: typeError, ID: request.ID, Error: ErrMethodNotFound})
+		return
+	}
+
+	if _, ok := c.serving[request.ID]; ok {
+		c.mutex.Unlock()
+		c.send(message{Type: typeError, ID: request.ID, Error: ErrDuplicateRequest})
+		return
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if request.TimeoutMs > 0 {
+		ctx, cancel = context.WithTimeout(c.ctx, time.Duration(request.TimeoutMs)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(c.ctx)
+	}
+	c.serving[request.ID] = cancel
+	c.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(c.serving, request.ID)
+			c.mutex.Unlock()
+			cancel()
+		}()
+
+		if isUnary {
+			c.serveUnary(ctx, request, handler)
+		} else {
+			c.serveStream(ctx, request, streamHandler)
+		}
+	}()
+}
+
+func (c *Conn) serveUnary(ctx context.Context, request message, handler Handler) {
+	result, err := handler(ctx, request.Params)
+	if err != nil {
+		c.send(message{Type: typeError, ID: request.ID, Error: toError(err)})
+		return
+	}
+
+	rawResult, err := json.Marshal(result)
+	if err != nil {
+		c.send(message{Type: typeError, ID: request.ID, Error: toError(err)})
+		return
+	}
+	c.send(message{Type: typeResponse, ID: request.ID, Result: rawResult})
+}
+
+func (c *Conn) serveStream(ctx context.Context, request message, handler StreamHandler) {
+	send := func(result any) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rawResult, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		return c.send(message{Type: typeStream, ID: request.ID, Result: rawResult})
+	}
+
+	err := handler(ctx, request.Params, send)
+	if err != nil {
+		c.send(message{Type: typeError, ID: request.ID, Error: toError(err)})
+		return
+	}
+	c.send(message{Type: typeEnd, ID: request.ID})
+}
+
+// Converts a handler's error into one to send to the caller.
+func toError(err error) *Error {
+	var rpcErr *Error
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: CodeCancelled, Message: err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: err.Error()}
+	default:
+		return &Error{Code: CodeInternal, Message: err.Error()}
+	}
+}
+
+// Stream receives the results of a call to a server-streaming method.
+type Stream struct {
+	conn   *Conn
+	ctx    context.Context
+	id     uint64
+	call   *pendingCall
+	method string
+
+	// Guards err, the error returned from all further calls to Next once the
+	// stream has finished.
+	mutex sync.Mutex
+	err   error
+}
+
+// Next waits for the next result and unmarshals it into result. It returns
+// io.EOF once the stream has ended successfully, or the error that ended it.
+// It must not be called concurrently.
+func (s *Stream) Next(result any) error {
+	s.mutex.Lock()
+	err := s.err
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case response, ok := <-s.call.responses:
+		if !ok {
+			return s.finish(ErrConnClosed)
+		}
+		switch response.Type {
+		case typeStream:
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(response.Result, result)
+		case typeEnd:
+			return s.finish(io.EOF)
+		case typeError:
+			return s.finish(response.Error)
+		default:
+			return s.finish(fmt.Errorf("unexpected %v message in stream from %v", response.Type, s.method))
+		}
+	case <-s.ctx.Done():
+		s.conn.sendCancel(s.id)
+		return s.finish(s.ctx.Err())
+	case <-s.call.done:
+		return s.finish(ErrStreamClosed)
+	}
+}
+
+// Records the first error to finish the stream, and returns it.
+func (s *Stream) finish(err error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err == nil {
+		s.err = err
+		s.conn.endCall(s.id, s.call)
+	}
+	return s.err
+}
+
+// Close stops receiving results, cancelling the call on the remote peer if it
+// has not finished.
+func (s *Stream) Close() {
+	s.mutex.Lock()
+	finished := s.err != nil
+	s.mutex.Unlock()
+
+	if !finished {
+		s.conn.sendCancel(s.id)
+		s.finish(ErrStreamClosed)
+	}
+}
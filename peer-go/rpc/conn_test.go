@@ -0,0 +1,396 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+	"github.com/thingify-app/thing-rtc/peer-go/internal/testutil"
+)
+
+type addParams struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func createConns(t *testing.T) (client *Conn, server *Conn) {
+	a, b := testutil.Pipe("rpc")
+	client = NewConn(a)
+	server = NewConn(b)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestCall(t *testing.T) {
+	client, server := createConns(t)
+	server.Register("add", Method(func(ctx context.Context, params addParams) (int, error) {
+		return params.A + params.B, nil
+	}))
+
+	var result int
+	err := client.Call(testContext(t), "add", addParams{A: 1, B: 2}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 3 {
+		t.Errorf("expected 3, got %v", result)
+	}
+}
+
+func TestCallsInBothDirections(t *testing.T) {
+	a, b := createConns(t)
+	a.Register("name", Method(func(ctx context.Context, params struct{}) (string, error) {
+		return "a", nil
+	}))
+	b.Register("name", Method(func(ctx context.Context, params struct{}) (string, error) {
+		return "b", nil
+	}))
+
+	var name string
+	if err := a.Call(testContext(t), "name", nil, &name); err != nil || name != "b" {
+		t.Errorf("expected b, got %v (error %v)", name, err)
+	}
+	if err := b.Call(testContext(t), "name", nil, &name); err != nil || name != "a" {
+		t.Errorf("expected a, got %v (error %v)", name, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	client, server := createConns(t)
+	server.Register("fail", Method(func(ctx context.Context, params struct{}) (any, error) {
+		return nil, NewError("busy", "try again later")
+	}))
+	server.Register("crash", Method(func(ctx context.Context, params struct{}) (any, error) {
+		return nil, errors.New("something broke")
+	}))
+	server.Register("add", Method(func(ctx context.Context, params addParams) (int, error) {
+		return params.A + params.B, nil
+	}))
+
+	err := client.Call(testContext(t), "missing", nil, nil)
+	if !errors.Is(err, ErrMethodNotFound) {
+		t.Errorf("expected ErrMethodNotFound, got %v", err)
+	}
+
+	err = client.Call(testContext(t), "fail", nil, nil)
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != "busy" || rpcErr.Message != "try again later" {
+		t.Errorf("expected busy error, got %v", err)
+	}
+
+	err = client.Call(testContext(t), "crash", nil, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeInternal || rpcErr.Message != "something broke" {
+		t.Errorf("expected internal error, got %v", err)
+	}
+
+	err = client.Call(testContext(t), "add", "not an object", nil)
+	if !errors.Is(err, ErrInvalidParams) {
+		t.Errorf("expected ErrInvalidParams, got %v", err)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	client, server := createConns(t)
+	server.Register("echo", Method(func(ctx context.Context, params int) (int, error) {
+		// Finish out of order.
+		time.Sleep(time.Duration(params%5) * time.Millisecond)
+		return params, nil
+	}))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var result int
+			err := client.Call(testContext(t), "echo", i, &result)
+			if err != nil || result != i {
+				t.Errorf("expected %v, got %v (error %v)", i, result, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCancellation(t *testing.T) {
+	client, server := createConns(t)
+	cancelled := make(chan error, 1)
+	server.Register("wait", Method(func(ctx context.Context, params struct{}) (any, error) {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	err := client.Call(ctx, "wait", nil, nil)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("expected handler to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
+
+func TestDeadlineIsPropagated(t *testing.T) {
+	client, server := createConns(t)
+	server.Register("deadline", Method(func(ctx context.Context, params struct{}) (bool, error) {
+		_, ok := ctx.Deadline()
+		return ok, nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var hasDeadline bool
+	err := client.Call(ctx, "deadline", nil, &hasDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasDeadline {
+		t.Error("expected handler context to have a deadline")
+	}
+}
+
+// A context which the context package can't see inside, so that every child
+// context is watched by a goroutine until it is cancelled.
+type opaqueContext struct {
+	done chan struct{}
+}
+
+func (c opaqueContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (c opaqueContext) Done() <-chan struct{}       { return c.done }
+func (c opaqueContext) Err() error                  { return nil }
+func (c opaqueContext) Value(key any) any           { return nil }
+
+func TestTimedCallsReleaseContexts(t *testing.T) {
+	client, server := createConns(t)
+	server.Register("echo", Method(func(ctx context.Context, params int) (int, error) {
+		return params, nil
+	}))
+	// Set before any requests arrive, so handleRequest sees it.
+	server.ctx = opaqueContext{done: make(chan struct{})}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := client.Call(ctx, "echo", i, nil)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Handler goroutines finish just after responding.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before+10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected around %v goroutines, got %v", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStream(t *testing.T) {
+	client, server := createConns(t)
+	server.RegisterStream("count", StreamMethod(func(ctx context.Context, params int, send func(int) error) error {
+		for i := 0; i < params; i++ {
+			if err := send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	stream, err := client.CallStream(testContext(t), "count", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		var value int
+		err := stream.Next(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != i {
+			t.Errorf("expected %v, got %v", i, value)
+		}
+	}
+	if err := stream.Next(nil); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	client, server := createConns(t)
+	server.RegisterStream("fail", StreamMethod(func(ctx context.Context, params struct{}, send func(int) error) error {
+		send(1)
+		return NewError("sensor_offline", "sensor went offline")
+	}))
+
+	stream, err := client.CallStream(testContext(t), "fail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value int
+	if err := stream.Next(&value); err != nil || value != 1 {
+		t.Fatalf("expected 1, got %v (error %v)", value, err)
+	}
+	err = stream.Next(&value)
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != "sensor_offline" {
+		t.Errorf("expected sensor_offline error, got %v", err)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := createConns(t)
+	cancelled := make(chan interface{})
+	server.RegisterStream("forever", StreamMethod(func(ctx context.Context, params struct{}, send func(int) error) error {
+		for i := 0; ; i++ {
+			if err := send(i); err != nil {
+				close(cancelled)
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}))
+
+	stream, err := client.CallStream(testContext(t), "forever", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Next(nil); err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	if err := stream.Next(nil); err != ErrStreamClosed {
+		t.Errorf("expected ErrStreamClosed, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+		// Continue
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handler was not cancelled")
+	}
+}
+
+func TestChannelCloseFailsCalls(t *testing.T) {
+	a, b := testutil.Pipe("rpc")
+	client := NewConn(a)
+	server := NewConn(b)
+
+	started := make(chan interface{})
+	server.Register("wait", Method(func(ctx context.Context, params struct{}) (any, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}))
+
+	result := make(chan error, 1)
+	go func() {
+		result <- client.Call(context.Background(), "wait", nil, nil)
+	}()
+	<-started
+	a.Close()
+
+	select {
+	case err := <-result:
+		if err != ErrConnClosed {
+			t.Errorf("expected ErrConnClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call did not fail")
+	}
+
+	<-client.Done()
+	<-server.Done()
+	if err := client.Call(context.Background(), "wait", nil, nil); err != ErrConnClosed {
+		t.Errorf("expected ErrConnClosed, got %v", err)
+	}
+}
+
+func TestDuplicateRequestIsRejected(t *testing.T) {
+	a, b := testutil.Pipe("rpc")
+	server := NewConn(b)
+	defer server.Close()
+
+	release := make(chan interface{})
+	server.Register("wait", Method(func(ctx context.Context, params struct{}) (int, error) {
+		<-release
+		return 1, nil
+	}))
+
+	// Play a misbehaving caller which reuses an ID while its call is in
+	// progress.
+	responses := a.Subscribe(thingrtc.SubscribeOptions{})
+	request := `{"type": "request", "id": 1, "method": "wait"}`
+	a.SendStringMessage(request)
+	a.SendStringMessage(request)
+
+	received, err := responses.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response message
+	json.Unmarshal(received.Data, &response)
+	if response.Type != typeError || !errors.Is(response.Error, ErrDuplicateRequest) {
+		t.Fatalf("expected duplicate request error, got %v", received.Text())
+	}
+
+	// The original call is unaffected.
+	close(release)
+	received, err = responses.Recv(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(received.Data, &response)
+	if response.Type != typeResponse || string(response.Result) != "1" {
+		t.Fatalf("expected response to original call, got %v", received.Text())
+	}
+}
+
+func ExampleConn() {
+	a, b := testutil.Pipe("rpc")
+	device := NewConn(a)
+	browser := NewConn(b)
+
+	device.Register("readSensor", Method(func(ctx context.Context, sensor string) (float64, error) {
+		return 21.5, nil
+	}))
+
+	var reading float64
+	err := browser.Call(context.Background(), "readSensor", "temperature", &reading)
+	fmt.Println(reading, err)
+	// Output: 21.5 <nil>
+}
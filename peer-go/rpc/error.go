@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error is an error returned by a remote method. Handlers may return an *Error
+// to control the code sent to the caller; any other error is sent with
+// CodeInternal.
+type Error struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Codes used by the framework itself.
+const (
+	CodeMethodNotFound   = "method_not_found"
+	CodeInvalidParams    = "invalid_params"
+	CodeInvalidRequest   = "invalid_request"
+	CodeInternal         = "internal"
+	CodeCancelled        = "cancelled"
+	CodeDeadlineExceeded = "deadline_exceeded"
+)
+
+var (
+	ErrMethodNotFound = &Error{Code: CodeMethodNotFound, Message: "method not found"}
+	ErrInvalidParams  = &Error{Code: CodeInvalidParams, Message: "invalid params"}
+	// Returned for a request reusing the ID of one which is still being served.
+	ErrDuplicateRequest = &Error{Code: CodeInvalidRequest, Message: "duplicate request id"}
+)
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %v: %v", e.Code, e.Message)
+}
+
+// Is reports whether target is an *Error with the same code, so that e.g.
+// errors.Is(err, rpc.ErrMethodNotFound) works for errors received from the
+// remote peer.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// NewError creates an *Error with the given code and message.
+func NewError(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Handler handles a call to a method, returning a result which is marshalled
+// to JSON.
+type Handler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// StreamHandler handles a call to a server-streaming method, calling send for
+// each result. The stream ends when it returns.
+type StreamHandler func(ctx context.Context, params json.RawMessage, send func(result any) error) error
+
+// Method adapts a function with typed params and result to a Handler.
+func Method[P any, R any](f func(ctx context.Context, params P) (R, error)) Handler {
+	return func(ctx context.Context, rawParams json.RawMessage) (any, error) {
+		params, err := unmarshalParams[P](rawParams)
+		if err != nil {
+			return nil, err
+		}
+		return f(ctx, params)
+	}
+}
+
+// StreamMethod adapts a function with typed params and results to a
+// StreamHandler.
+func StreamMethod[P any, R any](f func(ctx context.Context, params P, send func(result R) error) error) StreamHandler {
+	return func(ctx context.Context, rawParams json.RawMessage, send func(result any) error) error {
+		params, err := unmarshalParams[P](rawParams)
+		if err != nil {
+			return err
+		}
+		return f(ctx, params, func(result R) error {
+			return send(result)
+		})
+	}
+}
+
+func unmarshalParams[P any](rawParams json.RawMessage) (P, error) {
+	var params P
+	if len(rawParams) == 0 {
+		return params, nil
+	}
+	err := json.Unmarshal(rawParams, &params)
+	if err != nil {
+		return params, &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("invalid params: %v", err)}
+	}
+	return params, nil
+}
@@ -0,0 +1,367 @@
+package thingrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/rtspv2"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+var (
+	ErrRtspFailed      = errors.New("RTSP source failed")
+	ErrRtspStreamEnded = errors.New("RTSP stream ended")
+	ErrInvalidNALU     = errors.New("invalid NAL unit")
+)
+
+// The RTSP stream is considered healthy once it has been connected this long,
+// after which a failure starts the retry policy from the first attempt again.
+const rtspHealthyDuration = 10 * time.Second
+
+type RtspOption func(options *rtspOptions)
+
+type rtspOptions struct {
+	videoMimeType string
+	audioMimeType string
+	retryPolicy   RetryPolicy
+	timeout       time.Duration
+}
+
+func defaultRtspOptions() *rtspOptions {
+	return &rtspOptions{
+		videoMimeType: webrtc.MimeTypeH264,
+		retryPolicy:   NewExponentialBackoffRetryPolicy(time.Second, 30*time.Second),
+		timeout:       10 * time.Second,
+	}
+}
+
+// WithRtspVideoCodec sets the codec the camera sends video in, either
+// webrtc.MimeTypeH264 (the default) or webrtc.MimeTypeH265. Video is passed
+// through without transcoding, so H265 only reaches peers which support it.
+func WithRtspVideoCodec(mimeType string) RtspOption {
+	return func(options *rtspOptions) {
+		options.videoMimeType = mimeType
+	}
+}
+
+// WithRtspAudioCodec forwards the camera's audio as a second track, in the
+// given codec: webrtc.MimeTypePCMA, webrtc.MimeTypePCMU or webrtc.MimeTypeOpus.
+// Audio is passed through without transcoding, so AAC audio cannot be
+// forwarded. By default audio is not forwarded.
+func WithRtspAudioCodec(mimeType string) RtspOption {
+	return func(options *rtspOptions) {
+		options.audioMimeType = mimeType
+	}
+}
+
+// WithRtspRetryPolicy sets how long to wait before reconnecting to the camera
+// after it fails. Defaults to exponential backoff from 1 to 30 seconds.
+func WithRtspRetryPolicy(policy RetryPolicy) RtspOption {
+	return func(options *rtspOptions) {
+		options.retryPolicy = policy
+	}
+}
+
+// WithRtspTimeout sets how long to wait when connecting to the camera, and for
+// each read from it, before treating it as failed. Defaults to 10 seconds.
+func WithRtspTimeout(timeout time.Duration) RtspOption {
+	return func(options *rtspOptions) {
+		options.timeout = timeout
+	}
+}
+
+// A track which samples can be written to.
+type sampleTrack interface {
+	webrtc.TrackLocal
+	Codec() webrtc.RTPCodecCapability
+	WriteSample(sample media.Sample) error
+}
+
+// CreateRtspMediaSource forwards video (and optionally audio) from an RTSP
+// camera at rtspUrl, in the background until the source is closed. The camera
+// is reconnected to whenever it fails, and failures are reported to the error
+// listener of each peer using the source. Use State to monitor the camera.
+func CreateRtspMediaSource(rtspUrl string, opts ...RtspOption) (*MediaSource, error) {
+	options := defaultRtspOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	var videoTrack sampleTrack
+	var err error
+	switch {
+	case strings.EqualFold(options.videoMimeType, webrtc.MimeTypeH264):
+		videoTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeH264,
+		}, "pion-rtsp", "pion-rtsp")
+	case strings.EqualFold(options.videoMimeType, webrtc.MimeTypeH265):
+		videoTrack, err = newH265Track("pion-rtsp", "pion-rtsp")
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCodec, options.videoMimeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	videoTrack = newTappedTrack(videoTrack)
+	tracks := []webrtc.TrackLocal{videoTrack}
+
+	var audioTrack sampleTrack
+	if options.audioMimeType != "" {
+		if rtspAudioCodecType(options.audioMimeType) == 0 {
+			return nil, fmt.Errorf("%w: %v", ErrUnsupportedCodec, options.audioMimeType)
+		}
+		audioTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType: options.audioMimeType,
+		}, "pion-rtsp-audio", "pion-rtsp")
+		if err != nil {
+			return nil, err
+		}
+		audioTrack = newTappedTrack(audioTrack)
+		tracks = append(tracks, audioTrack)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	source := newMediaSource(tracks)
+	source.cancel = cancel
+	go source.rtspConsumer(ctx, rtspUrl, options, videoTrack, audioTrack)
+
+	return source, nil
+}
+
+// Returns the vdk codec type for an audio mime type, or 0 if it cannot be
+// forwarded.
+func rtspAudioCodecType(mimeType string) av.CodecType {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypePCMA):
+		return av.PCM_ALAW
+	case strings.EqualFold(mimeType, webrtc.MimeTypePCMU):
+		return av.PCM_MULAW
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		return av.OPUS
+	}
+	return 0
+}
+
+// Streams from the camera until ctx is cancelled, reconnecting according to
+// the retry policy.
+func (m *MediaSource) rtspConsumer(ctx context.Context, rtspUrl string, options *rtspOptions, videoTrack sampleTrack, audioTrack sampleTrack) {
+	failures := 0
+	for {
+		start := time.Now()
+		err := m.consumeRtsp(ctx, rtspUrl, options, videoTrack, audioTrack)
+		if ctx.Err() != nil {
+			m.updateState(func(state *MediaSourceState) {
+				state.Connected = false
+				state.Bitrate = 0
+			})
+			return
+		}
+
+		err = fmt.Errorf("%w: %w", ErrRtspFailed, err)
+		m.updateState(func(state *MediaSourceState) {
+			state.Connected = false
+			state.Bitrate = 0
+			state.LastError = err
+		})
+		m.reportError(err)
+
+		if time.Since(start) >= rtspHealthyDuration {
+			failures = 0
+		}
+		failures++
+		delay, retry := options.retryPolicy.NextDelay(failures)
+		if !retry {
+			m.logger.Load().Error("giving up on RTSP source", "failures", failures)
+			m.reportError(ErrRetriesExhausted)
+			return
+		}
+		m.logger.Load().Warn("RTSP source failed, reconnecting", "error", err, "failures", failures, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Streams from the camera once, until it fails or ctx is cancelled.
+func (m *MediaSource) consumeRtsp(ctx context.Context, rtspUrl string, options *rtspOptions, videoTrack sampleTrack, audioTrack sampleTrack) error {
+	logger := m.logger.Load()
+
+	session, err := rtspv2.Dial(rtspv2.RTSPClientOptions{
+		URL:              rtspUrl,
+		DialTimeout:      options.timeout,
+		ReadWriteTimeout: options.timeout,
+		DisableAudio:     audioTrack == nil,
+	})
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	videoType := av.H264
+	if strings.EqualFold(options.videoMimeType, webrtc.MimeTypeH265) {
+		videoType = av.H265
+	}
+	videoIndex, audioIndex := -1, -1
+	for i, codecData := range session.CodecData {
+		logger.Info("found RTSP stream", "index", i, "type", codecData.Type().String())
+		switch {
+		case codecData.Type().IsVideo() && videoIndex < 0:
+			videoIndex = i
+		case codecData.Type().IsAudio() && audioIndex < 0:
+			audioIndex = i
+		}
+	}
+	if videoIndex < 0 {
+		return fmt.Errorf("%w: no video stream", ErrUnsupportedCodec)
+	}
+	if codecType := session.CodecData[videoIndex].Type(); codecType != videoType {
+		return fmt.Errorf("%w: camera sends %v video, expected %v", ErrUnsupportedCodec, codecType, videoType)
+	}
+	if audioTrack != nil && audioIndex >= 0 {
+		if codecType := session.CodecData[audioIndex].Type(); codecType != rtspAudioCodecType(options.audioMimeType) {
+			// Keep the video going without audio.
+			m.reportError(fmt.Errorf("%w: camera sends %v audio, expected %v", ErrUnsupportedCodec, codecType, options.audioMimeType))
+			audioIndex = -1
+		}
+	}
+
+	parameterSets := videoParameterSets(session.CodecData[videoIndex])
+	m.updateState(func(state *MediaSourceState) {
+		state.Connected = true
+	})
+	logger.Info("RTSP source connected")
+
+	meter := bitrateMeter{start: time.Now()}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case signal := <-session.Signals:
+			switch signal {
+			case rtspv2.SignalCodecUpdate:
+				parameterSets = videoParameterSets(session.CodecData[videoIndex])
+			case rtspv2.SignalStreamRTPStop:
+				return ErrRtspStreamEnded
+			}
+		case packet := <-session.OutgoingPacketQueue:
+			var track sampleTrack
+			data := packet.Data
+			switch int(packet.Idx) {
+			case videoIndex:
+				track = videoTrack
+				data, err = avccToAnnexB(packet.Data, 4)
+				if err != nil {
+					// A single corrupt packet isn't worth reconnecting for.
+					logger.Warn("dropping malformed video packet", "error", err)
+					continue
+				}
+				// Prepend the parameter sets to every key frame, so that
+				// viewers can start decoding from it.
+				if packet.IsKeyFrame {
+					data = append(append([]byte{}, parameterSets...), data...)
+					m.updateState(func(state *MediaSourceState) {
+						state.LastKeyFrame = time.Now()
+					})
+				}
+			case audioIndex:
+				track = audioTrack
+			default:
+				continue
+			}
+
+			if bitrate, ok := meter.add(len(packet.Data)); ok {
+				m.updateState(func(state *MediaSourceState) {
+					state.Bitrate = bitrate
+				})
+			}
+
+			// Writes only fail for individual connections, which have their
+			// own error handling, so they must not stop the stream.
+			err = track.WriteSample(media.Sample{Data: data, Duration: packet.Duration})
+			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				logger.Debug("failed to write RTSP sample", "error", err)
+			}
+		}
+	}
+}
+
+// Measures the bitrate of data received in roughly one second windows.
+type bitrateMeter struct {
+	start time.Time
+	bytes int
+}
+
+// Records n bytes received, returning the bitrate of the last window if one
+// has just ended.
+func (b *bitrateMeter) add(n int) (int, bool) {
+	b.bytes += n
+	elapsed := time.Since(b.start)
+	if elapsed < time.Second {
+		return 0, false
+	}
+	bitrate := int(float64(b.bytes*8) / elapsed.Seconds())
+	b.start = time.Now()
+	b.bytes = 0
+	return bitrate, true
+}
+
+// Returns the H264 SPS and PPS, or H265 VPS, SPS and PPS, as Annex-B NAL
+// units, or nil if they are not yet known.
+func videoParameterSets(codecData av.CodecData) []byte {
+	var nalus [][]byte
+	switch codecData := codecData.(type) {
+	case h264parser.CodecData:
+		nalus = append(nalus, codecData.RecordInfo.SPS...)
+		nalus = append(nalus, codecData.RecordInfo.PPS...)
+	case h265parser.CodecData:
+		nalus = append(nalus, codecData.RecordInfo.VPS...)
+		nalus = append(nalus, codecData.RecordInfo.SPS...)
+		nalus = append(nalus, codecData.RecordInfo.PPS...)
+	}
+
+	var annexB []byte
+	for _, nalu := range nalus {
+		annexB = append(annexB, annexBStartCode...)
+		annexB = append(annexB, nalu...)
+	}
+	return annexB
+}
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// Converts NAL units each prefixed by a big-endian length of lengthSize bytes
+// (as received from cameras, or stored in MP4 files) to Annex-B, with each
+// prefixed by a start code instead.
+func avccToAnnexB(data []byte, lengthSize int) ([]byte, error) {
+	annexB := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, fmt.Errorf("%w: truncated length", ErrInvalidNALU)
+		}
+		var length uint32
+		for _, b := range data[:lengthSize] {
+			length = length<<8 | uint32(b)
+		}
+		data = data[lengthSize:]
+		if uint64(length) > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: length %v exceeds %v bytes remaining", ErrInvalidNALU, length, len(data))
+		}
+		annexB = append(annexB, annexBStartCode...)
+		annexB = append(annexB, data[:length]...)
+		data = data[length:]
+	}
+	return annexB, nil
+}
@@ -0,0 +1,240 @@
+package thingrtc
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+	mdcodec "github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	"github.com/thingify-app/thing-rtc/peer-go/codec"
+	peerconfig "github.com/thingify-app/thing-rtc/peer-go/peer-config"
+)
+
+func TestAvccToAnnexB(t *testing.T) {
+	avcc := []byte{0, 0, 0, 2, 0x65, 0x01, 0, 0, 0, 1, 0x06}
+	annexB, err := avccToAnnexB(avcc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0, 0, 0, 1, 0x65, 0x01, 0, 0, 0, 1, 0x06}
+	if !bytes.Equal(annexB, expected) {
+		t.Errorf("expected %v, got %v", expected, annexB)
+	}
+
+	for _, invalid := range [][]byte{{0, 0, 0, 5, 0x65}, {0, 0, 1}} {
+		_, err := avccToAnnexB(invalid, 4)
+		if !errors.Is(err, ErrInvalidNALU) {
+			t.Errorf("expected ErrInvalidNALU for %v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestH265Payloader(t *testing.T) {
+	payloader := &h265Payloader{}
+
+	// An IDR NAL unit (type 19) too large for one packet, and a small one.
+	large := append([]byte{19 << 1, 0x01}, bytes.Repeat([]byte{0xaa}, 2500)...)
+	small := []byte{1 << 1, 0x01, 0xbb}
+	var annexB []byte
+	for _, nalu := range [][]byte{large, small} {
+		annexB = append(annexB, annexBStartCode...)
+		annexB = append(annexB, nalu...)
+	}
+
+	payloads := payloader.Payload(1200, annexB)
+	if len(payloads) != 4 {
+		t.Fatalf("expected 3 fragments and 1 single packet, got %v payloads", len(payloads))
+	}
+
+	reassembled := []byte{large[0], large[1]}
+	for i, payload := range payloads[:3] {
+		if len(payload) > 1200 {
+			t.Errorf("fragment %v exceeds MTU: %v bytes", i, len(payload))
+		}
+		if (payload[0]>>1)&0x3f != h265FragmentationUnit {
+			t.Errorf("expected fragmentation unit, got type %v", (payload[0]>>1)&0x3f)
+		}
+		fuHeader := payload[2]
+		if start := fuHeader&0x80 != 0; start != (i == 0) {
+			t.Errorf("unexpected start bit on fragment %v", i)
+		}
+		if end := fuHeader&0x40 != 0; end != (i == 2) {
+			t.Errorf("unexpected end bit on fragment %v", i)
+		}
+		if fuHeader&0x3f != 19 {
+			t.Errorf("expected NAL unit type 19, got %v", fuHeader&0x3f)
+		}
+		reassembled = append(reassembled, payload[3:]...)
+	}
+	if !bytes.Equal(reassembled, large) {
+		t.Error("fragments do not reassemble to the original NAL unit")
+	}
+	if !bytes.Equal(payloads[3], small) {
+		t.Errorf("expected %v, got %v", small, payloads[3])
+	}
+}
+
+func TestRtspSourceUnsupportedCodec(t *testing.T) {
+	_, err := CreateRtspMediaSource("rtsp://127.0.0.1/", WithRtspVideoCodec(webrtc.MimeTypeVP8))
+	if !errors.Is(err, ErrUnsupportedCodec) {
+		t.Errorf("expected ErrUnsupportedCodec for video, got %v", err)
+	}
+	_, err = CreateRtspMediaSource("rtsp://127.0.0.1/", WithRtspAudioCodec("audio/aac"))
+	if !errors.Is(err, ErrUnsupportedCodec) {
+		t.Errorf("expected ErrUnsupportedCodec for audio, got %v", err)
+	}
+}
+
+func TestRtspSourceReconnects(t *testing.T) {
+	// A camera which hangs up immediately.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var attempts atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			attempts.Add(1)
+			conn.Close()
+		}
+	}()
+
+	source, err := CreateRtspMediaSource("rtsp://"+listener.Addr().String()+"/stream",
+		WithRtspRetryPolicy(NewConstantRetryPolicy(10*time.Millisecond)),
+		WithRtspTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := New(createRelayServer(), MockServerAuth{}, createTestPeerConfig(), WithMediaSources(source))
+	defer peer.Close()
+	errs := make(chan error, 100)
+	peer.OnError(func(err error) {
+		errs <- err
+	})
+
+	// Failures are reported to the peer rather than crashing the process,
+	// and the camera is retried.
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrRtspFailed) {
+				t.Errorf("expected ErrRtspFailed, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for error")
+		}
+	}
+
+	state := source.State()
+	if state.Connected {
+		t.Error("expected source not to be connected")
+	}
+	if !errors.Is(state.LastError, ErrRtspFailed) {
+		t.Errorf("expected last error to be ErrRtspFailed, got %v", state.LastError)
+	}
+
+	source.Close()
+	time.Sleep(100 * time.Millisecond)
+	closedAttempts := attempts.Load()
+	time.Sleep(100 * time.Millisecond)
+	if attempts.Load() != closedAttempts {
+		t.Error("expected no more attempts once the source is closed")
+	}
+}
+
+func TestClosedPeerStopsListeningToSource(t *testing.T) {
+	source := newMediaSource(nil)
+	peer := New(createRelayServer(), MockServerAuth{}, createTestPeerConfig(), WithMediaSources(source))
+	errs := make(chan error, 1)
+	peer.OnError(func(err error) {
+		errs <- err
+	})
+	peer.Close()
+
+	source.reportError(ErrRtspFailed)
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error after close: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(source.errorListeners) != 0 {
+		t.Errorf("expected no listeners, got %v", len(source.errorListeners))
+	}
+}
+
+func TestH265Track(t *testing.T) {
+	t.Run("Alone", func(t *testing.T) {
+		testH265Track(t)
+	})
+	// Sources with local encoders may be sent alongside H265 cameras.
+	t.Run("WithEncoderCodecs", func(t *testing.T) {
+		testH265Track(t, &codec.Codec{
+			CodecSelector: mediadevices.NewCodecSelector(mediadevices.WithVideoEncoders(testEncoderBuilder{mdcodec.NewRTPVP8Codec(90000)})),
+		})
+	})
+}
+
+func testH265Track(t *testing.T, codecs ...*codec.Codec) {
+	track, err := newH265Track("video", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		frame := append(append([]byte{}, annexBStartCode...), 1<<1, 0x01, 0xcc)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			track.WriteSample(media.Sample{Data: frame, Duration: 10 * time.Millisecond})
+		}
+	}()
+
+	url := createRelayServer()
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiator := New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, WithICEServers(), WithMediaSources(newMediaSource([]webrtc.TrackLocal{track}, codecs...)))
+	defer initiator.Close()
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responder := New(url, MockServerAuth{Token: "responder"}, responderConfig, WithICEServers())
+	defer responder.Close()
+
+	tracks := make(chan RemoteTrack, 1)
+	responder.OnTrack(func(track RemoteTrack) {
+		tracks <- track
+	})
+
+	connectPeers(t, initiator, responder)
+	received := waitForTrack(t, tracks)
+	if received.Codec().MimeType != webrtc.MimeTypeH265 {
+		t.Errorf("expected H265, got %v", received.Codec().MimeType)
+	}
+
+	received.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet, err := received.ReadRTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.Payload, []byte{1 << 1, 0x01, 0xcc}) {
+		t.Errorf("unexpected payload %v", packet.Payload)
+	}
+}
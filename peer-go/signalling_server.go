@@ -1,10 +1,13 @@
 package thingrtc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
@@ -17,23 +20,36 @@ import (
 // messages etc), send and receive messages, and disconnect from a server.
 // If there are any failures in the connection or processing of messages, it
 // will report these and return to a disconnected state.
+// All methods are safe to call concurrently, and listeners may be replaced at
+// any time.
 type SignallingServer struct {
 	URL        string
 	ServerAuth ServerAuth
 	PeerAuth   peerconfig.PeerAuth
+	Logger     *slog.Logger
 
+	// Guards all fields below, apart from wg and sendChan.
+	mutex       sync.Mutex
 	socket      *websocket.Conn
 	connected   bool
 	remoteNonce string
+	// Cancelled on Disconnect to stop all goroutines, which are tracked by wg.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners signallingListeners
 
+	wg       sync.WaitGroup
 	sendChan chan interface{}
+}
 
-	peerConnectListener    func()
-	iceCandidateListener   func(candidate webrtc.ICECandidateInit)
-	offerListener          func(offer webrtc.SessionDescription)
-	answerListener         func(answer webrtc.SessionDescription)
-	peerDisconnectListener func()
-	errorListener          func(err error)
+type signallingListeners struct {
+	connect        func()
+	peerConnect    func()
+	iceCandidate   func(candidate webrtc.ICECandidateInit)
+	offer          func(offer webrtc.SessionDescription)
+	answer         func(answer webrtc.SessionDescription)
+	peerDisconnect func()
+	err            func(err error)
 }
 
 func NewSignallingServer(serverUrl string, serverAuth ServerAuth, peerAuth peerconfig.PeerAuth) SignallingServer {
@@ -41,16 +57,20 @@ func NewSignallingServer(serverUrl string, serverAuth ServerAuth, peerAuth peerc
 		URL:        serverUrl,
 		ServerAuth: serverAuth,
 		PeerAuth:   peerAuth,
+		Logger:     slog.Default(),
 
 		sendChan: make(chan interface{}),
 
 		// Initialise listeners as empty functions to allow them to be optional.
-		peerConnectListener:    func() {},
-		iceCandidateListener:   func(candidate webrtc.ICECandidateInit) {},
-		offerListener:          func(offer webrtc.SessionDescription) {},
-		answerListener:         func(answer webrtc.SessionDescription) {},
-		peerDisconnectListener: func() {},
-		errorListener:          func(err error) {},
+		listeners: signallingListeners{
+			connect:        func() {},
+			peerConnect:    func() {},
+			iceCandidate:   func(candidate webrtc.ICECandidateInit) {},
+			offer:          func(offer webrtc.SessionDescription) {},
+			answer:         func(answer webrtc.SessionDescription) {},
+			peerDisconnect: func() {},
+			err:            func(err error) {},
+		},
 	}
 }
 
@@ -61,44 +81,96 @@ type signedMessage struct {
 	Nonce     string `json:"nonce"` // only present in peerConnect message
 }
 
+// Avoids logging signatures, nonces and signed data.
+func (m signedMessage) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("type", m.Type),
+		slog.Int("dataLength", len(m.Data)),
+	)
+}
+
+type authMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// Avoids logging the nonce and token.
+func (m authMessage) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("type", m.Type))
+}
+
 // Attempt to connect with a signalling server and exchange peer details.
+// Must only be called once.
 func (s *SignallingServer) Connect() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.mutex.Lock()
+	s.ctx = ctx
+	s.cancel = cancel
 	s.connected = true
+	s.mutex.Unlock()
 
+	s.wg.Add(1)
 	go func() {
-		socket, _, err := websocket.DefaultDialer.Dial(s.URL, http.Header{})
-		s.socket = socket
+		defer s.wg.Done()
+
+		socket, _, err := websocket.DefaultDialer.DialContext(ctx, s.URL, http.Header{})
 		if err != nil {
-			s.errorListener(err)
+			s.reportError(ctx, err)
+			return
+		}
+
+		// Disconnect may have been called while we were dialling, in which case
+		// nobody else will close the socket.
+		s.mutex.Lock()
+		if ctx.Err() != nil {
+			s.mutex.Unlock()
+			socket.Close()
 			return
 		}
+		s.socket = socket
+		s.mutex.Unlock()
 
-		s.startSendLoop()
+		s.startSendLoop(ctx, socket)
 
 		localNonce := s.PeerAuth.GenerateNonce()
 		token := s.ServerAuth.GenerateToken()
 		err = s.sendAuthMessage(localNonce, token)
 		if err != nil {
-			s.errorListener(err)
+			s.reportError(ctx, err)
 			return
 		}
+		s.getListeners().connect()
 
-		for s.connected {
+		for ctx.Err() == nil {
 			message := signedMessage{}
-			err := s.socket.ReadJSON(&message)
+			err := socket.ReadJSON(&message)
 			if err != nil {
-				s.errorListener(err)
+				s.reportError(ctx, err)
 				break
 			}
 			err = s.handleMessage(localNonce, message)
 			if err != nil {
-				s.errorListener(err)
+				s.reportError(ctx, err)
 				break
 			}
 		}
 	}()
 }
 
+// Reports an error to the listener, unless it was caused by Disconnect.
+func (s *SignallingServer) reportError(ctx context.Context, err error) {
+	if ctx.Err() == nil {
+		s.getListeners().err(err)
+	}
+}
+
+func (s *SignallingServer) getListeners() signallingListeners {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.listeners
+}
+
 func (s *SignallingServer) SendIceCandidate(candidate webrtc.ICECandidateInit) {
 	s.sendSignedMessage("iceCandidate", candidate)
 }
@@ -111,39 +183,90 @@ func (s *SignallingServer) SendAnswer(answer webrtc.SessionDescription) {
 	s.sendSignedMessage("answer", answer)
 }
 
+// OnConnect is called once connected to the server and the auth message has
+// been queued, before any peer has connected. The server does not acknowledge
+// authentication, so a rejected token is only reported later via OnError.
+func (s *SignallingServer) OnConnect(f func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners.connect = f
+}
+
 func (s *SignallingServer) OnPeerConnect(f func()) {
-	s.peerConnectListener = f
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners.peerConnect = f
 }
 
 func (s *SignallingServer) OnIceCandidate(f func(candidate webrtc.ICECandidateInit)) {
-	s.iceCandidateListener = f
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners.iceCandidate = f
 }
 
 func (s *SignallingServer) OnOffer(f func(offer webrtc.SessionDescription)) {
-	s.offerListener = f
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners.offer = f
 }
 
 func (s *SignallingServer) OnAnswer(f func(answer webrtc.SessionDescription)) {
-	s.answerListener = f
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners.answer = f
 }
 
 func (s *SignallingServer) OnPeerDisconnect(f func()) {
-	s.peerDisconnectListener = f
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners.peerDisconnect = f
 }
 
 func (s *SignallingServer) OnError(f func(err error)) {
-	s.errorListener = f
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners.err = f
 }
 
+// Disconnect closes the connection to the server and waits for all background
+// goroutines to exit. It must not be called from within a listener.
 func (s *SignallingServer) Disconnect() {
+	s.mutex.Lock()
 	s.connected = false
-	s.socket.Close()
+	cancel := s.cancel
+	socket := s.socket
 	s.socket = nil
+	s.mutex.Unlock()
+
+	if cancel == nil {
+		// Never connected.
+		return
+	}
+	cancel()
+
+	if socket != nil {
+		socket.Close()
+	}
+
+	s.wg.Wait()
 }
 
-func (s *SignallingServer) sendAuthMessage(localNonce string, token string) error {
+// Returns the context of the current connection, or an error if we are not
+// connected.
+func (s *SignallingServer) connectedContext() (context.Context, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if !s.connected {
-		return errors.New("not connected - cannot send message")
+		return nil, errors.New("not connected - cannot send message")
+	}
+	return s.ctx, nil
+}
+
+func (s *SignallingServer) sendAuthMessage(localNonce string, token string) error {
+	ctx, err := s.connectedContext()
+	if err != nil {
+		return err
 	}
 
 	authData := struct {
@@ -160,26 +283,24 @@ func (s *SignallingServer) sendAuthMessage(localNonce string, token string) erro
 	}
 	jsonData := string(jsonBytes)
 
-	authMessage := struct {
-		Type string `json:"type"`
-		Data string `json:"data"`
-	}{
+	return s.enqueueMessage(ctx, authMessage{
 		Type: "auth",
 		Data: jsonData,
-	}
-
-	s.sendChan <- authMessage
-
-	return nil
+	})
 }
 
 func (s *SignallingServer) sendSignedMessage(msgType string, data interface{}) error {
-	if !s.connected {
-		return errors.New("not connected - cannot send message")
+	ctx, err := s.connectedContext()
+	if err != nil {
+		return err
 	}
 
+	s.mutex.Lock()
+	remoteNonce := s.remoteNonce
+	s.mutex.Unlock()
+
 	// Add the nonce field to whatever data we have.
-	dataWithNonce, err := addField(data, "nonce", s.remoteNonce)
+	dataWithNonce, err := addField(data, "nonce", remoteNonce)
 	if err != nil {
 		return err
 	}
@@ -202,38 +323,54 @@ func (s *SignallingServer) sendSignedMessage(msgType string, data interface{}) e
 		Data:      jsonData,
 	}
 
-	s.sendChan <- message
+	return s.enqueueMessage(ctx, message)
+}
 
-	return nil
+func (s *SignallingServer) enqueueMessage(ctx context.Context, message interface{}) error {
+	select {
+	case s.sendChan <- message:
+		return nil
+	case <-ctx.Done():
+		return errors.New("disconnected - cannot send message")
+	}
 }
 
 // Avoids concurrent writes to the socket by queueing them up with a channel.
-func (s *SignallingServer) startSendLoop() {
+func (s *SignallingServer) startSendLoop(ctx context.Context, socket *websocket.Conn) {
+	s.wg.Add(1)
 	go func() {
-		for s.connected {
-			message := <-s.sendChan
-			fmt.Printf("Sending message: %v\n", message)
-			err := s.socket.WriteJSON(message)
-			if err != nil {
-				fmt.Printf("Error sending message: %v\n", err)
+		defer s.wg.Done()
+		for {
+			select {
+			case message := <-s.sendChan:
+				s.Logger.Debug("sending message", "message", message)
+				err := socket.WriteJSON(message)
+				if err != nil {
+					s.Logger.Warn("failed to send message", "message", message, "error", err)
+				}
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 }
 
 func (s *SignallingServer) handleMessage(localNonce string, message signedMessage) error {
-	fmt.Printf("Message received: %v\n", message)
+	s.Logger.Debug("message received", "message", message)
+	listeners := s.getListeners()
 	if message.Type == "peerConnect" {
 		// Extract the desired nonce from our peer.
 		nonce := message.Nonce
 		if nonce == "" {
 			return errors.New("empty nonce received")
 		}
+		s.mutex.Lock()
 		s.remoteNonce = nonce
-		s.peerConnectListener()
+		s.mutex.Unlock()
+		listeners.peerConnect()
 	} else if message.Type == "peerDisconnect" {
 		// No nonce on peerDisconnect.
-		s.peerDisconnectListener()
+		listeners.peerDisconnect()
 	} else {
 		// All other messages require a valid nonce and signature.
 		err := s.verifyMessage(localNonce, message)
@@ -248,21 +385,21 @@ func (s *SignallingServer) handleMessage(localNonce string, message signedMessag
 			if err != nil {
 				return err
 			}
-			s.iceCandidateListener(iceCandidate)
+			listeners.iceCandidate(iceCandidate)
 		case "offer":
 			offer := webrtc.SessionDescription{}
 			err := json.Unmarshal([]byte(message.Data), &offer)
 			if err != nil {
 				return err
 			}
-			s.offerListener(offer)
+			listeners.offer(offer)
 		case "answer":
 			answer := webrtc.SessionDescription{}
 			err := json.Unmarshal([]byte(message.Data), &answer)
 			if err != nil {
 				return err
 			}
-			s.answerListener(answer)
+			listeners.answer(answer)
 		}
 	}
 
@@ -281,12 +418,12 @@ func (s *SignallingServer) verifyMessage(localNonce string, message signedMessag
 
 	validNonce := localNonce != "" && nonceData.Nonce == localNonce
 	if !validNonce {
-		return fmt.Errorf("invalid nonce received: '%v', expected: '%v'", nonceData.Nonce, localNonce)
+		return errors.New("invalid nonce received")
 	}
 
 	validSignature := s.PeerAuth.VerifyMessage(message.Signature, message.Data)
 	if !validSignature {
-		return fmt.Errorf("invalid signature '%v' on message: '%v'", message.Signature, message.Data)
+		return fmt.Errorf("invalid signature on %v message", message.Type)
 	}
 
 	return nil
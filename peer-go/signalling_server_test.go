@@ -1,7 +1,10 @@
 package thingrtc
 
 import (
+	"bytes"
 	"encoding/json"
+	"log/slog"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/websocket"
@@ -406,3 +409,60 @@ func TestSendMessageConcurrentRace(t *testing.T) {
 		}()
 	}
 }
+
+func TestLoggedMessagesAreRedacted(t *testing.T) {
+	actions := func(conn *websocket.Conn) {
+		auth := Message{}
+		err := conn.ReadJSON(&auth)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteJSON(&PeerConnectMessage{Type: "peerConnect", Nonce: "secretPeerNonce"})
+
+		offer := Message{}
+		err = conn.ReadJSON(&offer)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteJSON(&Message{
+			Type:      "answer",
+			Signature: "secretRemoteSignature",
+			Data:      "{\"nonce\": \"secretNonce\"}",
+		})
+
+		// Wait for the client to disconnect.
+		conn.ReadMessage()
+	}
+
+	serverAuth := MockServerAuth{Token: "secretToken"}
+	peerAuth := MockPeerAuth{Nonce: "secretNonce", Signature: "secretSignature", VerifyResult: true}
+	signallingServer, channels := createSignallingServerWithAuth(serverAuth, peerAuth, actions)
+	buffer := bytes.Buffer{}
+	signallingServer.Logger = slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	signallingServer.Connect()
+
+	select {
+	case <-channels.peerConnect:
+	case err := <-channels.err:
+		t.Fatal(err)
+	}
+	signallingServer.SendOffer(webrtc.SessionDescription{})
+	select {
+	case <-channels.answer:
+	case err := <-channels.err:
+		t.Fatal(err)
+	}
+	signallingServer.Disconnect()
+
+	logged := buffer.String()
+	if !strings.Contains(logged, "offer") || !strings.Contains(logged, "answer") || !strings.Contains(logged, "auth") {
+		t.Errorf("message types should be logged: %v", logged)
+	}
+	for _, secret := range []string{"secretToken", "secretNonce", "secretPeerNonce", "secretSignature", "secretRemoteSignature"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("logged output contains %v: %v", secret, logged)
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package thingrtc
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
@@ -117,3 +123,147 @@ func createSignallingServerWithAuth(serverAuth ServerAuth, peerAuth peerconfig.P
 
 	return &signallingServer, &channels
 }
+
+// Creates a signalling server which pairs up the first two connections it
+// receives for each pairing, mimicking the real server: each side receives a
+// peerConnect message with the other's nonce, and all further messages are
+// relayed. Tokens created by CreateInsecureServerAuth are only paired with
+// the opposite role of the same pairing, while all other tokens are paired
+// together. Returns the server's "ws://" URL.
+func createRelayServer() string {
+	var mutex sync.Mutex
+	waiting := make(map[string][]*relayConn)
+
+	upgrader := websocket.Upgrader{}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		auth := struct {
+			Type string `json:"type"`
+			Data string `json:"data"`
+		}{}
+		err = conn.ReadJSON(&auth)
+		if err != nil {
+			return
+		}
+		authData := struct {
+			Nonce string `json:"nonce"`
+			Token string `json:"token"`
+		}{}
+		json.Unmarshal([]byte(auth.Data), &authData)
+		token := struct {
+			PairingId string `json:"pairingId"`
+			Role      string `json:"role"`
+		}{}
+		json.Unmarshal([]byte(authData.Token), &token)
+
+		local := &relayConn{conn: conn, nonce: authData.Nonce, role: token.Role, paired: make(chan *relayConn, 1)}
+
+		mutex.Lock()
+		candidates := waiting[token.PairingId]
+		index := slices.IndexFunc(candidates, func(other *relayConn) bool {
+			return other.role != local.role || local.role == ""
+		})
+		if index < 0 {
+			waiting[token.PairingId] = append(candidates, local)
+			mutex.Unlock()
+		} else {
+			other := candidates[index]
+			waiting[token.PairingId] = slices.Delete(candidates, index, index+1)
+			mutex.Unlock()
+
+			other.paired <- local
+			local.paired <- other
+		}
+
+		// Relay messages until either side disconnects.
+		var remote *relayConn
+		select {
+		case remote = <-local.paired:
+		case <-r.Context().Done():
+			return
+		}
+		remote.writeJSON(map[string]string{"type": "peerConnect", "nonce": local.nonce})
+		defer remote.conn.Close()
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			remote.writeMessage(message)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	return strings.Replace(server.URL, "http", "ws", 1)
+}
+
+type relayConn struct {
+	conn   *websocket.Conn
+	nonce  string
+	role   string
+	paired chan *relayConn
+
+	writeMutex sync.Mutex
+}
+
+func (r *relayConn) writeJSON(v interface{}) {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+	r.conn.WriteJSON(v)
+}
+
+func (r *relayConn) writeMessage(message []byte) {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+	r.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// Creates an initiator and responder which will connect to each other via a
+// local relay server, without any ICE servers.
+func createConnectedPeers(opts ...Option) (initiator Peer, responder Peer) {
+	url := createRelayServer()
+	opts = append([]Option{WithICEServers()}, opts...)
+
+	initiatorConfig := createTestPeerConfig()
+	initiatorConfig.Role = peerconfig.Initiator
+	initiator = New(url, MockServerAuth{Token: "initiator"}, initiatorConfig, opts...)
+
+	responderConfig := createTestPeerConfig()
+	responderConfig.Role = peerconfig.Responder
+	responder = New(url, MockServerAuth{Token: "responder"}, responderConfig, opts...)
+
+	return initiator, responder
+}
+
+// Connects both peers and waits until they are connected to each other.
+func connectPeers(t *testing.T, initiator Peer, responder Peer) {
+	t.Helper()
+
+	connected := make(chan interface{}, 2)
+	for _, peer := range []Peer{initiator, responder} {
+		peer.OnConnectionStateChange(func(state ConnectionState, reason error) {
+			if state == Connected {
+				connected <- nil
+			}
+		})
+		err := peer.Connect(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connected:
+			// Continue
+		case <-time.After(10 * time.Second):
+			t.Fatal("peers did not connect")
+		}
+	}
+}
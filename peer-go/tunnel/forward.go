@@ -0,0 +1,252 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// The number of datagrams queued for each UDP session while its data channel
+// opens, or while it is sending. Further datagrams are dropped.
+const udpQueueSize = 64
+
+// The subset of Peer used to open tunnels.
+type channelCreator interface {
+	CreateDataChannelWithOptions(label string, options thingrtc.DataChannelOptions) (thingrtc.DataChannel, error)
+}
+
+// Forwarder forwards a local port to an address reachable by the remote peer.
+type Forwarder struct {
+	creator       channelCreator
+	remoteAddress string
+	options       *options
+	connections   *connections
+
+	// Exactly one of these is set, depending on the network.
+	listener   net.Listener
+	packetConn net.PacketConn
+
+	// UDP sessions keyed by client address.
+	mutex    sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// ForwardTCP listens on localAddress, and forwards each connection to
+// remoteAddress, dialled by the remote peer. The remote peer must be serving
+// tunnels (see Serve) and allow the address. Connections accepted while the
+// peer is not connected are closed.
+func ForwardTCP(peer thingrtc.Peer, localAddress string, remoteAddress string, opts ...Option) (*Forwarder, error) {
+	return forwardTCP(peer, localAddress, remoteAddress, opts...)
+}
+
+// ForwardUDP listens on localAddress, and forwards datagrams from each client
+// address to remoteAddress, sent by the remote peer. Replies are sent back to
+// the client. Datagrams may be lost or reordered, as with UDP itself.
+func ForwardUDP(peer thingrtc.Peer, localAddress string, remoteAddress string, opts ...Option) (*Forwarder, error) {
+	return forwardUDP(peer, localAddress, remoteAddress, opts...)
+}
+
+func forwardTCP(creator channelCreator, localAddress string, remoteAddress string, opts ...Option) (*Forwarder, error) {
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Forwarder{
+		creator:       creator,
+		remoteAddress: remoteAddress,
+		options:       defaultOptions(opts),
+		connections:   newConnections(),
+		listener:      listener,
+	}
+	f.connections.track(listener)
+	f.connections.goIfOpen(f.acceptLoop)
+	return f, nil
+}
+
+func forwardUDP(creator channelCreator, localAddress string, remoteAddress string, opts ...Option) (*Forwarder, error) {
+	packetConn, err := net.ListenPacket("udp", localAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Forwarder{
+		creator:       creator,
+		remoteAddress: remoteAddress,
+		options:       defaultOptions(opts),
+		connections:   newConnections(),
+		packetConn:    packetConn,
+		sessions:      map[string]*udpSession{},
+	}
+	f.connections.track(packetConn)
+	f.connections.goIfOpen(f.readLoop)
+	return f, nil
+}
+
+// Addr returns the local address being forwarded, which is useful when
+// listening on port 0.
+func (f *Forwarder) Addr() net.Addr {
+	if f.listener != nil {
+		return f.listener.Addr()
+	}
+	return f.packetConn.LocalAddr()
+}
+
+// Close stops listening and closes all forwarded connections.
+func (f *Forwarder) Close() error {
+	f.connections.closeAll()
+	return nil
+}
+
+func (f *Forwarder) openChannel(network string) (*thingrtc.DataChannelStream, error) {
+	options := thingrtc.ReliableDataChannelOptions()
+	if network == "udp" {
+		options = thingrtc.UnreliableDataChannelOptions()
+	}
+	channel, err := f.creator.CreateDataChannelWithOptions(Label(network, f.remoteAddress), options)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(f.connections.ctx, f.options.dialTimeout)
+	defer cancel()
+	return thingrtc.OpenDataChannelStream(ctx, channel)
+}
+
+func (f *Forwarder) acceptLoop() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		started := f.connections.goIfOpen(func() {
+			untrack := f.connections.track(conn)
+			defer untrack()
+			defer conn.Close()
+
+			stream, err := f.openChannel("tcp")
+			if err != nil {
+				f.options.logger.Warn("could not open tunnel", "address", f.remoteAddress, "error", err)
+				return
+			}
+			untrackStream := f.connections.track(stream)
+			defer untrackStream()
+
+			relay(conn, stream)
+		})
+		if !started {
+			conn.Close()
+		}
+	}
+}
+
+func (f *Forwarder) readLoop() {
+	buffer := make([]byte, datagramBufferSize)
+	for {
+		n, addr, err := f.packetConn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		session := f.session(addr)
+		if session == nil {
+			return
+		}
+		select {
+		case session.outgoing <- append([]byte(nil), buffer[:n]...):
+		default:
+			// Drop the datagram, as the network would.
+		}
+	}
+}
+
+// A flow of datagrams between a local client and the remote address.
+type udpSession struct {
+	addr       net.Addr
+	outgoing   chan []byte
+	lastActive atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// Returns the session for a client address, starting one if needed, or nil if
+// the forwarder has been closed.
+func (f *Forwarder) session(addr net.Addr) *udpSession {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if session, ok := f.sessions[addr.String()]; ok {
+		session.touch()
+		return session
+	}
+
+	session := &udpSession{addr: addr, outgoing: make(chan []byte, udpQueueSize)}
+	session.touch()
+	if !f.connections.goIfOpen(func() { f.runSession(session) }) {
+		return nil
+	}
+	f.sessions[addr.String()] = session
+	return session
+}
+
+func (f *Forwarder) runSession(session *udpSession) {
+	defer func() {
+		f.mutex.Lock()
+		delete(f.sessions, session.addr.String())
+		f.mutex.Unlock()
+	}()
+
+	stream, err := f.openChannel("udp")
+	if err != nil {
+		f.options.logger.Warn("could not open tunnel", "address", f.remoteAddress, "error", err)
+		return
+	}
+	untrack := f.connections.track(stream)
+	defer untrack()
+	defer stream.Close()
+
+	// Ends once the stream is closed, by either side.
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for {
+			datagram, err := stream.ReadMessage()
+			if err != nil {
+				return
+			}
+			session.touch()
+			f.packetConn.WriteTo(datagram, session.addr)
+		}
+	}()
+
+	idleTimer := time.NewTicker(f.options.udpIdleTimeout / 4)
+	defer idleTimer.Stop()
+	for {
+		select {
+		case datagram := <-session.outgoing:
+			if err := stream.WriteMessage(datagram); errors.Is(err, thingrtc.ErrDataChannelClosed) {
+				return
+			}
+		case <-idleTimer.C:
+			if session.idleFor() >= f.options.udpIdleTimeout {
+				return
+			}
+		case <-received:
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	thingrtc "github.com/thingify-app/thing-rtc/peer-go"
+)
+
+// Allow decides whether the remote peer may connect to address over network
+// ("tcp" or "udp").
+type Allow func(network string, address string) bool
+
+// AllowAddresses allows connections to exactly the given addresses, over
+// either network.
+func AllowAddresses(addresses ...string) Allow {
+	allowed := map[string]bool{}
+	for _, address := range addresses {
+		allowed[address] = true
+	}
+	return func(network string, address string) bool {
+		return allowed[address]
+	}
+}
+
+// The subset of Peer used to receive tunnels.
+type channelRouter interface {
+	OnDataChannelWithPrefix(prefix string, f func(dataChannel thingrtc.DataChannel))
+}
+
+// Server connects tunnels opened by the remote peer to their addresses.
+type Server struct {
+	peer        channelRouter
+	allow       Allow
+	options     *options
+	connections *connections
+}
+
+// Serve handles tunnels opened by the remote peer, for as long as the peer
+// exists or until Close is called. Tunnels to addresses which allow rejects
+// are closed straight away. A nil allow rejects every tunnel.
+func Serve(peer thingrtc.Peer, allow Allow, opts ...Option) *Server {
+	return newServer(peer, allow, opts...)
+}
+
+func newServer(peer channelRouter, allow Allow, opts ...Option) *Server {
+	if allow == nil {
+		allow = AllowAddresses()
+	}
+	server := &Server{
+		peer:        peer,
+		allow:       allow,
+		options:     defaultOptions(opts),
+		connections: newConnections(),
+	}
+	peer.OnDataChannelWithPrefix(LabelPrefix, server.handle)
+	return server
+}
+
+// Close stops handling new tunnels and closes any open ones.
+func (s *Server) Close() error {
+	s.peer.OnDataChannelWithPrefix(LabelPrefix, nil)
+	s.connections.closeAll()
+	return nil
+}
+
+func (s *Server) handle(channel thingrtc.DataChannel) {
+	logger := s.options.logger.With("label", channel.GetLabel())
+
+	network, address, err := parseLabel(channel.GetLabel())
+	if err != nil {
+		logger.Warn("rejecting tunnel", "error", err)
+		channel.Close()
+		return
+	}
+	if !s.allow(network, address) {
+		logger.Warn("rejecting tunnel to address which is not allowed")
+		channel.Close()
+		return
+	}
+
+	started := s.connections.goIfOpen(func() {
+		err := s.serve(channel, network, address)
+		if err != nil {
+			logger.Warn("tunnel failed", "error", err)
+		}
+	})
+	if !started {
+		channel.Close()
+	}
+}
+
+func (s *Server) serve(channel thingrtc.DataChannel, network string, address string) error {
+	ctx, cancel := context.WithTimeout(s.connections.ctx, s.options.dialTimeout)
+	defer cancel()
+
+	stream, err := thingrtc.OpenDataChannelStream(ctx, channel)
+	if err != nil {
+		return err
+	}
+	untrackStream := s.connections.track(stream)
+	defer untrackStream()
+	defer stream.Close()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	untrack := s.connections.track(conn)
+	defer untrack()
+	defer conn.Close()
+
+	s.options.logger.Debug("tunnel opened", "network", network, "address", address)
+	if network == "udp" {
+		relayDatagrams(conn, stream, s.options.udpIdleTimeout)
+	} else {
+		relay(conn, stream)
+	}
+	s.options.logger.Debug("tunnel closed", "network", network, "address", address)
+	return nil
+}
+
+// Relays datagrams between a connected UDP socket and stream, one per
+// message, until either side closes or there is no traffic for idleTimeout.
+func relayDatagrams(conn net.Conn, stream *thingrtc.DataChannelStream, idleTimeout time.Duration) {
+	var lastActive atomic.Int64
+	touch := func() { lastActive.Store(time.Now().UnixNano()) }
+	touch()
+
+	go func() {
+		defer conn.Close()
+		for {
+			datagram, err := stream.ReadMessage()
+			if err != nil {
+				return
+			}
+			touch()
+			conn.Write(datagram)
+		}
+	}()
+
+	defer stream.Close()
+	buffer := make([]byte, datagramBufferSize)
+	for {
+		conn.SetReadDeadline(time.Unix(0, lastActive.Load()).Add(idleTimeout))
+		n, err := conn.Read(buffer)
+		var netErr net.Error
+		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			// The other direction may have been active in the meantime.
+			if time.Since(time.Unix(0, lastActive.Load())) >= idleTimeout {
+				return
+			}
+			continue
+		case errors.Is(err, net.ErrClosed):
+			return
+		case err != nil:
+			// Errors such as ICMP port unreachable are not fatal for UDP.
+			continue
+		}
+		touch()
+		// Drop datagrams which cannot be sent, as the network would.
+		if err := stream.WriteMessage(buffer[:n]); errors.Is(err, thingrtc.ErrDataChannelClosed) {
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Package tunnel forwards TCP connections and UDP datagrams between local
+// sockets and addresses reachable by the remote peer, like ssh -L.
+//
+// The peer which forwards a local port calls ForwardTCP or ForwardUDP, and
+// the peer which can reach the remote address calls Serve. Each forwarded TCP
+// connection gets its own reliable data channel, and each UDP client address
+// its own unreliable one, labelled with the address to connect to. Since
+// either peer may do both, forwarding from the remote peer back to us (like
+// ssh -R) is done by calling ForwardTCP on the remote peer instead.
+//
+// Data channels are used as detached streams if the Peer was created with
+// WithDetachDataChannels(true), and via their messages otherwise (see
+// thingrtc.DataChannelStream).
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LabelPrefix starts the label of every data channel used by a tunnel.
+const LabelPrefix = "tunnel/"
+
+// The default time allowed for a data channel to open and the remote address
+// to be dialled.
+const DefaultDialTimeout = 10 * time.Second
+
+// The default time after which a UDP session with no traffic in either
+// direction is closed.
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// Large enough for any UDP datagram.
+const datagramBufferSize = 64 * 1024
+
+var ErrInvalidLabel = errors.New("invalid tunnel label")
+
+type Option func(options *options)
+
+type options struct {
+	logger         *slog.Logger
+	dialTimeout    time.Duration
+	udpIdleTimeout time.Duration
+}
+
+func defaultOptions(opts []Option) *options {
+	options := &options{
+		logger:         slog.Default(),
+		dialTimeout:    DefaultDialTimeout,
+		udpIdleTimeout: DefaultUDPIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithLogger sets the logger used to report tunnelled connections and their
+// failures.
+func WithLogger(logger *slog.Logger) Option {
+	return func(options *options) {
+		options.logger = logger
+	}
+}
+
+// WithDialTimeout sets the time allowed to open each tunnel.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(options *options) {
+		options.dialTimeout = timeout
+	}
+}
+
+// WithUDPIdleTimeout sets how long a UDP session may go without traffic before
+// it is closed.
+func WithUDPIdleTimeout(timeout time.Duration) Option {
+	return func(options *options) {
+		options.udpIdleTimeout = timeout
+	}
+}
+
+// Label returns the label of a data channel tunnelling to address over network
+// ("tcp" or "udp").
+func Label(network string, address string) string {
+	return LabelPrefix + network + "/" + address
+}
+
+func parseLabel(label string) (network string, address string, err error) {
+	rest, ok := strings.CutPrefix(label, LabelPrefix)
+	if !ok {
+		return "", "", fmt.Errorf("%w: %v", ErrInvalidLabel, label)
+	}
+	network, address, ok = strings.Cut(rest, "/")
+	if !ok || (network != "tcp" && network != "udp") || address == "" {
+		return "", "", fmt.Errorf("%w: %v", ErrInvalidLabel, label)
+	}
+	return network, address, nil
+}
+
+// Copies in both directions until either side ends, then closes both.
+func relay(a io.ReadWriteCloser, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	copyTo := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyTo(a, b)
+	go copyTo(b, a)
+
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// Tracks the connections which Close must tear down.
+type connections struct {
+	// Cancelled by closeAll, to abandon tunnels which are still opening.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// Guards all fields below.
+	mutex  sync.Mutex
+	active map[io.Closer]struct{}
+	closed bool
+}
+
+func newConnections() *connections {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connections{
+		ctx:    ctx,
+		cancel: cancel,
+		active: map[io.Closer]struct{}{},
+	}
+}
+
+// Runs f in a goroutine, unless closeAll has already been called.
+func (c *connections) goIfOpen(f func()) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return false
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// Registers closer to be closed by closeAll, or closes it straight away if
+// closeAll has already been called. Returns a function which unregisters it.
+func (c *connections) track(closer io.Closer) (untrack func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		closer.Close()
+		return func() {}
+	}
+	c.active[closer] = struct{}{}
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.active, closer)
+	}
+}
+
+// Closes all tracked connections and waits for their goroutines to exit.
+func (c *connections) closeAll() {
+	c.cancel()
+
+	c.mutex.Lock()
+	c.closed = true
+	active := c.active
+	c.active = nil
+	c.mutex.Unlock()
+
+	for closer := range active {
+		closer.Close()
+	}
+	c.wg.Wait()
+}
@@ -0,0 +1,195 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/thingify-app/thing-rtc/peer-go/internal/testutil"
+)
+
+func startTCPEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func startUDPEchoServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startForwarding(t *testing.T, network string, allow Allow, remoteAddress string) *Forwarder {
+	local, remote := testutil.ConnectedPeers()
+	server := newServer(remote, allow)
+	t.Cleanup(func() { server.Close() })
+
+	forward := forwardTCP
+	if network == "udp" {
+		forward = forwardUDP
+	}
+	forwarder, err := forward(local, "127.0.0.1:0", remoteAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { forwarder.Close() })
+	return forwarder
+}
+
+func TestForwardTCP(t *testing.T) {
+	echoAddress := startTCPEchoServer(t)
+	forwarder := startForwarding(t, "tcp", AllowAddresses(echoAddress), echoAddress)
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Larger than a single message.
+	sent := make([]byte, 200*1024)
+	for i := range sent {
+		sent[i] = byte(i)
+	}
+	go conn.Write(sent)
+
+	received := make([]byte, len(sent))
+	_, err = io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Error("received data does not match")
+	}
+}
+
+func TestForwardTCPToAddressNotAllowed(t *testing.T) {
+	echoAddress := startTCPEchoServer(t)
+	t.Run("NotListed", func(t *testing.T) {
+		testForwardTCPRejected(t, AllowAddresses("127.0.0.1:1"), echoAddress)
+	})
+	t.Run("NilAllow", func(t *testing.T) {
+		testForwardTCPRejected(t, nil, echoAddress)
+	})
+}
+
+func testForwardTCPRejected(t *testing.T, allow Allow, remoteAddress string) {
+	forwarder := startForwarding(t, "tcp", allow, remoteAddress)
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	echoAddress := startUDPEchoServer(t)
+	forwarder := startForwarding(t, "udp", AllowAddresses(echoAddress), echoAddress)
+
+	conn, err := net.Dial("udp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buffer := make([]byte, 2048)
+	for _, datagram := range []string{"one", "two", "three"} {
+		_, err := conn.Write([]byte(datagram))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer[:n]) != datagram {
+			t.Errorf("expected %v, got %v", datagram, string(buffer[:n]))
+		}
+	}
+}
+
+func TestCloseEndsForwardedConnections(t *testing.T) {
+	echoAddress := startTCPEchoServer(t)
+	forwarder := startForwarding(t, "tcp", AllowAddresses(echoAddress), echoAddress)
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Wait for the tunnel to be established.
+	conn.Write([]byte("x"))
+	_, err = conn.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarder.Close()
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	_, err = net.Dial("tcp", forwarder.Addr().String())
+	if err == nil {
+		t.Error("expected forwarder to stop listening")
+	}
+}
+
+func TestParseLabel(t *testing.T) {
+	network, address, err := parseLabel(Label("udp", "[::1]:53"))
+	if err != nil || network != "udp" || address != "[::1]:53" {
+		t.Errorf("unexpected result %v, %v, %v", network, address, err)
+	}
+
+	for _, label := range []string{"other", "tunnel/", "tunnel/tcp", "tunnel/tcp/", "tunnel/ip/host:1"} {
+		_, _, err := parseLabel(label)
+		if !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("expected ErrInvalidLabel for %v, got %v", label, err)
+		}
+	}
+}
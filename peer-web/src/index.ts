@@ -4,3 +4,5 @@ export * from './peer-config/peer-config';
 export * from './peer-config/peer-auth';
 export * from './peer-config/shared-secret';
 export * from './server-auth';
+export * from './rpc';
+export * from './pubsub';
\ No newline at end of file
@@ -0,0 +1,265 @@
+import { DataChannel } from './peer';
+
+/**
+ * A publish/subscribe topic bus between two peers.
+ *
+ * This is wire compatible with the Go pubsub package in peer-go, which
+ * declares a reliable and an unreliable channel with the labels below. Attach
+ * every channel with one of those labels, e.g. from the dataChannelListener:
+ *
+ *     if (channel.getLabel().startsWith(PUBSUB_LABEL_PREFIX)) {
+ *         pubsub.attach(channel);
+ *     }
+ *
+ * Messages are JSON objects sent as string messages:
+ *
+ *     {"type": "subscribe", "filter": "sensors/+"}
+ *     {"type": "unsubscribe", "filter": "sensors/+"}
+ *     {"type": "publish", "topic": "sensors/temp", "payload": "<base64>", "retained": true}
+ */
+
+export const PUBSUB_LABEL_PREFIX = 'pubsub/';
+export const PUBSUB_RELIABLE_LABEL = PUBSUB_LABEL_PREFIX + 'reliable';
+export const PUBSUB_UNRELIABLE_LABEL = PUBSUB_LABEL_PREFIX + 'unreliable';
+
+/**
+ * How messages on a topic are delivered: either in order and retransmitted
+ * until received, or on the unreliable channel where they may be lost but are
+ * never delayed behind a lost one.
+ */
+export type QoS = 'reliable'|'bestEffort';
+
+export interface PubSubMessage {
+    topic: string;
+    payload: Uint8Array;
+    /** Whether this is a retained value sent in response to subscribing. */
+    retained: boolean;
+}
+
+export type PubSubHandler = (message: PubSubMessage) => void;
+
+interface WireMessage {
+    type: 'subscribe'|'unsubscribe'|'publish';
+    filter?: string;
+    topic?: string;
+    payload?: string;
+    retained?: boolean;
+}
+
+/**
+ * Returns whether topic matches filter, where '+' matches exactly one level and
+ * a trailing '#' matches any number of levels, including none.
+ */
+export function matchTopic(filter: string, topic: string): boolean {
+    const filterLevels = filter.split('/');
+    const topicLevels = topic.split('/');
+
+    for (let i = 0; i < filterLevels.length; i++) {
+        const level = filterLevels[i];
+        if (level === '#') {
+            return true;
+        }
+        if (i >= topicLevels.length) {
+            return false;
+        }
+        if (level !== '+' && level !== topicLevels[i]) {
+            return false;
+        }
+    }
+    return filterLevels.length === topicLevels.length;
+}
+
+/**
+ * Publishes and subscribes to topics on the remote peer, over all attached
+ * channels. Subscriptions and retained values are kept across reconnections.
+ */
+export class PubSub {
+    private channels: DataChannel[] = [];
+    private local = new Map<string, Set<PubSubHandler>>();
+    private remote = new Set<string>();
+    private retained = new Map<string, Uint8Array>();
+    private qos: { filter: string, qos: QoS }[] = [];
+    private closed = false;
+
+    /**
+     * Starts using a channel labelled PUBSUB_RELIABLE_LABEL or
+     * PUBSUB_UNRELIABLE_LABEL, until it closes. It takes over the channel's
+     * stringMessage and close listeners.
+     */
+    attach(channel: DataChannel) {
+        if (this.closed) {
+            return;
+        }
+        this.channels.push(channel);
+        channel.on('stringMessage', message => this.handleMessage(message));
+        channel.on('close', () => {
+            this.channels = this.channels.filter(c => c !== channel);
+            // The remote peer subscribes again once the channel is reattached.
+            if (channel.getLabel() === PUBSUB_RELIABLE_LABEL) {
+                this.remote.clear();
+            }
+        });
+
+        if (channel.getLabel() === PUBSUB_RELIABLE_LABEL) {
+            for (const filter of this.local.keys()) {
+                this.sendMessage(channel, { type: 'subscribe', filter }).catch(() => {});
+            }
+        }
+    }
+
+    /**
+     * Sets the QoS of topics matching filter. If several filters match a topic,
+     * the one set most recently wins. Topics which match none are reliable.
+     */
+    setQoS(filter: string, qos: QoS) {
+        this.qos = this.qos.filter(rule => rule.filter !== filter);
+        this.qos.push({ filter, qos });
+    }
+
+    /**
+     * Sends payload to topic, if the remote peer is subscribed to it. If retain
+     * is set, payload is also kept as the topic's retained value, or the
+     * retained value is cleared if payload is empty.
+     */
+    async publish(topic: string, payload: Uint8Array|string, retain: boolean = false): Promise<void> {
+        if (this.closed) {
+            throw new Error('pubsub closed');
+        }
+        const bytes = typeof payload === 'string' ? new TextEncoder().encode(payload) : payload;
+        if (retain) {
+            if (bytes.length === 0) {
+                this.retained.delete(topic);
+            } else {
+                this.retained.set(topic, bytes);
+            }
+        }
+
+        if (![...this.remote].some(filter => matchTopic(filter, topic))) {
+            return;
+        }
+
+        const rule = [...this.qos].reverse().find(rule => matchTopic(rule.filter, topic));
+        const channel = (rule?.qos === 'bestEffort' ? this.getChannel(PUBSUB_UNRELIABLE_LABEL) : undefined)
+            ?? this.getChannel(PUBSUB_RELIABLE_LABEL);
+        if (!channel) {
+            throw new Error('pubsub channel not open');
+        }
+        await this.sendMessage(channel, { type: 'publish', topic, payload: toBase64(bytes) });
+    }
+
+    /**
+     * Calls handler with each message received on topics matching filter,
+     * starting with any retained values. Returns a function which unsubscribes.
+     */
+    subscribe(filter: string, handler: PubSubHandler): () => void {
+        let handlers = this.local.get(filter);
+        if (!handlers) {
+            handlers = new Set();
+            this.local.set(filter, handlers);
+        }
+        handlers.add(handler);
+        this.sendControl('subscribe', filter);
+
+        return () => {
+            const handlers = this.local.get(filter);
+            if (handlers?.delete(handler) && handlers.size === 0) {
+                this.local.delete(filter);
+                this.sendControl('unsubscribe', filter);
+            }
+        };
+    }
+
+    /** Stops using all attached channels, without closing them. */
+    close() {
+        this.closed = true;
+        for (const channel of this.channels) {
+            channel.on('stringMessage', () => {});
+            channel.on('close', () => {});
+        }
+        this.channels = [];
+        this.local.clear();
+    }
+
+    private getChannel(label: string): DataChannel|undefined {
+        return this.channels.find(channel => channel.getLabel() === label);
+    }
+
+    // Failures are ignored, as subscriptions are sent again when a channel is
+    // attached.
+    private sendControl(type: 'subscribe'|'unsubscribe', filter: string) {
+        const channel = this.getChannel(PUBSUB_RELIABLE_LABEL);
+        if (channel && !this.closed) {
+            this.sendMessage(channel, { type, filter }).catch(() => {});
+        }
+    }
+
+    private async sendMessage(channel: DataChannel, message: WireMessage): Promise<void> {
+        await channel.sendMessage(JSON.stringify(message));
+    }
+
+    private handleMessage(data: string) {
+        let message: WireMessage;
+        try {
+            message = JSON.parse(data);
+        } catch (e) {
+            console.error('Invalid pubsub message received.');
+            return;
+        }
+
+        switch (message.type) {
+            case 'subscribe':
+                this.handleSubscribe(message.filter ?? '');
+                break;
+            case 'unsubscribe':
+                this.remote.delete(message.filter ?? '');
+                break;
+            case 'publish':
+                this.deliver({
+                    topic: message.topic ?? '',
+                    payload: fromBase64(message.payload ?? ''),
+                    retained: message.retained ?? false,
+                });
+                break;
+        }
+    }
+
+    private handleSubscribe(filter: string) {
+        this.remote.add(filter);
+        const channel = this.getChannel(PUBSUB_RELIABLE_LABEL);
+        if (!channel) {
+            return;
+        }
+        for (const [topic, payload] of this.retained) {
+            if (matchTopic(filter, topic)) {
+                this.sendMessage(channel, { type: 'publish', topic, payload: toBase64(payload), retained: true }).catch(() => {});
+            }
+        }
+    }
+
+    private deliver(message: PubSubMessage) {
+        for (const [filter, handlers] of this.local) {
+            if (matchTopic(filter, message.topic)) {
+                for (const handler of handlers) {
+                    handler(message);
+                }
+            }
+        }
+    }
+}
+
+function toBase64(bytes: Uint8Array): string {
+    let binary = '';
+    for (let i = 0; i < bytes.length; i++) {
+        binary += String.fromCharCode(bytes[i]);
+    }
+    return btoa(binary);
+}
+
+function fromBase64(data: string): Uint8Array {
+    const binary = atob(data);
+    const bytes = new Uint8Array(binary.length);
+    for (let i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i);
+    }
+    return bytes;
+}
@@ -0,0 +1,339 @@
+import { DataChannel } from './peer';
+
+/**
+ * Request/response calls, in both directions, over a DataChannel.
+ *
+ * This is wire compatible with the Go rpc package in peer-go. Messages are
+ * JSON objects sent as string messages:
+ *
+ *     {"type": "request", "id": 1, "method": "m", "params": ..., "timeoutMs": 500}
+ *     {"type": "response", "id": 1, "result": ...}
+ *     {"type": "error", "id": 1, "error": {"code": "...", "message": "...", "data": ...}}
+ *     {"type": "cancel", "id": 1}
+ *     {"type": "stream", "id": 1, "result": ...}
+ *     {"type": "end", "id": 1}
+ */
+
+/** Codes used by the framework itself. */
+export const RpcErrorCodes = {
+    methodNotFound: 'method_not_found',
+    invalidParams: 'invalid_params',
+    invalidRequest: 'invalid_request',
+    internal: 'internal',
+    cancelled: 'cancelled',
+    deadlineExceeded: 'deadline_exceeded',
+    connectionClosed: 'connection_closed',
+};
+
+/**
+ * An error returned by a remote method. Handlers may throw an RpcError to
+ * control the code sent to the caller; anything else is sent with the
+ * internal code.
+ */
+export class RpcError extends Error {
+    constructor(readonly code: string, message: string, readonly data?: any) {
+        super(message);
+        this.name = 'RpcError';
+    }
+}
+
+/** Handles a call to a method, returning its result. */
+export type RpcHandler = (params: any, signal: AbortSignal) => any;
+
+/**
+ * Handles a call to a server-streaming method, calling send for each result.
+ * The stream ends when the returned promise resolves.
+ */
+export type RpcStreamHandler = (params: any, send: (result: any) => Promise<void>, signal: AbortSignal) => Promise<void>|void;
+
+export interface RpcCallOptions {
+    /** Aborting the signal cancels the call on the remote peer. */
+    signal?: AbortSignal;
+    /** Sent to the remote peer, which cancels the call once it expires. */
+    timeoutMs?: number;
+}
+
+interface RpcMessage {
+    type: 'request'|'response'|'error'|'cancel'|'stream'|'end';
+    id: number;
+    method?: string;
+    params?: any;
+    timeoutMs?: number;
+    result?: any;
+    error?: { code: string, message: string, data?: any };
+}
+
+interface PendingCall {
+    onMessage: (message: RpcMessage) => void;
+    onClose: () => void;
+}
+
+/**
+ * Serves registered methods to, and calls methods on, the remote peer over a
+ * single DataChannel. It takes over the channel's stringMessage and close
+ * listeners.
+ */
+export class RpcConnection {
+    private handlers = new Map<string, RpcHandler>();
+    private streamHandlers = new Map<string, RpcStreamHandler>();
+    private nextId = 1;
+    private calls = new Map<number, PendingCall>();
+    private serving = new Map<number, AbortController>();
+    private closed = false;
+
+    constructor(private channel: DataChannel) {
+        channel.on('stringMessage', message => this.handleMessage(message));
+        channel.on('close', () => this.shutdown());
+    }
+
+    /** Registers a handler for a method, replacing any existing one. */
+    register(method: string, handler: RpcHandler) {
+        this.handlers.set(method, handler);
+    }
+
+    /** Registers a handler for a server-streaming method. */
+    registerStream(method: string, handler: RpcStreamHandler) {
+        this.streamHandlers.set(method, handler);
+    }
+
+    /** Calls a method on the remote peer, resolving with its result. */
+    async call<R = any>(method: string, params?: any, options: RpcCallOptions = {}): Promise<R> {
+        return new Promise<R>((resolve, reject) => {
+            this.startCall(method, params, options, {
+                onMessage: message => {
+                    if (message.type === 'response') {
+                        resolve(message.result);
+                    } else if (message.type === 'error') {
+                        reject(toRpcError(message));
+                    }
+                },
+                onClose: () => reject(new RpcError(RpcErrorCodes.connectionClosed, 'rpc connection closed')),
+            }, reject);
+        });
+    }
+
+    /**
+     * Calls a server-streaming method on the remote peer, yielding each
+     * result. Breaking out of the iteration cancels the call.
+     */
+    async *callStream<R = any>(method: string, params?: any, options: RpcCallOptions = {}): AsyncGenerator<R, void, undefined> {
+        const results: R[] = [];
+        let finished = false;
+        let error: any = undefined;
+        let wake: () => void = () => {};
+
+        const finish = (err?: any) => {
+            finished = true;
+            error = err;
+            wake();
+        };
+
+        const id = this.startCall(method, params, options, {
+            onMessage: message => {
+                if (message.type === 'stream') {
+                    results.push(message.result);
+                    wake();
+                } else if (message.type === 'end') {
+                    finish();
+                } else if (message.type === 'error') {
+                    finish(toRpcError(message));
+                }
+            },
+            onClose: () => finish(new RpcError(RpcErrorCodes.connectionClosed, 'rpc connection closed')),
+        }, finish);
+
+        try {
+            while (true) {
+                if (results.length > 0) {
+                    yield results.shift()!;
+                } else if (finished) {
+                    if (error !== undefined) {
+                        throw error;
+                    }
+                    return;
+                } else {
+                    await new Promise<void>(resolve => wake = resolve);
+                }
+            }
+        } finally {
+            if (this.calls.delete(id) && !finished) {
+                this.sendMessage({ type: 'cancel', id }).catch(() => {});
+            }
+        }
+    }
+
+    /** Stops serving and fails all calls in progress, without closing the channel. */
+    close() {
+        this.channel.on('stringMessage', () => {});
+        this.channel.on('close', () => {});
+        this.shutdown();
+    }
+
+    private startCall(method: string, params: any, options: RpcCallOptions, call: PendingCall, fail: (err: any) => void): number {
+        const id = this.nextId++;
+        if (this.closed) {
+            fail(new RpcError(RpcErrorCodes.connectionClosed, 'rpc connection closed'));
+            return id;
+        }
+
+        const cleanup = () => {
+            options.signal?.removeEventListener('abort', onAbort);
+            if (timeout !== undefined) {
+                clearTimeout(timeout);
+            }
+        };
+        const abort = (code: string, message: string) => {
+            if (this.calls.delete(id)) {
+                cleanup();
+                this.sendMessage({ type: 'cancel', id }).catch(() => {});
+                fail(new RpcError(code, message));
+            }
+        };
+        const onAbort = () => abort(RpcErrorCodes.cancelled, 'call cancelled');
+
+        if (options.signal?.aborted) {
+            fail(new RpcError(RpcErrorCodes.cancelled, 'call cancelled'));
+            return id;
+        }
+        options.signal?.addEventListener('abort', onAbort);
+
+        // Give up locally too, in case the remote peer never answers.
+        let timeout: ReturnType<typeof setTimeout>|undefined = undefined;
+        if (options.timeoutMs !== undefined) {
+            timeout = setTimeout(() => abort(RpcErrorCodes.deadlineExceeded, 'call timed out'), options.timeoutMs);
+        }
+
+        this.calls.set(id, {
+            onMessage: message => {
+                if (message.type !== 'stream') {
+                    this.calls.delete(id);
+                    cleanup();
+                }
+                call.onMessage(message);
+            },
+            onClose: () => {
+                cleanup();
+                call.onClose();
+            },
+        });
+
+        this.sendMessage({
+            type: 'request',
+            id,
+            method,
+            params,
+            timeoutMs: options.timeoutMs !== undefined ? Math.max(1, Math.ceil(options.timeoutMs)) : undefined,
+        }).catch(err => {
+            if (this.calls.delete(id)) {
+                cleanup();
+                fail(err);
+            }
+        });
+        return id;
+    }
+
+    private handleMessage(data: string) {
+        let message: RpcMessage;
+        try {
+            message = JSON.parse(data);
+        } catch (e) {
+            console.error('Invalid rpc message received.');
+            return;
+        }
+
+        switch (message.type) {
+            case 'request':
+                this.handleRequest(message);
+                break;
+            case 'cancel':
+                this.serving.get(message.id)?.abort();
+                break;
+            case 'response':
+            case 'error':
+            case 'stream':
+            case 'end':
+                this.calls.get(message.id)?.onMessage(message);
+                break;
+        }
+    }
+
+    private async handleRequest(request: RpcMessage) {
+        const method = request.method ?? '';
+        const handler = this.handlers.get(method);
+        const streamHandler = this.streamHandlers.get(method);
+        if (!handler && !streamHandler) {
+            this.sendError(request.id, new RpcError(RpcErrorCodes.methodNotFound, `method not found: ${method}`));
+            return;
+        }
+
+        if (this.serving.has(request.id)) {
+            this.sendError(request.id, new RpcError(RpcErrorCodes.invalidRequest, 'duplicate request id'));
+            return;
+        }
+
+        const controller = new AbortController();
+        this.serving.set(request.id, controller);
+        let timeout: ReturnType<typeof setTimeout>|undefined = undefined;
+        if (request.timeoutMs) {
+            timeout = setTimeout(() => controller.abort(), request.timeoutMs);
+        }
+
+        try {
+            if (handler) {
+                const result = await handler(request.params, controller.signal);
+                await this.sendMessage({ type: 'response', id: request.id, result: result ?? null });
+            } else {
+                const send = async (result: any) => {
+                    if (controller.signal.aborted) {
+                        throw new RpcError(RpcErrorCodes.cancelled, 'call cancelled');
+                    }
+                    await this.sendMessage({ type: 'stream', id: request.id, result: result ?? null });
+                };
+                await streamHandler!(request.params, send, controller.signal);
+                await this.sendMessage({ type: 'end', id: request.id });
+            }
+        } catch (e) {
+            this.sendError(request.id, e);
+        } finally {
+            clearTimeout(timeout);
+            this.serving.delete(request.id);
+        }
+    }
+
+    private sendError(id: number, e: any) {
+        const error = e instanceof RpcError
+            ? { code: e.code, message: e.message, data: e.data }
+            : { code: RpcErrorCodes.internal, message: e instanceof Error ? e.message : String(e) };
+        this.sendMessage({ type: 'error', id, error }).catch(() => {});
+    }
+
+    private async sendMessage(message: RpcMessage): Promise<void> {
+        if (this.closed) {
+            throw new RpcError(RpcErrorCodes.connectionClosed, 'rpc connection closed');
+        }
+        await this.channel.sendMessage(JSON.stringify(message));
+    }
+
+    private shutdown() {
+        if (this.closed) {
+            return;
+        }
+        this.closed = true;
+
+        for (const controller of this.serving.values()) {
+            controller.abort();
+        }
+        this.serving.clear();
+
+        const calls = [...this.calls.values()];
+        this.calls.clear();
+        for (const call of calls) {
+            call.onClose();
+        }
+    }
+}
+
+function toRpcError(message: RpcMessage): RpcError {
+    const error = message.error;
+    return new RpcError(error?.code ?? RpcErrorCodes.internal, error?.message ?? 'unknown error', error?.data);
+}